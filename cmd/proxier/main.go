@@ -19,6 +19,15 @@ import (
 func main() {
 	log := slog.Default()
 
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		if err := runPurge(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	configPath := flag.String("config", "./config.yaml", "Path to config file")
 	ver := flag.Bool("version", false, "Show version and exit")
 	flag.Parse()
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/ezex-io/proxier/internal/server"
+)
+
+// runPurge implements "proxier purge", removing cached responses through the
+// admin API of a running server.
+func runPurge(args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	configPath := flags.String("config", "./config.yaml", "Path to config file, used for the admin address and token")
+	admin := flags.String("admin", "", "Admin API address, overrides the config file")
+	token := flags.String("token", "", "Admin API token, overrides the config file")
+
+	var req cache.PurgeRequest
+	flags.StringVar(&req.URL, "url", "", "Purge the response of this absolute URL")
+	flags.StringVar(&req.Prefix, "prefix", "", "Purge responses whose URL starts with this absolute URL")
+	flags.StringVar(&req.Route, "route", "", "Purge responses of the proxy rule with this endpoint")
+	flags.Func("tag", "Purge responses with this surrogate key or cache tag (repeatable)", func(tag string) error {
+		req.Tags = append(req.Tags, tag)
+
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+
+		return err
+	}
+
+	if *admin == "" {
+		cfg, err := config.LoadConfig(*configPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		if cfg.Admin == nil {
+			return errors.New("admin API is not configured, set admin.listen or -admin")
+		}
+		*admin = cfg.Admin.Listen
+		if *token == "" {
+			*token = cfg.Admin.Token
+		}
+	}
+
+	purged, err := purge(adminURL(*admin), *token, req)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d responses\n", purged)
+
+	return nil
+}
+
+// adminURL returns the base URL of the admin API listening on addr, which
+// may already be a URL.
+func adminURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	return "http://" + addr
+}
+
+func purge(baseURL, token string, req cache.PurgeRequest) (int, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, baseURL+server.AdminPurgePath, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return 0, fmt.Errorf("purge request failed: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var result cache.PurgeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("invalid purge response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if result.Error == "" {
+			result.Error = http.StatusText(resp.StatusCode)
+		}
+
+		return 0, fmt.Errorf("purge failed with status %d: %s", resp.StatusCode, result.Error)
+	}
+
+	return result.Purged, nil
+}
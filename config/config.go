@@ -2,26 +2,466 @@ package config
 
 import (
 	"errors"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/ezex-io/proxier/internal/spec"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server *ServerConfig `yaml:"server"`
-	Proxy  []*ProxyRule  `yaml:"proxy"`
+	Server  *ServerConfig   `yaml:"server"`
+	Proxy   []*ProxyRule    `yaml:"proxy"`
+	Streams []*StreamConfig `yaml:"streams"`
+
+	ForwardProxy *ForwardProxyConfig `yaml:"forward_proxy"`
+	SOCKS5       *SOCKS5Config       `yaml:"socks5"`
+
+	Admin *AdminConfig `yaml:"admin"`
 }
 
 type ServerConfig struct {
 	Host       string `yaml:"host"`
 	ListenPort string `yaml:"listen_port"`
 	FastHTTP   bool   `yaml:"fast_http"`
+
+	// TrustedProxies lists the CIDRs of proxies whose forwarding headers are
+	// appended to. Forwarding headers from any other peer are replaced.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	TLS *TLSConfig `yaml:"tls"`
+	// HTTP2 enables HTTP/2 on the TLS listener.
+	HTTP2 bool `yaml:"http2"`
+	// H2C enables HTTP/2 over cleartext TCP, intended for internal ports.
+	H2C bool `yaml:"h2c"`
+
+	// ProxyProtocol accepts PROXY protocol v1/v2 headers on the listener.
+	ProxyProtocol *ProxyProtocolConfig `yaml:"proxy_protocol"`
+
+	// MaxConnsPerIP limits the open connections of each client address in
+	// fasthttp mode, 100 by default; -1 removes the limit. With
+	// proxy_protocol the address is the one announced in the header.
+	MaxConnsPerIP int `yaml:"max_conns_per_ip"`
+
+	// PurgeSources lists the CIDRs of clients allowed to remove cached
+	// responses with the PURGE method. Empty forwards PURGE requests.
+	PurgeSources []string `yaml:"purge_sources"`
+
+	// RateLimitRedis keeps the state of rate limits in a Redis-compatible
+	// server shared by all proxies. Limits are applied locally while it is
+	// unavailable.
+	RateLimitRedis *RedisConfig `yaml:"rate_limit_redis"`
+
+	// Access restricts the clients of every proxy rule, in addition to
+	// the access lists of each rule.
+	Access *AccessConfig `yaml:"access"`
+
+	// GeoIP loads the databases used by country and ASN access lists and by
+	// geo headers.
+	GeoIP *GeoIPConfig `yaml:"geoip"`
+}
+
+// AccessConfig restricts clients by their address, taken from forwarding
+// headers of trusted proxies. Entries are CIDRs or IP addresses, ISO country
+// codes and AS numbers; the last two require server.geoip. A client matching
+// any deny entry is rejected; when there are allow entries, it must match
+// one of them. Rejected clients get 403 Forbidden.
+type AccessConfig struct {
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+	AllowCountries []string `yaml:"allow_countries"`
+	DenyCountries  []string `yaml:"deny_countries"`
+	AllowASNs      []uint   `yaml:"allow_asns"`
+	DenyASNs       []uint   `yaml:"deny_asns"`
+}
+
+// GeoIPConfig loads MaxMind-format (mmdb) databases, such as GeoLite2-Country
+// and GeoLite2-ASN. Changed files are reloaded every ReloadInterval (default
+// 1m).
+type GeoIPConfig struct {
+	Databases      []string      `yaml:"databases"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// RedisConfig connects to a Redis-compatible server.
+type RedisConfig struct {
+	// Address is "host:port".
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	TLS      bool   `yaml:"tls"`
+	// KeyPrefix is prepended to every key, "proxier:ratelimit:" by default.
+	KeyPrefix string `yaml:"key_prefix"`
+	// Timeout bounds every command, 100ms by default.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ProxyProtocolConfig controls PROXY protocol parsing on the listener.
+type ProxyProtocolConfig struct {
+	// TrustedSources lists the CIDRs allowed to send a PROXY protocol header.
+	// Connections from other peers are handled as if it were disabled.
+	TrustedSources    []string      `yaml:"trusted_sources"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+}
+
+// PROXY protocol versions sent to destinations.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// ProxyProtocolVersion returns the numeric PROXY protocol version for a
+// send_proxy_protocol value, or zero when none is sent.
+func ProxyProtocolVersion(version string) int {
+	switch version {
+	case ProxyProtocolV1:
+		return 1
+	case ProxyProtocolV2:
+		return 2
+	default:
+		return 0
+	}
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
+// Proxy rule types.
+const (
+	RuleTypeHTTP = "http"
+	RuleTypeGRPC = "grpc"
+)
+
+// grpcEndpoint matches "/package.Service/" and "/package.Service/Method".
+var grpcEndpoint = regexp.MustCompile(`^/[A-Za-z_][A-Za-z0-9_.]*/([A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Upstream protocols for a proxy rule.
+const (
+	UpstreamHTTP1 = "http1"
+	UpstreamH2    = "h2"
+	UpstreamH2C   = "h2c"
+)
+
+// Host header modes for a proxy rule.
+const (
+	HostHeaderDestination = "destination"
+	HostHeaderPreserve    = "preserve"
+	HostHeaderCustom      = "custom"
+)
+
 type ProxyRule struct {
-	Endpoint       string `yaml:"endpoint"`
+	// Type is "http" (default) or "grpc". gRPC rules route by
+	// "/package.Service/" or "/package.Service/Method" and keep the path.
+	Type     string `yaml:"type"`
+	Endpoint string `yaml:"endpoint"`
+	// DestinationURL is an http(s) URL, "unix:///path/to.sock" with an
+	// optional ":/base/path" suffix for an HTTP server on a unix socket, or
+	// "fastcgi://host:port" / "fastcgi:///path/to.sock" for FastCGI.
 	DestinationURL string `yaml:"destination_url"`
+
+	// HostHeader selects the Host header sent to the destination:
+	// "destination" (default), "preserve" or "custom" (uses CustomHost).
+	HostHeader string `yaml:"host_header"`
+	CustomHost string `yaml:"custom_host"`
+
+	// UpstreamProtocol selects the protocol towards the destination: "http1",
+	// "h2" (HTTP/2 over TLS) or "h2c". By default HTTP/2 is only used when
+	// negotiated over TLS.
+	UpstreamProtocol string `yaml:"upstream_protocol"`
+
+	WebSocket *WebSocketConfig `yaml:"websocket"`
+
+	// FlushInterval controls how often response data is flushed to the
+	// client; -1 flushes after every write. Server-Sent Events are always
+	// flushed immediately.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// MaxBufferSize is the largest response body, in bytes, held in memory
+	// before it is streamed to the client.
+	MaxBufferSize int `yaml:"max_buffer_size"`
+	// LongLivedStreams lifts the write timeout for all streamed responses
+	// instead of only for Server-Sent Events.
+	LongLivedStreams bool `yaml:"long_lived_streams"`
+
+	// HealthCheck enables active health checks of a gRPC destination using
+	// the gRPC health checking protocol.
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+
+	// GRPCWeb translates gRPC-Web requests of a gRPC rule to native gRPC.
+	GRPCWeb *GRPCWebConfig `yaml:"grpc_web"`
+
+	// SendProxyProtocol sends a PROXY protocol header ("v1" or "v2") on every
+	// connection to the destination. Connections are not reused.
+	SendProxyProtocol string `yaml:"send_proxy_protocol"`
+
+	// FastCGI maps requests to scripts of a fastcgi destination.
+	FastCGI *FastCGIConfig `yaml:"fastcgi"`
+
+	// Cache stores cacheable responses of the route.
+	Cache *CacheConfig `yaml:"cache"`
+
+	// Coalesce shares the response of one GET or HEAD request with the
+	// identical requests arriving while it is in flight.
+	Coalesce *CoalesceConfig `yaml:"coalesce"`
+
+	// Compression compresses responses for clients accepting gzip, br or
+	// zstd.
+	Compression *CompressionConfig `yaml:"compression"`
+
+	// RateLimits reject requests exceeding any of the limits with 429 Too
+	// Many Requests.
+	RateLimits []*RateLimitConfig `yaml:"rate_limits"`
+
+	// Concurrency bounds the requests in flight to the destination.
+	Concurrency *ConcurrencyConfig `yaml:"concurrency"`
+
+	// Access restricts the clients of the rule, see AccessConfig.
+	Access *AccessConfig `yaml:"access"`
+
+	// GeoHeaders sends the country and AS number of the client to the
+	// destination in X-Geo-Country and X-Geo-ASN. It requires server.geoip.
+	GeoHeaders bool `yaml:"geo_headers"`
+
+	// Auth requires clients of the rule to authenticate.
+	Auth *AuthConfig `yaml:"auth"`
+}
+
+// AuthConfig requires clients to send Basic credentials or an API key;
+// others get 401 Unauthorized. Credentials are removed before proxying and
+// the user or key name is sent in IdentityHeader (default X-Auth-User).
+type AuthConfig struct {
+	Basic          *BasicAuthConfig `yaml:"basic"`
+	APIKeys        *APIKeysConfig   `yaml:"api_keys"`
+	IdentityHeader string           `yaml:"identity_header"`
+}
+
+// BasicAuthConfig accepts HTTP Basic credentials of users with bcrypt
+// password hashes, as written by "htpasswd -B".
+type BasicAuthConfig struct {
+	Realm string `yaml:"realm"`
+	// Users maps user names to bcrypt hashes.
+	Users map[string]string `yaml:"users"`
+	// HtpasswdFile holds more users, one "name:hash" per line.
+	HtpasswdFile string `yaml:"htpasswd_file"`
+}
+
+// APIKeysConfig accepts API keys sent in Header or QueryParam; without
+// either, keys are read from X-API-Key.
+type APIKeysConfig struct {
+	Header     string `yaml:"header"`
+	QueryParam string `yaml:"query_param"`
+	// Keys maps names, sent as the identity, to keys.
+	Keys map[string]string `yaml:"keys"`
+	// KeysFile holds more keys, one "name:key" per line.
+	KeysFile string `yaml:"keys_file"`
+}
+
+// CacheConfig bounds the response cache of a rule. Zero values use the
+// defaults of 64 MiB in memory and 1 MiB per response, or 16 MiB per
+// response with a disk tier.
+type CacheConfig struct {
+	MaxSize      int64 `yaml:"max_size"`
+	MaxEntrySize int64 `yaml:"max_entry_size"`
+
+	// StaleWhileRevalidate serves stale responses while they are refreshed
+	// in the background, StaleIfError while the destination fails. They
+	// apply when the response has no directive of the same name.
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error"`
+
+	Disk *DiskCacheConfig `yaml:"disk"`
+}
+
+// CoalesceConfig enables request coalescing on a rule. Requests share a
+// response when their method, URL and Vary headers are equal; waiters send
+// their own request after Timeout (default 5s).
+type CoalesceConfig struct {
+	Vary    []string      `yaml:"vary"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Response compression codings.
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+)
+
+// CompressionConfig compresses responses of a rule. Zero values use the
+// defaults: zstd, br and gzip, common text types, 1 KiB and the default
+// level of each coding.
+type CompressionConfig struct {
+	// Encodings lists the codings offered, in order of preference.
+	Encodings []string `yaml:"encodings"`
+	// Types lists compressed media types; "type/*" matches all subtypes.
+	Types   []string `yaml:"types"`
+	MinSize int64    `yaml:"min_size"`
+	// GzipLevel is 1-9, BrotliLevel 1-11 and ZstdLevel 1-22.
+	GzipLevel   int `yaml:"gzip_level"`
+	BrotliLevel int `yaml:"brotli_level"`
+	ZstdLevel   int `yaml:"zstd_level"`
+}
+
+// Rate limit algorithms.
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+// RateLimitConfig allows Requests per Period for each key of a rule.
+type RateLimitConfig struct {
+	// Algorithm is "token_bucket" (default) or "sliding_window".
+	Algorithm string        `yaml:"algorithm"`
+	Requests  int           `yaml:"requests"`
+	Period    time.Duration `yaml:"period"`
+	// Burst is the token bucket size; it defaults to Requests.
+	Burst int `yaml:"burst"`
+	// Key is "ip" (default), "header:<name>" or "jwt:<claim>". Requests
+	// without the header or claim are counted by client IP.
+	Key string `yaml:"key"`
+	// MaxKeys bounds the keys tracked in memory, 100000 by default.
+	MaxKeys int `yaml:"max_keys"`
+}
+
+// ConcurrencyConfig limits the requests of a rule in flight to the
+// destination. Requests above the limit wait in a queue of QueueSize for up
+// to QueueTimeout (default 5s) and are answered with 503 otherwise.
+type ConcurrencyConfig struct {
+	MaxInFlight  int           `yaml:"max_in_flight"`
+	QueueSize    int           `yaml:"queue_size"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// Adaptive lowers the limit while the destination is slow or failing.
+	Adaptive *AdaptiveConcurrencyConfig `yaml:"adaptive"`
+}
+
+// AdaptiveConcurrencyConfig adjusts a concurrency limit with AIMD between
+// MinLimit (default 1) and max_in_flight: responses within TargetLatency
+// raise it, slower responses and 5xx errors multiply it by Backoff
+// (default 0.9).
+type AdaptiveConcurrencyConfig struct {
+	MinLimit      int           `yaml:"min_limit"`
+	TargetLatency time.Duration `yaml:"target_latency"`
+	Backoff       float64       `yaml:"backoff"`
+}
+
+// DiskCacheConfig adds a disk tier to a response cache. MaxSize defaults to
+// 1 GiB.
+type DiskCacheConfig struct {
+	Dir     string `yaml:"dir"`
+	MaxSize int64  `yaml:"max_size"`
+}
+
+type FastCGIConfig struct {
+	// Root is the document root scripts are resolved against.
+	Root string `yaml:"root"`
+	// SplitPath lists extensions ending the script name, e.g. [".php"]; the
+	// rest of the path is passed as PATH_INFO.
+	SplitPath []string `yaml:"split_path"`
+	// Index is the script used for paths ending in "/".
+	Index string `yaml:"index"`
+	// Params are extra CGI environment parameters.
+	Params map[string]string `yaml:"params"`
+}
+
+type GRPCWebConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// AllowedOrigins are the CORS origins allowed to call the route; "*"
+	// allows any origin.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+type HealthCheckConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Service  string        `yaml:"service"`
+}
+
+// WebSocketConfig limits WebSocket and other upgraded connections of a rule.
+// Zero values mean no limit.
+type WebSocketConfig struct {
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxMessageSize int64         `yaml:"max_message_size"`
+	MaxConnections int64         `yaml:"max_connections"`
+}
+
+// StreamConfig forwards raw TCP connections or UDP datagrams received on
+// Listen to one of the Upstreams.
+type StreamConfig struct {
+	Name string `yaml:"name"`
+	// Protocol is "tcp" (default), "udp" or "tls" for TLS passthrough.
+	Protocol string `yaml:"protocol"`
+	Listen   string `yaml:"listen"`
+	// Upstreams receive the stream. With protocol "tls" they are optional
+	// and only serve connections matching no route.
+	Upstreams []string `yaml:"upstreams"`
+	// Routes pick upstreams by TLS server name; only for protocol "tls".
+	Routes []*SNIRoute `yaml:"routes"`
+	// LoadBalancing is "round_robin" (default), "least_conn" or "random".
+	LoadBalancing string `yaml:"load_balancing"`
+	// MaxConnections limits open TCP connections or UDP sessions; zero means
+	// no limit.
+	MaxConnections int `yaml:"max_connections"`
+	// IdleTimeout closes connections without traffic in either direction.
+	// UDP sessions default to 30s.
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// SendProxyProtocol sends a PROXY protocol header ("v1" or "v2") to TCP
+	// and TLS upstreams.
+	SendProxyProtocol string `yaml:"send_proxy_protocol"`
+}
+
+// SNIRoute forwards TLS connections for ServerNames to Upstreams. A server
+// name may start with "*." to match any single label.
+type SNIRoute struct {
+	ServerNames []string `yaml:"server_names"`
+	Upstreams   []string `yaml:"upstreams"`
+}
+
+// ForwardProxyConfig runs an HTTP forward proxy on its own listener.
+type ForwardProxyConfig struct {
+	Listen string `yaml:"listen"`
+	// Allow and Deny list destinations as "host", "*.host", ".host", an IP or
+	// CIDR, each optionally followed by ":port" or ":low-high", or ":port"
+	// alone. Deny wins; a non-empty allow list must match.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// Users maps user names to bcrypt hashes of the passwords required in
+	// Proxy-Authorization.
+	Users map[string]string `yaml:"users"`
+	// HtpasswdFile holds more users as "name:bcrypt-hash" lines.
+	HtpasswdFile string `yaml:"htpasswd_file"`
+}
+
+// SOCKS5Config runs a SOCKS5 proxy (CONNECT and UDP ASSOCIATE) on its own
+// listener. Allow and Deny work as for ForwardProxyConfig.
+type SOCKS5Config struct {
+	Listen string   `yaml:"listen"`
+	Allow  []string `yaml:"allow"`
+	Deny   []string `yaml:"deny"`
+	// Users enables username/password authentication; they map user names
+	// to bcrypt hashes, as in ForwardProxyConfig.
+	Users map[string]string `yaml:"users"`
+	// HtpasswdFile holds more users as "name:bcrypt-hash" lines.
+	HtpasswdFile string `yaml:"htpasswd_file"`
+}
+
+// AdminConfig runs the admin API, such as cache purging, on its own
+// listener.
+type AdminConfig struct {
+	Listen string `yaml:"listen"`
+	// Token, when set, is required as a bearer token on every request.
+	Token string `yaml:"token"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -53,12 +493,60 @@ func (c *Config) basicCheck() error {
 	if c.Server.ListenPort == "" {
 		return errors.New("server.listen_port cannot be empty")
 	}
+	if _, err := realip.ParseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		return errors.New("invalid server.trusted_proxies: " + err.Error())
+	}
+	if _, err := realip.ParsePrefixes(c.Server.PurgeSources); err != nil {
+		return errors.New("invalid server.purge_sources: " + err.Error())
+	}
+	if g := c.Server.GeoIP; g != nil {
+		if len(g.Databases) == 0 || slices.Contains(g.Databases, "") {
+			return errors.New("server.geoip.databases cannot be empty")
+		}
+		if g.ReloadInterval < 0 {
+			return errors.New("server.geoip.reload_interval cannot be negative")
+		}
+	}
+	if err := c.Server.Access.check(c.Server.GeoIP != nil); err != nil {
+		return errors.New("invalid server.access: " + err.Error())
+	}
+	if err := c.Server.checkProtocols(); err != nil {
+		return err
+	}
+	if r := c.Server.RateLimitRedis; r != nil {
+		if _, _, err := net.SplitHostPort(r.Address); err != nil {
+			return errors.New("invalid server.rate_limit_redis address: " + r.Address)
+		}
+		if r.DB < 0 || r.Timeout < 0 {
+			return errors.New("server.rate_limit_redis db and timeout cannot be negative")
+		}
+	}
+	if c.Admin != nil {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			return errors.New("invalid admin.listen address: " + c.Admin.Listen)
+		}
+	}
 
-	if len(c.Proxy) == 0 {
+	if len(c.Proxy) == 0 && len(c.Streams) == 0 && c.ForwardProxy == nil && c.SOCKS5 == nil {
 		return errors.New("at least one proxy rule must be defined")
 	}
 
+	if err := c.checkStreams(); err != nil {
+		return err
+	}
+	if fp := c.ForwardProxy; fp != nil {
+		if err := checkEgress("forward_proxy", fp.Listen, fp.Allow, fp.Deny, fp.Users); err != nil {
+			return err
+		}
+	}
+	if socks := c.SOCKS5; socks != nil {
+		if err := checkEgress("socks5", socks.Listen, socks.Allow, socks.Deny, socks.Users); err != nil {
+			return err
+		}
+	}
+
 	seenEndpoints := make(map[string]bool)
+	seenCacheDirs := make(map[string]bool)
 
 	for _, rule := range c.Proxy {
 		if rule.Endpoint == "" {
@@ -73,9 +561,536 @@ func (c *Config) basicCheck() error {
 		}
 		seenEndpoints[rule.Endpoint] = true
 
-		if _, err := url.ParseRequestURI(rule.DestinationURL); err != nil {
+		destURL, err := url.ParseRequestURI(rule.DestinationURL)
+		if err != nil {
 			return errors.New("invalid URL in proxy rule: " + rule.DestinationURL)
 		}
+		if _, _, err := spec.ParseDestination(rule.DestinationURL); err != nil {
+			return err
+		}
+		if err := checkFastCGI(rule, destURL); err != nil {
+			return err
+		}
+
+		switch rule.UpstreamProtocol {
+		case "", UpstreamHTTP1:
+		case UpstreamH2:
+			if destURL.Scheme != "https" {
+				return errors.New("upstream_protocol h2 requires an https destination_url: " + rule.Endpoint)
+			}
+		case UpstreamH2C:
+			if destURL.Scheme != "http" && destURL.Scheme != "unix" {
+				return errors.New("upstream_protocol h2c requires an http or unix destination_url: " + rule.Endpoint)
+			}
+		default:
+			return errors.New("invalid upstream_protocol in proxy rule: " + rule.UpstreamProtocol)
+		}
+
+		switch rule.HostHeader {
+		case "", HostHeaderDestination, HostHeaderPreserve:
+			if rule.CustomHost != "" {
+				return errors.New("proxy rule custom_host requires host_header custom: " + rule.Endpoint)
+			}
+		case HostHeaderCustom:
+			if rule.CustomHost == "" {
+				return errors.New("proxy rule custom_host cannot be empty when host_header is custom: " + rule.Endpoint)
+			}
+		default:
+			return errors.New("invalid host_header in proxy rule: " + rule.HostHeader)
+		}
+
+		if err := c.checkRuleType(rule); err != nil {
+			return err
+		}
+
+		if !validProxyProtocol(rule.SendProxyProtocol) {
+			return errors.New("invalid send_proxy_protocol in proxy rule: " + rule.SendProxyProtocol)
+		}
+
+		if rule.MaxBufferSize < 0 {
+			return errors.New("proxy rule max_buffer_size cannot be negative: " + rule.Endpoint)
+		}
+
+		if ws := rule.WebSocket; ws != nil {
+			if ws.IdleTimeout < 0 || ws.MaxMessageSize < 0 || ws.MaxConnections < 0 {
+				return errors.New("proxy rule websocket limits cannot be negative: " + rule.Endpoint)
+			}
+		}
+
+		if err := checkCache(rule); err != nil {
+			return err
+		}
+		if err := checkCoalesce(rule); err != nil {
+			return err
+		}
+		if err := checkCompression(rule); err != nil {
+			return err
+		}
+		if err := checkRateLimits(rule); err != nil {
+			return err
+		}
+		if err := checkConcurrency(rule); err != nil {
+			return err
+		}
+		if err := rule.Access.check(c.Server.GeoIP != nil); err != nil {
+			return errors.New("invalid proxy rule access: " + err.Error() + ": " + rule.Endpoint)
+		}
+		if rule.GeoHeaders && c.Server.GeoIP == nil {
+			return errors.New("proxy rule geo_headers requires server.geoip: " + rule.Endpoint)
+		}
+		if err := checkAuth(rule); err != nil {
+			return err
+		}
+		if rule.Cache != nil && rule.Cache.Disk != nil {
+			dir := filepath.Clean(rule.Cache.Disk.Dir)
+			if seenCacheDirs[dir] {
+				return errors.New("duplicate cache.disk.dir in proxy rule: " + rule.Endpoint)
+			}
+			seenCacheDirs[dir] = true
+		}
+	}
+
+	return nil
+}
+
+func checkCache(rule *ProxyRule) error {
+	cache := rule.Cache
+	if cache == nil {
+		return nil
+	}
+
+	if rule.Type == RuleTypeGRPC {
+		return errors.New("cache is not supported for grpc proxy rules: " + rule.Endpoint)
+	}
+	if cache.MaxSize < 0 || cache.MaxEntrySize < 0 {
+		return errors.New("proxy rule cache sizes cannot be negative: " + rule.Endpoint)
+	}
+	if cache.StaleWhileRevalidate < 0 || cache.StaleIfError < 0 {
+		return errors.New("proxy rule cache stale durations cannot be negative: " + rule.Endpoint)
+	}
+
+	limit := cache.MaxSize
+	if disk := cache.Disk; disk != nil {
+		if disk.Dir == "" {
+			return errors.New("proxy rule cache.disk.dir cannot be empty: " + rule.Endpoint)
+		}
+		if disk.MaxSize < 0 {
+			return errors.New("proxy rule cache sizes cannot be negative: " + rule.Endpoint)
+		}
+		limit = disk.MaxSize
+	}
+	if limit > 0 && cache.MaxEntrySize > limit {
+		return errors.New("proxy rule cache max_entry_size cannot exceed max_size: " + rule.Endpoint)
+	}
+
+	return nil
+}
+
+func checkCoalesce(rule *ProxyRule) error {
+	coalesce := rule.Coalesce
+	if coalesce == nil {
+		return nil
+	}
+
+	if rule.Type == RuleTypeGRPC {
+		return errors.New("coalesce is not supported for grpc proxy rules: " + rule.Endpoint)
+	}
+	if coalesce.Timeout < 0 {
+		return errors.New("proxy rule coalesce.timeout cannot be negative: " + rule.Endpoint)
+	}
+	for _, name := range coalesce.Vary {
+		if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+			return errors.New("invalid proxy rule coalesce.vary header " + strconv.Quote(name) + ": " + rule.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+func checkCompression(rule *ProxyRule) error {
+	compression := rule.Compression
+	if compression == nil {
+		return nil
+	}
+
+	if rule.Type == RuleTypeGRPC {
+		return errors.New("compression is not supported for grpc proxy rules: " + rule.Endpoint)
+	}
+
+	seen := make(map[string]bool)
+	for _, encoding := range compression.Encodings {
+		if encoding != EncodingGzip && encoding != EncodingBrotli && encoding != EncodingZstd {
+			return errors.New("invalid proxy rule compression encoding " + strconv.Quote(encoding) + ": " + rule.Endpoint)
+		}
+		if seen[encoding] {
+			return errors.New("duplicate proxy rule compression encoding " + encoding + ": " + rule.Endpoint)
+		}
+		seen[encoding] = true
+	}
+	for _, mediaType := range compression.Types {
+		major, minor, ok := strings.Cut(mediaType, "/")
+		if !ok || major == "" || minor == "" || strings.ContainsAny(mediaType, " ;") {
+			return errors.New("invalid proxy rule compression type " + strconv.Quote(mediaType) + ": " + rule.Endpoint)
+		}
+	}
+
+	if compression.MinSize < 0 {
+		return errors.New("proxy rule compression.min_size cannot be negative: " + rule.Endpoint)
+	}
+	if compression.GzipLevel < 0 || compression.GzipLevel > 9 ||
+		compression.BrotliLevel < 0 || compression.BrotliLevel > 11 ||
+		compression.ZstdLevel < 0 || compression.ZstdLevel > 22 {
+		return errors.New("proxy rule compression level out of range: " + rule.Endpoint)
+	}
+
+	return nil
+}
+
+func checkRateLimits(rule *ProxyRule) error {
+	for _, limit := range rule.RateLimits {
+		if limit == nil {
+			return errors.New("proxy rule rate_limits entry cannot be empty: " + rule.Endpoint)
+		}
+		switch limit.Algorithm {
+		case "", RateLimitTokenBucket, RateLimitSlidingWindow:
+		default:
+			return errors.New("invalid proxy rule rate limit algorithm " + strconv.Quote(limit.Algorithm) + ": " + rule.Endpoint)
+		}
+		if limit.Requests <= 0 || limit.Period < time.Millisecond {
+			return errors.New("proxy rule rate limit requests must be positive and period at least 1ms: " + rule.Endpoint)
+		}
+		if limit.Burst < 0 || limit.MaxKeys < 0 {
+			return errors.New("proxy rule rate limit burst and max_keys cannot be negative: " + rule.Endpoint)
+		}
+		if limit.Burst > 0 && limit.Algorithm == RateLimitSlidingWindow {
+			return errors.New("proxy rule rate limit burst requires the token_bucket algorithm: " + rule.Endpoint)
+		}
+		if _, err := spec.ParseRateLimitKey(limit.Key); err != nil {
+			return errors.New("invalid proxy rule rate limit key " + strconv.Quote(limit.Key) + ": " + rule.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+func checkConcurrency(rule *ProxyRule) error {
+	concurrency := rule.Concurrency
+	if concurrency == nil {
+		return nil
+	}
+
+	if concurrency.MaxInFlight <= 0 {
+		return errors.New("proxy rule concurrency.max_in_flight must be positive: " + rule.Endpoint)
+	}
+	if concurrency.QueueSize < 0 || concurrency.QueueTimeout < 0 {
+		return errors.New("proxy rule concurrency queue settings cannot be negative: " + rule.Endpoint)
+	}
+	if adaptive := concurrency.Adaptive; adaptive != nil {
+		if adaptive.TargetLatency <= 0 {
+			return errors.New("proxy rule concurrency.adaptive.target_latency must be positive: " + rule.Endpoint)
+		}
+		if adaptive.MinLimit < 0 || adaptive.MinLimit > concurrency.MaxInFlight {
+			return errors.New("proxy rule concurrency.adaptive.min_limit must be between 0 and max_in_flight: " +
+				rule.Endpoint)
+		}
+		if adaptive.Backoff < 0 || adaptive.Backoff >= 1 {
+			return errors.New("proxy rule concurrency.adaptive.backoff must be below 1: " + rule.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+// check validates the access lists, if any. Country and ASN lists need a
+// GeoIP database.
+func (a *AccessConfig) check(geoIP bool) error {
+	if a == nil {
+		return nil
+	}
+	if _, err := realip.ParsePrefixes(a.Allow); err != nil {
+		return err
+	}
+	if _, err := realip.ParsePrefixes(a.Deny); err != nil {
+		return err
+	}
+
+	geo := len(a.AllowCountries) > 0 || len(a.DenyCountries) > 0 || len(a.AllowASNs) > 0 || len(a.DenyASNs) > 0
+	if geo && !geoIP {
+		return errors.New("country and ASN lists require server.geoip")
+	}
+	for _, country := range slices.Concat(a.AllowCountries, a.DenyCountries) {
+		if len(country) != 2 || !isLetter(country[0]) || !isLetter(country[1]) {
+			return errors.New("invalid country code " + strconv.Quote(country))
+		}
+	}
+	if slices.Contains(a.AllowASNs, 0) || slices.Contains(a.DenyASNs, 0) {
+		return errors.New("AS numbers must be positive")
+	}
+
+	return nil
+}
+
+func checkAuth(rule *ProxyRule) error {
+	a := rule.Auth
+	if a == nil {
+		return nil
+	}
+
+	if a.Basic == nil && a.APIKeys == nil {
+		return errors.New("proxy rule auth requires basic or api_keys: " + rule.Endpoint)
+	}
+	if !validHeaderName(a.IdentityHeader) {
+		return errors.New("invalid proxy rule auth identity_header " + strconv.Quote(a.IdentityHeader) + ": " +
+			rule.Endpoint)
+	}
+	if b := a.Basic; b != nil {
+		if len(b.Users) == 0 && b.HtpasswdFile == "" {
+			return errors.New("proxy rule auth.basic requires users or htpasswd_file: " + rule.Endpoint)
+		}
+		for user, hash := range b.Users {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil || user == "" || strings.Contains(user, ":") {
+				return errors.New("invalid proxy rule auth user " + strconv.Quote(user) +
+					", expected a bcrypt hash: " + rule.Endpoint)
+			}
+		}
+	}
+	if k := a.APIKeys; k != nil {
+		if len(k.Keys) == 0 && k.KeysFile == "" {
+			return errors.New("proxy rule auth.api_keys requires keys or keys_file: " + rule.Endpoint)
+		}
+		for name, key := range k.Keys {
+			if key == "" {
+				return errors.New("proxy rule auth API key " + strconv.Quote(name) + " cannot be empty: " +
+					rule.Endpoint)
+			}
+		}
+		if !validHeaderName(k.Header) {
+			return errors.New("invalid proxy rule auth.api_keys header " + strconv.Quote(k.Header) + ": " +
+				rule.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+// validHeaderName reports whether name is empty or a valid header field
+// name.
+func validHeaderName(name string) bool {
+	for i := range len(name) {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func (s *ServerConfig) checkProtocols() error {
+	if s.TLS != nil && (s.TLS.CertFile == "" || s.TLS.KeyFile == "") {
+		return errors.New("server.tls requires both cert_file and key_file")
+	}
+	if s.HTTP2 && s.TLS == nil {
+		return errors.New("server.http2 requires server.tls")
+	}
+	if s.FastHTTP && (s.HTTP2 || s.H2C) {
+		return errors.New("server.http2 and server.h2c are not supported with fast_http")
+	}
+	if s.MaxConnsPerIP < -1 {
+		return errors.New("server.max_conns_per_ip must be -1 or more")
+	}
+	if pp := s.ProxyProtocol; pp != nil {
+		if len(pp.TrustedSources) == 0 {
+			return errors.New("server.proxy_protocol.trusted_sources cannot be empty")
+		}
+		if _, err := realip.ParseTrustedProxies(pp.TrustedSources); err != nil {
+			return errors.New("invalid server.proxy_protocol.trusted_sources: " + err.Error())
+		}
+		if pp.ReadHeaderTimeout < 0 {
+			return errors.New("server.proxy_protocol.read_header_timeout cannot be negative")
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) checkRuleType(rule *ProxyRule) error {
+	switch rule.Type {
+	case "", RuleTypeHTTP:
+		if rule.HealthCheck != nil {
+			return errors.New("health_check is only supported for grpc proxy rules: " + rule.Endpoint)
+		}
+		if rule.GRPCWeb != nil {
+			return errors.New("grpc_web is only supported for grpc proxy rules: " + rule.Endpoint)
+		}
+	case RuleTypeGRPC:
+		if !grpcEndpoint.MatchString(rule.Endpoint) {
+			return errors.New("grpc proxy rule endpoint must be /package.Service/ or /package.Service/Method: " +
+				rule.Endpoint)
+		}
+		if c.Server.FastHTTP {
+			return errors.New("grpc proxy rules are not supported with fast_http: " + rule.Endpoint)
+		}
+		// gRPC-Web clients use HTTP/1.1, native gRPC clients need HTTP/2.
+		grpcWebOnly := rule.GRPCWeb != nil && rule.GRPCWeb.Enabled
+		if !c.Server.H2C && !c.Server.HTTP2 && !grpcWebOnly {
+			return errors.New("grpc proxy rules require server.h2c or server.http2: " + rule.Endpoint)
+		}
+		if hc := rule.HealthCheck; hc != nil && (hc.Interval < 0 || hc.Timeout < 0) {
+			return errors.New("proxy rule health_check durations cannot be negative: " + rule.Endpoint)
+		}
+	default:
+		return errors.New("invalid proxy rule type: " + rule.Type)
+	}
+
+	return nil
+}
+
+func (c *Config) checkStreams() error {
+	seenNames := make(map[string]bool)
+
+	for _, streamCfg := range c.Streams {
+		if streamCfg.Name == "" {
+			return errors.New("stream name cannot be empty")
+		}
+		if seenNames[streamCfg.Name] {
+			return errors.New("duplicate stream name: " + streamCfg.Name)
+		}
+		seenNames[streamCfg.Name] = true
+
+		switch streamCfg.Protocol {
+		case "", spec.StreamTCP, spec.StreamUDP:
+			if len(streamCfg.Routes) > 0 {
+				return errors.New("stream routes are only supported with protocol tls: " + streamCfg.Name)
+			}
+			if len(streamCfg.Upstreams) == 0 {
+				return errors.New("stream upstreams cannot be empty: " + streamCfg.Name)
+			}
+		case spec.StreamTLSPassthrough:
+			if err := checkSNIRoutes(streamCfg); err != nil {
+				return err
+			}
+		default:
+			return errors.New("invalid protocol in stream: " + streamCfg.Protocol)
+		}
+
+		if _, _, err := net.SplitHostPort(streamCfg.Listen); err != nil {
+			return errors.New("invalid listen address in stream " + streamCfg.Name + ": " + streamCfg.Listen)
+		}
+
+		if err := checkUpstreams(streamCfg.Name, streamCfg.Upstreams); err != nil {
+			return err
+		}
+
+		switch streamCfg.LoadBalancing {
+		case "", spec.BalanceRoundRobin, spec.BalanceLeastConn, spec.BalanceRandom:
+		default:
+			return errors.New("invalid load_balancing in stream: " + streamCfg.LoadBalancing)
+		}
+
+		if !validProxyProtocol(streamCfg.SendProxyProtocol) {
+			return errors.New("invalid send_proxy_protocol in stream: " + streamCfg.SendProxyProtocol)
+		}
+		if streamCfg.SendProxyProtocol != "" && streamCfg.Protocol == spec.StreamUDP {
+			return errors.New("send_proxy_protocol is not supported for udp streams: " + streamCfg.Name)
+		}
+
+		if streamCfg.MaxConnections < 0 || streamCfg.IdleTimeout < 0 || streamCfg.ConnectTimeout < 0 {
+			return errors.New("stream limits cannot be negative: " + streamCfg.Name)
+		}
+	}
+
+	return nil
+}
+
+// checkEgress validates the listener, access list and users of the forward
+// or SOCKS5 proxy.
+func checkEgress(name, listen string, allow, deny []string, users map[string]string) error {
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return errors.New("invalid " + name + ".listen address: " + listen)
+	}
+	for _, list := range [][]string{allow, deny} {
+		if _, err := spec.ParseAccessRules(list); err != nil {
+			return errors.New("invalid " + name + " access list: " + err.Error())
+		}
+	}
+	for user, hash := range users {
+		// SOCKS5 encodes user names in at most 255 bytes, see RFC 1929.
+		if user == "" || strings.Contains(user, ":") || len(user) > 255 {
+			return errors.New("invalid " + name + " user: " + user)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return errors.New("invalid " + name + " user " + strconv.Quote(user) + ", expected a bcrypt hash")
+		}
+	}
+
+	return nil
+}
+
+func checkSNIRoutes(streamCfg *StreamConfig) error {
+	if len(streamCfg.Routes) == 0 && len(streamCfg.Upstreams) == 0 {
+		return errors.New("tls stream requires routes or upstreams: " + streamCfg.Name)
+	}
+
+	seenNames := make(map[string]bool)
+	for _, route := range streamCfg.Routes {
+		if len(route.ServerNames) == 0 {
+			return errors.New("stream route server_names cannot be empty: " + streamCfg.Name)
+		}
+		for _, name := range route.ServerNames {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name == "" || strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+				return errors.New("invalid server name in stream " + streamCfg.Name + ": " + name)
+			}
+			if seenNames[name] {
+				return errors.New("duplicate server name in stream " + streamCfg.Name + ": " + name)
+			}
+			seenNames[name] = true
+		}
+
+		if len(route.Upstreams) == 0 {
+			return errors.New("stream route upstreams cannot be empty: " + streamCfg.Name)
+		}
+		if err := checkUpstreams(streamCfg.Name, route.Upstreams); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkUpstreams(name string, upstreams []string) error {
+	for _, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return errors.New("invalid upstream in stream " + name + ": " + upstream)
+		}
+	}
+
+	return nil
+}
+
+func validProxyProtocol(version string) bool {
+	return version == "" || ProxyProtocolVersion(version) != 0
+}
+
+func checkFastCGI(rule *ProxyRule, destURL *url.URL) error {
+	if destURL.Scheme != "fastcgi" {
+		if rule.FastCGI != nil {
+			return errors.New("fastcgi is only supported for fastcgi destinations: " + rule.Endpoint)
+		}
+
+		return nil
+	}
+
+	if rule.FastCGI == nil || !filepath.IsAbs(rule.FastCGI.Root) {
+		return errors.New("fastcgi destination requires an absolute fastcgi.root: " + rule.Endpoint)
+	}
+	if rule.Type == RuleTypeGRPC || rule.UpstreamProtocol != "" {
+		return errors.New("fastcgi destinations do not support grpc or upstream_protocol: " + rule.Endpoint)
 	}
 
 	return nil
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -180,3 +181,1156 @@ func TestLoadConfig_EmptyFile(t *testing.T) {
 	assert.Error(t, err, "Expected error due to empty file")
 	assert.Contains(t, err.Error(), "server configuration is missing")
 }
+
+func TestLoadConfig_InvalidTrustedProxies(t *testing.T) {
+	yamlContent := `
+server:
+  host: "127.0.0.1"
+  listen_port: "8080"
+  trusted_proxies:
+    - "10.0.0.0/8"
+    - "not-a-cidr"
+
+proxy:
+  - endpoint: "/api"
+    destination_url: "https://example.com"
+`
+	configFile := createTempConfig(t, yamlContent)
+	defer func() {
+		_ = os.Remove(configFile)
+	}()
+
+	_, err := LoadConfig(configFile)
+	assert.Error(t, err, "Expected error due to invalid trusted proxy")
+	assert.Contains(t, err.Error(), "invalid server.trusted_proxies")
+}
+
+func TestLoadConfig_HostHeader(t *testing.T) {
+	yamlContent := `
+server:
+  host: "127.0.0.1"
+  listen_port: "8080"
+
+proxy:
+  - endpoint: "/api"
+    destination_url: "https://example.com"
+    host_header: "custom"
+`
+	configFile := createTempConfig(t, yamlContent)
+	defer func() {
+		_ = os.Remove(configFile)
+	}()
+
+	_, err := LoadConfig(configFile)
+	assert.Error(t, err, "Expected error due to missing custom_host")
+	assert.Contains(t, err.Error(), "custom_host cannot be empty")
+
+	yamlContent = `
+server:
+  host: "127.0.0.1"
+  listen_port: "8080"
+
+proxy:
+  - endpoint: "/api"
+    destination_url: "https://example.com"
+    host_header: "unknown"
+`
+	configFile = createTempConfig(t, yamlContent)
+	defer func() {
+		_ = os.Remove(configFile)
+	}()
+
+	_, err = LoadConfig(configFile)
+	assert.Error(t, err, "Expected error due to invalid host_header")
+	assert.Contains(t, err.Error(), "invalid host_header")
+
+	yamlContent = `
+server:
+  host: "127.0.0.1"
+  listen_port: "8080"
+
+proxy:
+  - endpoint: "/api"
+    destination_url: "https://example.com"
+    custom_host: "api.internal"
+`
+	configFile = createTempConfig(t, yamlContent)
+	defer func() {
+		_ = os.Remove(configFile)
+	}()
+
+	_, err = LoadConfig(configFile)
+	assert.Error(t, err, "Expected error due to custom_host without host_header custom")
+	assert.Contains(t, err.Error(), "custom_host requires host_header custom")
+}
+
+func TestLoadConfig_Streaming(t *testing.T) {
+	yamlContent := `
+server:
+  host: "127.0.0.1"
+  listen_port: "8080"
+
+proxy:
+  - endpoint: "/events"
+    destination_url: "https://example.com"
+    flush_interval: 250ms
+    max_buffer_size: 4096
+`
+	configFile := createTempConfig(t, yamlContent)
+	defer func() {
+		_ = os.Remove(configFile)
+	}()
+
+	cfg, err := LoadConfig(configFile)
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, cfg.Proxy[0].FlushInterval)
+	assert.Equal(t, 4096, cfg.Proxy[0].MaxBufferSize)
+}
+
+func TestLoadConfig_Protocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  string
+		rule    string
+		wantErr string
+	}{
+		{
+			name:    "http2 without tls",
+			server:  "  http2: true\n",
+			wantErr: "server.http2 requires server.tls",
+		},
+		{
+			name:    "h2c with fasthttp",
+			server:  "  h2c: true\n  fast_http: true\n",
+			wantErr: "not supported with fast_http",
+		},
+		{
+			name:    "negative max_conns_per_ip",
+			server:  "  max_conns_per_ip: -2\n",
+			wantErr: "server.max_conns_per_ip must be -1 or more",
+		},
+		{
+			name:    "tls without key",
+			server:  "  tls:\n    cert_file: cert.pem\n",
+			wantErr: "requires both cert_file and key_file",
+		},
+		{
+			name:    "h2 requires https",
+			rule:    "    upstream_protocol: h2\n",
+			wantErr: "requires an https destination_url",
+		},
+		{
+			name:    "unknown upstream protocol",
+			rule:    "    upstream_protocol: spdy\n",
+			wantErr: "invalid upstream_protocol",
+		},
+		{
+			name: "h2c upstream",
+			rule: "    upstream_protocol: h2c\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" + tt.server +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://example.com\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_GRPCRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  string
+		rule    string
+		wantErr string
+	}{
+		{
+			name:   "valid service route",
+			server: "  h2c: true\n",
+			rule:   "  - type: grpc\n    endpoint: /echo.v1.Echo/\n",
+		},
+		{
+			name:   "valid method route",
+			server: "  h2c: true\n",
+			rule: "  - type: grpc\n    endpoint: /echo.v1.Echo/Say\n" +
+				"    health_check:\n      interval: 5s\n",
+		},
+		{
+			name:    "invalid endpoint",
+			server:  "  h2c: true\n",
+			rule:    "  - type: grpc\n    endpoint: /api\n",
+			wantErr: "must be /package.Service/",
+		},
+		{
+			name:    "listener without http2",
+			rule:    "  - type: grpc\n    endpoint: /echo.v1.Echo/\n",
+			wantErr: "require server.h2c or server.http2",
+		},
+		{
+			name:    "fasthttp",
+			server:  "  fast_http: true\n  h2c: true\n",
+			rule:    "  - type: grpc\n    endpoint: /echo.v1.Echo/\n",
+			wantErr: "not supported with fast_http",
+		},
+		{
+			name:    "health check on http rule",
+			rule:    "  - endpoint: /api\n    health_check:\n      interval: 5s\n",
+			wantErr: "health_check is only supported for grpc",
+		},
+		{
+			name:    "unknown type",
+			rule:    "  - type: thrift\n    endpoint: /api\n",
+			wantErr: "invalid proxy rule type",
+		},
+		{
+			name: "grpc-web without http2 listener",
+			rule: "  - type: grpc\n    endpoint: /echo.v1.Echo/\n" +
+				"    grpc_web:\n      enabled: true\n      allowed_origins: [\"*\"]\n",
+		},
+		{
+			name:    "grpc-web on http rule",
+			rule:    "  - endpoint: /api\n    grpc_web:\n      enabled: true\n",
+			wantErr: "grpc_web is only supported for grpc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" + tt.server +
+				"proxy:\n" + tt.rule + "    destination_url: \"http://127.0.0.1:9000\"\n"
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Streams(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams string
+		wantErr string
+	}{
+		{
+			name: "streams only",
+			streams: "  - name: redis\n    listen: \":6380\"\n    upstreams: [\"10.0.0.1:6379\", \"10.0.0.2:6379\"]\n" +
+				"    load_balancing: least_conn\n    idle_timeout: 5m\n" +
+				"  - name: dns\n    protocol: udp\n    listen: \"127.0.0.1:5353\"\n    upstreams: [\"1.1.1.1:53\"]\n",
+		},
+		{
+			name: "tls passthrough",
+			streams: "  - name: tls\n    protocol: tls\n    listen: \":443\"\n    routes:\n" +
+				"      - server_names: [\"a.example.com\", \"*.svc.example.com\"]\n        upstreams: [\"10.0.0.1:443\"]\n",
+		},
+		{
+			name:    "tls without routes or upstreams",
+			streams: "  - name: tls\n    protocol: tls\n    listen: \":443\"\n",
+			wantErr: "requires routes or upstreams",
+		},
+		{
+			name: "duplicate server name",
+			streams: "  - name: tls\n    protocol: tls\n    listen: \":443\"\n    routes:\n" +
+				"      - server_names: [\"a.example.com\"]\n        upstreams: [\"h:1\"]\n" +
+				"      - server_names: [\"A.example.com\"]\n        upstreams: [\"h:2\"]\n",
+			wantErr: "duplicate server name",
+		},
+		{
+			name: "misplaced wildcard",
+			streams: "  - name: tls\n    protocol: tls\n    listen: \":443\"\n    routes:\n" +
+				"      - server_names: [\"a.*.example.com\"]\n        upstreams: [\"h:1\"]\n",
+			wantErr: "invalid server name",
+		},
+		{
+			name:    "routes on tcp stream",
+			streams: "  - name: a\n    listen: \":1\"\n    upstreams: [\"h:1\"]\n    routes:\n      - server_names: [\"a\"]\n        upstreams: [\"h:1\"]\n",
+			wantErr: "only supported with protocol tls",
+		},
+		{
+			name:    "duplicate name",
+			streams: "  - name: a\n    listen: \":1\"\n    upstreams: [\"h:1\"]\n  - name: a\n    listen: \":2\"\n    upstreams: [\"h:1\"]\n",
+			wantErr: "duplicate stream name",
+		},
+		{
+			name:    "unknown protocol",
+			streams: "  - name: a\n    protocol: sctp\n    listen: \":1\"\n    upstreams: [\"h:1\"]\n",
+			wantErr: "invalid protocol in stream",
+		},
+		{
+			name:    "listen without port",
+			streams: "  - name: a\n    listen: \"localhost\"\n    upstreams: [\"h:1\"]\n",
+			wantErr: "invalid listen address",
+		},
+		{
+			name:    "no upstreams",
+			streams: "  - name: a\n    listen: \":1\"\n",
+			wantErr: "stream upstreams cannot be empty",
+		},
+		{
+			name:    "upstream without port",
+			streams: "  - name: a\n    listen: \":1\"\n    upstreams: [\"h\"]\n",
+			wantErr: "invalid upstream in stream",
+		},
+		{
+			name:    "unknown load balancing",
+			streams: "  - name: a\n    listen: \":1\"\n    upstreams: [\"h:1\"]\n    load_balancing: weighted\n",
+			wantErr: "invalid load_balancing",
+		},
+		{
+			name:    "proxy protocol on udp",
+			streams: "  - name: a\n    protocol: udp\n    listen: \":1\"\n    upstreams: [\"h:1\"]\n    send_proxy_protocol: v1\n",
+			wantErr: "not supported for udp streams",
+		},
+		{
+			name:    "negative limit",
+			streams: "  - name: a\n    listen: \":1\"\n    upstreams: [\"h:1\"]\n    max_connections: -1\n",
+			wantErr: "stream limits cannot be negative",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\nstreams:\n" + tt.streams
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_ProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  string
+		rule    string
+		wantErr string
+	}{
+		{
+			name:   "listener and upstream",
+			server: "  proxy_protocol:\n    trusted_sources: [\"10.0.0.0/8\"]\n    read_header_timeout: 3s\n",
+			rule:   "    send_proxy_protocol: v2\n",
+		},
+		{
+			name:    "no trusted sources",
+			server:  "  proxy_protocol:\n    read_header_timeout: 3s\n",
+			wantErr: "trusted_sources cannot be empty",
+		},
+		{
+			name:    "invalid trusted source",
+			server:  "  proxy_protocol:\n    trusted_sources: [\"nope\"]\n",
+			wantErr: "invalid server.proxy_protocol.trusted_sources",
+		},
+		{
+			name:    "unknown version",
+			rule:    "    send_proxy_protocol: v3\n",
+			wantErr: "invalid send_proxy_protocol",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" + tt.server +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://example.com\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			cfg, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				assert.Equal(t, 2, ProxyProtocolVersion(cfg.Proxy[0].SendProxyProtocol))
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_UnixSocketDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		wantErr     bool
+	}{
+		{destination: "unix:///run/app.sock"},
+		{destination: "unix:///run/app.sock:/api"},
+		{destination: "unix://host/run/app.sock", wantErr: true},
+		{destination: "unix:///:/api", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"" + tt.destination + "\"\n"
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLoadConfig_FastCGI(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "tcp",
+			rule: "    destination_url: \"fastcgi://127.0.0.1:9000\"\n    fastcgi:\n      root: /var/www\n" +
+				"      split_path: [\".php\"]\n      index: index.php\n      params:\n        APP_ENV: prod\n",
+		},
+		{
+			name: "unix socket",
+			rule: "    destination_url: \"fastcgi:///run/php-fpm.sock\"\n    fastcgi:\n      root: /var/www\n",
+		},
+		{
+			name:    "missing root",
+			rule:    "    destination_url: \"fastcgi://127.0.0.1:9000\"\n",
+			wantErr: "requires an absolute fastcgi.root",
+		},
+		{
+			name:    "missing port",
+			rule:    "    destination_url: \"fastcgi://php\"\n    fastcgi:\n      root: /var/www\n",
+			wantErr: "requires a port",
+		},
+		{
+			name:    "fastcgi on http destination",
+			rule:    "    destination_url: \"http://example.com\"\n    fastcgi:\n      root: /var/www\n",
+			wantErr: "only supported for fastcgi destinations",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/php\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+// secretHash is the bcrypt hash of "secret".
+const secretHash = "$2a$04$Pyl2iCMZK1Re4i5w.u0MVeI3ToyM6xm5Urlji.frBU6vpCF6n8KVi"
+
+func TestLoadConfig_ForwardProxy(t *testing.T) {
+	tests := []struct {
+		name         string
+		forwardProxy string
+		wantErr      string
+	}{
+		{
+			name: "valid",
+			forwardProxy: "  listen: \":3128\"\n  allow: [\"*.example.com\", \"10.0.0.0/8:443\", \":8443\"]\n" +
+				"  deny: [\"169.254.0.0/16\", \":22\"]\n  users:\n    alice: \"" + secretHash + "\"\n" +
+				"  htpasswd_file: /etc/proxier/htpasswd\n",
+		},
+		{
+			name:         "missing listen",
+			forwardProxy: "  allow: [\"example.com\"]\n",
+			wantErr:      "invalid forward_proxy.listen address",
+		},
+		{
+			name:         "invalid access list",
+			forwardProxy: "  listen: \":3128\"\n  deny: [\"example.com:99999\"]\n",
+			wantErr:      "invalid forward_proxy access list",
+		},
+		{
+			name:         "invalid user",
+			forwardProxy: "  listen: \":3128\"\n  users:\n    \"a:b\": \"" + secretHash + "\"\n",
+			wantErr:      "invalid forward_proxy user",
+		},
+		{
+			name:         "plaintext password",
+			forwardProxy: "  listen: \":3128\"\n  users:\n    alice: secret\n",
+			wantErr:      "invalid forward_proxy user \"alice\", expected a bcrypt hash",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"forward_proxy:\n" + tt.forwardProxy
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_SOCKS5(t *testing.T) {
+	tests := []struct {
+		name    string
+		socks5  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			socks5: "  listen: \":1080\"\n  allow: [\".internal.example.com\"]\n  users:\n    alice: \"" + secretHash +
+				"\"\n",
+		},
+		{
+			name:    "invalid listen",
+			socks5:  "  listen: \"1080\"\n",
+			wantErr: "invalid socks5.listen address",
+		},
+		{
+			name:    "invalid access list",
+			socks5:  "  listen: \":1080\"\n  allow: [\"10.0.0.0/40\"]\n",
+			wantErr: "invalid socks5 access list",
+		},
+		{
+			name:    "empty user",
+			socks5:  "  listen: \":1080\"\n  users:\n    \"\": \"" + secretHash + "\"\n",
+			wantErr: "invalid socks5 user",
+		},
+		{
+			name:    "plaintext password",
+			socks5:  "  listen: \":1080\"\n  users:\n    alice: secret\n",
+			wantErr: "expected a bcrypt hash",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"socks5:\n" + tt.socks5
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Cache(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			rule: "    cache: {}\n",
+		},
+		{
+			name: "sizes",
+			rule: "    cache:\n      max_size: 1048576\n      max_entry_size: 65536\n",
+		},
+		{
+			name:    "negative size",
+			rule:    "    cache:\n      max_size: -1\n",
+			wantErr: "cache sizes cannot be negative",
+		},
+		{
+			name:    "entry larger than cache",
+			rule:    "    cache:\n      max_size: 1024\n      max_entry_size: 2048\n",
+			wantErr: "max_entry_size cannot exceed max_size",
+		},
+		{
+			name: "disk tier",
+			rule: "    cache:\n      max_size: 1024\n      max_entry_size: 2048\n" +
+				"      stale_while_revalidate: 30s\n      stale_if_error: 1h\n" +
+				"      disk:\n        dir: /var/cache/proxier/api\n        max_size: 1073741824\n",
+		},
+		{
+			name:    "disk without dir",
+			rule:    "    cache:\n      disk:\n        max_size: 1024\n",
+			wantErr: "cache.disk.dir cannot be empty",
+		},
+		{
+			name:    "negative stale duration",
+			rule:    "    cache:\n      stale_if_error: -1s\n",
+			wantErr: "stale durations cannot be negative",
+		},
+		{
+			name: "duplicate disk dir",
+			rule: "    cache:\n      disk:\n        dir: /var/cache/proxier\n" +
+				"  - endpoint: \"/other\"\n    destination_url: \"http://127.0.0.1:9001\"\n" +
+				"    cache:\n      disk:\n        dir: /var/cache/proxier/\n",
+			wantErr: "duplicate cache.disk.dir",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Purge(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			config: "  purge_sources: [\"10.0.0.0/8\", \"127.0.0.1\"]\nadmin:\n  listen: \"127.0.0.1:9090\"\n  token: secret\n",
+		},
+		{
+			name:    "invalid purge sources",
+			config:  "  purge_sources: [\"10.0.0.0/40\"]\n",
+			wantErr: "invalid server.purge_sources",
+		},
+		{
+			name:    "invalid admin listen",
+			config:  "admin:\n  listen: \"9090\"\n",
+			wantErr: "invalid admin.listen address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" + tt.config +
+				"proxy:\n  - endpoint: /api\n    destination_url: http://127.0.0.1:9000\n"
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Coalesce(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			rule: "    coalesce: {}\n",
+		},
+		{
+			name: "vary and timeout",
+			rule: "    coalesce:\n      vary: [\"Accept-Encoding\", \"Accept-Language\"]\n      timeout: 2s\n",
+		},
+		{
+			name:    "negative timeout",
+			rule:    "    coalesce:\n      timeout: -1s\n",
+			wantErr: "coalesce.timeout cannot be negative",
+		},
+		{
+			name:    "invalid vary header",
+			rule:    "    coalesce:\n      vary: [\"Accept Encoding\"]\n",
+			wantErr: "invalid proxy rule coalesce.vary header",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Compression(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			rule: "    compression: {}\n",
+		},
+		{
+			name: "all settings",
+			rule: "    compression:\n      encodings: [br, gzip]\n      types: [\"text/*\", \"application/json\"]\n" +
+				"      min_size: 512\n      gzip_level: 9\n      brotli_level: 5\n      zstd_level: 19\n",
+		},
+		{
+			name:    "unknown encoding",
+			rule:    "    compression:\n      encodings: [deflate]\n",
+			wantErr: "invalid proxy rule compression encoding",
+		},
+		{
+			name:    "duplicate encoding",
+			rule:    "    compression:\n      encodings: [gzip, gzip]\n",
+			wantErr: "duplicate proxy rule compression encoding",
+		},
+		{
+			name:    "invalid type",
+			rule:    "    compression:\n      types: [\"json\"]\n",
+			wantErr: "invalid proxy rule compression type",
+		},
+		{
+			name:    "negative min size",
+			rule:    "    compression:\n      min_size: -1\n",
+			wantErr: "compression.min_size cannot be negative",
+		},
+		{
+			name:    "level out of range",
+			rule:    "    compression:\n      brotli_level: 12\n",
+			wantErr: "compression level out of range",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_RateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "per ip",
+			rule: "    rate_limits:\n      - requests: 100\n        period: 1m\n",
+		},
+		{
+			name: "several keys",
+			rule: "    rate_limits:\n      - requests: 10\n        period: 1s\n        burst: 50\n        key: \"header:X-API-Key\"\n" +
+				"      - algorithm: sliding_window\n        requests: 1000\n        period: 1h\n        key: \"jwt:sub\"\n        max_keys: 5000\n",
+		},
+		{
+			name:    "unknown algorithm",
+			rule:    "    rate_limits:\n      - algorithm: leaky_bucket\n        requests: 1\n        period: 1s\n",
+			wantErr: "invalid proxy rule rate limit algorithm",
+		},
+		{
+			name:    "missing period",
+			rule:    "    rate_limits:\n      - requests: 1\n",
+			wantErr: "requests must be positive and period at least 1ms",
+		},
+		{
+			name:    "negative burst",
+			rule:    "    rate_limits:\n      - requests: 1\n        period: 1s\n        burst: -1\n",
+			wantErr: "burst and max_keys cannot be negative",
+		},
+		{
+			name:    "burst with sliding window",
+			rule:    "    rate_limits:\n      - algorithm: sliding_window\n        requests: 1\n        period: 1s\n        burst: 5\n",
+			wantErr: "burst requires the token_bucket algorithm",
+		},
+		{
+			name:    "invalid key",
+			rule:    "    rate_limits:\n      - requests: 1\n        period: 1s\n        key: \"cookie:session\"\n",
+			wantErr: "invalid proxy rule rate limit key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_RateLimitRedis(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			config: "  rate_limit_redis:\n    address: \"127.0.0.1:6379\"\n    password: secret\n    db: 2\n" +
+				"    key_prefix: \"edge:\"\n    timeout: 50ms\n",
+		},
+		{
+			name:    "missing port",
+			config:  "  rate_limit_redis:\n    address: \"127.0.0.1\"\n",
+			wantErr: "invalid server.rate_limit_redis address",
+		},
+		{
+			name:    "negative db",
+			config:  "  rate_limit_redis:\n    address: \"127.0.0.1:6379\"\n    db: -1\n",
+			wantErr: "db and timeout cannot be negative",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" + tt.config +
+				"proxy:\n  - endpoint: /api\n    destination_url: http://127.0.0.1:9000\n"
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Concurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "fixed limit",
+			rule: "    concurrency:\n      max_in_flight: 100\n      queue_size: 50\n      queue_timeout: 2s\n",
+		},
+		{
+			name: "adaptive",
+			rule: "    concurrency:\n      max_in_flight: 100\n      adaptive:\n        min_limit: 10\n" +
+				"        target_latency: 250ms\n        backoff: 0.8\n",
+		},
+		{
+			name:    "missing max in flight",
+			rule:    "    concurrency:\n      queue_size: 10\n",
+			wantErr: "concurrency.max_in_flight must be positive",
+		},
+		{
+			name:    "negative queue",
+			rule:    "    concurrency:\n      max_in_flight: 1\n      queue_size: -1\n",
+			wantErr: "queue settings cannot be negative",
+		},
+		{
+			name:    "adaptive without target",
+			rule:    "    concurrency:\n      max_in_flight: 10\n      adaptive:\n        min_limit: 1\n",
+			wantErr: "target_latency must be positive",
+		},
+		{
+			name:    "min limit above max",
+			rule:    "    concurrency:\n      max_in_flight: 10\n      adaptive:\n        min_limit: 20\n        target_latency: 1s\n",
+			wantErr: "min_limit must be between 0 and max_in_flight",
+		},
+		{
+			name:    "backoff out of range",
+			rule:    "    concurrency:\n      max_in_flight: 10\n      adaptive:\n        target_latency: 1s\n        backoff: 1.5\n",
+			wantErr: "backoff must be below 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Access(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  string
+		rule    string
+		wantErr string
+	}{
+		{
+			name:   "global and rule lists",
+			server: "  access:\n    deny: [\"203.0.113.0/24\"]\n",
+			rule:   "    access:\n      allow: [\"10.0.0.0/8\", \"2001:db8::/32\", \"192.0.2.1\"]\n",
+		},
+		{
+			name:    "invalid global CIDR",
+			server:  "  access:\n    allow: [\"10.0.0.0/33\"]\n",
+			wantErr: "invalid server.access",
+		},
+		{
+			name:    "invalid rule address",
+			rule:    "    access:\n      deny: [\"10.0.0\"]\n",
+			wantErr: "invalid proxy rule access",
+		},
+		{
+			name:   "countries and ASNs",
+			server: "  geoip:\n    databases: [/var/lib/GeoLite2-Country.mmdb, /var/lib/GeoLite2-ASN.mmdb]\n",
+			rule: "    geo_headers: true\n    access:\n      allow_countries: [de, AT]\n" +
+				"      deny_asns: [64500]\n",
+		},
+		{
+			name:    "countries without database",
+			rule:    "    access:\n      deny_countries: [RU]\n",
+			wantErr: "country and ASN lists require server.geoip",
+		},
+		{
+			name:    "geo headers without database",
+			rule:    "    geo_headers: true\n",
+			wantErr: "geo_headers requires server.geoip",
+		},
+		{
+			name:    "invalid country",
+			server:  "  geoip:\n    databases: [/var/lib/GeoLite2-Country.mmdb]\n  access:\n    allow_countries: [DEU]\n",
+			wantErr: "invalid country code",
+		},
+		{
+			name:    "zero ASN",
+			server:  "  geoip:\n    databases: [/var/lib/GeoLite2-ASN.mmdb]\n",
+			rule:    "    access:\n      allow_asns: [0]\n",
+			wantErr: "AS numbers must be positive",
+		},
+		{
+			name:    "geoip without databases",
+			server:  "  geoip:\n    reload_interval: 1h\n",
+			wantErr: "server.geoip.databases cannot be empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" + tt.server +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_Auth(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr string
+	}{
+		{
+			name: "basic and api keys",
+			rule: "    auth:\n      identity_header: X-User\n      basic:\n        realm: internal\n" +
+				"        users:\n          alice: \"" + secretHash + "\"\n        htpasswd_file: /etc/proxier/htpasswd\n" +
+				"      api_keys:\n        header: X-Token\n        query_param: token\n" +
+				"        keys:\n          ci: \"k3y\"\n",
+		},
+		{
+			name: "api keys file",
+			rule: "    auth:\n      api_keys:\n        keys_file: /etc/proxier/keys\n",
+		},
+		{
+			name:    "no method",
+			rule:    "    auth:\n      identity_header: X-User\n",
+			wantErr: "auth requires basic or api_keys",
+		},
+		{
+			name:    "plain password",
+			rule:    "    auth:\n      basic:\n        users:\n          alice: secret\n",
+			wantErr: "expected a bcrypt hash",
+		},
+		{
+			name:    "basic without users",
+			rule:    "    auth:\n      basic:\n        realm: internal\n",
+			wantErr: "auth.basic requires users or htpasswd_file",
+		},
+		{
+			name:    "empty key",
+			rule:    "    auth:\n      api_keys:\n        keys:\n          ci: \"\"\n",
+			wantErr: "cannot be empty",
+		},
+		{
+			name:    "api keys without keys",
+			rule:    "    auth:\n      api_keys:\n        header: X-Token\n",
+			wantErr: "auth.api_keys requires keys or keys_file",
+		},
+		{
+			name:    "invalid identity header",
+			rule:    "    auth:\n      identity_header: \"X User\"\n      api_keys:\n        keys_file: /etc/keys\n",
+			wantErr: "invalid proxy rule auth identity_header",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yamlContent := "server:\n  host: \"127.0.0.1\"\n  listen_port: \"8080\"\n" +
+				"proxy:\n  - endpoint: \"/api\"\n    destination_url: \"http://127.0.0.1:9000\"\n" + tt.rule
+
+			configFile := createTempConfig(t, yamlContent)
+			defer func() {
+				_ = os.Remove(configFile)
+			}()
+
+			_, err := LoadConfig(configFile)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Package acl decides which destinations egress proxies may connect to.
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+const dialTimeout = 30 * time.Second
+
+// ErrDenied is returned when a destination is not allowed.
+var ErrDenied = errors.New("destination denied by access list")
+
+// rule matches destinations by host and port.
+type rule spec.AccessRule
+
+// ACL holds allow and deny lists. Deny rules win; when allow rules exist a
+// destination must match one of them. A nil ACL allows everything.
+type ACL struct {
+	allow []rule
+	deny  []rule
+}
+
+// New parses allow and deny lists, see spec.ParseAccessRules.
+func New(allow, deny []string) (*ACL, error) {
+	allowRules, err := parseRules(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyRules, err := parseRules(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ACL{allow: allowRules, deny: denyRules}, nil
+}
+
+func parseRules(entries []string) ([]rule, error) {
+	parsed, err := spec.ParseAccessRules(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]rule, len(parsed))
+	for i, r := range parsed {
+		rules[i] = rule(r)
+	}
+
+	return rules, nil
+}
+
+func (r rule) matchPort(port int) bool {
+	return r.PortLow == 0 || (port >= r.PortLow && port <= r.PortHigh)
+}
+
+func (r rule) matchHost(host string, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	if r.AnyHost {
+		return true
+	}
+
+	switch {
+	case r.Domain == "":
+		return false
+	case strings.HasPrefix(r.Domain, "*."):
+		return strings.HasSuffix(host, r.Domain[1:])
+	case strings.HasPrefix(r.Domain, "."):
+		return host == r.Domain[1:] || strings.HasSuffix(host, r.Domain)
+	default:
+		return host == r.Domain
+	}
+}
+
+func (r rule) matchIP(ip netip.Addr, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+
+	return r.AnyHost || (r.Prefix.IsValid() && r.Prefix.Contains(ip))
+}
+
+// CheckHost evaluates the host rules for a destination. allowed reports a
+// host rule allowed it; pending reports the decision depends on the IP
+// address the host resolves to, see CheckIP.
+func (a *ACL) CheckHost(host string, port int) (allowed, pending bool) {
+	if a == nil {
+		return true, false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range a.deny {
+		if r.matchHost(host, port) {
+			return false, false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true, false
+	}
+	for _, r := range a.allow {
+		if r.matchHost(host, port) {
+			return true, false
+		}
+	}
+
+	for _, r := range a.allow {
+		if r.Prefix.IsValid() {
+			return false, true
+		}
+	}
+
+	return false, false
+}
+
+// CheckIP evaluates the IP rules for a resolved destination address.
+// hostAllowed is the allowed result of CheckHost.
+func (a *ACL) CheckIP(ip netip.Addr, port int, hostAllowed bool) bool {
+	if a == nil {
+		return true
+	}
+
+	ip = ip.Unmap()
+	for _, r := range a.deny {
+		if r.matchIP(ip, port) {
+			return false
+		}
+	}
+	if hostAllowed {
+		return true
+	}
+	for _, r := range a.allow {
+		if r.matchIP(ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allowed reports whether address ("host:port") passes the host rules and,
+// when ip is valid, the IP rules.
+func (a *ACL) Allowed(address string, ip netip.Addr) bool {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	allowed, pending := a.CheckHost(host, port)
+	if !allowed && !pending {
+		return false
+	}
+	if !ip.IsValid() {
+		if parsed, err := netip.ParseAddr(host); err == nil {
+			ip = parsed
+		}
+	}
+	if !ip.IsValid() {
+		return allowed
+	}
+
+	return a.CheckIP(ip, port, allowed)
+}
+
+// DialContext connects to address when the access list allows it. IP rules
+// are checked against every address the host resolves to, right before
+// connecting, so DNS answers cannot bypass them.
+func (a *ACL) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := splitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, pending := a.CheckHost(host, port)
+	if !allowed && !pending {
+		return nil, fmt.Errorf("%w: %s", ErrDenied, address)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(_, resolved string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(resolved)
+			if err != nil {
+				return err
+			}
+			if !a.CheckIP(addrPort.Addr(), port, allowed) {
+				return fmt.Errorf("%w: %s (%s)", ErrDenied, address, addrPort.Addr())
+			}
+
+			return nil
+		},
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+func splitHostPort(address string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %q", address)
+	}
+
+	return host, int(port), nil
+}
@@ -0,0 +1,101 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_Invalid(t *testing.T) {
+	for _, entry := range []string{
+		"*", ":", "example.com:", "example.com:0", "example.com:70000", ":443-80",
+		"10.0.0.0/33", "[::1", "*.*.example.com", "",
+	} {
+		_, err := New([]string{entry}, nil)
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	list, err := New(
+		[]string{"example.com", "*.example.org", ".example.net", "10.0.0.0/8:443", "[2001:db8::/32]:80-90", ":8443"},
+		[]string{"blocked.example.org", "10.1.0.0/16", ":22"},
+	)
+	require.NoError(t, err)
+
+	tests := []struct {
+		address string
+		ip      string
+		allowed bool
+	}{
+		{"example.com:80", "", true},
+		{"EXAMPLE.com.:80", "", true},
+		{"www.example.com:80", "", false},
+		{"api.example.org:443", "", true},
+		{"example.org:443", "", false},
+		{"blocked.example.org:443", "", false},
+		{"example.net:80", "", true},
+		{"a.b.example.net:80", "", true},
+		{"example.com:22", "", false},
+		{"10.2.3.4:443", "", true},
+		{"10.2.3.4:80", "", false},
+		{"10.1.2.3:443", "", false},
+		{"[2001:db8::1]:85", "", true},
+		{"[2001:db8::1]:91", "", false},
+		{"anything.test:8443", "", true},
+		{"internal.test:443", "10.2.3.4", true},
+		{"internal.test:443", "192.168.0.1", false},
+		{"example.com:443", "10.1.0.1", false},
+		{"not-an-address", "", false},
+	}
+
+	for _, tt := range tests {
+		var ip netip.Addr
+		if tt.ip != "" {
+			ip = netip.MustParseAddr(tt.ip)
+		}
+		assert.Equal(t, tt.allowed, list.Allowed(tt.address, ip), "%s %s", tt.address, tt.ip)
+	}
+}
+
+func TestNilACL(t *testing.T) {
+	var list *ACL
+
+	assert.True(t, list.Allowed("example.com:80", netip.Addr{}))
+}
+
+func TestDialContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	allowed, err := New([]string{"localhost"}, nil)
+	require.NoError(t, err)
+	conn, err := allowed.DialContext(context.Background(), "tcp", "localhost:"+port)
+	require.NoError(t, err)
+	_ = conn.Close()
+
+	// Host rules pass, but the resolved address is denied at dial time.
+	denied, err := New([]string{"localhost"}, []string{"127.0.0.0/8", "::1"})
+	require.NoError(t, err)
+	_, err = denied.DialContext(context.Background(), "tcp", "localhost:"+port)
+	assert.True(t, errors.Is(err, ErrDenied), "unexpected error: %v", err)
+
+	_, err = allowed.DialContext(context.Background(), "tcp", "127.0.0.1:"+port)
+	assert.True(t, errors.Is(err, ErrDenied), "unexpected error: %v", err)
+}
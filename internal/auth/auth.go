@@ -0,0 +1,266 @@
+// Package auth authenticates clients of a route with HTTP Basic credentials
+// checked against bcrypt hashes, or with API keys.
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultRealm        = "proxier"
+	defaultAPIKeyHeader = "X-API-Key"
+	// maxVerified bounds the credentials whose bcrypt check is remembered.
+	maxVerified = 1024
+)
+
+// Config configures the accepted credentials. Clients may use any of them.
+type Config struct {
+	// Realm is sent in the Basic challenge, "proxier" by default.
+	Realm string
+	// Users maps user names to bcrypt hashes.
+	Users map[string]string
+	// HtpasswdFile holds more users as "name:bcrypt-hash" lines.
+	HtpasswdFile string
+
+	// APIKeyHeader and APIKeyQuery name the header and query parameter
+	// carrying an API key. Without either, keys are read from X-API-Key.
+	APIKeyHeader string
+	APIKeyQuery  string
+	// APIKeys maps names, forwarded as the identity, to keys.
+	APIKeys map[string]string
+	// APIKeysFile holds more keys as "name:key" lines.
+	APIKeysFile string
+}
+
+// Request is the part of a client request credentials are read from.
+type Request struct {
+	// Header returns the value of a request header.
+	Header func(name string) string
+	// Query returns the value of a query parameter.
+	Query func(name string) string
+}
+
+// Authenticator checks the credentials of requests.
+type Authenticator struct {
+	realm string
+	users map[string][]byte
+
+	apiKeyHeader string
+	apiKeyQuery  string
+	// apiKeys maps the SHA-256 of keys to their names, so that a lookup does
+	// not compare the keys themselves.
+	apiKeys map[[sha256.Size]byte]string
+
+	mu sync.Mutex
+	// verified holds the SHA-256 of Basic credentials that passed the
+	// bcrypt check, which is deliberately slow.
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// New loads the users and API keys.
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{
+		realm:    cfg.Realm,
+		users:    make(map[string][]byte),
+		apiKeys:  make(map[[sha256.Size]byte]string),
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+	if a.realm == "" {
+		a.realm = defaultRealm
+	}
+
+	users := cfg.Users
+	if cfg.HtpasswdFile != "" {
+		fileUsers, err := readPairs(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		users = merge(users, fileUsers)
+	}
+	for user, hash := range users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("unsupported password hash of user %q, only bcrypt is supported", user)
+		}
+		a.users[user] = []byte(hash)
+	}
+
+	keys := cfg.APIKeys
+	if cfg.APIKeysFile != "" {
+		fileKeys, err := readPairs(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = merge(keys, fileKeys)
+	}
+	for name, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty API key %q", name)
+		}
+		a.apiKeys[sha256.Sum256([]byte(key))] = name
+	}
+	if len(a.apiKeys) > 0 {
+		a.apiKeyHeader = http.CanonicalHeaderKey(cfg.APIKeyHeader)
+		a.apiKeyQuery = cfg.APIKeyQuery
+		if a.apiKeyHeader == "" && a.apiKeyQuery == "" {
+			a.apiKeyHeader = defaultAPIKeyHeader
+		}
+	}
+
+	if len(a.users) == 0 && len(a.apiKeys) == 0 {
+		return nil, errors.New("no users or API keys configured")
+	}
+
+	return a, nil
+}
+
+// readPairs reads "name:value" lines, skipping blank lines and comments.
+func readPairs(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	defer file.Close()
+
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, ":")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid line %d in %s, expected name:value", line, path)
+		}
+		pairs[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+
+	return pairs, nil
+}
+
+// merge returns the entries of both maps, those of files winning.
+func merge(config, file map[string]string) map[string]string {
+	merged := make(map[string]string, len(config)+len(file))
+	for name, value := range config {
+		merged[name] = value
+	}
+	for name, value := range file {
+		merged[name] = value
+	}
+
+	return merged
+}
+
+// Authenticate returns the user name or API key name of req, and whether its
+// credentials are valid.
+func (a *Authenticator) Authenticate(req Request) (string, bool) {
+	if len(a.users) > 0 {
+		if user, password, ok := ParseBasic(req.Header("Authorization")); ok {
+			if a.CheckPassword(user, password) {
+				return user, true
+			}
+		}
+	}
+
+	if len(a.apiKeys) > 0 {
+		key := ""
+		if a.apiKeyHeader != "" {
+			key = req.Header(a.apiKeyHeader)
+		}
+		if key == "" && a.apiKeyQuery != "" {
+			key = req.Query(a.apiKeyQuery)
+		}
+		if key != "" {
+			if name, found := a.apiKeys[sha256.Sum256([]byte(key))]; found {
+				return name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// CheckPassword compares a password with the bcrypt hash of user.
+func (a *Authenticator) CheckPassword(user, password string) bool {
+	hash, found := a.users[user]
+	if !found {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mu.Lock()
+	_, verified := a.verified[sum]
+	a.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	if len(a.verified) >= maxVerified {
+		clear(a.verified)
+	}
+	a.verified[sum] = struct{}{}
+	a.mu.Unlock()
+
+	return true
+}
+
+// Challenge returns the WWW-Authenticate value sent with 401 responses, or
+// an empty string when only API keys are accepted.
+func (a *Authenticator) Challenge() string {
+	if len(a.users) == 0 {
+		return ""
+	}
+
+	return `Basic realm="` + strings.ReplaceAll(a.realm, `"`, `'`) + `", charset="UTF-8"`
+}
+
+// Basic reports whether Basic credentials are accepted; they are removed
+// from requests before proxying.
+func (a *Authenticator) Basic() bool {
+	return len(a.users) > 0
+}
+
+// APIKeyHeader returns the header carrying API keys, or an empty string.
+func (a *Authenticator) APIKeyHeader() string {
+	return a.apiKeyHeader
+}
+
+// APIKeyQuery returns the query parameter carrying API keys, or an empty
+// string.
+func (a *Authenticator) APIKeyQuery() string {
+	return a.apiKeyQuery
+}
+
+// ParseBasic parses Basic credentials, see RFC 7617.
+func ParseBasic(header string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+
+	return strings.Cut(string(decoded), ":")
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash(t *testing.T, password string) string {
+	t.Helper()
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	return string(hashed)
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+// request returns a request with the given headers and query parameters.
+func request(headers, query map[string]string) Request {
+	return Request{
+		Header: func(name string) string { return headers[name] },
+		Query:  func(name string) string { return query[name] },
+	}
+}
+
+func basic(user, password string) map[string]string {
+	return map[string]string{
+		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)),
+	}
+}
+
+func TestAuthenticate_Basic(t *testing.T) {
+	htpasswd := writeFile(t, "# users\nbob:"+hash(t, "builder")+"\n\n")
+	a, err := New(Config{Users: map[string]string{"alice": hash(t, "wonderland")}, HtpasswdFile: htpasswd})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		identity string
+		ok       bool
+	}{
+		{name: "config user", headers: basic("alice", "wonderland"), identity: "alice", ok: true},
+		{name: "file user", headers: basic("bob", "builder"), identity: "bob", ok: true},
+		{name: "wrong password", headers: basic("alice", "builder")},
+		{name: "unknown user", headers: basic("carol", "wonderland")},
+		{name: "other scheme", headers: map[string]string{"Authorization": "Bearer token"}},
+		{name: "no credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The second check is answered from the verified credentials.
+			for range 2 {
+				identity, ok := a.Authenticate(request(tt.headers, nil))
+				assert.Equal(t, tt.ok, ok)
+				assert.Equal(t, tt.identity, identity)
+			}
+		})
+	}
+
+	assert.Len(t, a.verified, 2)
+	assert.Equal(t, `Basic realm="proxier", charset="UTF-8"`, a.Challenge())
+	assert.Empty(t, a.APIKeyHeader())
+}
+
+func TestAuthenticate_APIKeys(t *testing.T) {
+	keys := writeFile(t, "ci:file-key\n")
+	a, err := New(Config{
+		APIKeyHeader: "x-token",
+		APIKeyQuery:  "token",
+		APIKeys:      map[string]string{"billing": "config-key", "ci": "replaced"},
+		APIKeysFile:  keys,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		query    map[string]string
+		identity string
+		ok       bool
+	}{
+		{name: "header", headers: map[string]string{"X-Token": "config-key"}, identity: "billing", ok: true},
+		{name: "query", query: map[string]string{"token": "file-key"}, identity: "ci", ok: true},
+		{name: "replaced by file", headers: map[string]string{"X-Token": "replaced"}},
+		{name: "unknown", query: map[string]string{"token": "guess"}},
+		{name: "basic is not accepted", headers: basic("billing", "config-key")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, ok := a.Authenticate(request(tt.headers, tt.query))
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.identity, identity)
+		})
+	}
+
+	assert.Empty(t, a.Challenge())
+	assert.Equal(t, "X-Token", a.APIKeyHeader())
+	assert.Equal(t, "token", a.APIKeyQuery())
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{name: "empty", wantErr: "no users or API keys"},
+		{
+			name:    "plain password",
+			cfg:     Config{Users: map[string]string{"alice": "wonderland"}},
+			wantErr: "only bcrypt is supported",
+		},
+		{
+			name:    "apr1 hash in file",
+			cfg:     Config{HtpasswdFile: writeFile(t, "alice:$apr1$salt$hash\n")},
+			wantErr: "only bcrypt is supported",
+		},
+		{
+			name:    "missing file",
+			cfg:     Config{APIKeysFile: filepath.Join(t.TempDir(), "missing")},
+			wantErr: "failed to read credentials",
+		},
+		{
+			name:    "key without name",
+			cfg:     Config{APIKeysFile: writeFile(t, "just-a-key\n")},
+			wantErr: "invalid line 1",
+		},
+		{
+			name:    "empty key",
+			cfg:     Config{APIKeys: map[string]string{"ci": ""}},
+			wantErr: "empty API key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,631 @@
+// Package cache implements a shared HTTP response cache (RFC 9111) used as
+// a round tripper in front of a destination.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+)
+
+const (
+	headerXCache = "X-Cache"
+
+	defaultMaxSize          = 64 << 20
+	defaultMaxEntrySize     = 1 << 20
+	defaultDiskMaxSize      = 1 << 30
+	defaultDiskMaxEntrySize = 16 << 20
+
+	revalidateTimeout = 30 * time.Second
+)
+
+// Values of the X-Cache response header.
+const (
+	// Hit is a fresh response served from the cache.
+	Hit = "HIT"
+	// Miss is a response fetched from the destination.
+	Miss = "MISS"
+	// Revalidated is a stored response confirmed by the destination.
+	Revalidated = "REVALIDATED"
+	// Stale is a stale response served while it is refreshed in the
+	// background or because the destination failed.
+	Stale = "STALE"
+	// Bypass is a response to a request the cache does not handle.
+	Bypass = "BYPASS"
+)
+
+// Config configures a cache.
+type Config struct {
+	// Name identifies the cache in metrics, usually the route endpoint.
+	Name string
+	// MaxSize bounds the total size of stored responses in bytes.
+	MaxSize int64
+	// MaxEntrySize is the largest response stored, in bytes.
+	MaxEntrySize int64
+
+	// StaleWhileRevalidate and StaleIfError apply to responses without the
+	// Cache-Control directives of the same name, see RFC 5861.
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	// Dir enables a disk tier below the memory cache, bounded by
+	// DiskMaxSize bytes. Responses larger than the memory entry limit are
+	// only kept on disk.
+	Dir         string
+	DiskMaxSize int64
+}
+
+// Store keeps cached responses. Entries are immutable once saved.
+type Store interface {
+	// Lookup returns the stored variant of key accepted by match.
+	Lookup(key string, match func(*Entry) bool) *Entry
+	// Save stores entry, replacing the variant with the same Vary values.
+	Save(entry *Entry)
+	// Remove deletes all variants of key.
+	Remove(key string)
+	// Purge deletes the entries accepted by match, which sees entries
+	// without their body, and returns how many were deleted.
+	Purge(match func(*Entry) bool) int
+}
+
+// Entry is a stored response.
+type Entry struct {
+	// Key identifies the resource, see WithKey.
+	Key string
+	// Vary lists the request headers selecting this variant and VaryValues
+	// their values in the request that produced it.
+	Vary       []string
+	VaryValues []string
+
+	Status int
+	Header http.Header
+	Body   []byte
+	// Date is when the response was generated, corrected by its Age.
+	Date time.Time
+	// Expires is when the response becomes stale.
+	Expires time.Time
+}
+
+func (e *Entry) variantKey() string {
+	return e.Key + "\x00" + strings.Join(e.VaryValues, "\x00")
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for name, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+
+	return size
+}
+
+func (e *Entry) fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+func (e *Entry) age(now time.Time) time.Duration {
+	return max(now.Sub(e.Date), 0)
+}
+
+func (e *Entry) matches(req *http.Request) bool {
+	values := varyValues(req, e.Vary)
+	for i, value := range values {
+		if value != e.VaryValues[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Cache is a response cache for one route.
+type Cache struct {
+	cfg     Config
+	store   Store
+	metrics *cacheMetrics
+	now     func() time.Time
+
+	mu sync.Mutex
+	// refreshing holds the variants revalidated in the background.
+	refreshing map[string]struct{}
+}
+
+// New creates a cache kept in memory and, when Dir is set, on disk.
+func New(cfg Config) (*Cache, error) {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultMaxSize
+	}
+	memoryEntryLimit := min(defaultMaxEntrySize, cfg.MaxSize)
+
+	cacheMetrics := newCacheMetrics(cfg.Name)
+	var store Store = newMemoryStore(cfg.MaxSize, cacheMetrics)
+
+	if cfg.Dir != "" {
+		if cfg.DiskMaxSize <= 0 {
+			cfg.DiskMaxSize = defaultDiskMaxSize
+		}
+		disk, err := newDiskStore(cfg.Dir, cfg.DiskMaxSize, cacheMetrics)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.MaxEntrySize > 0 {
+			memoryEntryLimit = min(memoryEntryLimit, cfg.MaxEntrySize)
+		} else {
+			cfg.MaxEntrySize = min(defaultDiskMaxEntrySize, cfg.DiskMaxSize)
+		}
+		store = &tieredStore{
+			memory:           newMemoryStore(cfg.MaxSize, cacheMetrics),
+			disk:             disk,
+			memoryEntryLimit: memoryEntryLimit,
+		}
+	} else if cfg.MaxEntrySize <= 0 {
+		cfg.MaxEntrySize = memoryEntryLimit
+	}
+
+	return &Cache{
+		cfg:        cfg,
+		store:      store,
+		metrics:    cacheMetrics,
+		now:        time.Now,
+		refreshing: make(map[string]struct{}),
+	}, nil
+}
+
+type keyContextKey struct{}
+
+// WithKey sets the cache key of requests using ctx, normally the host and
+// request URI received from the client. Without it the URL of the outgoing
+// request is used.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, key)
+}
+
+type authenticatedContextKey struct{}
+
+// WithAuthenticated marks requests using ctx as authenticated by the proxy,
+// which removes the credentials before the request reaches the cache. Their
+// responses are only stored when a response to a request with an
+// Authorization header could be, see RFC 9111, section 3.5.
+func WithAuthenticated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authenticatedContextKey{}, true)
+}
+
+// authenticated reports whether req carries or carried credentials.
+func authenticated(req *http.Request) bool {
+	if req.Header.Get("Authorization") != "" {
+		return true
+	}
+	marked, _ := req.Context().Value(authenticatedContextKey{}).(bool)
+
+	return marked
+}
+
+func requestKey(req *http.Request) string {
+	if key, ok := req.Context().Value(keyContextKey{}).(string); ok {
+		return key
+	}
+
+	return req.URL.String()
+}
+
+// Transport returns a round tripper answering from the cache and storing
+// responses of base.
+func (c *Cache) Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{cache: c, base: base}
+}
+
+type transport struct {
+	cache *Cache
+	base  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.cache
+	key := requestKey(req)
+
+	if !cacheableRequest(req) {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		// Unsafe methods invalidate the stored response, see RFC 9111, 4.4.
+		if req.Method != http.MethodGet && req.Method != http.MethodHead &&
+			req.Method != http.MethodOptions && resp.StatusCode < http.StatusBadRequest {
+			c.store.Remove(key)
+		}
+		c.metrics.result(Bypass).Inc()
+		resp.Header.Set(headerXCache, Bypass)
+
+		return resp, nil
+	}
+
+	now := c.now()
+	reqDirs := parseCacheControl(req.Header)
+	entry := c.lookup(key, req)
+	if entry != nil && usable(entry, reqDirs, now) {
+		return c.serve(req, entry, Hit, now), nil
+	}
+	if entry == nil && reqDirs.has("only-if-cached") {
+		return c.gatewayTimeout(req), nil
+	}
+	if entry != nil && !entry.fresh(now) && !reqDirs.has("no-cache") && !reqDirs.has("max-age") &&
+		c.staleWhileRevalidate(entry, now) {
+		t.refresh(req, entry)
+
+		return c.serve(req, entry, Stale, now), nil
+	}
+
+	outReq := req
+	revalidating := entry != nil && hasValidators(entry)
+	if revalidating {
+		outReq = conditionalRequest(req, entry)
+	}
+
+	resp, err := t.base.RoundTrip(outReq)
+	if entry != nil && (err != nil || serverError(resp.StatusCode)) && c.staleIfError(entry, reqDirs, now) {
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		return c.serve(req, entry, Stale, now), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revalidating && resp.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		refreshed := c.refresh(entry, resp.Header, now)
+		c.store.Save(refreshed)
+
+		return c.serve(req, refreshed, Revalidated, now), nil
+	}
+
+	c.metrics.result(Miss).Inc()
+	if storable(req, resp) && resp.ContentLength <= c.cfg.MaxEntrySize {
+		c.record(req, resp, key, now)
+	}
+	resp.Header.Set(headerXCache, Miss)
+
+	return resp, nil
+}
+
+// refresh revalidates entry in the background, once per variant at a time.
+func (t *transport) refresh(req *http.Request, entry *Entry) {
+	c := t.cache
+	variant := entry.variantKey()
+
+	c.mu.Lock()
+	if _, ok := c.refreshing[variant]; ok {
+		c.mu.Unlock()
+
+		return
+	}
+	c.refreshing[variant] = struct{}{}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), revalidateTimeout)
+	bgReq := req.Clone(ctx)
+	bgReq.Method = http.MethodGet
+	outReq := bgReq
+	if hasValidators(entry) {
+		outReq = conditionalRequest(bgReq, entry)
+	}
+
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			delete(c.refreshing, variant)
+			c.mu.Unlock()
+		}()
+
+		resp, err := t.base.RoundTrip(outReq)
+		if err != nil {
+			log.Printf("[Cache] background revalidation of %s failed: %v", entry.Key, err)
+
+			return
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		now := c.now()
+		switch {
+		case resp.StatusCode == http.StatusNotModified && outReq != bgReq:
+			c.store.Save(c.refresh(entry, resp.Header, now))
+		case storable(bgReq, resp) && resp.ContentLength <= c.cfg.MaxEntrySize:
+			body, err := io.ReadAll(io.LimitReader(resp.Body, c.cfg.MaxEntrySize+1))
+			if err != nil || int64(len(body)) > c.cfg.MaxEntrySize {
+				return
+			}
+			refreshed := c.newEntry(bgReq, entry.Key, resp.StatusCode, resp.Header, now)
+			refreshed.Body = body
+			c.store.Save(refreshed)
+		}
+	}()
+}
+
+// lookup returns the stored variant matching req.
+func (c *Cache) lookup(key string, req *http.Request) *Entry {
+	return c.store.Lookup(key, func(entry *Entry) bool {
+		return entry.matches(req)
+	})
+}
+
+// usable reports whether a stored response satisfies the request
+// directives without contacting the destination.
+func usable(entry *Entry, reqDirs directives, now time.Time) bool {
+	if !entry.fresh(now) || reqDirs.has("no-cache") {
+		return false
+	}
+	if maxAge, ok := reqDirs.seconds("max-age"); ok && entry.age(now) > maxAge {
+		return false
+	}
+
+	return true
+}
+
+// staleWhileRevalidate reports whether a stale entry may be served while it
+// is revalidated in the background.
+func (c *Cache) staleWhileRevalidate(entry *Entry, now time.Time) bool {
+	dirs := parseCacheControl(entry.Header)
+	if !staleAllowed(dirs) {
+		return false
+	}
+
+	window, ok := dirs.seconds("stale-while-revalidate")
+	if !ok {
+		window = c.cfg.StaleWhileRevalidate
+	}
+
+	return now.Before(entry.Expires.Add(window))
+}
+
+// staleIfError reports whether a stale entry may be served because the
+// destination failed.
+func (c *Cache) staleIfError(entry *Entry, reqDirs directives, now time.Time) bool {
+	dirs := parseCacheControl(entry.Header)
+	if !staleAllowed(dirs) {
+		return false
+	}
+
+	window, ok := dirs.seconds("stale-if-error")
+	if !ok {
+		window = c.cfg.StaleIfError
+	}
+	if requested, ok := reqDirs.seconds("stale-if-error"); ok {
+		window = requested
+	}
+
+	return now.Before(entry.Expires.Add(window))
+}
+
+// staleAllowed reports whether a response may be served stale at all, see
+// RFC 9111, section 4.2.4.
+func staleAllowed(dirs directives) bool {
+	return !dirs.has("must-revalidate") && !dirs.has("proxy-revalidate") && !dirs.has("no-cache")
+}
+
+func serverError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func hasValidators(entry *Entry) bool {
+	return entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != ""
+}
+
+// conditionalRequest asks the destination whether entry is still valid.
+func conditionalRequest(req *http.Request, entry *Entry) *http.Request {
+	outReq := req.Clone(req.Context())
+	outReq.Header.Del("If-Match")
+	outReq.Header.Del("If-Unmodified-Since")
+	outReq.Header.Del("If-None-Match")
+	outReq.Header.Del("If-Modified-Since")
+
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		outReq.Header.Set("If-None-Match", etag)
+	}
+	if modified := entry.Header.Get("Last-Modified"); modified != "" {
+		outReq.Header.Set("If-Modified-Since", modified)
+	}
+
+	return outReq
+}
+
+// newEntry creates the entry of a response received at now.
+func (c *Cache) newEntry(req *http.Request, key string, status int, header http.Header, now time.Time) *Entry {
+	vary := varyNames(header)
+	entry := &Entry{
+		Key:        key,
+		Vary:       vary,
+		VaryValues: varyValues(req, vary),
+		Status:     status,
+		Header:     storedHeader(header),
+		Date:       responseDate(header, now),
+	}
+
+	lifetime, _ := freshnessLifetime(header, parseCacheControl(header), entry.Date)
+	entry.Expires = entry.Date.Add(lifetime)
+
+	return entry
+}
+
+// refresh updates a stored response with the headers of a 304 response, see
+// RFC 9111, section 4.3.4.
+func (c *Cache) refresh(entry *Entry, header http.Header, now time.Time) *Entry {
+	merged := entry.Header.Clone()
+	for name, values := range storedHeader(header) {
+		if name == "Content-Length" || name == "Content-Encoding" || name == "Content-Type" {
+			continue
+		}
+		merged[name] = values
+	}
+
+	refreshed := *entry
+	refreshed.Header = merged
+	refreshed.Date = responseDate(header, now)
+
+	lifetime, _ := freshnessLifetime(merged, parseCacheControl(merged), refreshed.Date)
+	refreshed.Expires = refreshed.Date.Add(lifetime)
+
+	return &refreshed
+}
+
+// record stores the response once its body has been read completely.
+func (c *Cache) record(req *http.Request, resp *http.Response, key string, now time.Time) {
+	entry := c.newEntry(req, key, resp.StatusCode, resp.Header, now)
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		limit:      c.cfg.MaxEntrySize,
+		done: func(body []byte) {
+			entry.Body = body
+			c.store.Save(entry)
+		},
+	}
+}
+
+// serve answers req with a stored response.
+func (c *Cache) serve(req *http.Request, entry *Entry, result string, now time.Time) *http.Response {
+	c.metrics.result(result).Inc()
+
+	header := entry.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(entry.age(now)/time.Second), 10))
+	header.Set(headerXCache, result)
+
+	status := entry.Status
+	var body io.ReadCloser = io.NopCloser(bytes.NewReader(entry.Body))
+	length := int64(len(entry.Body))
+	if notModified(req, entry) {
+		status = http.StatusNotModified
+		header.Del("Content-Length")
+		body, length = http.NoBody, 0
+	} else if req.Method == http.MethodHead {
+		body = http.NoBody
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+// gatewayTimeout answers an only-if-cached request without a stored
+// response, see RFC 9111, section 5.2.1.7.
+func (c *Cache) gatewayTimeout(req *http.Request) *http.Response {
+	c.metrics.result(Miss).Inc()
+
+	return &http.Response{
+		Status:     "504 " + http.StatusText(http.StatusGatewayTimeout),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{headerXCache: {Miss}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// recordingBody keeps a copy of the body read by the client and hands it to
+// done once it was read completely within limit.
+type recordingBody struct {
+	io.ReadCloser
+
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func(body []byte)
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow && n > 0 {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !b.overflow && b.done != nil {
+		b.done(bytes.Clone(b.buf.Bytes()))
+		b.done = nil
+	}
+
+	return n, err
+}
+
+// cacheMetrics holds the metric series of one cache.
+type cacheMetrics struct {
+	name        string
+	entries     *metrics.Gauge
+	bytes       *metrics.Gauge
+	diskEntries *metrics.Gauge
+	diskBytes   *metrics.Gauge
+	evictions   *metrics.Counter
+	purged      *metrics.Counter
+}
+
+var (
+	entriesGauge = metrics.Default.GaugeVec("proxier_cache_entries",
+		"Responses currently stored in the cache.")
+	sizeGauge = metrics.Default.GaugeVec("proxier_cache_size_bytes",
+		"Size of the responses stored in the cache.")
+	diskEntriesGauge = metrics.Default.GaugeVec("proxier_cache_disk_entries",
+		"Responses currently stored in the disk tier of the cache.")
+	diskSizeGauge = metrics.Default.GaugeVec("proxier_cache_disk_size_bytes",
+		"Size of the responses stored in the disk tier of the cache.")
+	evictionsTotal = metrics.Default.CounterVec("proxier_cache_evictions_total",
+		"Responses evicted from the cache to stay within its size.")
+	purgedTotal = metrics.Default.CounterVec("proxier_cache_purged_total",
+		"Responses removed from the cache by purge requests.")
+	requestsTotal = metrics.Default.CounterVec("proxier_cache_requests_total",
+		"Requests handled by the cache by X-Cache result.")
+)
+
+func newCacheMetrics(name string) *cacheMetrics {
+	labels := metrics.Labels{"cache": name}
+
+	return &cacheMetrics{
+		name:        name,
+		entries:     entriesGauge.With(labels),
+		bytes:       sizeGauge.With(labels),
+		diskEntries: diskEntriesGauge.With(labels),
+		diskBytes:   diskSizeGauge.With(labels),
+		evictions:   evictionsTotal.With(labels),
+		purged:      purgedTotal.With(labels),
+	}
+}
+
+func (m *cacheMetrics) result(result string) *metrics.Counter {
+	return requestsTotal.With(metrics.Labels{"cache": m.name, "result": strings.ToLower(result)})
+}
@@ -0,0 +1,404 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestCache returns a cache with a manual clock in front of handler,
+// counting the requests reaching handler.
+func newTestCache(t *testing.T, cfg Config, handler http.HandlerFunc) (*http.Client, string, *testClock, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	if cfg.Name == "" {
+		cfg.Name = t.Name()
+	}
+	c, err := New(cfg)
+	require.NoError(t, err)
+	clock := &testClock{now: time.Now()}
+	c.now = clock.Now
+
+	return &http.Client{Transport: c.Transport(http.DefaultTransport)}, upstream.URL, clock, &calls
+}
+
+func fetch(t *testing.T, client *http.Client, method, target string, header http.Header) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, target, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(body)
+}
+
+func TestCache_MaxAge(t *testing.T) {
+	var version atomic.Int32
+	client, target, clock, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "v"+strconv.Itoa(int(version.Add(1))))
+	})
+
+	resp, body := fetch(t, client, http.MethodGet, target+"/a", nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, "v1", body)
+
+	clock.Advance(30 * time.Second)
+	resp, body = fetch(t, client, http.MethodGet, target+"/a", nil)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+	assert.Equal(t, "30", resp.Header.Get("Age"))
+	assert.Equal(t, "v1", body)
+
+	resp, body = fetch(t, client, http.MethodHead, target+"/a", nil)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+	assert.Empty(t, body)
+
+	clock.Advance(31 * time.Second)
+	resp, body = fetch(t, client, http.MethodGet, target+"/a", nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, "v2", body)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCache_NotStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+		req    http.Header
+	}{
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}, http.StatusOK, nil},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, http.StatusOK, nil},
+		{"no freshness", http.Header{}, http.StatusOK, nil},
+		{"set-cookie", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, http.StatusOK, nil},
+		{"vary star", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, http.StatusOK, nil},
+		{"status", http.Header{"Cache-Control": {"max-age=60"}}, http.StatusInternalServerError, nil},
+		{"authorization", http.Header{"Cache-Control": {"max-age=60"}}, http.StatusOK,
+			http.Header{"Authorization": {"Bearer x"}}},
+		{"request no-store", http.Header{"Cache-Control": {"max-age=60"}}, http.StatusOK,
+			http.Header{"Cache-Control": {"no-store"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, target, _, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, _ *http.Request) {
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			fetch(t, client, http.MethodGet, target, tt.req)
+			resp, _ := fetch(t, client, http.MethodGet, target, tt.req)
+			assert.NotEqual(t, Hit, resp.Header.Get(headerXCache))
+			assert.Equal(t, int32(2), calls.Load())
+		})
+	}
+}
+
+func TestCache_Expires(t *testing.T) {
+	client, target, clock, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		now := time.Now()
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		w.Header().Set("Expires", now.Add(time.Minute).UTC().Format(http.TimeFormat))
+	})
+
+	fetch(t, client, http.MethodGet, target, nil)
+	resp, _ := fetch(t, client, http.MethodGet, target, nil)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+
+	clock.Advance(2 * time.Minute)
+	resp, _ = fetch(t, client, http.MethodGet, target, nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCache_Vary(t *testing.T) {
+	client, target, _, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		_, _ = io.WriteString(w, "lang="+r.Header.Get("Accept-Language"))
+	})
+
+	english := http.Header{"Accept-Language": {"en"}}
+	german := http.Header{"Accept-Language": {"de"}}
+
+	fetch(t, client, http.MethodGet, target, english)
+	fetch(t, client, http.MethodGet, target, german)
+
+	resp, body := fetch(t, client, http.MethodGet, target, english)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+	assert.Equal(t, "lang=en", body)
+
+	resp, body = fetch(t, client, http.MethodGet, target, german)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+	assert.Equal(t, "lang=de", body)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		validator string
+		value     string
+		condition string
+	}{
+		{"etag", "ETag", `"v1"`, "If-None-Match"},
+		{"last-modified", "Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT", "If-Modified-Since"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, target, clock, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+				// Without Date the age is measured by the test clock.
+				w.Header()["Date"] = nil
+				w.Header().Set("Cache-Control", "max-age=10")
+				w.Header().Set(tt.validator, tt.value)
+				if r.Header.Get(tt.condition) == tt.value {
+					w.WriteHeader(http.StatusNotModified)
+
+					return
+				}
+				_, _ = io.WriteString(w, "body")
+			})
+
+			fetch(t, client, http.MethodGet, target, nil)
+
+			clock.Advance(20 * time.Second)
+			resp, body := fetch(t, client, http.MethodGet, target, nil)
+			assert.Equal(t, Revalidated, resp.Header.Get(headerXCache))
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "body", body)
+
+			resp, _ = fetch(t, client, http.MethodGet, target, nil)
+			assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+
+			// Client conditionals are answered from the stored response.
+			resp, body = fetch(t, client, http.MethodGet, target, http.Header{tt.condition: {tt.value}})
+			assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+			assert.Empty(t, body)
+			assert.Equal(t, int32(2), calls.Load())
+		})
+	}
+}
+
+func TestCache_RequestDirectives(t *testing.T) {
+	client, target, clock, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	resp, _ := fetch(t, client, http.MethodGet, target+"/missing", http.Header{"Cache-Control": {"only-if-cached"}})
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, int32(0), calls.Load())
+
+	fetch(t, client, http.MethodGet, target, nil)
+	clock.Advance(20 * time.Second)
+
+	resp, _ = fetch(t, client, http.MethodGet, target, http.Header{"Cache-Control": {"max-age=10"}})
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+
+	resp, _ = fetch(t, client, http.MethodGet, target, http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestCache_UnsafeMethodInvalidates(t *testing.T) {
+	client, target, _, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	fetch(t, client, http.MethodGet, target, nil)
+	resp, _ := fetch(t, client, http.MethodPost, target, nil)
+	assert.Equal(t, Bypass, resp.Header.Get(headerXCache))
+
+	resp, _ = fetch(t, client, http.MethodGet, target, nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestCache_SizeLimits(t *testing.T) {
+	client, target, _, calls := newTestCache(t, Config{MaxSize: 4096, MaxEntrySize: 1024},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+			_, _ = w.Write(make([]byte, size))
+		})
+
+	// Too large for a single entry.
+	fetch(t, client, http.MethodGet, target+"/?size=2048", nil)
+	resp, _ := fetch(t, client, http.MethodGet, target+"/?size=2048", nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Filling the cache evicts the least recently used entry.
+	for i := range 6 {
+		fetch(t, client, http.MethodGet, target+"/"+strconv.Itoa(i)+"?size=900", nil)
+	}
+	resp, _ = fetch(t, client, http.MethodGet, target+"/0?size=900", nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	resp, _ = fetch(t, client, http.MethodGet, target+"/5?size=900", nil)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header   http.Header
+		lifetime time.Duration
+		explicit bool
+	}{
+		{http.Header{"Cache-Control": {"max-age=60"}}, time.Minute, true},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute, true},
+		{http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=invalid"}}, 0, true},
+		{http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+		{http.Header{}, 0, false},
+	}
+
+	for _, tt := range tests {
+		lifetime, explicit := freshnessLifetime(tt.header, parseCacheControl(tt.header), date)
+		assert.Equal(t, tt.lifetime, lifetime, tt.header)
+		assert.Equal(t, tt.explicit, explicit, tt.header)
+	}
+}
+
+func TestVaryValues(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header["Accept-Language"] = []string{"en,  de", " fr"}
+
+	values := varyValues(req, []string{"Accept-Language", "Accept-Encoding"})
+	assert.Equal(t, []string{"en, de,fr", ""}, values)
+	assert.Equal(t, []string{"en,  de", " fr"}, req.Header["Accept-Language"], "the request is not modified")
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int32
+	client, target, clock, calls := newTestCache(t, Config{}, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header()["Date"] = nil
+		w.Header().Set("Cache-Control", "max-age=10, stale-while-revalidate=30")
+		_, _ = io.WriteString(w, "v"+strconv.Itoa(int(version.Add(1))))
+	})
+
+	fetch(t, client, http.MethodGet, target, nil)
+	clock.Advance(20 * time.Second)
+
+	resp, body := fetch(t, client, http.MethodGet, target, nil)
+	assert.Equal(t, Stale, resp.Header.Get(headerXCache))
+	assert.Equal(t, "v1", body)
+
+	require.Eventually(t, func() bool {
+		resp, body := fetch(t, client, http.MethodGet, target, nil)
+
+		return resp.Header.Get(headerXCache) == Hit && body == "v2"
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Beyond the window the response is fetched again.
+	clock.Advance(time.Minute)
+	resp, body = fetch(t, client, http.MethodGet, target, nil)
+	assert.Equal(t, Miss, resp.Header.Get(headerXCache))
+	assert.Equal(t, "v3", body)
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		cfg          Config
+		stale        bool
+	}{
+		{"directive", "max-age=10, stale-if-error=60", Config{}, true},
+		{"configured", "max-age=10", Config{StaleIfError: time.Minute}, true},
+		{"expired window", "max-age=10, stale-if-error=5", Config{}, false},
+		{"must-revalidate", "max-age=10, must-revalidate", Config{StaleIfError: time.Minute}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			client, target, clock, _ := newTestCache(t, tt.cfg, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header()["Date"] = nil
+				if failing.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+
+					return
+				}
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				_, _ = io.WriteString(w, "cached")
+			})
+
+			fetch(t, client, http.MethodGet, target, nil)
+			clock.Advance(20 * time.Second)
+			failing.Store(true)
+
+			resp, body := fetch(t, client, http.MethodGet, target, nil)
+			if tt.stale {
+				assert.Equal(t, Stale, resp.Header.Get(headerXCache))
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, "cached", body)
+			} else {
+				assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCache_StaleIfErrorUnreachable(t *testing.T) {
+	client, target, clock, _ := newTestCache(t, Config{StaleIfError: time.Hour}, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header()["Date"] = nil
+		w.Header().Set("Cache-Control", "max-age=10")
+		_, _ = io.WriteString(w, "cached")
+	})
+
+	fetch(t, client, http.MethodGet, target, nil)
+	clock.Advance(20 * time.Second)
+
+	// Point the same cache key at a closed port.
+	req, err := http.NewRequestWithContext(WithKey(t.Context(), target), http.MethodGet, "http://127.0.0.1:1/", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, Stale, resp.Header.Get(headerXCache))
+	assert.Equal(t, "cached", string(body))
+}
@@ -0,0 +1,421 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskFileSuffix = ".cache"
+	diskTempPrefix = "tmp-"
+	// diskMagic starts every cache file, followed by the length of the JSON
+	// metadata, the metadata and the body.
+	diskMagic = "PXC1"
+)
+
+// diskMeta is the metadata of an entry stored on disk.
+type diskMeta struct {
+	Key        string      `json:"key"`
+	Vary       []string    `json:"vary,omitempty"`
+	VaryValues []string    `json:"vary_values,omitempty"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Date       time.Time   `json:"date"`
+	Expires    time.Time   `json:"expires"`
+}
+
+// diskItem is an entry known to the disk store; its body stays on disk.
+type diskItem struct {
+	entry *Entry
+	file  string
+	size  int64
+}
+
+// diskStore keeps entries in files below dir and evicts the least recently
+// used ones once their total size exceeds maxSize. The index is rebuilt from
+// the files on start.
+type diskStore struct {
+	dir     string
+	maxSize int64
+	metrics *cacheMetrics
+
+	mu       sync.Mutex
+	size     int64
+	lru      *list.List
+	items    map[string]*list.Element
+	variants map[string]map[string]struct{}
+}
+
+func newDiskStore(dir string, maxSize int64, metrics *cacheMetrics) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	store := &diskStore{
+		dir:      dir,
+		maxSize:  maxSize,
+		metrics:  metrics,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		variants: make(map[string]map[string]struct{}),
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// load indexes the files left by a previous run, oldest first.
+func (s *diskStore) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	type loaded struct {
+		item    *diskItem
+		modTime time.Time
+	}
+	items := make([]loaded, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.Name())
+		if strings.HasPrefix(file.Name(), diskTempPrefix) {
+			_ = os.Remove(path)
+
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskFileSuffix) {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entry, err := readDiskFile(path, false)
+		if err != nil {
+			log.Printf("[Cache] removing unreadable cache file %s: %v", path, err)
+			_ = os.Remove(path)
+
+			continue
+		}
+		items = append(items, loaded{
+			item:    &diskItem{entry: entry, file: path, size: info.Size()},
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].modTime.Before(items[j].modTime)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, loaded := range items {
+		s.add(loaded.item)
+	}
+	s.evict()
+	s.updateMetrics()
+
+	return nil
+}
+
+func (s *diskStore) Lookup(key string, match func(*Entry) bool) *Entry {
+	s.mu.Lock()
+	var found *diskItem
+	for variant := range s.variants[key] {
+		elem := s.items[variant]
+		item := elem.Value.(*diskItem) //nolint:forcetypeassert // only items are stored
+		if match(item.entry) {
+			s.lru.MoveToFront(elem)
+			found = item
+
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if found == nil {
+		return nil
+	}
+
+	entry, err := readDiskFile(found.file, true)
+	if err != nil {
+		log.Printf("[Cache] failed to read cache file %s: %v", found.file, err)
+		s.mu.Lock()
+		if elem, ok := s.items[found.entry.variantKey()]; ok && elem.Value == found {
+			s.remove(elem)
+			s.updateMetrics()
+		}
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	return entry
+}
+
+func (s *diskStore) Save(entry *Entry) {
+	variant := entry.variantKey()
+	sum := sha256.Sum256([]byte(variant))
+	path := filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskFileSuffix)
+
+	temp, size, err := writeDiskFile(s.dir, entry)
+	if err != nil {
+		log.Printf("[Cache] failed to write cache file %s: %v", path, err)
+
+		return
+	}
+	if size > s.maxSize {
+		_ = os.Remove(temp)
+
+		return
+	}
+
+	meta := *entry
+	meta.Body = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The file is moved into place under the lock, so that removing the item
+	// it replaces cannot delete it before it is indexed.
+	if err := os.Rename(temp, path); err != nil {
+		_ = os.Remove(temp)
+		log.Printf("[Cache] failed to write cache file %s: %v", path, err)
+
+		return
+	}
+	if elem, ok := s.items[variant]; ok {
+		// The file was replaced in place, only forget the old item.
+		s.forget(elem)
+	}
+	s.add(&diskItem{entry: &meta, file: path, size: size})
+	s.evict()
+	s.updateMetrics()
+}
+
+func (s *diskStore) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for variant := range s.variants[key] {
+		s.remove(s.items[variant])
+	}
+	s.updateMetrics()
+}
+
+func (s *diskStore) Purge(match func(*Entry) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for elem := s.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*diskItem).entry) { //nolint:forcetypeassert // only items are stored
+			s.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	s.updateMetrics()
+
+	return purged
+}
+
+func (s *diskStore) add(item *diskItem) {
+	variant := item.entry.variantKey()
+	s.items[variant] = s.lru.PushFront(item)
+	if s.variants[item.entry.Key] == nil {
+		s.variants[item.entry.Key] = make(map[string]struct{})
+	}
+	s.variants[item.entry.Key][variant] = struct{}{}
+	s.size += item.size
+}
+
+func (s *diskStore) evict() {
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+		s.metrics.evictions.Inc()
+	}
+}
+
+// remove forgets the item of elem and deletes its file.
+func (s *diskStore) remove(elem *list.Element) {
+	item := s.forget(elem)
+	if err := os.Remove(item.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[Cache] failed to remove cache file %s: %v", item.file, err)
+	}
+}
+
+func (s *diskStore) forget(elem *list.Element) *diskItem {
+	item := elem.Value.(*diskItem) //nolint:forcetypeassert // only items are stored
+	variant := item.entry.variantKey()
+
+	s.lru.Remove(elem)
+	delete(s.items, variant)
+	delete(s.variants[item.entry.Key], variant)
+	if len(s.variants[item.entry.Key]) == 0 {
+		delete(s.variants, item.entry.Key)
+	}
+	s.size -= item.size
+
+	return item
+}
+
+func (s *diskStore) updateMetrics() {
+	s.metrics.diskEntries.Set(int64(s.lru.Len()))
+	s.metrics.diskBytes.Set(s.size)
+}
+
+// writeDiskFile writes entry to a temporary file in dir, to be renamed to its
+// final path so that readers never see partial files. It returns the name
+// and size of the file.
+func writeDiskFile(dir string, entry *Entry) (string, int64, error) {
+	meta, err := json.Marshal(diskMeta{
+		Key:        entry.Key,
+		Vary:       entry.Vary,
+		VaryValues: entry.VaryValues,
+		Status:     entry.Status,
+		Header:     entry.Header,
+		Date:       entry.Date,
+		Expires:    entry.Expires,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	file, err := os.CreateTemp(dir, diskTempPrefix+"*")
+	if err != nil {
+		return "", 0, err
+	}
+
+	writer := bufio.NewWriter(file)
+	_, _ = writer.WriteString(diskMagic)
+	_ = binary.Write(writer, binary.BigEndian, uint32(len(meta)))
+	_, _ = writer.Write(meta)
+	_, _ = writer.Write(entry.Body)
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+
+		return "", 0, err
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+
+		return "", 0, err
+	}
+
+	return file.Name(), int64(len(diskMagic) + 4 + len(meta) + len(entry.Body)), nil
+}
+
+// readDiskFile reads the entry stored at path, with its body when withBody
+// is set.
+func readDiskFile(path string, withBody bool) (*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, len(diskMagic)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(diskMagic)]) != diskMagic {
+		return nil, errors.New("invalid cache file")
+	}
+
+	meta := make([]byte, binary.BigEndian.Uint32(header[len(diskMagic):]))
+	if _, err := io.ReadFull(reader, meta); err != nil {
+		return nil, err
+	}
+	var decoded diskMeta
+	if err := json.Unmarshal(meta, &decoded); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Key:        decoded.Key,
+		Vary:       decoded.Vary,
+		VaryValues: decoded.VaryValues,
+		Status:     decoded.Status,
+		Header:     decoded.Header,
+		Date:       decoded.Date,
+		Expires:    decoded.Expires,
+	}
+	if len(entry.VaryValues) != len(entry.Vary) {
+		return nil, errors.New("invalid cache file metadata")
+	}
+
+	if withBody {
+		if entry.Body, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// tieredStore keeps entries up to memoryEntryLimit in memory in front of
+// the disk store.
+type tieredStore struct {
+	memory           *memoryStore
+	disk             *diskStore
+	memoryEntryLimit int64
+}
+
+func (s *tieredStore) Lookup(key string, match func(*Entry) bool) *Entry {
+	if entry := s.memory.Lookup(key, match); entry != nil {
+		return entry
+	}
+
+	entry := s.disk.Lookup(key, match)
+	if entry != nil && entry.size() <= s.memoryEntryLimit {
+		s.memory.Save(entry)
+	}
+
+	return entry
+}
+
+func (s *tieredStore) Save(entry *Entry) {
+	if entry.size() <= s.memoryEntryLimit {
+		s.memory.Save(entry)
+	} else {
+		// Drop an older variant kept in memory.
+		s.memory.removeVariant(entry.variantKey())
+	}
+	s.disk.Save(entry)
+}
+
+func (s *tieredStore) Remove(key string) {
+	s.memory.Remove(key)
+	s.disk.Remove(key)
+}
+
+// Purge returns the number of entries purged from disk, which holds every
+// entry also kept in memory.
+func (s *tieredStore) Purge(match func(*Entry) bool) int {
+	return max(s.memory.Purge(match), s.disk.Purge(match))
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func diskEntry(key string, body string) *Entry {
+	now := time.Now()
+
+	return &Entry{
+		Key:     key,
+		Status:  http.StatusOK,
+		Header:  http.Header{"Content-Type": {"text/plain"}},
+		Body:    []byte(body),
+		Date:    now,
+		Expires: now.Add(time.Minute),
+	}
+}
+
+func matchAll(*Entry) bool {
+	return true
+}
+
+func TestDiskStore_Persistence(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := newDiskStore(dir, 1<<20, newCacheMetrics(t.Name()))
+	require.NoError(t, err)
+	store.Save(diskEntry("example.com/a", "first"))
+	store.Save(diskEntry("example.com/b", "second"))
+	store.Remove("example.com/b")
+
+	reopened, err := newDiskStore(dir, 1<<20, newCacheMetrics(t.Name()))
+	require.NoError(t, err)
+
+	entry := reopened.Lookup("example.com/a", matchAll)
+	require.NotNil(t, entry)
+	assert.Equal(t, "first", string(entry.Body))
+	assert.Equal(t, "text/plain", entry.Header.Get("Content-Type"))
+	assert.Nil(t, reopened.Lookup("example.com/b", matchAll))
+}
+
+func TestDiskStore_Eviction(t *testing.T) {
+	store, err := newDiskStore(t.TempDir(), 2048, newCacheMetrics(t.Name()))
+	require.NoError(t, err)
+
+	body := strings.Repeat("x", 500)
+	for i := range 5 {
+		store.Save(diskEntry("example.com/"+strconv.Itoa(i), body))
+	}
+
+	assert.Nil(t, store.Lookup("example.com/0", matchAll))
+	assert.NotNil(t, store.Lookup("example.com/4", matchAll))
+	assert.LessOrEqual(t, store.size, int64(2048))
+
+	files, err := filepath.Glob(filepath.Join(store.dir, "*"+diskFileSuffix))
+	require.NoError(t, err)
+	assert.Len(t, files, store.lru.Len())
+}
+
+func TestDiskStore_RemoveDuringSave(t *testing.T) {
+	store, err := newDiskStore(t.TempDir(), 1<<20, newCacheMetrics(t.Name()))
+	require.NoError(t, err)
+	store.Save(diskEntry("example.com/a", "old"))
+
+	// Remove the old item while Save of a new one is under way.
+	store.mu.Lock()
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+
+		store.Save(diskEntry("example.com/a", "new"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for variant := range store.variants["example.com/a"] {
+		store.remove(store.items[variant])
+	}
+	store.mu.Unlock()
+	<-saved
+
+	entry := store.Lookup("example.com/a", matchAll)
+	require.NotNil(t, entry)
+	assert.Equal(t, "new", string(entry.Body))
+}
+
+func TestDiskStore_InvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken"+diskFileSuffix), []byte("garbage"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, diskTempPrefix+"1"), []byte("partial"), 0o600))
+
+	store, err := newDiskStore(dir, 1<<20, newCacheMetrics(t.Name()))
+	require.NoError(t, err)
+	assert.Equal(t, 0, store.lru.Len())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestCache_DiskTier(t *testing.T) {
+	dir := t.TempDir()
+	large := strings.Repeat("x", 2<<20)
+
+	client, target, _, calls := newTestCache(t, Config{Dir: dir}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/large" {
+			_, _ = w.Write([]byte(large))
+
+			return
+		}
+		_, _ = w.Write([]byte("small"))
+	})
+
+	fetch(t, client, http.MethodGet, target+"/large", nil)
+	resp, body := fetch(t, client, http.MethodGet, target+"/large", nil)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+	assert.Equal(t, large, body)
+
+	fetch(t, client, http.MethodGet, target+"/small", nil)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// A new cache on the same directory serves the stored responses.
+	restarted, err := New(Config{Name: t.Name(), Dir: dir})
+	require.NoError(t, err)
+	restartedClient := &http.Client{Transport: restarted.Transport(http.DefaultTransport)}
+
+	resp, body = fetch(t, restartedClient, http.MethodGet, target+"/small", nil)
+	assert.Equal(t, Hit, resp.Header.Get(headerXCache))
+	assert.Equal(t, "small", body)
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// memoryStore keeps entries in memory and evicts the least recently used
+// ones once their total size exceeds maxSize.
+type memoryStore struct {
+	maxSize int64
+	metrics *cacheMetrics
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+	// variants maps a key to the variant keys stored for it.
+	variants map[string]map[string]struct{}
+}
+
+func newMemoryStore(maxSize int64, metrics *cacheMetrics) *memoryStore {
+	return &memoryStore{
+		maxSize:  maxSize,
+		metrics:  metrics,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		variants: make(map[string]map[string]struct{}),
+	}
+}
+
+func (s *memoryStore) Lookup(key string, match func(*Entry) bool) *Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for variant := range s.variants[key] {
+		elem := s.items[variant]
+		entry := elem.Value.(*Entry) //nolint:forcetypeassert // only entries are stored
+		if match(entry) {
+			s.lru.MoveToFront(elem)
+
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Save(entry *Entry) {
+	size := entry.size()
+	if size > s.maxSize {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	variant := entry.variantKey()
+	if elem, ok := s.items[variant]; ok {
+		s.removeElement(elem)
+	}
+
+	s.items[variant] = s.lru.PushFront(entry)
+	if s.variants[entry.Key] == nil {
+		s.variants[entry.Key] = make(map[string]struct{})
+	}
+	s.variants[entry.Key][variant] = struct{}{}
+	s.size += size
+
+	for s.size > s.maxSize {
+		s.removeElement(s.lru.Back())
+		s.metrics.evictions.Inc()
+	}
+	s.updateMetrics()
+}
+
+func (s *memoryStore) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for variant := range s.variants[key] {
+		s.removeElement(s.items[variant])
+	}
+	s.updateMetrics()
+}
+
+func (s *memoryStore) Purge(match func(*Entry) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for elem := s.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*Entry)) { //nolint:forcetypeassert // only entries are stored
+			s.removeElement(elem)
+			purged++
+		}
+		elem = next
+	}
+	s.updateMetrics()
+
+	return purged
+}
+
+func (s *memoryStore) removeVariant(variant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[variant]; ok {
+		s.removeElement(elem)
+		s.updateMetrics()
+	}
+}
+
+func (s *memoryStore) removeElement(elem *list.Element) {
+	entry := elem.Value.(*Entry) //nolint:forcetypeassert // only entries are stored
+	variant := entry.variantKey()
+
+	s.lru.Remove(elem)
+	delete(s.items, variant)
+	delete(s.variants[entry.Key], variant)
+	if len(s.variants[entry.Key]) == 0 {
+		delete(s.variants, entry.Key)
+	}
+	s.size -= entry.size()
+}
+
+func (s *memoryStore) updateMetrics() {
+	s.metrics.entries.Set(int64(s.lru.Len()))
+	s.metrics.bytes.Set(s.size)
+}
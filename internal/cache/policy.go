@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives holds parsed Cache-Control directives, keyed by lower case
+// name.
+type directives map[string]string
+
+func parseCacheControl(header http.Header) directives {
+	dirs := make(directives)
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			dirs[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+
+	return dirs
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+
+	return ok
+}
+
+// seconds returns the delta-seconds argument of a directive.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	secs, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || secs < 0 {
+		// Invalid values are treated as already stale, see RFC 9111, 1.2.2.
+		return 0, true
+	}
+
+	return time.Duration(secs) * time.Second, true
+}
+
+// cacheableStatus lists the status codes stored by the cache, see RFC 9110,
+// section 15.1.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheableRequest reports whether a response to req may be served from or
+// stored in the cache.
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Header.Get("Upgrade") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+
+	return !parseCacheControl(req.Header).has("no-store")
+}
+
+// storable reports whether resp to req may be stored by a shared cache, see
+// RFC 9111, section 3.
+func storable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheableStatus[resp.StatusCode] {
+		return false
+	}
+
+	dirs := parseCacheControl(resp.Header)
+	if dirs.has("no-store") || dirs.has("private") {
+		return false
+	}
+	if authenticated(req) &&
+		!dirs.has("public") && !dirs.has("s-maxage") && !dirs.has("must-revalidate") {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	if _, ok := freshnessLifetime(resp.Header, dirs, time.Time{}); ok {
+		return true
+	}
+
+	return resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// freshnessLifetime returns the lifetime of a response generated at date,
+// see RFC 9111, section 4.2.1. ok is false without explicit freshness.
+func freshnessLifetime(header http.Header, dirs directives, date time.Time) (time.Duration, bool) {
+	if dirs.has("no-cache") {
+		return 0, true
+	}
+	if lifetime, ok := dirs.seconds("s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := dirs.seconds("max-age"); ok {
+		return lifetime, true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil || date.IsZero() {
+			return 0, true
+		}
+
+		return max(at.Sub(date), 0), true
+	}
+
+	return 0, false
+}
+
+// responseDate returns when a response received at now was generated,
+// accounting for its Date and Age headers, see RFC 9111, section 4.2.3.
+func responseDate(header http.Header, now time.Time) time.Time {
+	age := time.Duration(0)
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && now.After(date) {
+		age = now.Sub(date)
+	}
+	if secs, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		age = max(age, time.Duration(secs)*time.Second)
+	}
+
+	return now.Add(-age)
+}
+
+// varyNames returns the canonical header names listed in Vary.
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+// varyValues returns the normalized request values of the Vary headers.
+func varyValues(req *http.Request, names []string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		// Header.Values shares its slice with the request, so it is not
+		// normalized in place.
+		parts := req.Header.Values(name)
+		normalized := make([]string, len(parts))
+		for j, part := range parts {
+			normalized[j] = strings.Join(strings.Fields(part), " ")
+		}
+		values[i] = strings.Join(normalized, ",")
+	}
+
+	return values
+}
+
+// hopHeaders are not stored with a response.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// storedHeader returns the response header kept with a stored response.
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			stored.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		stored.Del(name)
+	}
+	stored.Del("Age")
+	stored.Del(headerXCache)
+
+	return stored
+}
+
+// notModified evaluates the conditional headers of req against a stored
+// response, see RFC 9110, section 13.2.2.
+func notModified(req *http.Request, entry *Entry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(entry.Header.Get("Last-Modified"))
+
+		return err == nil && !modified.After(since)
+	}
+
+	return false
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Response headers listing the tags of a response, as emitted by the
+// destination. Surrogate-Key separates tags by spaces, Cache-Tag by commas.
+const (
+	headerSurrogateKey = "Surrogate-Key"
+	headerCacheTag     = "Cache-Tag"
+)
+
+// maxPurgeRequestSize bounds the JSON body of a purge request.
+const maxPurgeRequestSize = 64 << 10
+
+var (
+	// ErrEmptyPurge is returned for a purge request selecting nothing.
+	ErrEmptyPurge = errors.New("purge request needs a url, prefix, route or tags")
+	// ErrUnknownRoute is returned when a purge names a route without cache.
+	ErrUnknownRoute = errors.New("route has no cache")
+)
+
+// tags returns the tags of a stored response.
+func (e *Entry) tags() []string {
+	var tags []string
+	for _, value := range e.Header.Values(headerSurrogateKey) {
+		tags = append(tags, strings.Fields(value)...)
+	}
+	for _, value := range e.Header.Values(headerCacheTag) {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
+
+// Purge removes the stored responses accepted by match and returns how many
+// were removed. match sees entries without their body.
+func (c *Cache) Purge(match func(*Entry) bool) int {
+	purged := c.store.Purge(match)
+	if purged > 0 {
+		c.metrics.purged.Add(uint64(purged))
+	}
+
+	return purged
+}
+
+// PurgeKey removes all variants stored for key, see WithKey.
+func (c *Cache) PurgeKey(key string) int {
+	return c.Purge(func(entry *Entry) bool {
+		return entry.Key == key
+	})
+}
+
+// PurgeRequest selects the responses removed by Registry.Purge. Set fields
+// must all match; Route alone purges every response of the route.
+type PurgeRequest struct {
+	// URL is the absolute URL of a response as requested by clients.
+	URL string `json:"url,omitempty"`
+	// Prefix is the start of the absolute URLs of responses.
+	Prefix string `json:"prefix,omitempty"`
+	// Route is the endpoint of the proxy rule owning the cache.
+	Route string `json:"route,omitempty"`
+	// Tags matches responses carrying any of them in a Surrogate-Key or
+	// Cache-Tag header.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// matcher returns the entry filter of the request.
+func (r PurgeRequest) matcher() (func(*Entry) bool, error) {
+	if r.URL == "" && r.Prefix == "" && r.Route == "" && len(r.Tags) == 0 {
+		return nil, ErrEmptyPurge
+	}
+
+	var key, prefix string
+	if r.URL != "" {
+		var err error
+		if key, err = urlKey(r.URL); err != nil {
+			return nil, err
+		}
+	}
+	if r.Prefix != "" {
+		var err error
+		if prefix, err = urlKey(r.Prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(entry *Entry) bool {
+		if key != "" && entry.Key != key {
+			return false
+		}
+		if prefix != "" && !strings.HasPrefix(entry.Key, prefix) {
+			return false
+		}
+		if len(r.Tags) > 0 && !slices.ContainsFunc(entry.tags(), func(tag string) bool {
+			return slices.Contains(r.Tags, tag)
+		}) {
+			return false
+		}
+
+		return true
+	}, nil
+}
+
+// urlKey converts an absolute URL to the cache key of the response, the
+// host and request URI.
+func urlKey(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid purge URL %q: must be absolute", rawURL)
+	}
+
+	return u.Host + u.RequestURI(), nil
+}
+
+// Registry holds the caches of all routes so that they can be purged.
+type Registry struct {
+	mu     sync.RWMutex
+	caches map[string]*Cache
+}
+
+// Default is the registry of the caches created for proxy rules.
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{caches: make(map[string]*Cache)}
+}
+
+// Register adds the cache of route, replacing a previous one.
+func (r *Registry) Register(route string, c *Cache) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.caches[route] = c
+}
+
+// Purge removes the responses selected by req from the registered caches
+// and returns how many were removed.
+func (r *Registry) Purge(req PurgeRequest) (int, error) {
+	match, err := req.matcher()
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if req.Route != "" {
+		c, ok := r.caches[req.Route]
+		if !ok {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownRoute, req.Route)
+		}
+
+		return c.Purge(match), nil
+	}
+
+	purged := 0
+	for _, c := range r.caches {
+		purged += c.Purge(match)
+	}
+
+	return purged, nil
+}
+
+// PurgeResponse is the body answering a purge request.
+type PurgeResponse struct {
+	Purged int    `json:"purged"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Handler serves purge requests: a POST with a JSON PurgeRequest body,
+// answered with a JSON PurgeResponse.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writePurgeResponse(w, http.StatusMethodNotAllowed, PurgeResponse{Error: "method not allowed"})
+
+			return
+		}
+
+		var purge PurgeRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxPurgeRequestSize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&purge); err != nil {
+			writePurgeResponse(w, http.StatusBadRequest, PurgeResponse{Error: "invalid purge request: " + err.Error()})
+
+			return
+		}
+
+		purged, err := r.Purge(purge)
+		switch {
+		case errors.Is(err, ErrUnknownRoute):
+			writePurgeResponse(w, http.StatusNotFound, PurgeResponse{Error: err.Error()})
+		case err != nil:
+			writePurgeResponse(w, http.StatusBadRequest, PurgeResponse{Error: err.Error()})
+		default:
+			log.Printf("[Cache] purged %d responses (url=%q prefix=%q route=%q tags=%q)",
+				purged, purge.URL, purge.Prefix, purge.Route, purge.Tags)
+			writePurgeResponse(w, http.StatusOK, PurgeResponse{Purged: purged})
+		}
+	})
+}
+
+func writePurgeResponse(w http.ResponseWriter, status int, resp PurgeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func taggedEntry(key string, header http.Header) *Entry {
+	entry := diskEntry(key, "body")
+	for name, values := range header {
+		entry.Header[name] = values
+	}
+
+	return entry
+}
+
+func newPurgeRegistry(t *testing.T) (*Registry, map[string]*Cache) {
+	t.Helper()
+
+	caches := make(map[string]*Cache)
+	registry := NewRegistry()
+	for _, route := range []string{"/api", "/static"} {
+		c, err := New(Config{Name: t.Name() + route})
+		require.NoError(t, err)
+		registry.Register(route, c)
+		caches[route] = c
+	}
+
+	caches["/api"].store.Save(taggedEntry("example.com/api/users?page=1",
+		http.Header{"Surrogate-Key": {"users page-1"}}))
+	caches["/api"].store.Save(taggedEntry("example.com/api/users?page=2",
+		http.Header{"Surrogate-Key": {"users"}}))
+	caches["/api"].store.Save(taggedEntry("example.com/api/orders", nil))
+	caches["/static"].store.Save(taggedEntry("example.com/static/app.js",
+		http.Header{"Cache-Tag": {"assets, js"}}))
+	caches["/static"].store.Save(taggedEntry("other.com/static/app.js", nil))
+
+	return registry, caches
+}
+
+func TestRegistry_Purge(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     PurgeRequest
+		purged  int
+		wantErr error
+	}{
+		{"url", PurgeRequest{URL: "https://example.com/api/users?page=1"}, 1, nil},
+		{"url without match", PurgeRequest{URL: "https://example.com/api/users"}, 0, nil},
+		{"prefix", PurgeRequest{Prefix: "http://example.com/api/users"}, 2, nil},
+		{"host prefix", PurgeRequest{Prefix: "http://example.com"}, 4, nil},
+		{"route", PurgeRequest{Route: "/static"}, 2, nil},
+		{"route and prefix", PurgeRequest{Route: "/static", Prefix: "http://other.com/"}, 1, nil},
+		{"surrogate key", PurgeRequest{Tags: []string{"users"}}, 2, nil},
+		{"cache tag", PurgeRequest{Tags: []string{"js", "unknown"}}, 1, nil},
+		{"unknown route", PurgeRequest{Route: "/missing"}, 0, ErrUnknownRoute},
+		{"empty", PurgeRequest{}, 0, ErrEmptyPurge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, _ := newPurgeRegistry(t)
+
+			purged, err := registry.Purge(tt.req)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.purged, purged)
+
+			// Purging again finds nothing.
+			purged, err = registry.Purge(tt.req)
+			require.NoError(t, err)
+			assert.Zero(t, purged)
+		})
+	}
+
+	t.Run("relative url", func(t *testing.T) {
+		registry, _ := newPurgeRegistry(t)
+
+		_, err := registry.Purge(PurgeRequest{URL: "/api/users"})
+		assert.Error(t, err)
+	})
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry, caches := newPurgeRegistry(t)
+	handler := registry.Handler()
+
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/cache/purge", strings.NewReader(body)))
+
+		return rec
+	}
+
+	rec := serve(http.MethodPost, `{"tags": ["users"]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"purged": 2}`, rec.Body.String())
+	assert.Nil(t, caches["/api"].store.Lookup("example.com/api/users?page=2", matchAll))
+	assert.NotNil(t, caches["/api"].store.Lookup("example.com/api/orders", matchAll))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodGet, "").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, `{"paths": []}`).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, `{}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, `{"route": "/missing"}`).Code)
+}
+
+func TestDiskStore_Purge(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(Config{Name: t.Name(), Dir: dir})
+	require.NoError(t, err)
+
+	c.store.Save(taggedEntry("example.com/a", http.Header{"Surrogate-Key": {"a"}}))
+	c.store.Save(taggedEntry("example.com/b", nil))
+	assert.Equal(t, 1, c.Purge(func(entry *Entry) bool {
+		return entry.Key == "example.com/a"
+	}))
+
+	reopened, err := newDiskStore(dir, 1<<20, newCacheMetrics(t.Name()))
+	require.NoError(t, err)
+	assert.Nil(t, reopened.Lookup("example.com/a", matchAll))
+	assert.NotNil(t, reopened.Lookup("example.com/b", matchAll))
+}
@@ -0,0 +1,258 @@
+// Package forwardproxy implements an HTTP forward proxy: absolute-form
+// requests are forwarded and CONNECT requests are tunneled to destinations
+// allowed by an access list.
+package forwardproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/acl"
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/ezex-io/proxier/internal/metrics"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	authRealm      = "proxier"
+)
+
+var (
+	requestsTotal = metrics.Default.CounterVec("proxier_forward_proxy_requests_total",
+		"Requests handled by the forward proxy.")
+	tunnelsActive = metrics.Default.GaugeVec("proxier_forward_proxy_tunnels_active",
+		"Open CONNECT tunnels of the forward proxy.")
+)
+
+// Config configures a forward proxy.
+type Config struct {
+	// Allow and Deny are access list entries, see acl.New.
+	Allow []string
+	Deny  []string
+	// Auth checks the users of Basic Proxy-Authorization credentials; nil
+	// disables authentication.
+	Auth *auth.Authenticator
+}
+
+// Handler serves forward proxy requests.
+type Handler struct {
+	acl     *acl.ACL
+	auth    *auth.Authenticator
+	proxy   *httputil.ReverseProxy
+	tunnels *metrics.Gauge
+}
+
+// New creates a forward proxy handler.
+func New(cfg Config) (*Handler, error) {
+	list, err := acl.New(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           list.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	handler := &Handler{
+		acl:     list,
+		auth:    cfg.Auth,
+		tunnels: tunnelsActive.With(nil),
+	}
+	handler.proxy = &httputil.ReverseProxy{
+		// The outgoing request keeps the absolute URL of the client request.
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			w.WriteHeader(errorStatus(err))
+		},
+	}
+
+	return handler, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	defer func() {
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestsTotal.With(metrics.Labels{"method": methodLabel(r.Method), "code": strconv.Itoa(status)}).Inc()
+		log.Printf("[ForwardProxy] %s %s %s %d %s", r.RemoteAddr, r.Method, target(r), status,
+			time.Since(start).Round(time.Millisecond))
+	}()
+
+	if !h.authorized(r) {
+		rec.Header().Set("Proxy-Authenticate", `Basic realm="`+authRealm+`"`)
+		rec.WriteHeader(http.StatusProxyAuthRequired)
+
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodConnect:
+		h.serveConnect(rec, r)
+	case r.URL.IsAbs() && (r.URL.Scheme == "http" || r.URL.Scheme == "https"):
+		h.proxy.ServeHTTP(rec, r)
+	default:
+		http.Error(rec, "not a proxy request", http.StatusBadRequest)
+	}
+}
+
+// serveConnect tunnels a CONNECT request to its destination.
+func (h *Handler) serveConnect(w *statusRecorder, r *http.Request) {
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		http.Error(w, "CONNECT requires host:port", http.StatusBadRequest)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), connectTimeout)
+	backend, err := h.acl.DialContext(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+
+		return
+	}
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_ = backend.Close()
+		http.Error(w, "CONNECT is not supported on this connection", http.StatusInternalServerError)
+
+		return
+	}
+	// Hijacking keeps the deadlines of the server on the connection.
+	_ = client.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		_ = backend.Close()
+		_ = client.Close()
+
+		return
+	}
+	w.status = http.StatusOK
+
+	var clientConn net.Conn = client
+	if buffered.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: client, reader: buffered.Reader}
+	}
+
+	h.tunnels.Inc()
+	defer h.tunnels.Dec()
+	tunnel(clientConn, backend)
+}
+
+// authorized checks the Basic Proxy-Authorization credentials.
+func (h *Handler) authorized(r *http.Request) bool {
+	if h.auth == nil {
+		return true
+	}
+
+	user, password, ok := auth.ParseBasic(r.Header.Get("Proxy-Authorization"))
+
+	return ok && h.auth.CheckPassword(user, password)
+}
+
+// errorStatus maps dial and round trip errors to a response status.
+func errorStatus(err error) int {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, acl.ErrDenied):
+		return http.StatusForbidden
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func target(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		return r.Host
+	}
+
+	return r.URL.String()
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodConnect, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// tunnel copies data between client and backend until one side is done.
+func tunnel(client, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(backend, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+
+	<-done
+	_ = backend.Close()
+	_ = client.Close()
+	<-done
+}
+
+// bufferedConn reads data the server buffered before the connection was
+// hijacked.
+type bufferedConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// statusRecorder records the response status for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
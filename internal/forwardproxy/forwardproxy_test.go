@@ -0,0 +1,175 @@
+package forwardproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newBackend(t *testing.T, tlsBackend bool) *httptest.Server {
+	t.Helper()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Authorization", r.Header.Get("Proxy-Authorization"))
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	})
+
+	var backend *httptest.Server
+	if tlsBackend {
+		backend = httptest.NewTLSServer(handler)
+	} else {
+		backend = httptest.NewServer(handler)
+	}
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func startProxy(t *testing.T, cfg Config) *url.URL {
+	t.Helper()
+
+	handler, err := New(cfg)
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	proxyURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	return proxyURL
+}
+
+func clientFor(proxyURL *url.URL) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test certificate
+		},
+	}
+}
+
+func get(t *testing.T, client *http.Client, target string) (int, http.Header, string) {
+	t.Helper()
+
+	resp, err := client.Get(target)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.StatusCode, resp.Header, string(body)
+}
+
+func TestForwardProxy_AbsoluteForm(t *testing.T) {
+	backend := newBackend(t, false)
+	proxyURL := startProxy(t, Config{Allow: []string{"127.0.0.1"}})
+
+	status, header, body := get(t, clientFor(proxyURL), backend.URL+"/path")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello /path", body)
+	assert.Empty(t, header.Get("X-Proxy-Authorization"))
+}
+
+func TestForwardProxy_Connect(t *testing.T) {
+	backend := newBackend(t, true)
+	proxyURL := startProxy(t, Config{})
+
+	status, _, body := get(t, clientFor(proxyURL), backend.URL+"/secure")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello /secure", body)
+}
+
+func TestForwardProxy_Denied(t *testing.T) {
+	plain := newBackend(t, false)
+	secure := newBackend(t, true)
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		target string
+	}{
+		{"deny cidr", Config{Deny: []string{"127.0.0.0/8"}}, plain.URL},
+		{"deny port", Config{Deny: []string{":" + mustPort(t, plain.URL)}}, plain.URL},
+		{"not allowed", Config{Allow: []string{"example.com"}}, plain.URL},
+		{"allowed host, denied ip", Config{Allow: []string{"localhost"}, Deny: []string{"127.0.0.1"}},
+			"http://localhost:" + mustPort(t, plain.URL)},
+		{"connect denied", Config{Deny: []string{"127.0.0.1"}}, secure.URL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := clientFor(startProxy(t, tt.cfg))
+
+			resp, err := client.Get(tt.target)
+			if err != nil {
+				// The client reports refused CONNECT requests as errors.
+				assert.Contains(t, err.Error(), "Forbidden")
+
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		})
+	}
+}
+
+func TestForwardProxy_Auth(t *testing.T) {
+	backend := newBackend(t, false)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	authenticator, err := auth.New(auth.Config{Users: map[string]string{"alice": string(hash)}})
+	require.NoError(t, err)
+	proxyURL := startProxy(t, Config{Auth: authenticator})
+
+	status, header, _ := get(t, clientFor(proxyURL), backend.URL)
+	assert.Equal(t, http.StatusProxyAuthRequired, status)
+	assert.Equal(t, `Basic realm="proxier"`, header.Get("Proxy-Authenticate"))
+
+	wrong := *proxyURL
+	wrong.User = url.UserPassword("alice", "wrong")
+	status, _, _ = get(t, clientFor(&wrong), backend.URL)
+	assert.Equal(t, http.StatusProxyAuthRequired, status)
+
+	valid := *proxyURL
+	valid.User = url.UserPassword("alice", "secret")
+	status, header, body := get(t, clientFor(&valid), backend.URL+"/ok")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello /ok", body)
+	assert.Empty(t, header.Get("X-Proxy-Authorization"), "credentials must not reach the destination")
+
+	secure := newBackend(t, true)
+	status, _, body = get(t, clientFor(&valid), secure.URL+"/tls")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello /tls", body)
+}
+
+func TestForwardProxy_NotProxyRequest(t *testing.T) {
+	proxyURL := startProxy(t, Config{})
+
+	status, _, _ := get(t, http.DefaultClient, proxyURL.String()+"/")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestNew_InvalidACL(t *testing.T) {
+	_, err := New(Config{Allow: []string{"example.com:70000"}})
+	assert.Error(t, err)
+}
+
+func mustPort(t *testing.T, rawURL string) string {
+	t.Helper()
+
+	parsed, err := url.Parse(rawURL)
+	require.NoError(t, err)
+
+	return parsed.Port()
+}
@@ -0,0 +1,186 @@
+// Package geoip looks up the country and autonomous system of client
+// addresses in MaxMind-format (mmdb) databases, such as GeoLite2-Country and
+// GeoLite2-ASN, and reloads them when their files change.
+package geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const defaultReloadInterval = time.Minute
+
+// Config configures the databases.
+type Config struct {
+	// Databases are the paths of the mmdb files. A lookup merges the fields
+	// found in all of them, the first database winning.
+	Databases []string
+	// ReloadInterval is how often the files are checked for changes, 1m by
+	// default.
+	ReloadInterval time.Duration
+}
+
+// Record is what is known about an address. Fields are empty when none of
+// the databases has them, such as for private addresses.
+type Record struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, such as "DE".
+	Country string
+	// ASN is the number of the autonomous system announcing the address.
+	ASN uint
+}
+
+// mmdbRecord holds the fields read from the country, city and ASN databases.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// database is a loaded mmdb file.
+type database struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+}
+
+// DB looks up addresses in a set of databases.
+type DB struct {
+	interval  time.Duration
+	databases atomic.Pointer[[]*database]
+}
+
+// Open loads the databases.
+func Open(cfg Config) (*DB, error) {
+	if len(cfg.Databases) == 0 {
+		return nil, errors.New("no GeoIP database configured")
+	}
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = defaultReloadInterval
+	}
+
+	databases := make([]*database, 0, len(cfg.Databases))
+	for _, path := range cfg.Databases {
+		db, err := load(path)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, db)
+	}
+
+	db := &DB{interval: cfg.ReloadInterval}
+	db.databases.Store(&databases)
+
+	return db, nil
+}
+
+// load reads a database into memory, so that a replaced file can be swapped
+// in while lookups are running.
+func load(path string) (*database, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database %s: %w", path, err)
+	}
+
+	return &database{path: path, reader: reader, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Lookup returns the record of addr.
+func (db *DB) Lookup(addr netip.Addr) Record {
+	var record Record
+	if !addr.IsValid() {
+		return record
+	}
+
+	ip := net.IP(addr.Unmap().AsSlice())
+	for _, d := range *db.databases.Load() {
+		var found mmdbRecord
+		if err := d.reader.Lookup(ip, &found); err != nil {
+			continue
+		}
+
+		if record.Country == "" {
+			record.Country = found.Country.ISOCode
+		}
+		if record.Country == "" {
+			record.Country = found.RegisteredCountry.ISOCode
+		}
+		if record.ASN == 0 {
+			record.ASN = found.ASN
+		}
+	}
+
+	return record
+}
+
+// Run reloads the databases whose files changed until ctx is done. A file
+// that fails to load keeps the previous database in use.
+func (db *DB) Run(ctx context.Context) {
+	ticker := time.NewTicker(db.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.Reload()
+		}
+	}
+}
+
+// Reload reloads the databases whose files changed since they were loaded.
+func (db *DB) Reload() {
+	current := *db.databases.Load()
+	databases := make([]*database, len(current))
+	changed := false
+
+	for i, d := range current {
+		databases[i] = d
+
+		info, err := os.Stat(d.path)
+		if err != nil || (info.ModTime().Equal(d.modTime) && info.Size() == d.size) {
+			continue
+		}
+
+		changed = true
+		reloaded, err := load(d.path)
+		if err != nil {
+			log.Printf("[GeoIP] failed to reload %s, keeping the loaded database: %v", d.path, err)
+
+			// Retry once the file changes again.
+			kept := *d
+			kept.modTime, kept.size = info.ModTime(), info.Size()
+			databases[i] = &kept
+
+			continue
+		}
+		log.Printf("[GeoIP] reloaded %s", d.path)
+		databases[i] = reloaded
+	}
+
+	if changed {
+		db.databases.Store(&databases)
+	}
+}
@@ -0,0 +1,115 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeDB writes an mmdb file mapping networks to records.
+func writeDB(t *testing.T, path string, networks map[string]mmdbtype.Map) {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "Test", IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, tree.Insert(network, record))
+	}
+
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = tree.WriteTo(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
+func country(code string) mmdbtype.Map {
+	return mmdbtype.Map{"country": mmdbtype.Map{"iso_code": mmdbtype.String(code)}}
+}
+
+func TestLookup(t *testing.T) {
+	dir := t.TempDir()
+	countries := filepath.Join(dir, "country.mmdb")
+	asns := filepath.Join(dir, "asn.mmdb")
+	writeDB(t, countries, map[string]mmdbtype.Map{
+		"192.0.2.0/24":  country("DE"),
+		"2001:db8::/32": country("FR"),
+		"198.51.100.0/24": {
+			"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("NL")},
+		},
+	})
+	writeDB(t, asns, map[string]mmdbtype.Map{
+		"192.0.2.0/25": {"autonomous_system_number": mmdbtype.Uint32(64500)},
+	})
+
+	db, err := Open(Config{Databases: []string{countries, asns}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		addr string
+		want Record
+	}{
+		{addr: "192.0.2.1", want: Record{Country: "DE", ASN: 64500}},
+		{addr: "::ffff:192.0.2.1", want: Record{Country: "DE", ASN: 64500}},
+		{addr: "192.0.2.200", want: Record{Country: "DE"}},
+		{addr: "2001:db8::1", want: Record{Country: "FR"}},
+		{addr: "198.51.100.1", want: Record{Country: "NL"}},
+		{addr: "10.0.0.1", want: Record{}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, db.Lookup(netip.MustParseAddr(tt.addr)), tt.addr)
+	}
+	assert.Equal(t, Record{}, db.Lookup(netip.Addr{}))
+}
+
+func TestOpen_Invalid(t *testing.T) {
+	_, err := Open(Config{})
+	require.Error(t, err)
+
+	_, err = Open(Config{Databases: []string{filepath.Join(t.TempDir(), "missing.mmdb")}})
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "broken.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o600))
+	_, err = Open(Config{Databases: []string{path}})
+	require.ErrorContains(t, err, "invalid GeoIP database")
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	writeDB(t, path, map[string]mmdbtype.Map{"192.0.2.0/24": country("DE")})
+
+	db, err := Open(Config{Databases: []string{path}})
+	require.NoError(t, err)
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	// Unchanged files are kept.
+	loaded := db.databases.Load()
+	db.Reload()
+	assert.Same(t, loaded, db.databases.Load())
+
+	writeDB(t, path, map[string]mmdbtype.Map{
+		"192.0.2.0/24":    country("AT"),
+		"198.51.100.0/24": country("CH"),
+	})
+	db.Reload()
+	assert.Equal(t, "AT", db.Lookup(addr).Country)
+
+	// A broken file keeps the loaded database.
+	require.NoError(t, os.WriteFile(path, []byte("truncated"), 0o600))
+	db.Reload()
+	assert.Equal(t, "AT", db.Lookup(addr).Country)
+
+	writeDB(t, path, map[string]mmdbtype.Map{"192.0.2.0/24": country("BE")})
+	db.Reload()
+	assert.Equal(t, "BE", db.Lookup(addr).Country)
+}
@@ -0,0 +1,242 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry exposed on the /metrics endpoint of the admin API.
+var Default = NewRegistry()
+
+// Labels are the label names and values of a metric series.
+type Labels map[string]string
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	val atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.val.Add(1)
+}
+
+func (c *Counter) Add(delta uint64) {
+	c.val.Add(delta)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.val.Load()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	val atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.val.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.val.Add(-1)
+}
+
+func (g *Gauge) Add(delta int64) {
+	g.val.Add(delta)
+}
+
+func (g *Gauge) Set(val int64) {
+	g.val.Store(val)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.val.Load()
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	series map[string]any
+}
+
+// Registry holds metric families and renders them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// CounterVec is a counter family whose series differ by their labels.
+type CounterVec struct {
+	r   *Registry
+	fam *family
+}
+
+// GaugeVec is a gauge family whose series differ by their labels.
+type GaugeVec struct {
+	r   *Registry
+	fam *family
+}
+
+// CounterVec declares the counter family name. Families are declared once,
+// as package variables, so that the kind of a name is fixed: declaring a
+// name twice panics when the program starts.
+func (r *Registry) CounterVec(name, help string) *CounterVec {
+	return &CounterVec{r: r, fam: r.declare(name, help, "counter")}
+}
+
+// GaugeVec declares the gauge family name, see CounterVec.
+func (r *Registry) GaugeVec(name, help string) *GaugeVec {
+	return &GaugeVec{r: r, fam: r.declare(name, help, "gauge")}
+}
+
+// With returns the counter series for the given labels, creating it on
+// first use.
+func (v *CounterVec) With(labels Labels) *Counter {
+	return v.r.series(v.fam, labels, func() any { return &Counter{} }).(*Counter)
+}
+
+// With returns the gauge series for the given labels, creating it on first
+// use.
+func (v *GaugeVec) With(labels Labels) *Gauge {
+	return v.r.series(v.fam, labels, func() any { return &Gauge{} }).(*Gauge)
+}
+
+func (r *Registry) declare(name, help, kind string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if fam, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %s already declared as %s", name, fam.kind))
+	}
+	fam := &family{name: name, help: help, kind: kind, series: make(map[string]any)}
+	r.families[name] = fam
+
+	return fam
+}
+
+func (r *Registry) series(fam *family, labels Labels, create func() any) any {
+	key := formatLabels(labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metric, ok := fam.series[key]
+	if !ok {
+		metric = create()
+		fam.series[key] = metric
+	}
+
+	return metric
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(writer io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cw := &countingWriter{w: bufio.NewWriter(writer)}
+	for _, name := range names {
+		fam := r.families[name]
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.kind)
+
+		keys := make([]string, 0, len(fam.series))
+		for key := range fam.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			var val string
+			switch metric := fam.series[key].(type) {
+			case *Counter:
+				val = strconv.FormatUint(metric.Value(), 10)
+			case *Gauge:
+				val = strconv.FormatInt(metric.Value(), 10)
+			}
+			fmt.Fprintf(cw, "%s%s %s\n", fam.name, key, val)
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+
+	return cw.n, cw.err
+}
+
+// Handler serves the registry over HTTP.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	builder.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			builder.WriteString(",")
+		}
+		builder.WriteString(name)
+		builder.WriteString(`="`)
+		builder.WriteString(escapeLabel(labels[name]))
+		builder.WriteString(`"`)
+	}
+	builder.WriteString("}")
+
+	return builder.String()
+}
+
+func escapeLabel(val string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(val)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+
+	return n, err
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.CounterVec("requests_total", "Total requests.")
+
+	requests.With(Labels{"route": "/a"}).Inc()
+	requests.With(Labels{"route": "/a"}).Add(2)
+	requests.With(Labels{"route": "/b"}).Inc()
+	reg.GaugeVec("connections", "Open connections.").With(nil).Set(5)
+
+	var builder strings.Builder
+	_, err := reg.WriteTo(&builder)
+	require.NoError(t, err)
+
+	want := `# HELP connections Open connections.
+# TYPE connections gauge
+connections 5
+# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{route="/a"} 3
+requests_total{route="/b"} 1
+`
+	assert.Equal(t, want, builder.String())
+}
+
+func TestRegistry_DeclaredTwice(t *testing.T) {
+	reg := NewRegistry()
+	reg.CounterVec("value", "A value.")
+
+	assert.PanicsWithValue(t, "metric value already declared as counter", func() {
+		reg.GaugeVec("value", "A value.")
+	})
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	reg := NewRegistry()
+	reg.CounterVec("hits_total", "Hits.").With(Labels{"path": `a"b`}).Inc()
+
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `hits_total{path="a\"b"} 1`)
+}
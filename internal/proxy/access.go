@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/ezex-io/proxier/internal/geoip"
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/valyala/fasthttp"
+)
+
+// IPAccess restricts the clients of a route by address. A client matching
+// any deny entry is rejected; when there are allow entries, it must match one
+// of them.
+type IPAccess struct {
+	Allow realip.Prefixes
+	Deny  realip.Prefixes
+	// AllowCountries and DenyCountries list ISO 3166-1 alpha-2 codes in upper
+	// case, AllowASNs and DenyASNs autonomous system numbers. They are looked
+	// up in the database of WithGeoIP; clients missing from it match none.
+	AllowCountries []string
+	DenyCountries  []string
+	AllowASNs      []uint
+	DenyASNs       []uint
+}
+
+// geo reports whether the lists need the GeoIP record of the client.
+func (a IPAccess) geo() bool {
+	return len(a.AllowCountries) > 0 || len(a.DenyCountries) > 0 || len(a.AllowASNs) > 0 || len(a.DenyASNs) > 0
+}
+
+// allows reports whether the client at addr, with the given GeoIP record,
+// passes the lists.
+func (a IPAccess) allows(addr netip.Addr, record geoip.Record) bool {
+	country := record.Country != ""
+	asn := record.ASN != 0
+
+	if a.Deny.Contains(addr) ||
+		country && slices.Contains(a.DenyCountries, record.Country) ||
+		asn && slices.Contains(a.DenyASNs, record.ASN) {
+		return false
+	}
+	if len(a.Allow) == 0 && len(a.AllowCountries) == 0 && len(a.AllowASNs) == 0 {
+		return true
+	}
+
+	return a.Allow.Contains(addr) ||
+		country && slices.Contains(a.AllowCountries, record.Country) ||
+		asn && slices.Contains(a.AllowASNs, record.ASN)
+}
+
+// allowsClient reports whether the client at addr passes every access list
+// of the route.
+func (opt *options) allowsClient(addr netip.Addr) bool {
+	var (
+		record   geoip.Record
+		lookedUp bool
+	)
+	for _, access := range opt.ipAccess {
+		if !lookedUp && opt.geoIP != nil && access.geo() {
+			record, lookedUp = opt.geoIP.Lookup(addr), true
+		}
+		if !access.allows(addr, record) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// accessHTTP answers requests of clients rejected by the access lists of
+// the route with 403 Forbidden.
+func accessHTTP(opt *options, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !opt.allowsClient(clientIPHTTP(r, opt.trustedProxies)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// accessFastHTTP answers requests of clients rejected by the access lists of
+// the route with 403 Forbidden.
+func accessFastHTTP(opt *options, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !opt.allowsClient(clientIPFastHTTP(ctx, opt.trustedProxies)) {
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			ctx.SetContentType("text/plain; charset=utf-8")
+			ctx.SetBodyString(http.StatusText(http.StatusForbidden) + "\n")
+
+			return
+		}
+
+		next(ctx)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPAccess_Backends(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	parse := func(list ...string) realip.Prefixes {
+		prefixes, err := realip.ParsePrefixes(list)
+		require.NoError(t, err)
+
+		return prefixes
+	}
+	opts := []Option{
+		WithTrustedProxies(realip.TrustedProxies(parse("127.0.0.1", "::1"))),
+		WithIPAccess(IPAccess{Deny: parse("203.0.113.0/24")}),
+		WithIPAccess(IPAccess{Allow: parse("198.51.100.0/24", "203.0.113.0/24")}),
+	}
+
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, opts...) {
+		t.Run(name, func(t *testing.T) {
+			get := func(forwardedFor string) (int, string) {
+				req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxyURL+"/stream/item", nil)
+				require.NoError(t, err)
+				if forwardedFor != "" {
+					req.Header.Set("X-Forwarded-For", forwardedFor)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				return resp.StatusCode, string(body)
+			}
+
+			status, body := get("198.51.100.7")
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, "ok", body)
+
+			// Denied by the first list although allowed by the second.
+			status, body = get("203.0.113.5")
+			assert.Equal(t, http.StatusForbidden, status)
+			assert.Equal(t, "Forbidden\n", body)
+
+			// Not in the allow list.
+			status, _ = get("192.0.2.1")
+			assert.Equal(t, http.StatusForbidden, status)
+
+			// The client is the rightmost untrusted address.
+			status, _ = get("198.51.100.7, 192.0.2.1")
+			assert.Equal(t, http.StatusForbidden, status)
+			status, _ = get("192.0.2.1, 198.51.100.7")
+			assert.Equal(t, http.StatusOK, status)
+
+			// The loopback peer itself is not allowed.
+			status, _ = get("")
+			assert.Equal(t, http.StatusForbidden, status)
+		})
+	}
+}
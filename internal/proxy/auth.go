@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	headerAuthorization   = "Authorization"
+	headerWWWAuthenticate = "WWW-Authenticate"
+
+	defaultIdentityHeader = "X-Auth-User"
+)
+
+// isBasic reports whether an Authorization value uses the Basic scheme.
+func isBasic(authorization string) bool {
+	const prefix = "Basic "
+
+	return len(authorization) >= len(prefix) && strings.EqualFold(authorization[:len(prefix)], prefix)
+}
+
+// removeQueryParam removes every occurrence of name from a raw query,
+// keeping the other parameters as sent.
+func removeQueryParam(rawQuery, name string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+
+	return strings.Join(kept, "&")
+}
+
+// authHTTP answers requests of the net/http backend without valid
+// credentials with 401 Unauthorized. Authenticated requests are forwarded
+// without their credentials and with the identity header.
+func authHTTP(opt *options, next http.HandlerFunc) http.HandlerFunc {
+	a := opt.auth
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := a.Authenticate(auth.Request{
+			Header: r.Header.Get,
+			Query:  func(name string) string { return r.URL.Query().Get(name) },
+		})
+		if !ok {
+			if challenge := a.Challenge(); challenge != "" {
+				w.Header().Set(headerWWWAuthenticate, challenge)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+			return
+		}
+
+		if a.Basic() && isBasic(r.Header.Get(headerAuthorization)) {
+			r.Header.Del(headerAuthorization)
+		}
+		if header := a.APIKeyHeader(); header != "" {
+			r.Header.Del(header)
+		}
+		if param := a.APIKeyQuery(); param != "" {
+			r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, param)
+		}
+		r.Header.Set(opt.identityHeader, identity)
+
+		next(w, r)
+	}
+}
+
+// authFastHTTP authenticates requests of the fasthttp backend, like
+// authHTTP.
+func authFastHTTP(opt *options, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	a := opt.auth
+
+	return func(ctx *fasthttp.RequestCtx) {
+		header := &ctx.Request.Header
+		identity, ok := a.Authenticate(auth.Request{
+			Header: func(name string) string { return string(header.Peek(name)) },
+			Query:  func(name string) string { return string(ctx.QueryArgs().Peek(name)) },
+		})
+		if !ok {
+			ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+			ctx.SetContentType("text/plain; charset=utf-8")
+			ctx.SetBodyString(http.StatusText(http.StatusUnauthorized) + "\n")
+			if challenge := a.Challenge(); challenge != "" {
+				ctx.Response.Header.Set(headerWWWAuthenticate, challenge)
+			}
+
+			return
+		}
+
+		if a.Basic() && isBasic(string(header.Peek(headerAuthorization))) {
+			header.Del(headerAuthorization)
+		}
+		if name := a.APIKeyHeader(); name != "" {
+			header.Del(name)
+		}
+		if param := a.APIKeyQuery(); param != "" {
+			uri := ctx.URI()
+			uri.SetQueryString(removeQueryParam(string(uri.QueryString()), param))
+		}
+		header.Set(opt.identityHeader, identity)
+
+		next(ctx)
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth_Backends(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Auth-User")+"|"+r.Header.Get("Authorization")+"|"+
+			r.Header.Get("X-API-Key")+"|"+r.URL.RawQuery)
+	}))
+	defer upstream.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	require.NoError(t, err)
+	authenticator, err := auth.New(auth.Config{
+		Users:        map[string]string{"alice": string(hash)},
+		APIKeyHeader: "X-API-Key",
+		APIKeyQuery:  "api_key",
+		APIKeys:      map[string]string{"ci": "secret"},
+	})
+	require.NoError(t, err)
+
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithAuth(authenticator, "")) {
+		t.Run(name, func(t *testing.T) {
+			get := func(query string, header http.Header) (*http.Response, string) {
+				req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxyURL+"/stream/item"+query, nil)
+				require.NoError(t, err)
+				for key, values := range header {
+					req.Header[key] = values
+				}
+				req.Header.Set("X-Auth-User", "spoofed")
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				return resp, string(body)
+			}
+
+			resp, body := get("", nil)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			assert.Equal(t, "Unauthorized\n", body)
+			assert.Equal(t, `Basic realm="proxier", charset="UTF-8"`, resp.Header.Get("WWW-Authenticate"))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth("alice", "wonderland")
+			resp, body = get("?a=1", req.Header)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "alice|||a=1", body)
+
+			req.SetBasicAuth("alice", "guess")
+			resp, _ = get("", req.Header)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+			resp, body = get("", http.Header{"X-Api-Key": {"secret"}})
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "ci|||", body)
+
+			// The key is removed from the query, the other parameters kept.
+			resp, body = get("?b=2&api_key=secret&a=1", http.Header{"Authorization": {"Bearer upstream"}})
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "ci|Bearer upstream||b=2&a=1", body)
+
+			resp, _ = get("?api_key=guess", nil)
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		})
+	}
+}
+
+func TestAuth_CachedRoute(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{}, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-release:
+			case <-time.After(time.Second):
+			}
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		_, _ = io.WriteString(w, r.Header.Get("X-Auth-User"))
+	}))
+	defer upstream.Close()
+
+	authenticator, err := auth.New(auth.Config{APIKeys: map[string]string{"alice": "a-key", "bob": "b-key"}})
+	require.NoError(t, err)
+
+	// get is also called from goroutines, so it does not stop the test.
+	get := func(url, key string) string {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return string(body)
+	}
+
+	for _, name := range []string{"net/http", "fasthttp"} {
+		t.Run(name, func(t *testing.T) {
+			// Each backend gets its own cache.
+			responseCache, err := cache.New(cache.Config{Name: t.Name()})
+			require.NoError(t, err)
+			proxyURL := serveBackends(t, "/stream", upstream.URL, WithAuth(authenticator, ""), WithCache(responseCache),
+				WithCoalescing(Coalescing{Timeout: 5 * time.Second}))[name]
+			calls.Store(0)
+
+			// Responses to authenticated requests are not shared, unless public.
+			assert.Equal(t, "alice", get(proxyURL+"/stream/private", "a-key"))
+			assert.Equal(t, "bob", get(proxyURL+"/stream/private", "b-key"))
+			assert.Equal(t, "alice", get(proxyURL+"/stream/public", "a-key"))
+			assert.Equal(t, "alice", get(proxyURL+"/stream/public", "b-key"))
+			assert.Equal(t, int32(3), calls.Load())
+
+			// Concurrent requests of different clients are not coalesced.
+			calls.Store(0)
+			var wg sync.WaitGroup
+			bodies := make([]string, 2)
+			for i, key := range []string{"a-key", "b-key"} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					bodies[i] = get(proxyURL+"/stream/slow", key)
+				}()
+			}
+			assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, time.Millisecond)
+			release <- struct{}{}
+			release <- struct{}{}
+			wg.Wait()
+			assert.Equal(t, []string{"alice", "bob"}, bodies)
+		})
+	}
+}
+
+func TestRemoveQueryParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "", want: ""},
+		{query: "key=secret", want: ""},
+		{query: "a=1&key=secret&b=2", want: "a=1&b=2"},
+		{query: "key=1&key=2&c=%20x", want: "c=%20x"},
+		{query: "k%65y=secret&keys=1", want: "keys=1"},
+		{query: "key&a", want: "a"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, removeQueryParam(tt.query, "key"), tt.query)
+	}
+}
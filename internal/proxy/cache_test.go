@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "path="+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	responseCache, err := cache.New(cache.Config{Name: t.Name()})
+	require.NoError(t, err)
+
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithCache(responseCache)) {
+		t.Run(name, func(t *testing.T) {
+			calls.Store(0)
+
+			get := func(path string) (string, string) {
+				resp, err := http.Get(proxyURL + path)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				return resp.Header.Get("X-Cache"), string(body)
+			}
+
+			result, body := get("/stream/" + name)
+			assert.Equal(t, cache.Miss, result)
+			assert.Equal(t, "path=/"+name, body)
+
+			result, body = get("/stream/" + name)
+			assert.Equal(t, cache.Hit, result)
+			assert.Equal(t, "path=/"+name, body)
+
+			result, _ = get("/stream/" + name + "?other")
+			assert.Equal(t, cache.Miss, result)
+			assert.Equal(t, int32(2), calls.Load())
+		})
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method == "PURGE" {
+			w.WriteHeader(http.StatusTeapot)
+
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "cached")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name    string
+		sources []string
+		status  int
+		purged  bool
+	}{
+		{"trusted", []string{"127.0.0.1"}, http.StatusOK, true},
+		{"untrusted", []string{"10.0.0.0/8"}, http.StatusForbidden, false},
+		{"disabled", nil, http.StatusTeapot, false},
+	}
+
+	for _, tt := range tests {
+		sources, err := realip.ParsePrefixes(tt.sources)
+		require.NoError(t, err)
+		responseCache, err := cache.New(cache.Config{Name: t.Name() + "/" + tt.name})
+		require.NoError(t, err)
+
+		for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithCache(responseCache), WithPurge(sources)) {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				send := func(method string) *http.Response {
+					req, err := http.NewRequestWithContext(t.Context(), method, proxyURL+"/stream/item", nil)
+					require.NoError(t, err)
+					resp, err := http.DefaultClient.Do(req)
+					require.NoError(t, err)
+					_, _ = io.Copy(io.Discard, resp.Body)
+					_ = resp.Body.Close()
+
+					return resp
+				}
+
+				send(http.MethodGet)
+				assert.Equal(t, tt.status, send("PURGE").StatusCode)
+
+				result := send(http.MethodGet).Header.Get("X-Cache")
+				if tt.purged {
+					assert.Equal(t, cache.Miss, result)
+				} else {
+					assert.Equal(t, cache.Hit, result)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+)
+
+// defaultCoalescingTimeout is how long a request waits for a shared response
+// when Coalescing.Timeout is not set.
+const defaultCoalescingTimeout = 5 * time.Second
+
+// Coalescing collapses concurrent identical GET and HEAD requests of a route
+// into one request to the destination whose response is shared.
+type Coalescing struct {
+	// Vary lists request headers whose values must be equal, in addition to
+	// the method and URL, for requests to share a response. Requests with
+	// Authorization, Cookie or Range headers are only coalesced when these
+	// are listed, and responses are only shared when every header in their
+	// Vary is listed.
+	Vary []string
+	// Timeout is how long a request waits for the shared response before it
+	// sends its own request.
+	Timeout time.Duration
+}
+
+var (
+	// personalHeaders make a request unique unless listed in Coalescing.Vary.
+	personalHeaders = []string{"Authorization", "Cookie", "Range"}
+	// conditionalHeaders are always part of the key, so that conditional
+	// requests only share a 304 response among themselves.
+	conditionalHeaders = []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"}
+
+	coalescedRequests = metrics.Default.CounterVec("proxier_coalesced_requests_total",
+		"Requests handled by request coalescing: leader, shared or fallback.")
+)
+
+// coalescingTransport shares the response of one in-flight request with the
+// identical requests arriving while it is pending.
+type coalescingTransport struct {
+	base        http.RoundTripper
+	endpoint    string
+	vary        []string
+	timeout     time.Duration
+	maxBodySize int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a request in flight. The response fields are set before
+// done is closed, and only when shared is true.
+type coalescedCall struct {
+	done chan struct{}
+
+	shared        bool
+	status        int
+	header        http.Header
+	body          []byte
+	contentLength int64
+}
+
+func newCoalescingTransport(endpoint string, base http.RoundTripper, cfg Coalescing,
+	maxBodySize int,
+) *coalescingTransport {
+	vary := make([]string, 0, len(cfg.Vary))
+	for _, name := range cfg.Vary {
+		vary = append(vary, http.CanonicalHeaderKey(name))
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultCoalescingTimeout
+	}
+
+	return &coalescingTransport{
+		base:        base,
+		endpoint:    endpoint,
+		vary:        vary,
+		timeout:     cfg.Timeout,
+		maxBodySize: int64(maxBodySize),
+		calls:       make(map[string]*coalescedCall),
+	}
+}
+
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := t.key(req)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	if call, ok := t.calls[key]; ok {
+		t.mu.Unlock()
+
+		return t.wait(req, call)
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	t.calls[key] = call
+	t.mu.Unlock()
+
+	t.result("leader").Inc()
+	resp, err := t.base.RoundTrip(req)
+
+	return t.lead(req, key, call, resp, err)
+}
+
+// key identifies the requests that may share a response, or reports false
+// when req must be sent on its own.
+func (t *coalescingTransport) key(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return "", false
+	}
+	if req.ContentLength != 0 || req.Header.Get("Upgrade") != "" {
+		return "", false
+	}
+	for _, name := range personalHeaders {
+		if req.Header.Get(name) != "" && !slices.Contains(t.vary, name) {
+			return "", false
+		}
+	}
+
+	var key strings.Builder
+	key.WriteString(req.Method + " " + req.Host + " " + req.URL.String())
+	for _, name := range slices.Concat(t.vary, conditionalHeaders) {
+		key.WriteString("\x00" + strings.Join(req.Header.Values(name), ", "))
+	}
+
+	return key.String(), true
+}
+
+// lead completes the call with the response of the leading request, sharing
+// it when it is complete within the buffer size and not client specific.
+func (t *coalescingTransport) lead(req *http.Request, key string, call *coalescedCall,
+	resp *http.Response, err error,
+) (*http.Response, error) {
+	if err != nil || !t.shareable(resp) {
+		t.finish(key, call)
+
+		return resp, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.maxBodySize+1))
+	if err != nil {
+		t.finish(key, call)
+		_ = resp.Body.Close()
+
+		return nil, err
+	}
+	if int64(len(body)) > t.maxBodySize {
+		t.finish(key, call)
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+
+	if req.Method != http.MethodHead {
+		resp.ContentLength = int64(len(body))
+	}
+	call.shared = true
+	call.status = resp.StatusCode
+	call.header = resp.Header.Clone()
+	call.body = body
+	call.contentLength = resp.ContentLength
+	t.finish(key, call)
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+// shareable reports whether resp may be handed to other clients.
+func (t *coalescingTransport) shareable(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.ContentLength > t.maxBodySize {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	// Requests only share a response when they agree on every header it
+	// varies on, so those must all be part of the key.
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" || name != "" && !slices.Contains(t.vary, name) && !slices.Contains(conditionalHeaders, name) {
+				return false
+			}
+		}
+	}
+
+	return !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+func (t *coalescingTransport) finish(key string, call *coalescedCall) {
+	t.mu.Lock()
+	delete(t.calls, key)
+	t.mu.Unlock()
+
+	close(call.done)
+}
+
+// wait returns the response of call, or sends req itself when call fails,
+// cannot be shared or takes longer than the timeout.
+func (t *coalescingTransport) wait(req *http.Request, call *coalescedCall) (*http.Response, error) {
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.done:
+		if call.shared {
+			t.result("shared").Inc()
+
+			return call.response(req), nil
+		}
+	case <-timer.C:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	t.result("fallback").Inc()
+
+	return t.base.RoundTrip(req)
+}
+
+func (t *coalescingTransport) result(result string) *metrics.Counter {
+	return coalescedRequests.With(metrics.Labels{"endpoint": t.endpoint, "result": result})
+}
+
+// response returns a copy of the shared response for req.
+func (c *coalescedCall) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(c.status) + " " + http.StatusText(c.status),
+		StatusCode:    c.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: c.contentLength,
+		Request:       req,
+	}
+}
+
+// prefixedBody returns the part of a body already read before the rest.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
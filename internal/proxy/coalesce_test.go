@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// heldRoundTripper answers every request with the response of respond once
+// release is closed.
+type heldRoundTripper struct {
+	calls   atomic.Int32
+	release chan struct{}
+	respond func(req *http.Request, call int32) *http.Response
+}
+
+func (h *heldRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := h.calls.Add(1)
+	select {
+	case <-h.release:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	return h.respond(req, call), nil
+}
+
+func textResponse(req *http.Request, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// coalesce sends the requests concurrently, releasing the round tripper
+// once they are all pending, and returns the response bodies.
+func coalesce(t *testing.T, transport http.RoundTripper, base *heldRoundTripper, reqs ...*http.Request) []string {
+	t.Helper()
+
+	bodies := make([]string, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := transport.RoundTrip(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			bodies[i] = string(body)
+		}()
+		if i == 0 {
+			require.Eventually(t, func() bool { return base.calls.Load() == 1 }, time.Second, time.Millisecond)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(base.release)
+	wg.Wait()
+
+	return bodies
+}
+
+func newCoalescingRequest(t *testing.T, method, target string, header http.Header) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), method, target, nil)
+	require.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	return req
+}
+
+func TestCoalescing(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Coalescing
+		headers  []http.Header
+		response http.Header
+		calls    int32
+	}{
+		{
+			name:    "identical",
+			headers: []http.Header{nil, nil, nil, nil},
+			calls:   1,
+		},
+		{
+			name:    "vary",
+			cfg:     Coalescing{Vary: []string{"accept-language"}},
+			headers: []http.Header{{"Accept-Language": {"en"}}, {"Accept-Language": {"de"}}, {"Accept-Language": {"en"}}},
+			calls:   2,
+		},
+		{
+			name:    "authorization",
+			headers: []http.Header{{"Authorization": {"Bearer a"}}, {"Authorization": {"Bearer a"}}},
+			calls:   2,
+		},
+		{
+			name:    "authorization in vary",
+			cfg:     Coalescing{Vary: []string{"Authorization"}},
+			headers: []http.Header{{"Authorization": {"Bearer a"}}, {"Authorization": {"Bearer a"}}},
+			calls:   1,
+		},
+		{
+			name:    "conditional",
+			headers: []http.Header{nil, {"If-None-Match": {`"v1"`}}, nil},
+			calls:   2,
+		},
+		{
+			name:     "set-cookie",
+			headers:  []http.Header{nil, nil, nil},
+			response: http.Header{"Set-Cookie": {"session=1"}},
+			calls:    3,
+		},
+		{
+			name:     "response varies outside the key",
+			headers:  []http.Header{nil, nil, nil},
+			response: http.Header{"Vary": {"Accept-Encoding"}},
+			calls:    3,
+		},
+		{
+			name:     "response varies on everything",
+			headers:  []http.Header{nil, nil},
+			response: http.Header{"Vary": {"*"}},
+			calls:    2,
+		},
+		{
+			name:     "response varies on the key",
+			cfg:      Coalescing{Vary: []string{"Accept-Language"}},
+			headers:  []http.Header{{"Accept-Language": {"en"}}, {"Accept-Language": {"en"}}},
+			response: http.Header{"Vary": {"accept-language, If-None-Match"}},
+			calls:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &heldRoundTripper{
+				release: make(chan struct{}),
+				respond: func(req *http.Request, call int32) *http.Response {
+					return textResponse(req, tt.response.Clone(),
+						"response "+strconv.Itoa(int(call))+" "+req.Header.Get("Accept-Language"))
+				},
+			}
+			transport := newCoalescingTransport(t.Name(), base, tt.cfg, defaultMaxBufferSize)
+
+			reqs := make([]*http.Request, 0, len(tt.headers))
+			for _, header := range tt.headers {
+				reqs = append(reqs, newCoalescingRequest(t, http.MethodGet, "http://upstream/item", header))
+			}
+
+			bodies := coalesce(t, transport, base, reqs...)
+			assert.Equal(t, tt.calls, base.calls.Load())
+			if tt.calls == 1 {
+				for _, body := range bodies {
+					assert.Equal(t, bodies[0], body)
+				}
+			}
+			if tt.name == "vary" {
+				assert.Equal(t, bodies[0], bodies[2])
+				assert.NotEqual(t, bodies[0], bodies[1])
+			}
+		})
+	}
+}
+
+func TestCoalescing_Timeout(t *testing.T) {
+	base := &heldRoundTripper{
+		release: make(chan struct{}),
+		respond: func(req *http.Request, call int32) *http.Response {
+			return textResponse(req, nil, "response "+strconv.Itoa(int(call)))
+		},
+	}
+	transport := newCoalescingTransport(t.Name(), base, Coalescing{Timeout: 10 * time.Millisecond},
+		defaultMaxBufferSize)
+
+	leader := make(chan string)
+	go func() {
+		resp, err := transport.RoundTrip(newCoalescingRequest(t, http.MethodGet, "http://upstream/slow", nil))
+		if !assert.NoError(t, err) {
+			close(leader)
+
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		leader <- string(body)
+	}()
+	require.Eventually(t, func() bool { return base.calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	// The waiter gives up on the leader and sends its own request.
+	waiter := make(chan *http.Response)
+	go func() {
+		resp, err := transport.RoundTrip(newCoalescingRequest(t, http.MethodGet, "http://upstream/slow", nil))
+		assert.NoError(t, err)
+		waiter <- resp
+	}()
+	require.Eventually(t, func() bool { return base.calls.Load() == 2 }, time.Second, time.Millisecond)
+
+	close(base.release)
+	resp := <-waiter
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "response 2", string(body))
+	assert.Equal(t, "response 1", <-leader)
+}
+
+func TestCoalescing_LargeBody(t *testing.T) {
+	large := strings.Repeat("x", 64)
+	base := &heldRoundTripper{
+		release: make(chan struct{}),
+		respond: func(req *http.Request, _ int32) *http.Response {
+			resp := textResponse(req, nil, large)
+			resp.ContentLength = -1
+
+			return resp
+		},
+	}
+	transport := newCoalescingTransport(t.Name(), base, Coalescing{}, 16)
+
+	bodies := coalesce(t, transport, base,
+		newCoalescingRequest(t, http.MethodGet, "http://upstream/large", nil),
+		newCoalescingRequest(t, http.MethodGet, "http://upstream/large", nil))
+
+	// The leader streams the whole body; the waiter sends its own request.
+	assert.Equal(t, []string{large, large}, bodies)
+	assert.Equal(t, int32(2), base.calls.Load())
+}
+
+func TestCoalescing_Backends(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		<-release
+		_, _ = io.WriteString(w, "shared")
+	}))
+	defer upstream.Close()
+
+	backends := serveBackends(t, "/stream", upstream.URL, WithCoalescing(Coalescing{Timeout: 5 * time.Second}))
+	var wg sync.WaitGroup
+	for _, proxyURL := range backends {
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				resp, err := http.Get(proxyURL + "/stream/item")
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				assert.Equal(t, "shared", string(body))
+			}()
+		}
+	}
+
+	// Each backend has its own handler, so the destination sees one request per
+	// backend.
+	require.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), calls.Load())
+}
@@ -0,0 +1,422 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fasthttp"
+)
+
+// Content codings produced by response compression.
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+)
+
+const (
+	defaultCompressionMinSize = 1024
+	compressionChunkSize      = 32 << 10
+)
+
+// defaultCompressionEncodings lists the codings in order of preference.
+var defaultCompressionEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// defaultCompressionTypes lists the media types compressed by default; a
+// "type/*" entry matches all subtypes.
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/xml",
+	"application/atom+xml",
+	"application/rss+xml",
+	"application/wasm",
+	"image/svg+xml",
+	"font/otf",
+	"font/ttf",
+}
+
+// Compression compresses responses of a route for clients announcing
+// support in Accept-Encoding.
+type Compression struct {
+	// Encodings lists the codings offered, in order of preference. It
+	// defaults to zstd, br and gzip.
+	Encodings []string
+	// Types lists the compressed media types; "type/*" matches all subtypes.
+	Types []string
+	// MinSize is the smallest response compressed, in bytes. Responses of
+	// unknown length are always compressed.
+	MinSize int64
+	// GzipLevel (1-9), BrotliLevel (0-11) and ZstdLevel (1-22) set the
+	// compression levels; zero uses the default of each coding.
+	GzipLevel   int
+	BrotliLevel int
+	ZstdLevel   int
+}
+
+// encoder is a compressing writer that can be reused after Reset.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressor applies Compression to responses of both backends.
+type compressor struct {
+	encodings []string
+	types     []string
+	minSize   int64
+	pools     map[string]*sync.Pool
+}
+
+func newCompressor(cfg Compression) *compressor {
+	c := &compressor{
+		encodings: cfg.Encodings,
+		types:     cfg.Types,
+		minSize:   cfg.MinSize,
+		pools:     make(map[string]*sync.Pool),
+	}
+	if len(c.encodings) == 0 {
+		c.encodings = defaultCompressionEncodings
+	}
+	if len(c.types) == 0 {
+		c.types = defaultCompressionTypes
+	}
+	if c.minSize <= 0 {
+		c.minSize = defaultCompressionMinSize
+	}
+
+	gzipLevel := cfg.GzipLevel
+	if gzipLevel == 0 {
+		gzipLevel = gzip.DefaultCompression
+	}
+	brotliLevel := cfg.BrotliLevel
+	if brotliLevel == 0 {
+		brotliLevel = brotli.DefaultCompression
+	}
+	zstdLevel := zstd.SpeedDefault
+	if cfg.ZstdLevel > 0 {
+		zstdLevel = zstd.EncoderLevelFromZstd(cfg.ZstdLevel)
+	}
+
+	c.pools[EncodingGzip] = &sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzipLevel)
+
+		return w
+	}}
+	c.pools[EncodingBrotli] = &sync.Pool{New: func() any {
+		return brotli.NewWriterLevel(io.Discard, brotliLevel)
+	}}
+	c.pools[EncodingZstd] = &sync.Pool{New: func() any {
+		// One goroutine-free encoder per stream, with the 8 MiB window
+		// browsers accept.
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstdLevel),
+			zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+
+		return w
+	}}
+
+	return c
+}
+
+// responseHeader gives access to the response headers of both backends.
+type responseHeader interface {
+	Get(key string) string
+	Values(key string) []string
+	Set(key, value string)
+	Add(key, value string)
+	Del(key string)
+}
+
+// negotiate picks the coding of a response and updates its headers, or
+// returns "" when the response is sent as is. Vary is set on every response
+// that could be compressed.
+func (c *compressor) negotiate(acceptEncoding, method string, status int, header responseHeader) string {
+	if status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusPartialContent || status == http.StatusNotModified {
+		return ""
+	}
+	// Already compressed upstream.
+	if coding := header.Get("Content-Encoding"); coding != "" && !strings.EqualFold(coding, "identity") {
+		return ""
+	}
+	if header.Get("Content-Range") != "" || !c.compressible(header.Get("Content-Type")) {
+		return ""
+	}
+	if hasToken(strings.Join(header.Values("Cache-Control"), ","), "no-transform") {
+		return ""
+	}
+
+	addVary(header, "Accept-Encoding")
+	if method == http.MethodHead {
+		return ""
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < c.minSize {
+		return ""
+	}
+
+	coding := c.choose(acceptEncoding)
+	if coding == "" {
+		return ""
+	}
+
+	header.Set("Content-Encoding", coding)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	// The representation changed, so a strong validator no longer applies.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+
+	return coding
+}
+
+// compressible reports whether the media type is in the allow-list.
+// Server-Sent Events are never compressed, they must reach clients
+// unbuffered.
+func (c *compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+
+	for _, allowed := range c.types {
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// choose returns the offered coding with the highest quality in
+// acceptEncoding, preferring earlier codings on ties.
+func (c *compressor) choose(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		quality := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = q
+			}
+		}
+		if coding == "*" {
+			wildcard = quality
+		} else {
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range c.encodings {
+		quality, ok := qualities[coding]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+
+	return best
+}
+
+// addVary adds name to the Vary header unless it is already covered.
+func addVary(header responseHeader, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// reader returns body compressed with coding. With flush set, every chunk
+// read from body is flushed, so that streamed responses are not held back.
+func (c *compressor) reader(coding string, body io.Reader, flush bool) *compressReader {
+	pool := c.pools[coding]
+	r := &compressReader{
+		src:   body,
+		chunk: make([]byte, compressionChunkSize),
+		flush: flush,
+		pool:  pool,
+	}
+	r.enc = pool.Get().(encoder) //nolint:forcetypeassert // pools only hold encoders
+	r.enc.Reset(&r.buf)
+
+	return r
+}
+
+// compressHTTP compresses a response of the net/http backend.
+func (c *compressor) compressHTTP(resp *http.Response) {
+	req := resp.Request
+	coding := c.negotiate(strings.Join(req.Header.Values("Accept-Encoding"), ","), req.Method,
+		resp.StatusCode, resp.Header)
+	if coding == "" {
+		return
+	}
+
+	resp.Body = &compressedBody{
+		compressReader: c.reader(coding, resp.Body, resp.ContentLength < 0),
+		body:           resp.Body,
+	}
+	resp.ContentLength = -1
+}
+
+// compressFastHTTP compresses the body of a fasthttp response whose headers
+// are already set. It returns the body, its size and the release function
+// to use instead.
+func (c *compressor) compressFastHTTP(ctx *fasthttp.RequestCtx, body io.Reader, size int,
+	release func(),
+) (io.Reader, int, func()) {
+	acceptEncoding := make([]string, 0, 1)
+	for _, value := range ctx.Request.Header.PeekAll("Accept-Encoding") {
+		acceptEncoding = append(acceptEncoding, string(value))
+	}
+
+	header := fastHTTPResponseHeader{&ctx.Response.Header}
+	coding := c.negotiate(strings.Join(acceptEncoding, ","), string(ctx.Method()),
+		ctx.Response.StatusCode(), header)
+	if coding == "" {
+		return body, size, release
+	}
+
+	compressed := c.reader(coding, body, size < 0)
+
+	return compressed, -1, func() {
+		_ = compressed.Close()
+		release()
+	}
+}
+
+// compressReader compresses src while it is read.
+type compressReader struct {
+	src   io.Reader
+	enc   encoder
+	pool  *sync.Pool
+	buf   bytes.Buffer
+	chunk []byte
+	flush bool
+	done  bool
+}
+
+func (r *compressReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && !r.done {
+		n, err := r.src.Read(r.chunk)
+		if n > 0 {
+			if _, werr := r.enc.Write(r.chunk[:n]); werr != nil {
+				return 0, werr
+			}
+			if r.flush {
+				if ferr := r.enc.Flush(); ferr != nil {
+					return 0, ferr
+				}
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			if cerr := r.enc.Close(); cerr != nil {
+				return 0, cerr
+			}
+			r.release()
+		case err != nil:
+			return 0, err
+		}
+	}
+
+	return r.buf.Read(p)
+}
+
+// Close returns the encoder to its pool when the body was not read to the
+// end.
+func (r *compressReader) Close() error {
+	if !r.done {
+		_ = r.enc.Close()
+		r.release()
+	}
+
+	return nil
+}
+
+func (r *compressReader) release() {
+	r.done = true
+	r.enc.Reset(io.Discard)
+	r.pool.Put(r.enc)
+	r.enc = nil
+}
+
+// compressedBody closes the upstream body together with the compressor.
+type compressedBody struct {
+	*compressReader
+
+	body io.Closer
+}
+
+func (b *compressedBody) Close() error {
+	_ = b.compressReader.Close()
+
+	return b.body.Close()
+}
+
+// fastHTTPResponseHeader adapts a fasthttp response header to
+// responseHeader.
+type fastHTTPResponseHeader struct {
+	h *fasthttp.ResponseHeader
+}
+
+func (f fastHTTPResponseHeader) Get(key string) string {
+	return string(f.h.Peek(key))
+}
+
+func (f fastHTTPResponseHeader) Values(key string) []string {
+	values := f.h.PeekAll(key)
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		result = append(result, string(value))
+	}
+
+	return result
+}
+
+func (f fastHTTPResponseHeader) Set(key, value string) {
+	f.h.Set(key, value)
+}
+
+func (f fastHTTPResponseHeader) Add(key, value string) {
+	f.h.Add(key, value)
+}
+
+func (f fastHTTPResponseHeader) Del(key string) {
+	if strings.EqualFold(key, "Content-Length") {
+		f.h.SetContentLength(-1)
+
+		return
+	}
+	f.h.Del(key)
+}
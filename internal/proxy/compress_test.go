@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressor_Choose(t *testing.T) {
+	c := newCompressor(Compression{})
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", EncodingGzip},
+		{"gzip, deflate, br", EncodingBrotli},
+		{"gzip, deflate, br, zstd", EncodingZstd},
+		{"br;q=0.5, gzip", EncodingGzip},
+		{"zstd;q=0, gzip;q=0.1", EncodingGzip},
+		{"*", EncodingZstd},
+		{"*;q=0.5, zstd;q=0", EncodingBrotli},
+		{"GZIP", EncodingGzip},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, c.choose(tt.acceptEncoding), tt.acceptEncoding)
+	}
+
+	preferGzip := newCompressor(Compression{Encodings: []string{EncodingGzip, EncodingBrotli}})
+	assert.Equal(t, EncodingGzip, preferGzip.choose("zstd, br, gzip"))
+}
+
+func TestCompressor_Negotiate(t *testing.T) {
+	c := newCompressor(Compression{Types: []string{"text/*", "application/json"}, MinSize: 100})
+
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		header   http.Header
+		want     string
+		wantVary bool
+	}{
+		{"json", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"application/json"}}, EncodingGzip, true},
+		{"text subtype", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"text/css; charset=utf-8"}}, EncodingGzip, true},
+		{"type not allowed", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"image/png"}}, "", false},
+		{"event stream", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"text/event-stream"}}, "", false},
+		{"small", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"text/plain"}, "Content-Length": {"99"}}, "", true},
+		{"compressed", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, "", false},
+		{"no-transform", http.MethodGet, http.StatusOK, http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"public, no-transform"}}, "", false},
+		{"partial", http.MethodGet, http.StatusPartialContent, http.Header{"Content-Type": {"text/plain"}}, "", false},
+		{"head", http.MethodHead, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.Set("ETag", `"v1"`)
+			got := c.negotiate("gzip", tt.method, tt.status, tt.header)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantVary, tt.header.Get("Vary") == "Accept-Encoding")
+			if got != "" {
+				assert.Equal(t, got, tt.header.Get("Content-Encoding"))
+				assert.Empty(t, tt.header.Get("Content-Length"))
+				assert.Equal(t, `W/"v1"`, tt.header.Get("ETag"))
+			}
+		})
+	}
+
+	header := http.Header{"Content-Type": {"text/plain"}, "Vary": {"Origin, accept-encoding"}}
+	c.negotiate("gzip", http.MethodGet, http.StatusOK, header)
+	assert.Equal(t, []string{"Origin, accept-encoding"}, header.Values("Vary"))
+}
+
+func decompress(t *testing.T, coding string, body []byte) string {
+	t.Helper()
+
+	var reader io.Reader
+	switch coding {
+	case EncodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		reader = gz
+	case EncodingBrotli:
+		reader = brotli.NewReader(bytes.NewReader(body))
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		defer zr.Close()
+		reader = zr
+	default:
+		return string(body)
+	}
+
+	decoded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	return string(decoded)
+}
+
+func TestCompression_Backends(t *testing.T) {
+	payload := strings.Repeat(`{"name":"proxier","kind":"reverse proxy"}`, 200)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, `{}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = io.WriteString(w, payload)
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", EncodingGzip)
+			gz := gzip.NewWriter(w)
+			_, _ = io.WriteString(gz, payload)
+			_ = gz.Close()
+		case "/chunked":
+			w.Header().Set("Content-Type", "text/plain")
+			for range 4 {
+				_, _ = io.WriteString(w, payload)
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, payload)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       string
+	}{
+		{"/json", "gzip", EncodingGzip, payload},
+		{"/json", "gzip, br", EncodingBrotli, payload},
+		{"/json", "gzip, br, zstd", EncodingZstd, payload},
+		{"/json", "identity", "", payload},
+		{"/chunked", "gzip", EncodingGzip, strings.Repeat(payload, 4)},
+		{"/small", "gzip", "", `{}`},
+		{"/image", "gzip", "", payload},
+		{"/encoded", "br, gzip", EncodingGzip, payload},
+	}
+
+	for backend, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithCompression(Compression{})) {
+		for _, tt := range tests {
+			t.Run(backend+tt.path+"/"+tt.acceptEncoding, func(t *testing.T) {
+				req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxyURL+"/stream"+tt.path, nil)
+				require.NoError(t, err)
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				assert.Equal(t, tt.wantEncoding, resp.Header.Get("Content-Encoding"))
+				assert.Equal(t, tt.wantBody, decompress(t, tt.wantEncoding, body))
+				if tt.path == "/json" {
+					assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+				}
+				if tt.wantEncoding != "" && tt.path != "/encoded" {
+					assert.Less(t, len(body), len(tt.wantBody))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	defaultAdaptiveBackoff = 0.9
+	defaultQueueTimeout    = 5 * time.Second
+)
+
+var (
+	errQueueFull    = errors.New("too many requests in flight")
+	errQueueTimeout = errors.New("timed out waiting for a request slot")
+)
+
+var (
+	concurrencyInFlight = metrics.Default.GaugeVec("proxier_concurrency_in_flight",
+		"Requests currently sent to the destination.")
+	concurrencyQueued = metrics.Default.GaugeVec("proxier_concurrency_queued",
+		"Requests waiting for a concurrency slot.")
+	concurrencyLimit = metrics.Default.GaugeVec("proxier_concurrency_limit",
+		"Current concurrency limit.")
+	concurrencyRejected = metrics.Default.CounterVec("proxier_concurrency_rejected_total",
+		"Requests rejected by the concurrency limit: queue_full or queue_timeout.")
+)
+
+// ConcurrencyLimit bounds the requests of a route in flight to the
+// destination. Requests above the limit wait in a bounded queue.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the number of requests sent concurrently.
+	MaxInFlight int
+	// QueueSize is the number of requests waiting for a slot; zero rejects
+	// requests right away when all slots are taken.
+	QueueSize int
+	// QueueTimeout is how long a request waits for a slot, 5s by default.
+	QueueTimeout time.Duration
+	// Adaptive, when set, lowers the limit below MaxInFlight while the
+	// destination is slow or failing.
+	Adaptive *AdaptiveConcurrency
+}
+
+// AdaptiveConcurrency adjusts the limit with AIMD: every request answered
+// within TargetLatency raises the limit by 1/limit, so by one per round of
+// requests, and every slower or failed request multiplies it by Backoff.
+type AdaptiveConcurrency struct {
+	// MinLimit is the lowest limit, 1 by default.
+	MinLimit int
+	// TargetLatency is the slowest time to the response headers still
+	// considered healthy.
+	TargetLatency time.Duration
+	// Backoff is the factor applied on slow or failed requests, 0.9 by
+	// default.
+	Backoff float64
+}
+
+// concurrencyLimiter hands out request slots in arrival order.
+type concurrencyLimiter struct {
+	maxLimit  float64
+	queueSize int
+	timeout   time.Duration
+	adaptive  *AdaptiveConcurrency
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// queue holds the channels of waiting requests, closed when they are
+	// granted a slot.
+	queue *list.List
+
+	inFlightGauge *metrics.Gauge
+	queuedGauge   *metrics.Gauge
+	limitGauge    *metrics.Gauge
+	queueFull     *metrics.Counter
+	queueTimeout  *metrics.Counter
+}
+
+func newConcurrencyLimiter(endpoint string, cfg ConcurrencyLimit) *concurrencyLimiter {
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = defaultQueueTimeout
+	}
+	if cfg.Adaptive != nil {
+		adaptive := *cfg.Adaptive
+		adaptive.MinLimit = min(max(adaptive.MinLimit, 1), cfg.MaxInFlight)
+		if adaptive.Backoff <= 0 || adaptive.Backoff >= 1 {
+			adaptive.Backoff = defaultAdaptiveBackoff
+		}
+		cfg.Adaptive = &adaptive
+	}
+
+	labels := metrics.Labels{"endpoint": endpoint}
+	rejected := func(reason string) *metrics.Counter {
+		return concurrencyRejected.With(metrics.Labels{"endpoint": endpoint, "reason": reason})
+	}
+
+	l := &concurrencyLimiter{
+		maxLimit:      float64(cfg.MaxInFlight),
+		queueSize:     cfg.QueueSize,
+		timeout:       cfg.QueueTimeout,
+		adaptive:      cfg.Adaptive,
+		limit:         float64(cfg.MaxInFlight),
+		queue:         list.New(),
+		inFlightGauge: concurrencyInFlight.With(labels),
+		queuedGauge:   concurrencyQueued.With(labels),
+		limitGauge:    concurrencyLimit.With(labels),
+		queueFull:     rejected("queue_full"),
+		queueTimeout:  rejected("queue_timeout"),
+	}
+	l.limitGauge.Set(int64(cfg.MaxInFlight))
+
+	return l
+}
+
+// acquire waits for a request slot. It fails when the queue is full, the
+// queue timeout passes or ctx is done.
+func (l *concurrencyLimiter) acquire(ctx context.Context) (*concurrencySlot, error) {
+	l.mu.Lock()
+	if l.inFlight < l.current() {
+		l.inFlight++
+		l.inFlightGauge.Set(int64(l.inFlight))
+		l.mu.Unlock()
+
+		return l.newSlot(), nil
+	}
+	if l.queue.Len() >= l.queueSize {
+		l.mu.Unlock()
+		l.queueFull.Inc()
+
+		return nil, errQueueFull
+	}
+	granted := make(chan struct{})
+	elem := l.queue.PushBack(granted)
+	l.queuedGauge.Set(int64(l.queue.Len()))
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-granted:
+		return l.newSlot(), nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-granted:
+		// The slot was granted while giving up; hand it on.
+		l.inFlight--
+		l.grant()
+	default:
+		l.queue.Remove(elem)
+		l.queuedGauge.Set(int64(l.queue.Len()))
+	}
+	if errors.Is(err, errQueueTimeout) {
+		l.queueTimeout.Inc()
+	}
+
+	return nil, err
+}
+
+// current returns the number of slots. Callers hold mu.
+func (l *concurrencyLimiter) current() int {
+	return int(l.limit)
+}
+
+// grant hands free slots to waiting requests. Callers hold mu.
+func (l *concurrencyLimiter) grant() {
+	for l.inFlight < l.current() && l.queue.Len() > 0 {
+		granted := l.queue.Remove(l.queue.Front()).(chan struct{}) //nolint:forcetypeassert // only channels are queued
+		l.inFlight++
+		close(granted)
+	}
+	l.inFlightGauge.Set(int64(l.inFlight))
+	l.queuedGauge.Set(int64(l.queue.Len()))
+}
+
+// release frees a slot and, when adaptive, adjusts the limit by the outcome
+// of the request.
+func (l *concurrencyLimiter) release(latency time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if a := l.adaptive; a != nil {
+		if ok && latency <= a.TargetLatency {
+			l.limit = math.Min(l.maxLimit, l.limit+1/l.limit)
+		} else {
+			l.limit = math.Max(float64(a.MinLimit), l.limit*a.Backoff)
+		}
+		l.limitGauge.Set(int64(l.current()))
+	}
+	l.grant()
+}
+
+func (l *concurrencyLimiter) newSlot() *concurrencySlot {
+	return &concurrencySlot{limiter: l, start: time.Now()}
+}
+
+// concurrencySlot is a slot held by one request until its response is
+// sent.
+type concurrencySlot struct {
+	limiter *concurrencyLimiter
+	start   time.Time
+	once    sync.Once
+
+	// untilSent is set when the slot is released once a streamed body
+	// has been sent rather than when the handler returns.
+	untilSent bool
+
+	mu        sync.Mutex
+	latency   time.Duration
+	responded bool
+	failed    bool
+}
+
+// respond records the arrival of the response headers from the destination.
+func (s *concurrencySlot) respond(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.responded {
+		s.responded = true
+		s.latency = time.Since(s.start)
+		s.failed = status >= http.StatusInternalServerError
+	}
+}
+
+// release returns the slot; only the first call has an effect.
+func (s *concurrencySlot) release() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		latency, ok := s.latency, s.responded && !s.failed
+		s.mu.Unlock()
+
+		s.limiter.release(latency, ok)
+	})
+}
+
+type concurrencySlotKey struct{}
+
+// slotFromContext returns the slot of a net/http request, or nil.
+func slotFromContext(ctx context.Context) *concurrencySlot {
+	slot, _ := ctx.Value(concurrencySlotKey{}).(*concurrencySlot)
+
+	return slot
+}
+
+// concurrencySlotUserValue keeps the slot of a fasthttp request.
+const concurrencySlotUserValue = "proxier.concurrencySlot"
+
+// slotFromFastHTTP returns the slot of a fasthttp request, or nil.
+func slotFromFastHTTP(ctx *fasthttp.RequestCtx) *concurrencySlot {
+	slot, _ := ctx.UserValue(concurrencySlotUserValue).(*concurrencySlot)
+
+	return slot
+}
+
+// concurrencyHTTP holds a slot for each request of the net/http backend
+// until its response is sent, answering 503 Service Unavailable when none
+// is available. Upgrade requests are bounded by UpgradeLimits instead.
+func concurrencyHTTP(opt *options, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header.Get("Connection"), r.Header.Get("Upgrade")) != "" {
+			next(w, r)
+
+			return
+		}
+
+		slot, err := opt.concurrency.acquire(r.Context())
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+
+			return
+		}
+		defer slot.release()
+
+		next(w, r.WithContext(context.WithValue(r.Context(), concurrencySlotKey{}, slot)))
+	}
+}
+
+// concurrencyFastHTTP holds a slot for each request of the fasthttp
+// backend, like concurrencyHTTP. A streamed body keeps the slot until it is
+// sent, see streamBody.
+func concurrencyFastHTTP(opt *options, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if upgradeType(string(ctx.Request.Header.Peek("Connection")), string(ctx.Request.Header.Peek("Upgrade"))) != "" {
+			next(ctx)
+
+			return
+		}
+
+		slot, err := opt.concurrency.acquire(ctx)
+		if err != nil {
+			ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			ctx.SetBodyString("Proxy error: " + err.Error())
+
+			return
+		}
+
+		ctx.SetUserValue(concurrencySlotUserValue, slot)
+		next(ctx)
+		slot.respond(ctx.Response.StatusCode())
+		if !slot.untilSent {
+			slot.release()
+		}
+	}
+}
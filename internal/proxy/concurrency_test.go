@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter_Queue(t *testing.T) {
+	limiter := newConcurrencyLimiter(t.Name(), ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeout: time.Minute})
+
+	first, err := limiter.acquire(t.Context())
+	require.NoError(t, err)
+
+	queued := make(chan *concurrencySlot)
+	go func() {
+		slot, err := limiter.acquire(t.Context())
+		assert.NoError(t, err)
+		queued <- slot
+	}()
+	require.Eventually(t, func() bool {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+
+		return limiter.queue.Len() == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = limiter.acquire(t.Context())
+	require.ErrorIs(t, err, errQueueFull)
+
+	first.release()
+	first.release()
+	second := <-queued
+	assert.Equal(t, 1, limiter.inFlight)
+
+	second.release()
+	assert.Equal(t, 0, limiter.inFlight)
+}
+
+func TestConcurrencyLimiter_Timeout(t *testing.T) {
+	limiter := newConcurrencyLimiter(t.Name(), ConcurrencyLimit{MaxInFlight: 1, QueueSize: 5, QueueTimeout: 20 * time.Millisecond})
+
+	slot, err := limiter.acquire(t.Context())
+	require.NoError(t, err)
+
+	_, err = limiter.acquire(t.Context())
+	require.ErrorIs(t, err, errQueueTimeout)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	_, err = limiter.acquire(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	assert.Equal(t, 0, limiter.queue.Len())
+	slot.release()
+	assert.Equal(t, 0, limiter.inFlight)
+}
+
+func TestConcurrencyLimiter_Adaptive(t *testing.T) {
+	limiter := newConcurrencyLimiter(t.Name(), ConcurrencyLimit{
+		MaxInFlight: 10,
+		Adaptive:    &AdaptiveConcurrency{MinLimit: 2, TargetLatency: 100 * time.Millisecond, Backoff: 0.5},
+	})
+
+	run := func(latency time.Duration, ok bool) {
+		_, err := limiter.acquire(t.Context())
+		require.NoError(t, err)
+		limiter.release(latency, ok)
+	}
+
+	// Slow responses halve the limit down to the minimum.
+	run(time.Second, true)
+	assert.Equal(t, 5, limiter.current())
+	run(time.Second, true)
+	run(time.Second, true)
+	assert.Equal(t, 2, limiter.current())
+
+	// Failures count as slow.
+	run(time.Millisecond, false)
+	assert.Equal(t, 2, limiter.current())
+
+	// Fast responses raise it by about one per round of requests.
+	for range 2 {
+		run(time.Millisecond, true)
+	}
+	assert.Equal(t, 2, limiter.current())
+	for range 3 {
+		run(time.Millisecond, true)
+	}
+	assert.Equal(t, 3, limiter.current())
+	for range 100 {
+		run(time.Millisecond, true)
+	}
+	assert.Equal(t, 10, limiter.current())
+}
+
+func TestConcurrencyLimit_Backends(t *testing.T) {
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/held" {
+			arrived <- struct{}{}
+			<-release
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	limit := ConcurrencyLimit{MaxInFlight: 1}
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithConcurrencyLimit(t.Name(), limit)) {
+		t.Run(name, func(t *testing.T) {
+			release = make(chan struct{})
+			get := func(path string) int {
+				resp, err := http.Get(proxyURL + "/stream" + path)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+				_, _ = io.Copy(io.Discard, resp.Body)
+
+				return resp.StatusCode
+			}
+
+			held := make(chan int)
+			go func() {
+				held <- get("/held")
+			}()
+			<-arrived
+
+			assert.Equal(t, http.StatusServiceUnavailable, get("/other"))
+
+			close(release)
+			assert.Equal(t, http.StatusOK, <-held)
+			assert.Eventually(t, func() bool {
+				return get("/other") == http.StatusOK
+			}, time.Second, 10*time.Millisecond)
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+// unixSocketHost is the Host sent to unix socket destinations.
+const unixSocketHost = spec.UnixSocketHost
+
+// upstreamDialer opens connections to a destination, through its unix
+// socket when set, and sends a PROXY protocol header when configured.
+type upstreamDialer struct {
+	socket        string
+	proxyProtocol int
+}
+
+// custom reports whether connections need more than a plain TCP dial.
+func (d upstreamDialer) custom() bool {
+	return d.socket != "" || d.proxyProtocol > 0
+}
+
+func (d upstreamDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if d.proxyProtocol > 0 {
+		dial = dialWithProxyHeader(dial, d.proxyProtocol)
+	}
+	if d.socket != "" {
+		network, addr = "unix", d.socket
+	}
+
+	return dial(ctx, network, addr)
+}
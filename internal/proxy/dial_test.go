@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUnixBackend serves HTTP on a unix socket and echoes the request path
+// and Host header.
+func newUnixBackend(t *testing.T) string {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Host+" "+r.URL.Path)
+	}))
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return socket
+}
+
+func TestUnixSocketDestination(t *testing.T) {
+	socket := newUnixBackend(t)
+
+	tests := []struct {
+		name        string
+		destination string
+		want        string
+	}{
+		{name: "socket", destination: "unix://" + socket, want: "localhost /users"},
+		{name: "base path", destination: "unix://" + socket + ":/api/v1", want: "localhost /api/v1/users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, proxyURL := range serveBackends(t, "/svc", tt.destination) {
+				resp, err := http.Get(proxyURL + "/svc/users")
+				require.NoError(t, err)
+
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				require.NoError(t, err)
+
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, tt.want, string(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+// schemeFastCGI is the destination URL scheme of FastCGI applications.
+const schemeFastCGI = spec.SchemeFastCGI
+
+// FastCGI record types and constants, see the FastCGI 1.0 specification.
+const (
+	fcgiVersion        = 1
+	fcgiBeginRequest   = 1
+	fcgiEndRequest     = 3
+	fcgiParams         = 4
+	fcgiStdin          = 5
+	fcgiStdout         = 6
+	fcgiStderr         = 7
+	fcgiResponder      = 1
+	fcgiRequestID      = 1
+	fcgiMaxContentSize = 65535
+	fcgiHeaderSize     = 8
+)
+
+// fastCGIMaxBufferedBody is the largest request body of unknown length, such
+// as a chunked one, buffered to send its CONTENT_LENGTH. Larger bodies are
+// rejected with 411 Length Required.
+const fastCGIMaxBufferedBody = 10 << 20
+
+var errFastCGIBodyTooLarge = errors.New("request body of unknown length is too large")
+
+// FastCGI describes how requests are mapped to scripts of a FastCGI
+// application such as PHP-FPM.
+type FastCGI struct {
+	// Root is the document root scripts are resolved against.
+	Root string
+	// SplitPath lists extensions, such as ".php", that end the script name;
+	// the rest of the path becomes PATH_INFO.
+	SplitPath []string
+	// Index is appended to paths ending in "/".
+	Index string
+	// Params are extra CGI environment parameters sent with every request.
+	Params map[string]string
+}
+
+// fastCGITransport is an http.RoundTripper that sends each request to a
+// FastCGI responder over its own connection.
+type fastCGITransport struct {
+	address string
+	dialer  upstreamDialer
+	config  FastCGI
+}
+
+func newFastCGITransport(address string, dialer upstreamDialer, config FastCGI) *fastCGITransport {
+	return &fastCGITransport{address: address, dialer: dialer, config: config}
+}
+
+func (t *fastCGITransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+		buffered, err := bufferBody(req)
+		if errors.Is(err, errFastCGIBodyTooLarge) {
+			return lengthRequired(req), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		req = buffered
+	}
+
+	conn, err := t.dialer.dialContext(req.Context(), "tcp", t.address)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(req.Context(), func() {
+		_ = conn.Close()
+	})
+
+	resp, err := t.exchange(conn, req)
+	if err != nil {
+		stop()
+		_ = conn.Close()
+
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		return nil, err
+	}
+
+	resp.Body = &fastCGIBody{Reader: resp.Body, close: func() error {
+		stop()
+
+		return conn.Close()
+	}}
+
+	return resp, nil
+}
+
+// bufferBody reads a request body of unknown length into memory, because
+// CGI applications only read CONTENT_LENGTH bytes of stdin. It returns a copy
+// of req with the buffered body.
+func bufferBody(req *http.Request) (*http.Request, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, fastCGIMaxBufferedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > fastCGIMaxBufferedBody {
+		return nil, errFastCGIBodyTooLarge
+	}
+
+	buffered := *req
+	buffered.Body = io.NopCloser(bytes.NewReader(body))
+	buffered.ContentLength = int64(len(body))
+
+	return &buffered, nil
+}
+
+// lengthRequired answers req with 411 Length Required.
+func lengthRequired(req *http.Request) *http.Response {
+	body := http.StatusText(http.StatusLengthRequired)
+
+	return &http.Response{
+		Status:        "411 " + body,
+		StatusCode:    http.StatusLengthRequired,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func (t *fastCGITransport) exchange(conn net.Conn, req *http.Request) (*http.Response, error) {
+	writer := bufio.NewWriter(conn)
+
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeRecord(writer, fcgiBeginRequest, begin); err != nil {
+		return nil, err
+	}
+	if err := writeStream(writer, fcgiParams, encodeParams(t.params(req))); err != nil {
+		return nil, err
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		if err := copyStdin(writer, req.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeRecord(writer, fcgiStdin, nil); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readCGIResponse(req, &stdoutReader{reader: bufio.NewReader(conn)})
+}
+
+// params builds the CGI environment of req.
+func (t *fastCGITransport) params(req *http.Request) map[string]string {
+	scriptName, pathInfo := t.splitPath(req.URL.Path)
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+		port = "80"
+		if req.Header.Get("X-Forwarded-Proto") == "https" {
+			port = "443"
+		}
+	}
+	remoteHost, remotePort, _ := net.SplitHostPort(req.RemoteAddr)
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "proxier",
+		"SERVER_PROTOCOL":   req.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REMOTE_ADDR":       remoteHost,
+		"REMOTE_PORT":       remotePort,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     t.config.Root,
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   filepath.Join(t.config.Root, filepath.FromSlash(scriptName)),
+		"PATH_INFO":         pathInfo,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+		"REQUEST_SCHEME":    "http",
+	}
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = filepath.Join(t.config.Root, filepath.FromSlash(pathInfo))
+	}
+	if req.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "https" {
+		params["HTTPS"] = "on"
+		params["REQUEST_SCHEME"] = "https"
+	}
+
+	for name, values := range req.Header {
+		// X_Forwarded_For would map to the same variable as X-Forwarded-For.
+		if strings.Contains(name, "_") {
+			continue
+		}
+		key := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		// Content headers have their own variables; HTTP_PROXY would let
+		// clients set the proxy of the application (httpoxy).
+		if key == "CONTENT_TYPE" || key == "CONTENT_LENGTH" || key == "PROXY" {
+			continue
+		}
+		params["HTTP_"+key] = strings.Join(values, ", ")
+	}
+	params["HTTP_HOST"] = req.Host
+
+	for name, value := range t.config.Params {
+		params[name] = value
+	}
+
+	return params
+}
+
+// splitPath splits a request path into the script name and PATH_INFO.
+func (t *fastCGITransport) splitPath(requestPath string) (string, string) {
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	lower := strings.ToLower(cleaned)
+	for _, ext := range t.config.SplitPath {
+		ext = strings.ToLower(ext)
+		for offset := 0; ; {
+			index := strings.Index(lower[offset:], ext)
+			if index < 0 {
+				break
+			}
+			end := offset + index + len(ext)
+			if end == len(cleaned) || cleaned[end] == '/' {
+				return cleaned[:end], cleaned[end:]
+			}
+			offset = end
+		}
+	}
+
+	if strings.HasSuffix(cleaned, "/") && t.config.Index != "" {
+		return cleaned + t.config.Index, ""
+	}
+
+	return cleaned, ""
+}
+
+// readCGIResponse parses the CGI headers at the start of stdout.
+func readCGIResponse(req *http.Request, stdout io.Reader) (*http.Response, error) {
+	reader := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && len(header) > 0) {
+		return nil, fmt.Errorf("reading FastCGI response headers: %w", err)
+	}
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(header),
+		Body:          io.NopCloser(reader),
+		ContentLength: -1,
+		Request:       req,
+	}
+
+	if status := resp.Header.Get("Status"); status != "" {
+		code, _, _ := strings.Cut(status, " ")
+		resp.StatusCode, err = strconv.Atoi(code)
+		if err != nil || resp.StatusCode < 100 || resp.StatusCode > 999 {
+			return nil, fmt.Errorf("invalid FastCGI status %q", status)
+		}
+		resp.Header.Del("Status")
+	} else if resp.Header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+
+	if length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = length
+	}
+
+	return resp, nil
+}
+
+// fastCGIBody closes the connection together with the response body.
+type fastCGIBody struct {
+	io.Reader
+	close func() error
+}
+
+func (b *fastCGIBody) Close() error {
+	return b.close()
+}
+
+// stdoutReader returns the content of FCGI_STDOUT records until the end of
+// the request. FCGI_STDERR content is logged.
+type stdoutReader struct {
+	reader    *bufio.Reader
+	remaining int
+	padding   int
+	done      bool
+}
+
+func (r *stdoutReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.nextStdout(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= n
+	if r.remaining == 0 && err == nil {
+		_, err = r.reader.Discard(r.padding)
+	}
+
+	return n, err
+}
+
+// nextStdout advances to the next FCGI_STDOUT record with content.
+func (r *stdoutReader) nextStdout() error {
+	header := make([]byte, fcgiHeaderSize)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+
+	recordType := header[1]
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	padding := int(header[6])
+
+	switch recordType {
+	case fcgiStdout:
+		r.remaining, r.padding = length, padding
+		if length == 0 {
+			_, err := r.reader.Discard(padding)
+
+			return err
+		}
+
+		return nil
+	case fcgiStderr:
+		message := make([]byte, length+padding)
+		if _, err := io.ReadFull(r.reader, message); err != nil {
+			return err
+		}
+		if length > 0 {
+			log.Printf("[Proxy] FastCGI stderr: %s", strings.TrimSpace(string(message[:length])))
+		}
+
+		return nil
+	case fcgiEndRequest:
+		r.done = true
+		_, err := r.reader.Discard(length + padding)
+
+		return err
+	default:
+		_, err := r.reader.Discard(length + padding)
+
+		return err
+	}
+}
+
+func writeRecord(w io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{fcgiVersion, recordType, 0, fcgiRequestID, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+
+	return err
+}
+
+// writeStream writes content as a stream of records ended by an empty one.
+func writeStream(w io.Writer, recordType byte, content []byte) error {
+	for len(content) > 0 {
+		chunk := content[:min(len(content), fcgiMaxContentSize)]
+		if err := writeRecord(w, recordType, chunk); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+	}
+
+	return writeRecord(w, recordType, nil)
+}
+
+func copyStdin(w io.Writer, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if writeErr := writeRecord(w, fcgiStdin, buf[:n]); writeErr != nil {
+				return writeErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// encodeParams encodes name-value pairs as FastCGI expects them.
+func encodeParams(params map[string]string) []byte {
+	var buf []byte
+	for name, value := range params {
+		buf = appendParamLength(buf, len(name))
+		buf = appendParamLength(buf, len(value))
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+
+	return buf
+}
+
+func appendParamLength(buf []byte, length int) []byte {
+	if length < 128 {
+		return append(buf, byte(length))
+	}
+
+	return binary.BigEndian.AppendUint32(buf, uint32(length)|1<<31)
+}
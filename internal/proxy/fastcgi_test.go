@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFastCGIBackend serves a FastCGI responder that reports the CGI
+// environment it received.
+func newFastCGIBackend(t *testing.T, network, address string) string {
+	t.Helper()
+
+	listener, err := net.Listen(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		_ = fcgi.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			env := fcgi.ProcessEnv(r)
+			body, _ := io.ReadAll(r.Body)
+
+			w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+			w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = fmt.Fprintf(w, "%s %s|%s|%s|%s|%s", r.Method, r.URL.RequestURI(),
+				env["PATH_TRANSLATED"], env["APP_ENV"], r.Header.Get("X-Test"), body)
+		}))
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestFastCGIDestination(t *testing.T) {
+	root := t.TempDir()
+	tcpAddr := newFastCGIBackend(t, "tcp", "127.0.0.1:0")
+	socket := newFastCGIBackend(t, "unix", filepath.Join(t.TempDir(), "fpm.sock"))
+
+	config := FastCGI{
+		Root:      root,
+		SplitPath: []string{".php"},
+		Index:     "index.php",
+		Params:    map[string]string{"APP_ENV": "test"},
+	}
+
+	for _, destination := range []string{"fastcgi://" + tcpAddr, "fastcgi://" + socket} {
+		t.Run(destination, func(t *testing.T) {
+			for _, proxyURL := range serveBackends(t, "/app", destination, WithFastCGI(config)) {
+				req, err := http.NewRequest(http.MethodPost, proxyURL+"/app/blog/post.php/2024/hello?x=1",
+					strings.NewReader("payload"))
+				require.NoError(t, err)
+				req.Header.Set("X-Test", "yes")
+				req.Header.Set("Proxy", "http://evil")
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				require.NoError(t, err)
+
+				assert.Equal(t, http.StatusCreated, resp.StatusCode)
+				assert.Equal(t, filepath.Join(root, "blog", "post.php"), resp.Header.Get("X-Script"))
+				assert.Equal(t, "POST /blog/post.php/2024/hello?x=1|"+filepath.Join(root, "2024", "hello")+
+					"|test|yes|payload", string(body))
+
+				resp, err = http.Get(proxyURL + "/app/")
+				require.NoError(t, err)
+				_ = resp.Body.Close()
+				assert.Equal(t, filepath.Join(root, "index.php"), resp.Header.Get("X-Script"))
+			}
+		})
+	}
+}
+
+func TestFastCGIChunkedBody(t *testing.T) {
+	destination := "fastcgi://" + newFastCGIBackend(t, "tcp", "127.0.0.1:0")
+
+	for backend, proxyURL := range serveBackends(t, "/app", destination, WithFastCGI(FastCGI{Root: t.TempDir()})) {
+		t.Run(backend, func(t *testing.T) {
+			// A reader of unknown length is sent chunked.
+			req, err := http.NewRequest(http.MethodPost, proxyURL+"/app/upload.php",
+				io.MultiReader(strings.NewReader("pay"), strings.NewReader("load")))
+			require.NoError(t, err)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+			assert.Equal(t, "7", resp.Header.Get("X-Content-Length"))
+			assert.True(t, strings.HasSuffix(string(body), "|payload"), string(body))
+		})
+	}
+}
+
+func TestFastCGIChunkedBody_TooLarge(t *testing.T) {
+	transport := newFastCGITransport("127.0.0.1:1", upstreamDialer{}, FastCGI{})
+
+	req := httptest.NewRequest(http.MethodPost, "/upload.php",
+		io.LimitReader(zeroReader{}, fastCGIMaxBufferedBody+1))
+	req.ContentLength = -1
+
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusLengthRequired, resp.StatusCode)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+
+	return len(p), nil
+}
+
+func TestFastCGISplitPath(t *testing.T) {
+	transport := newFastCGITransport("", upstreamDialer{}, FastCGI{SplitPath: []string{".php"}, Index: "index.php"})
+
+	tests := []struct {
+		path       string
+		scriptName string
+		pathInfo   string
+	}{
+		{path: "/index.php", scriptName: "/index.php"},
+		{path: "/a.php/b/c", scriptName: "/a.php", pathInfo: "/b/c"},
+		{path: "/a.phpx/b.php/c", scriptName: "/a.phpx/b.php", pathInfo: "/c"},
+		{path: "/A.PHP", scriptName: "/A.PHP"},
+		{path: "/dir/", scriptName: "/dir/index.php"},
+		{path: "/../../etc/passwd", scriptName: "/etc/passwd"},
+		{path: "/static/app.js", scriptName: "/static/app.js"},
+	}
+
+	for _, tt := range tests {
+		scriptName, pathInfo := transport.splitPath(tt.path)
+		assert.Equal(t, tt.scriptName, scriptName, tt.path)
+		assert.Equal(t, tt.pathInfo, pathInfo, tt.path)
+	}
+}
+
+func TestFastCGIParams(t *testing.T) {
+	transport := newFastCGITransport("", upstreamDialer{}, FastCGI{Root: "/srv"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.test:8080/x.php?q=1", nil)
+	req.Header.Set("Proxy", "http://evil")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header["X_Forwarded_For"] = []string{"127.0.0.1"}
+	req.Header["X_Custom"] = []string{"spoofed"}
+	req.RemoteAddr = "203.0.113.9:4567"
+
+	params := transport.params(req)
+	assert.NotContains(t, params, "HTTP_PROXY")
+	assert.Equal(t, "203.0.113.9", params["HTTP_X_FORWARDED_FOR"])
+	assert.NotContains(t, params, "HTTP_X_CUSTOM")
+	assert.Equal(t, "on", params["HTTPS"])
+	assert.Equal(t, "app.test", params["SERVER_NAME"])
+	assert.Equal(t, "8080", params["SERVER_PORT"])
+	assert.Equal(t, "203.0.113.9", params["REMOTE_ADDR"])
+	assert.Equal(t, "q=1", params["QUERY_STRING"])
+	assert.Equal(t, "/srv/x.php", params["SCRIPT_FILENAME"])
+}
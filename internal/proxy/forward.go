@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	headerForwarded       = "Forwarded"
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedHost  = "X-Forwarded-Host"
+	headerXForwardedProto = "X-Forwarded-Proto"
+)
+
+// hopHeaders are removed when forwarding, see RFC 9110, section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardingHeaders holds the values of the forwarding headers sent upstream.
+type forwardingHeaders struct {
+	xForwardedFor   string
+	xForwardedHost  string
+	xForwardedProto string
+	forwarded       string
+}
+
+// newForwardingHeaders computes the forwarding headers for a request received
+// from peer. Headers set by a trusted peer are appended to, otherwise they
+// are replaced so that clients cannot inject them.
+func newForwardingHeaders(trusted realip.TrustedProxies, peer netip.Addr,
+	host, proto string, prior func(key string) string,
+) forwardingHeaders {
+	hdrs := forwardingHeaders{
+		xForwardedHost:  host,
+		xForwardedProto: proto,
+		forwarded:       forwardedElement(peer, host, proto),
+	}
+	if peer.IsValid() {
+		hdrs.xForwardedFor = peer.String()
+	}
+
+	if !trusted.Contains(peer) {
+		return hdrs
+	}
+
+	if xff := prior(headerXForwardedFor); xff != "" {
+		if hdrs.xForwardedFor == "" {
+			hdrs.xForwardedFor = xff
+		} else {
+			hdrs.xForwardedFor = xff + ", " + hdrs.xForwardedFor
+		}
+	}
+	if xfh := prior(headerXForwardedHost); xfh != "" {
+		hdrs.xForwardedHost = xfh
+	}
+	if xfp := prior(headerXForwardedProto); xfp != "" {
+		hdrs.xForwardedProto = xfp
+	}
+	if fwd := prior(headerForwarded); fwd != "" {
+		hdrs.forwarded = fwd + ", " + hdrs.forwarded
+	}
+
+	return hdrs
+}
+
+func (f forwardingHeaders) applyHTTP(header http.Header) {
+	setOrDelete := func(key, value string) {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+
+	setOrDelete(headerXForwardedFor, f.xForwardedFor)
+	setOrDelete(headerXForwardedHost, f.xForwardedHost)
+	setOrDelete(headerXForwardedProto, f.xForwardedProto)
+	setOrDelete(headerForwarded, f.forwarded)
+}
+
+func (f forwardingHeaders) applyFastHTTP(header *fasthttp.RequestHeader) {
+	setOrDelete := func(key, value string) {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+
+	setOrDelete(headerXForwardedFor, f.xForwardedFor)
+	setOrDelete(headerXForwardedHost, f.xForwardedHost)
+	setOrDelete(headerXForwardedProto, f.xForwardedProto)
+	setOrDelete(headerForwarded, f.forwarded)
+}
+
+// clientIPHTTP returns the address of the original client of a net/http
+// request, see realip.TrustedProxies.ClientIP.
+func clientIPHTTP(r *http.Request, trusted realip.TrustedProxies) netip.Addr {
+	return trusted.ClientIP(realip.AddrFromRemote(r.RemoteAddr),
+		strings.Join(r.Header.Values(headerXForwardedFor), ", "))
+}
+
+// clientIPFastHTTP returns the address of the original client of a fasthttp
+// request, see realip.TrustedProxies.ClientIP.
+func clientIPFastHTTP(ctx *fasthttp.RequestCtx, trusted realip.TrustedProxies) netip.Addr {
+	values := ctx.Request.Header.PeekAll(headerXForwardedFor)
+	xff := make([]string, 0, len(values))
+	for _, value := range values {
+		xff = append(xff, string(value))
+	}
+
+	return trusted.ClientIP(realip.AddrFromIP(ctx.RemoteIP()), strings.Join(xff, ", "))
+}
+
+// forwardedElement builds a single RFC 7239 forwarded-element.
+func forwardedElement(peer netip.Addr, host, proto string) string {
+	node := "unknown"
+	if peer.IsValid() {
+		node = peer.String()
+		if peer.Is6() {
+			node = `"[` + node + `]"`
+		}
+	}
+
+	elem := "for=" + node
+	if host != "" {
+		elem += ";host=" + quoteForwarded(host)
+	}
+	if proto != "" {
+		elem += ";proto=" + proto
+	}
+
+	return elem
+}
+
+// quoteForwarded quotes a forwarded-pair value unless it is a valid token.
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		}
+	}
+
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// hopHeader is implemented by both fasthttp request and response headers.
+type hopHeader interface {
+	Peek(key string) []byte
+	Del(key string)
+}
+
+// removeHopHeadersFastHTTP strips hop-by-hop headers, including the ones
+// named in the Connection header, mirroring httputil.ReverseProxy.
+func removeHopHeadersFastHTTP(header hopHeader) {
+	for _, name := range strings.Split(string(header.Peek("Connection")), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			header.Del(name)
+		}
+	}
+
+	keepTrailers := hasToken(string(header.Peek("Te")), "trailers")
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	if keepTrailers {
+		if req, ok := header.(*fasthttp.RequestHeader); ok {
+			req.Set("Te", "trailers")
+		}
+	}
+}
+
+// hasToken reports whether a comma separated header value contains token.
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ezex-io/proxier/internal/geoip"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	headerGeoCountry = "X-Geo-Country"
+	headerGeoASN     = "X-Geo-ASN"
+)
+
+// geoHeaders returns the values of the geo headers for a record, empty when
+// unknown.
+func geoHeaders(record geoip.Record) (country, asn string) {
+	if record.ASN != 0 {
+		asn = strconv.FormatUint(uint64(record.ASN), 10)
+	}
+
+	return record.Country, asn
+}
+
+// geoHeadersHTTP replaces the geo headers of net/http requests with the
+// values looked up for the client, so that clients cannot set them.
+func geoHeadersHTTP(opt *options, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		country, asn := geoHeaders(opt.geoIP.Lookup(clientIPHTTP(r, opt.trustedProxies)))
+
+		r.Header.Del(headerGeoCountry)
+		r.Header.Del(headerGeoASN)
+		if country != "" {
+			r.Header.Set(headerGeoCountry, country)
+		}
+		if asn != "" {
+			r.Header.Set(headerGeoASN, asn)
+		}
+
+		next(w, r)
+	}
+}
+
+// geoHeadersFastHTTP replaces the geo headers of fasthttp requests, like
+// geoHeadersHTTP.
+func geoHeadersFastHTTP(opt *options, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		country, asn := geoHeaders(opt.geoIP.Lookup(clientIPFastHTTP(ctx, opt.trustedProxies)))
+
+		header := &ctx.Request.Header
+		header.Del(headerGeoCountry)
+		header.Del(headerGeoASN)
+		if country != "" {
+			header.Set(headerGeoCountry, country)
+		}
+		if asn != "" {
+			header.Set(headerGeoASN, asn)
+		}
+
+		next(ctx)
+	}
+}
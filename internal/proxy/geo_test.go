@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ezex-io/proxier/internal/geoip"
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openGeoIP writes a GeoIP database with a country and an AS number per
+// network and opens it.
+func openGeoIP(t *testing.T, networks map[string]geoip.Record) *geoip.DB {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "Test", IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.NoError(t, tree.Insert(network, mmdbtype.Map{
+			"country":                  mmdbtype.Map{"iso_code": mmdbtype.String(record.Country)},
+			"autonomous_system_number": mmdbtype.Uint32(record.ASN),
+		}))
+	}
+
+	path := filepath.Join(t.TempDir(), "geo.mmdb")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = tree.WriteTo(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	db, err := geoip.Open(geoip.Config{Databases: []string{path}})
+	require.NoError(t, err)
+
+	return db
+}
+
+func TestGeoIP_Backends(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Geo-Country")+"/"+r.Header.Get("X-Geo-ASN"))
+	}))
+	defer upstream.Close()
+
+	db := openGeoIP(t, map[string]geoip.Record{
+		"192.0.2.0/24":    {Country: "DE", ASN: 64500},
+		"198.51.100.0/24": {Country: "FR", ASN: 64501},
+		"203.0.113.0/24":  {Country: "DE", ASN: 64666},
+	})
+	trusted, err := realip.ParseTrustedProxies([]string{"127.0.0.1", "::1"})
+	require.NoError(t, err)
+	opts := []Option{
+		WithTrustedProxies(trusted),
+		WithGeoIP(db),
+		WithGeoHeaders(),
+		WithIPAccess(IPAccess{AllowCountries: []string{"DE"}, DenyASNs: []uint{64666}}),
+	}
+
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, opts...) {
+		t.Run(name, func(t *testing.T) {
+			get := func(client string) (int, string) {
+				req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxyURL+"/stream/item", nil)
+				require.NoError(t, err)
+				req.Header.Set("X-Forwarded-For", client)
+				req.Header.Set("X-Geo-Country", "US")
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				return resp.StatusCode, string(body)
+			}
+
+			status, body := get("192.0.2.1")
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, "DE/64500", body)
+
+			// Another country, a denied AS and an unknown address.
+			for _, client := range []string{"198.51.100.1", "203.0.113.1", "10.0.0.1"} {
+				status, _ = get(client)
+				assert.Equal(t, http.StatusForbidden, status, client)
+			}
+		})
+	}
+}
+
+func TestGeoHeaders_Unknown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Geo-Country")+"/"+r.Header.Get("X-Geo-ASN"))
+	}))
+	defer upstream.Close()
+
+	db := openGeoIP(t, map[string]geoip.Record{"192.0.2.0/24": {Country: "DE", ASN: 64500}})
+
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithGeoIP(db), WithGeoHeaders()) {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxyURL+"/stream/item", nil)
+			require.NoError(t, err)
+			// Not trusted: the client is the loopback peer, which is unknown,
+			// and the headers it sent are dropped.
+			req.Header.Set("X-Forwarded-For", "192.0.2.1")
+			req.Header.Set("X-Geo-Country", "US")
+			req.Header.Set("X-Geo-ASN", "1")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "/", string(body))
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	grpcOK               = 0
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+const grpcMaxMessageSize = 4 << 20
+
+var errGRPCMessageTooLarge = errors.New("grpc message exceeds limit")
+
+// GRPCHandler proxies gRPC calls for a service or method prefix. Paths are
+// forwarded unchanged, responses are flushed as they arrive so streaming
+// calls work, and failures are reported as gRPC statuses.
+func GRPCHandler(endpoint string, destination string, opts ...Option) (string, http.HandlerFunc, error) {
+	targetURL, socket, err := spec.ParseDestination(destination)
+	if err != nil {
+		return "", nil, err
+	}
+
+	opt := newOptions(opts)
+	protocol := opt.protocol
+	if protocol == ProtocolAuto || protocol == ProtocolHTTP1 {
+		protocol = ProtocolH2C
+		if targetURL.Scheme == "https" {
+			protocol = ProtocolH2
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport:     newTransport(protocol, upstreamDialer{socket: socket, proxyProtocol: opt.proxyProtocol}),
+		FlushInterval: -1,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = targetURL.Scheme
+			pr.Out.URL.Host = targetURL.Host
+			pr.Out.URL.Path = strings.TrimSuffix(targetURL.Path, "/") + pr.In.URL.Path
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = opt.upstreamHost(pr.In.Host, targetURL.Host)
+			if opt.proxyProtocol > 0 {
+				pr.Out = withRequestAddrs(pr.Out)
+			}
+
+			proto := "http"
+			if pr.In.TLS != nil {
+				proto = "https"
+			}
+			newForwardingHeaders(opt.trustedProxies, realip.AddrFromRemote(pr.In.RemoteAddr),
+				pr.In.Host, proto, func(key string) string {
+					return strings.Join(pr.In.Header.Values(key), ", ")
+				}).applyHTTP(pr.Out.Header)
+
+			log.Printf("[Proxy] gRPC %s -> %s", pr.In.URL.Path, targetURL.String())
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if slot := slotFromContext(resp.Request.Context()); slot != nil {
+				slot.respond(resp.StatusCode)
+			}
+			if resp.StatusCode == http.StatusOK && isGRPCContentType(resp.Header.Get("Content-Type")) {
+				return nil
+			}
+
+			code := grpcCodeFromHTTP(resp.StatusCode)
+			message := fmt.Sprintf("upstream returned HTTP %d", resp.StatusCode)
+			_ = resp.Body.Close()
+			setTrailersOnly(resp, code, message)
+
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[Proxy] gRPC error for %s: %v", r.URL.Path, err)
+			writeGRPCError(w, grpcUnavailable, err.Error())
+		},
+	}
+
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		if opt.health != nil && !opt.health.Healthy() {
+			writeGRPCError(w, grpcUnavailable, "upstream is not serving")
+
+			return
+		}
+
+		// Streaming calls may outlive the server read and write timeouts.
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+
+		proxy.ServeHTTP(w, r)
+	}
+
+	if opt.geoHeaders && opt.geoIP != nil {
+		serve = geoHeadersHTTP(opt, serve)
+	}
+	if opt.concurrency != nil {
+		serve = concurrencyHTTP(opt, serve)
+	}
+
+	var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+		if web := opt.grpcWeb; web != nil {
+			if r.Method == http.MethodOptions {
+				web.servePreflight(w, r)
+
+				return
+			}
+			if grpcType, text, ok := grpcWebMode(r.Header.Get("Content-Type")); ok {
+				web.serveGRPCWeb(w, r, grpcType, text, http.HandlerFunc(serve))
+
+				return
+			}
+		}
+
+		if !isGRPCContentType(r.Header.Get("Content-Type")) {
+			writeGRPCError(w, grpcInternal, "invalid gRPC content-type")
+
+			return
+		}
+		if r.ProtoMajor != 2 {
+			writeGRPCError(w, grpcInternal, "gRPC requires HTTP/2")
+
+			return
+		}
+
+		serve(w, r)
+	}
+	if opt.auth != nil {
+		handler = authHTTP(opt, handler)
+	}
+	if len(opt.rateLimits) > 0 {
+		handler = rateLimitHTTP(opt, handler)
+	}
+	if len(opt.ipAccess) > 0 {
+		handler = accessHTTP(opt, handler)
+	}
+
+	return endpoint, handler, nil
+}
+
+func isGRPCContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// grpcCodeFromHTTP maps HTTP statuses to gRPC codes as described in
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md.
+func grpcCodeFromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// writeGRPCError writes a trailers-only gRPC response.
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// setTrailersOnly replaces an upstream response by a trailers-only gRPC
+// response with the given status.
+func setTrailersOnly(resp *http.Response, code int, message string) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", encodeGRPCMessage(message))
+
+	resp.StatusCode = http.StatusOK
+	resp.Status = http.StatusText(http.StatusOK)
+	resp.Header = header
+	resp.Trailer = nil
+	resp.ContentLength = 0
+	resp.Body = http.NoBody
+}
+
+// encodeGRPCMessage percent-encodes a grpc-message value.
+func encodeGRPCMessage(message string) string {
+	var builder strings.Builder
+	for i := range len(message) {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+
+	return builder.String()
+}
+
+// grpcFrame prefixes a message with the gRPC length-prefixed framing.
+func grpcFrame(flags byte, msg []byte) []byte {
+	frame := make([]byte, 5+len(msg))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+
+	return frame
+}
+
+// readGRPCFrame reads one length-prefixed gRPC frame.
+func readGRPCFrame(r io.Reader) (byte, []byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:5])
+	if size > grpcMaxMessageSize {
+		return 0, nil, errGRPCMessageTooLarge
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+
+	return prefix[0], msg, nil
+}
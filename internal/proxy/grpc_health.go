@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+const grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+// servingStatusServing is HealthCheckResponse.SERVING in grpc.health.v1.
+const servingStatusServing = 1
+
+var upstreamHealthy = metrics.Default.GaugeVec("proxier_upstream_healthy",
+	"Whether the destination passed its last active health check.")
+
+// GRPCHealthCheck configures active checks using the gRPC health checking
+// protocol (grpc.health.v1.Health/Check).
+type GRPCHealthCheck struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Service is the service name sent in the check, empty for the server.
+	Service string
+	// ProxyProtocol sends a PROXY protocol header of this version on check
+	// connections; zero sends none.
+	ProxyProtocol int
+}
+
+// GRPCHealthChecker periodically checks a gRPC destination. Until the first
+// check completes the destination is assumed to be healthy.
+type GRPCHealthChecker struct {
+	endpoint  string
+	targetURL *url.URL
+	check     GRPCHealthCheck
+	client    *http.Client
+	healthy   atomic.Bool
+	gauge     *metrics.Gauge
+}
+
+func NewGRPCHealthChecker(endpoint, destination string, check GRPCHealthCheck,
+	protocol UpstreamProtocol,
+) (*GRPCHealthChecker, error) {
+	targetURL, socket, err := spec.ParseDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if protocol == ProtocolAuto || protocol == ProtocolHTTP1 {
+		protocol = ProtocolH2C
+		if targetURL.Scheme == "https" {
+			protocol = ProtocolH2
+		}
+	}
+
+	dialer := upstreamDialer{socket: socket, proxyProtocol: check.ProxyProtocol}
+	checker := &GRPCHealthChecker{
+		endpoint:  endpoint,
+		targetURL: targetURL,
+		check:     check,
+		client:    &http.Client{Transport: newTransport(protocol, dialer)},
+		gauge:     upstreamHealthy.With(metrics.Labels{"endpoint": endpoint}),
+	}
+	checker.setHealthy(true)
+
+	return checker, nil
+}
+
+// Healthy reports the result of the last check.
+func (c *GRPCHealthChecker) Healthy() bool {
+	return c.healthy.Load()
+}
+
+// Run checks the destination every interval until ctx is done.
+func (c *GRPCHealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.check.Interval)
+	defer ticker.Stop()
+
+	for {
+		c.runCheck(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *GRPCHealthChecker) runCheck(ctx context.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx, c.check.Timeout)
+	defer cancel()
+
+	err := c.Check(checkCtx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	healthy := err == nil
+	if healthy != c.Healthy() {
+		if healthy {
+			log.Printf("[Proxy] gRPC upstream for %s is serving", c.endpoint)
+		} else {
+			log.Printf("[Proxy] gRPC upstream for %s is not serving: %v", c.endpoint, err)
+		}
+	}
+	c.setHealthy(healthy)
+}
+
+func (c *GRPCHealthChecker) setHealthy(healthy bool) {
+	c.healthy.Store(healthy)
+	if healthy {
+		c.gauge.Set(1)
+	} else {
+		c.gauge.Set(0)
+	}
+}
+
+// Check performs a single health check call.
+func (c *GRPCHealthChecker) Check(ctx context.Context) error {
+	checkURL := *c.targetURL
+	checkURL.Path = strings.TrimSuffix(checkURL.Path, "/") + grpcHealthCheckPath
+
+	body := grpcFrame(0, encodeHealthCheckRequest(c.check.Service))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, checkURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned HTTP %d", resp.StatusCode)
+	}
+
+	_, msg, frameErr := readGRPCFrame(resp.Body)
+	if frameErr != nil && !errors.Is(frameErr, io.EOF) {
+		return frameErr
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return fmt.Errorf("health check failed with grpc-status %s", status)
+	}
+
+	serving, err := decodeHealthCheckResponse(msg)
+	if err != nil {
+		return err
+	}
+	if serving != servingStatusServing {
+		return fmt.Errorf("health check status is %d", serving)
+	}
+
+	return nil
+}
+
+// encodeHealthCheckRequest encodes HealthCheckRequest{service = 1}.
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+
+	msg := []byte{0x0a}
+	msg = binary.AppendUvarint(msg, uint64(len(service)))
+
+	return append(msg, service...)
+}
+
+// decodeHealthCheckResponse decodes the status field (1) of a
+// HealthCheckResponse, skipping unknown fields.
+func decodeHealthCheckResponse(msg []byte) (uint64, error) {
+	var status uint64
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("malformed health check response")
+		}
+		msg = msg[n:]
+
+		switch tag & 0x7 {
+		case 0: // varint
+			val, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[n:]
+			if tag>>3 == 1 {
+				status = val
+			}
+		case 2: // length-delimited
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[n+int(size):]
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[8:]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return 0, errors.New("malformed health check response")
+			}
+			msg = msg[4:]
+		default:
+			return 0, errors.New("malformed health check response")
+		}
+	}
+
+	return status, nil
+}
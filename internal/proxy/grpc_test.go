@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newH2CServer starts a test server accepting HTTP/2 over cleartext.
+func newH2CServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func h2cClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+// newGRPCUpstream echoes every frame of /echo.Echo/* calls and implements
+// the health checking protocol, reporting serving while serving is true.
+func newGRPCUpstream(t *testing.T, serving *atomic.Bool) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo.Echo/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+
+		for {
+			_, msg, err := readGRPCFrame(r.Body)
+			if err != nil {
+				break
+			}
+			_, _ = w.Write(grpcFrame(0, msg))
+			_ = http.NewResponseController(w).Flush()
+		}
+
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "done")
+	})
+	mux.HandleFunc(grpcHealthCheckPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+
+		status := byte(2) // NOT_SERVING
+		if serving.Load() {
+			status = servingStatusServing
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write(grpcFrame(0, []byte{0x08, status}))
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	return newH2CServer(t, mux)
+}
+
+func TestGRPCHandler_Unary(t *testing.T) {
+	serving := &atomic.Bool{}
+	upstream := newGRPCUpstream(t, serving)
+
+	_, handler, err := GRPCHandler("/echo.Echo/", upstream.URL)
+	require.NoError(t, err)
+	proxyServer := newH2CServer(t, handler)
+
+	req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/echo.Echo/Unary",
+		bytes.NewReader(grpcFrame(0, []byte("hello"))))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := h2cClient().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	_, msg, err := readGRPCFrame(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"), "Trailers must be preserved")
+	assert.Equal(t, "done", resp.Trailer.Get("Grpc-Message"))
+}
+
+func TestGRPCHandler_Streaming(t *testing.T) {
+	serving := &atomic.Bool{}
+	upstream := newGRPCUpstream(t, serving)
+
+	_, handler, err := GRPCHandler("/echo.Echo/", upstream.URL)
+	require.NoError(t, err)
+	proxyServer := newH2CServer(t, handler)
+
+	reqBody, reqWriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/echo.Echo/Stream", reqBody)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := h2cClient().Do(req)
+		if err == nil {
+			respCh <- resp
+		}
+		close(respCh)
+	}()
+
+	_, err = reqWriter.Write(grpcFrame(0, []byte("one")))
+	require.NoError(t, err)
+
+	resp := <-respCh
+	require.NotNil(t, resp)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// Each message is echoed before the client finishes sending.
+	for _, want := range []string{"one", "two"} {
+		if want != "one" {
+			_, err = reqWriter.Write(grpcFrame(0, []byte(want)))
+			require.NoError(t, err)
+		}
+
+		_, msg, err := readGRPCFrame(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(msg))
+	}
+
+	require.NoError(t, reqWriter.Close())
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestGRPCHandler_ErrorMapping(t *testing.T) {
+	notFound := newH2CServer(t, http.NotFoundHandler())
+
+	tests := []struct {
+		name        string
+		destination string
+		want        string
+	}{
+		{"unreachable upstream", "http://127.0.0.1:9999", "14"},
+		{"non-gRPC upstream response", notFound.URL, "12"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, handler, err := GRPCHandler("/echo.Echo/", tt.destination)
+			require.NoError(t, err)
+			proxyServer := newH2CServer(t, handler)
+
+			req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/echo.Echo/Unary",
+				bytes.NewReader(grpcFrame(0, nil)))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/grpc")
+
+			resp, err := h2cClient().Do(req)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+			assert.Equal(t, tt.want, resp.Header.Get("Grpc-Status"))
+		})
+	}
+}
+
+func TestGRPCHealthChecker(t *testing.T) {
+	serving := &atomic.Bool{}
+	upstream := newGRPCUpstream(t, serving)
+
+	checker, err := NewGRPCHealthChecker("/echo.Echo/", upstream.URL, GRPCHealthCheck{
+		Interval: 10 * time.Millisecond,
+		Timeout:  time.Second,
+		Service:  "echo.Echo",
+	}, ProtocolAuto)
+	require.NoError(t, err)
+	assert.True(t, checker.Healthy(), "Destinations are healthy until checked")
+
+	assert.Error(t, checker.Check(context.Background()))
+	serving.Store(true)
+	assert.NoError(t, checker.Check(context.Background()))
+
+	_, handler, err := GRPCHandler("/echo.Echo/", upstream.URL, WithHealthChecker(checker))
+	require.NoError(t, err)
+	proxyServer := newH2CServer(t, handler)
+
+	serving.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checker.Run(ctx)
+
+	require.Eventually(t, func() bool { return !checker.Healthy() }, 2*time.Second, 10*time.Millisecond)
+
+	req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/echo.Echo/Unary",
+		bytes.NewReader(grpcFrame(0, nil)))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := h2cClient().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	assert.Equal(t, "14", resp.Header.Get("Grpc-Status"))
+}
+
+func TestDecodeHealthCheckResponse(t *testing.T) {
+	status, err := decodeHealthCheckResponse([]byte{0x12, 0x02, 'h', 'i', 0x08, 0x01})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), status)
+
+	_, err = decodeHealthCheckResponse([]byte{0x12, 0x05, 'h'})
+	assert.Error(t, err)
+
+	assert.Equal(t, []byte{0x0a, 0x03, 'a', '.', 'B'}, encodeHealthCheckRequest("a.B"))
+	assert.Empty(t, encodeHealthCheckRequest(""))
+}
@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const grpcWebTrailerFlag = 0x80
+
+// defaultGRPCWebHeaders are allowed in CORS preflight requests when the
+// browser does not list the headers it intends to send.
+const defaultGRPCWebHeaders = "content-type, x-grpc-web, x-user-agent, grpc-timeout, authorization"
+
+// GRPCWeb configures the translation of gRPC-Web requests to native gRPC.
+type GRPCWeb struct {
+	// AllowedOrigins are the CORS origins allowed to call the route. "*"
+	// allows any origin.
+	AllowedOrigins []string
+}
+
+// grpcWebMode returns the native gRPC content type for a gRPC-Web request and
+// whether the request uses the base64 text mode.
+func grpcWebMode(contentType string) (string, bool, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false, false
+	}
+
+	switch {
+	case mediaType == "application/grpc-web-text" || strings.HasPrefix(mediaType, "application/grpc-web-text+"):
+		return "application/grpc" + strings.TrimPrefix(mediaType, "application/grpc-web-text"), true, true
+	case mediaType == "application/grpc-web" || strings.HasPrefix(mediaType, "application/grpc-web+"):
+		return "application/grpc" + strings.TrimPrefix(mediaType, "application/grpc-web"), false, true
+	default:
+		return "", false, false
+	}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or an
+// empty string when the origin is not allowed.
+func (g *GRPCWeb) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range g.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// servePreflight answers a CORS preflight request.
+func (g *GRPCWeb) servePreflight(w http.ResponseWriter, r *http.Request) {
+	origin := g.allowOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		w.WriteHeader(http.StatusForbidden)
+
+		return
+	}
+
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if headers == "" {
+		headers = defaultGRPCWebHeaders
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", headers)
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.Header().Add("Vary", "Origin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveGRPCWeb translates a gRPC-Web call into a native gRPC call handled by
+// next, and converts the response and its trailers back.
+func (g *GRPCWeb) serveGRPCWeb(w http.ResponseWriter, r *http.Request, grpcType string, text bool,
+	next http.Handler,
+) {
+	if origin := g.allowOrigin(r.Header.Get("Origin")); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+		w.Header().Add("Vary", "Origin")
+	}
+
+	webType := r.Header.Get("Content-Type")
+	outReq := r.Clone(r.Context())
+	outReq.Header.Set("Content-Type", grpcType)
+	outReq.Header.Set("Te", "trailers")
+	outReq.Header.Del("X-Grpc-Web")
+	if text {
+		outReq.Body = io.NopCloser(&base64GroupReader{r: r.Body})
+		outReq.ContentLength = -1
+		outReq.Header.Del("Content-Length")
+	}
+
+	gw := &grpcWebResponseWriter{w: w, header: make(http.Header), contentType: webType, text: text}
+	if text {
+		gw.encoder = base64.NewEncoder(base64.StdEncoding, w)
+	}
+
+	next.ServeHTTP(gw, outReq)
+	gw.finish()
+}
+
+// grpcWebResponseWriter rewrites a native gRPC response into gRPC-Web.
+// Trailers are collected and sent as a final length-prefixed frame.
+type grpcWebResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	contentType string
+	wroteHeader bool
+	wroteBody   bool
+
+	// In text mode, encoder is replaced at the end of every message, so
+	// that its base64 is padded and sent without waiting for the next one.
+	text    bool
+	encoder io.WriteCloser
+	// prefix holds the part of the frame prefix read so far, and remaining
+	// the bytes of the current message still to come.
+	prefix    []byte
+	remaining int
+}
+
+func (gw *grpcWebResponseWriter) Header() http.Header {
+	return gw.header
+}
+
+func (gw *grpcWebResponseWriter) WriteHeader(status int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+
+	dst := gw.w.Header()
+	for key, values := range gw.header {
+		if key == "Trailer" || strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		dst[key] = slices.Clone(values)
+	}
+	dst.Set("Content-Type", gw.contentType)
+	dst.Del("Content-Length")
+
+	gw.w.WriteHeader(status)
+}
+
+func (gw *grpcWebResponseWriter) Write(p []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	gw.wroteBody = true
+
+	if gw.text {
+		return gw.writeText(p)
+	}
+
+	return gw.w.Write(p)
+}
+
+// writeText encodes p, padding and flushing the output at the end of every
+// message.
+func (gw *grpcWebResponseWriter) writeText(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if gw.remaining > 0 {
+			n = min(n, gw.remaining)
+			gw.remaining -= n
+		} else {
+			n = min(n, 5-len(gw.prefix))
+			gw.prefix = append(gw.prefix, p[:n]...)
+		}
+
+		if _, err := gw.encoder.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+
+		if len(gw.prefix) == 5 {
+			gw.remaining = int(binary.BigEndian.Uint32(gw.prefix[1:]))
+			gw.prefix = gw.prefix[:0]
+			if gw.remaining > 0 {
+				continue
+			}
+		}
+		if gw.remaining == 0 && len(gw.prefix) == 0 {
+			if err := gw.encoder.Close(); err != nil {
+				return written, err
+			}
+			gw.encoder = base64.NewEncoder(base64.StdEncoding, gw.w)
+			gw.Flush()
+		}
+	}
+
+	return written, nil
+}
+
+func (gw *grpcWebResponseWriter) Flush() {
+	_ = http.NewResponseController(gw.w).Flush()
+}
+
+func (gw *grpcWebResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.w
+}
+
+// finish writes the trailer frame. Trailers-only responses already carry
+// the status in their headers and are left untouched.
+func (gw *grpcWebResponseWriter) finish() {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+
+	trailers := gw.trailers()
+	if !gw.wroteBody && gw.w.Header().Get("Grpc-Status") != "" && len(trailers) == 0 {
+		return
+	}
+
+	var block bytes.Buffer
+	keys := make([]string, 0, len(trailers))
+	for key := range trailers {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		for _, value := range trailers[key] {
+			block.WriteString(strings.ToLower(key) + ": " + value + "\r\n")
+		}
+	}
+
+	frame := grpcFrame(grpcWebTrailerFlag, block.Bytes())
+	if gw.text {
+		_, _ = gw.writeText(frame)
+		// Pads the rest of a message the handler did not finish.
+		_ = gw.encoder.Close()
+	} else {
+		_, _ = gw.w.Write(frame)
+	}
+	gw.Flush()
+}
+
+// trailers returns the trailers set by the handler, either announced through
+// the Trailer header or set with http.TrailerPrefix.
+func (gw *grpcWebResponseWriter) trailers() http.Header {
+	trailers := make(http.Header)
+
+	for _, announced := range gw.header.Values("Trailer") {
+		for _, key := range strings.Split(announced, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values := gw.header.Values(key); len(values) > 0 {
+				trailers[key] = values
+			}
+		}
+	}
+	for key, values := range gw.header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(key, http.TrailerPrefix))] = values
+		}
+	}
+
+	return trailers
+}
+
+// base64GroupReader decodes base64 text where every chunk may carry its own
+// padding, as sent by gRPC-Web text clients.
+type base64GroupReader struct {
+	r       io.Reader
+	pending []byte
+	decoded []byte
+	err     error
+}
+
+func (b *base64GroupReader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			if len(b.pending) > 0 && b.err == io.EOF {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			return 0, b.err
+		}
+
+		buf := make([]byte, 4096)
+		n, err := b.r.Read(buf)
+		b.err = err
+		for _, c := range buf[:n] {
+			if c != '\r' && c != '\n' {
+				b.pending = append(b.pending, c)
+			}
+		}
+
+		for len(b.pending) >= 4 {
+			group := make([]byte, 3)
+			decodedLen, decodeErr := base64.StdEncoding.Decode(group, b.pending[:4])
+			if decodeErr != nil {
+				b.err = decodeErr
+
+				break
+			}
+			b.decoded = append(b.decoded, group[:decodedLen]...)
+			b.pending = b.pending[4:]
+		}
+	}
+
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+
+	return n, nil
+}
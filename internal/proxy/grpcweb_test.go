@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGRPCWebProxy(t *testing.T) string {
+	t.Helper()
+
+	upstream := newGRPCUpstream(t, &atomic.Bool{})
+	_, handler, err := GRPCHandler("/echo.Echo/", upstream.URL,
+		WithGRPCWeb(GRPCWeb{AllowedOrigins: []string{"https://app.test"}}))
+	require.NoError(t, err)
+
+	// gRPC-Web clients use HTTP/1.1.
+	proxyServer := httptest.NewServer(handler)
+	t.Cleanup(proxyServer.Close)
+
+	return proxyServer.URL
+}
+
+func readGRPCWebFrames(t *testing.T, body io.Reader) (string, string) {
+	t.Helper()
+
+	_, msg, err := readGRPCFrame(body)
+	require.NoError(t, err)
+
+	flags, trailer, err := readGRPCFrame(body)
+	require.NoError(t, err)
+	assert.Equal(t, byte(grpcWebTrailerFlag), flags)
+
+	return string(msg), string(trailer)
+}
+
+func TestGRPCWeb_Binary(t *testing.T) {
+	proxyURL := newGRPCWebProxy(t)
+
+	req, err := http.NewRequest(http.MethodPost, proxyURL+"/echo.Echo/Unary",
+		bytes.NewReader(grpcFrame(0, []byte("hello"))))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("Origin", "https://app.test")
+	req.Header.Set("X-Grpc-Web", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/grpc-web+proto", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "https://app.test", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "grpc-status")
+
+	msg, trailer := readGRPCWebFrames(t, resp.Body)
+	assert.Equal(t, "hello", msg)
+	assert.Equal(t, "grpc-message: done\r\ngrpc-status: 0\r\n", trailer)
+}
+
+func TestGRPCWeb_Text(t *testing.T) {
+	proxyURL := newGRPCWebProxy(t)
+
+	// Each message is encoded, and padded, on its own.
+	body := base64.StdEncoding.EncodeToString(grpcFrame(0, []byte("hi"))) +
+		base64.StdEncoding.EncodeToString(grpcFrame(0, []byte("there")))
+
+	req, err := http.NewRequest(http.MethodPost, proxyURL+"/echo.Echo/Stream", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc-web-text")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, "application/grpc-web-text", resp.Header.Get("Content-Type"))
+
+	// Each message is padded on its own in the response too.
+	decoded, err := io.ReadAll(&base64GroupReader{r: resp.Body})
+	require.NoError(t, err)
+
+	reader := bytes.NewReader(decoded)
+	_, first, err := readGRPCFrame(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(first))
+
+	msg, trailer := readGRPCWebFrames(t, reader)
+	assert.Equal(t, "there", msg)
+	assert.Contains(t, trailer, "grpc-status: 0")
+}
+
+func TestGRPCWeb_TextMessageBoundaries(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	gw := &grpcWebResponseWriter{
+		w: recorder, header: make(http.Header), contentType: "application/grpc-web-text", text: true,
+		encoder: base64.NewEncoder(base64.StdEncoding, recorder),
+	}
+
+	// A message split across writes is sent, padded, once complete.
+	first := grpcFrame(0, []byte("hello"))
+	_, err := gw.Write(first[:4])
+	require.NoError(t, err)
+	assert.False(t, recorder.Flushed)
+
+	_, err = gw.Write(first[4:])
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(first), recorder.Body.String())
+	assert.True(t, recorder.Flushed)
+
+	// Several messages in one write are padded one by one.
+	recorder.Body.Reset()
+	second, empty := grpcFrame(0, []byte("hi")), grpcFrame(0, nil)
+	_, err = gw.Write(append(slices.Clone(second), empty...))
+	require.NoError(t, err)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(second)+base64.StdEncoding.EncodeToString(empty),
+		recorder.Body.String())
+}
+
+func TestGRPCWeb_Preflight(t *testing.T) {
+	proxyURL := newGRPCWebProxy(t)
+
+	tests := []struct {
+		origin     string
+		wantStatus int
+	}{
+		{"https://app.test", http.StatusNoContent},
+		{"https://evil.test", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodOptions, proxyURL+"/echo.Echo/Unary", http.NoBody)
+			require.NoError(t, err)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantStatus == http.StatusNoContent {
+				assert.Equal(t, tt.origin, resp.Header.Get("Access-Control-Allow-Origin"))
+				assert.Equal(t, "content-type,x-grpc-web", resp.Header.Get("Access-Control-Allow-Headers"))
+				assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), "POST")
+			}
+		})
+	}
+}
+
+func TestGRPCWeb_UnreachableUpstream(t *testing.T) {
+	_, handler, err := GRPCHandler("/echo.Echo/", "http://127.0.0.1:9999", WithGRPCWeb(GRPCWeb{}))
+	require.NoError(t, err)
+	proxyServer := httptest.NewServer(handler)
+	defer proxyServer.Close()
+
+	resp, err := http.Post(proxyServer.URL+"/echo.Echo/Unary", "application/grpc-web",
+		bytes.NewReader(grpcFrame(0, nil)))
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, "application/grpc-web", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "14", resp.Header.Get("Grpc-Status"))
+}
+
+func TestGRPCWebMode(t *testing.T) {
+	tests := []struct {
+		contentType string
+		wantType    string
+		wantText    bool
+		wantOK      bool
+	}{
+		{"application/grpc-web", "application/grpc", false, true},
+		{"application/grpc-web+proto", "application/grpc+proto", false, true},
+		{"application/grpc-web-text", "application/grpc", true, true},
+		{"application/grpc-web-text+proto", "application/grpc+proto", true, true},
+		{"application/grpc", "", false, false},
+		{"application/json", "", false, false},
+	}
+
+	for _, tt := range tests {
+		gotType, gotText, gotOK := grpcWebMode(tt.contentType)
+		assert.Equal(t, tt.wantType, gotType, tt.contentType)
+		assert.Equal(t, tt.wantText, gotText, tt.contentType)
+		assert.Equal(t, tt.wantOK, gotOK, tt.contentType)
+	}
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/ezex-io/proxier/internal/geoip"
+	"github.com/ezex-io/proxier/internal/ratelimit"
+	"github.com/ezex-io/proxier/internal/realip"
+)
+
+// Option configures optional behavior of a proxy handler.
+type Option func(*options)
+
+type options struct {
+	trustedProxies realip.TrustedProxies
+	preserveHost   bool
+	customHost     string
+	upgradeLimits  UpgradeLimits
+	flushInterval  time.Duration
+	maxBufferSize  int
+	writeTimeout   time.Duration
+	longLived      bool
+	protocol       UpstreamProtocol
+	health         healthReporter
+	grpcWeb        *GRPCWeb
+	proxyProtocol  int
+	fastCGI        FastCGI
+	cache          *cache.Cache
+	purgeSources   realip.Prefixes
+	coalescing     *Coalescing
+	compressor     *compressor
+	rateLimits     []*ratelimit.Limiter
+	concurrency    *concurrencyLimiter
+	ipAccess       []IPAccess
+	geoIP          *geoip.DB
+	geoHeaders     bool
+	auth           *auth.Authenticator
+	identityHeader string
+	baseContext    context.Context
+}
+
+// healthReporter reports the state of active health checks.
+type healthReporter interface {
+	Healthy() bool
+}
+
+func newOptions(opts []Option) *options {
+	opt := &options{
+		maxBufferSize: defaultMaxBufferSize,
+		baseContext:   context.Background(),
+	}
+	for _, apply := range opts {
+		apply(opt)
+	}
+
+	return opt
+}
+
+// WithTrustedProxies sets the networks whose forwarding headers are appended to
+// instead of being replaced.
+func WithTrustedProxies(trusted realip.TrustedProxies) Option {
+	return func(opt *options) {
+		opt.trustedProxies = trusted
+	}
+}
+
+// WithPreserveHost forwards the Host header received from the client instead
+// of the destination host.
+func WithPreserveHost() Option {
+	return func(opt *options) {
+		opt.preserveHost = true
+	}
+}
+
+// WithCustomHost sends a fixed Host header to the destination.
+func WithCustomHost(host string) Option {
+	return func(opt *options) {
+		opt.customHost = host
+	}
+}
+
+// WithUpgradeLimits bounds connections upgraded to another protocol, such as
+// WebSocket.
+func WithUpgradeLimits(limits UpgradeLimits) Option {
+	return func(opt *options) {
+		opt.upgradeLimits = limits
+	}
+}
+
+// WithFlushInterval sets how often response data is flushed to the client.
+// Zero leaves flushing to the server buffers and a negative value flushes
+// after every write. Server-Sent Events are always flushed immediately.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(opt *options) {
+		opt.flushInterval = interval
+	}
+}
+
+// WithMaxBufferSize sets the largest response body that is buffered in
+// memory before the fasthttp handler streams it instead.
+func WithMaxBufferSize(size int) Option {
+	return func(opt *options) {
+		if size > 0 {
+			opt.maxBufferSize = size
+		}
+	}
+}
+
+// WithWriteTimeout sets the write timeout of the server. Streamed responses
+// keep the connection as long as every write completes within it.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(opt *options) {
+		opt.writeTimeout = timeout
+	}
+}
+
+// WithLongLivedStreams lifts the write timeout for streamed responses, which
+// Server-Sent Events always do, so that clients may stop reading for longer.
+func WithLongLivedStreams() Option {
+	return func(opt *options) {
+		opt.longLived = true
+	}
+}
+
+// WithUpstreamProtocol selects the HTTP version used towards the destination.
+func WithUpstreamProtocol(protocol UpstreamProtocol) Option {
+	return func(opt *options) {
+		opt.protocol = protocol
+	}
+}
+
+// WithHealthChecker rejects requests while the checker reports the
+// destination as unhealthy.
+func WithHealthChecker(checker *GRPCHealthChecker) Option {
+	return func(opt *options) {
+		opt.health = checker
+	}
+}
+
+// WithGRPCWeb translates gRPC-Web requests on a gRPC route.
+func WithGRPCWeb(web GRPCWeb) Option {
+	return func(opt *options) {
+		opt.grpcWeb = &web
+	}
+}
+
+// WithProxyProtocol sends a PROXY protocol header of the given version on
+// every connection to the destination.
+func WithProxyProtocol(version int) Option {
+	return func(opt *options) {
+		opt.proxyProtocol = version
+	}
+}
+
+// WithFastCGI configures how requests to a fastcgi destination are mapped to
+// scripts.
+func WithFastCGI(config FastCGI) Option {
+	return func(opt *options) {
+		opt.fastCGI = config
+	}
+}
+
+// WithCache answers cacheable requests from c and stores responses in it.
+func WithCache(c *cache.Cache) Option {
+	return func(opt *options) {
+		opt.cache = c
+	}
+}
+
+// WithPurge answers PURGE requests from clients in sources by removing the
+// cached response of the request URL instead of forwarding them. It only
+// applies together with WithCache.
+func WithPurge(sources realip.Prefixes) Option {
+	return func(opt *options) {
+		opt.purgeSources = sources
+	}
+}
+
+// WithCoalescing shares the response of one request with identical requests
+// arriving while it is in flight.
+func WithCoalescing(coalescing Coalescing) Option {
+	return func(opt *options) {
+		opt.coalescing = &coalescing
+	}
+}
+
+// WithCompression compresses responses for clients accepting gzip, brotli
+// or zstd.
+func WithCompression(compression Compression) Option {
+	return func(opt *options) {
+		opt.compressor = newCompressor(compression)
+	}
+}
+
+// WithRateLimits rejects requests exceeding any of the limits with 429 Too
+// Many Requests. Responses describe the most restrictive limit in
+// RateLimit-* headers.
+func WithRateLimits(limiters ...*ratelimit.Limiter) Option {
+	return func(opt *options) {
+		opt.rateLimits = append(opt.rateLimits, limiters...)
+	}
+}
+
+// WithConcurrencyLimit bounds the requests of the route in flight to the
+// destination. Requests that find the queue full or time out waiting are
+// answered with 503 Service Unavailable.
+func WithConcurrencyLimit(endpoint string, limit ConcurrencyLimit) Option {
+	return func(opt *options) {
+		opt.concurrency = newConcurrencyLimiter(endpoint, limit)
+	}
+}
+
+// WithIPAccess rejects requests of clients outside the allow list or inside
+// the deny list with 403 Forbidden. Clients must pass every list given.
+func WithIPAccess(access IPAccess) Option {
+	return func(opt *options) {
+		opt.ipAccess = append(opt.ipAccess, access)
+	}
+}
+
+// WithGeoIP looks up clients in db for the country and ASN lists of
+// WithIPAccess and for WithGeoHeaders.
+func WithGeoIP(db *geoip.DB) Option {
+	return func(opt *options) {
+		opt.geoIP = db
+	}
+}
+
+// WithGeoHeaders sends the country and autonomous system of the client to
+// the destination in X-Geo-Country and X-Geo-ASN, replacing any sent by the
+// client. It only applies together with WithGeoIP.
+func WithGeoHeaders() Option {
+	return func(opt *options) {
+		opt.geoHeaders = true
+	}
+}
+
+// WithAuth answers requests without valid credentials of a with 401
+// Unauthorized. Credentials are removed before proxying, and the user or API
+// key name is sent in identityHeader, X-Auth-User by default.
+func WithAuth(a *auth.Authenticator, identityHeader string) Option {
+	return func(opt *options) {
+		opt.auth = a
+		opt.identityHeader = identityHeader
+		if opt.identityHeader == "" {
+			opt.identityHeader = defaultIdentityHeader
+		}
+	}
+}
+
+// upstreamHost returns the Host header to send to the destination.
+func (opt *options) upstreamHost(clientHost, destinationHost string) string {
+	switch {
+	case opt.customHost != "":
+		return opt.customHost
+	case opt.preserveHost && clientHost != "":
+		return clientHost
+	default:
+		return destinationHost
+	}
+}
+
+// WithBaseContext sets the context the upstream requests of the fasthttp
+// backend derive from, so that they are cancelled once the server stops.
+// Requests of the net/http backend use the context of the client request.
+func WithBaseContext(ctx context.Context) Option {
+	return func(opt *options) {
+		opt.baseContext = ctx
+	}
+}
@@ -1,51 +1,136 @@
 package proxy
 
 import (
-	"fmt"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
 
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/ezex-io/proxier/internal/spec"
 	"github.com/valyala/fasthttp"
 )
 
-func HTTPHandler(endpoint string, destination string) (string, http.HandlerFunc, error) {
-	targetURL, err := url.Parse(destination)
+func HTTPHandler(endpoint string, destination string, opts ...Option) (string, http.HandlerFunc, error) {
+	targetURL, socket, err := spec.ParseDestination(destination)
 	if err != nil {
-		return "", nil, fmt.Errorf("invalid destination URL %s: %w", destination, err)
+		return "", nil, err
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-
-	proxy.Director = func(r *http.Request) {
-		originalPath := r.URL.Path
-		trimmedPath := strings.TrimPrefix(originalPath, endpoint)
-
-		r.URL.Path = targetURL.Path + trimmedPath
-		r.URL.Scheme = targetURL.Scheme
-		r.URL.Host = targetURL.Host
-		r.Host = targetURL.Host
+	opt := newOptions(opts)
+	dialer := upstreamDialer{socket: socket, proxyProtocol: opt.proxyProtocol}
+	tracker := newUpgradeTracker(endpoint, opt.upgradeLimits)
+
+	proxy := &httputil.ReverseProxy{
+		Transport:     &upgradeTransport{base: newUpstreamTransport(endpoint, targetURL, dialer, opt), tracker: tracker},
+		FlushInterval: opt.flushInterval,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("[Proxy] error for %s: %v", r.URL.Path, err)
+
+			if errors.Is(err, errUpgradeLimit) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if slot := slotFromContext(resp.Request.Context()); slot != nil {
+				slot.respond(resp.StatusCode)
+			}
+			if opt.compressor != nil {
+				opt.compressor.compressHTTP(resp)
+			}
+			keepWriteDeadlineHTTP(resp, opt)
+
+			return nil
+		},
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			originalPath := pr.In.URL.Path
+			trimmedPath := strings.TrimPrefix(originalPath, endpoint)
+
+			pr.Out.URL.Path = targetURL.Path + trimmedPath
+			pr.Out.URL.RawPath = ""
+			pr.Out.URL.Scheme = targetURL.Scheme
+			pr.Out.URL.Host = targetURL.Host
+			pr.Out.Host = opt.upstreamHost(pr.In.Host, targetURL.Host)
+			if opt.proxyProtocol > 0 {
+				pr.Out = withRequestAddrs(pr.Out)
+			}
+			if opt.cache != nil {
+				pr.Out = pr.Out.WithContext(opt.cacheContext(pr.Out.Context(), pr.In.Host+pr.In.URL.RequestURI()))
+			}
+
+			proto := "http"
+			if pr.In.TLS != nil {
+				proto = "https"
+			}
+			newForwardingHeaders(opt.trustedProxies, realip.AddrFromRemote(pr.In.RemoteAddr),
+				pr.In.Host, proto, func(key string) string {
+					return strings.Join(pr.In.Header.Values(key), ", ")
+				}).applyHTTP(pr.Out.Header)
+
+			log.Printf("[Proxy] %s -> %s%s", originalPath, targetURL.String(), trimmedPath)
+		},
+	}
 
-		log.Printf("[Proxy] %s -> %s%s", originalPath, targetURL.String(), trimmedPath)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		r, dw := withDeadlineWriter(r, w)
+		proxy.ServeHTTP(dw, r)
+	}
+	if opt.geoHeaders && opt.geoIP != nil {
+		handler = geoHeadersHTTP(opt, handler)
+	}
+	if opt.concurrency != nil {
+		handler = concurrencyHTTP(opt, handler)
+	}
+	if opt.purgeEnabled() {
+		handler = purgeHTTP(opt, handler)
+	}
+	if opt.auth != nil {
+		handler = authHTTP(opt, handler)
+	}
+	if len(opt.rateLimits) > 0 {
+		handler = rateLimitHTTP(opt, handler)
+	}
+	if len(opt.ipAccess) > 0 {
+		handler = accessHTTP(opt, handler)
 	}
 
-	return endpoint, proxy.ServeHTTP, nil
+	return endpoint, handler, nil
 }
 
-func FastHTTPHandler(endpoint string, destination string) (string, fasthttp.RequestHandler, error) {
-	targetURL, err := url.Parse(destination)
+func FastHTTPHandler(endpoint string, destination string, opts ...Option) (string, fasthttp.RequestHandler, error) {
+	targetURL, socket, err := spec.ParseDestination(destination)
 	if err != nil {
-		return "", nil, fmt.Errorf("invalid destination URL %s: %w", destination, err)
+		return "", nil, err
 	}
 
+	opt := newOptions(opts)
+	dialer := upstreamDialer{socket: socket, proxyProtocol: opt.proxyProtocol}
+	tracker := newUpgradeTracker(endpoint, opt.upgradeLimits)
+
 	client := &fasthttp.HostClient{
-		Addr:  targetURL.Host,
-		IsTLS: targetURL.Scheme == "https",
+		Addr:                targetURL.Host,
+		IsTLS:               targetURL.Scheme == "https",
+		StreamResponseBody:  true,
+		MaxResponseBodySize: opt.maxBufferSize,
+	}
+	if socket != "" {
+		client.Dial = func(string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}
 	}
 
-	handler := func(ctx *fasthttp.RequestCtx) {
+	var transport http.RoundTripper
+	fastCGI := targetURL.Scheme == schemeFastCGI
+	if fastCGI || needsHTTPTransport(opt) {
+		transport = newUpstreamTransport(endpoint, targetURL, dialer, opt)
+	}
+
+	var handler fasthttp.RequestHandler = func(ctx *fasthttp.RequestCtx) {
 		originalPath := string(ctx.Path())
 		if !strings.HasPrefix(originalPath, endpoint) {
 			ctx.SetStatusCode(fasthttp.StatusNotFound)
@@ -63,16 +148,77 @@ func FastHTTPHandler(endpoint string, destination string) (string, fasthttp.Requ
 		log.Printf("[Proxy] %s -> %s%s", originalPath, targetURL.String(), trimmedPath)
 
 		req := &ctx.Request
-		resp := &ctx.Response
+		cacheKey := string(req.Host()) + string(req.Header.RequestURI())
+		proto := "http"
+		if ctx.IsTLS() {
+			proto = "https"
+		}
+		fwd := newForwardingHeaders(opt.trustedProxies, realip.AddrFromIP(ctx.RemoteIP()),
+			string(req.Host()), proto, func(key string) string {
+				values := req.Header.PeekAll(key)
+				parts := make([]string, 0, len(values))
+				for _, value := range values {
+					parts = append(parts, string(value))
+				}
+
+				return strings.Join(parts, ", ")
+			})
+
+		protocol := upgradeType(string(req.Header.Peek("Connection")), string(req.Header.Peek("Upgrade")))
+
+		removeHopHeadersFastHTTP(&req.Header)
+		fwd.applyFastHTTP(&req.Header)
+
+		upstreamHost := opt.upstreamHost(string(req.Host()), targetURL.Host)
 
 		req.URI().SetScheme(targetURL.Scheme)
 		req.URI().SetHost(targetURL.Host)
 		req.URI().SetPath(fullProxyPath)
+		req.Header.SetHost(upstreamHost)
+		req.UseHostHeader = true
+
+		if protocol != "" && !fastCGI {
+			serveFastHTTPUpgrade(ctx, targetURL, tracker, protocol, dialer)
+
+			return
+		}
+
+		if transport != nil {
+			roundTripFastHTTP(ctx, transport, opt, cacheKey)
+
+			return
+		}
 
-		if err := client.Do(req, resp); err != nil {
+		upstream := fasthttp.AcquireResponse()
+		if err := client.Do(req, upstream); err != nil {
+			fasthttp.ReleaseResponse(upstream)
 			ctx.SetStatusCode(fasthttp.StatusBadGateway)
 			ctx.SetBodyString("Proxy error: " + err.Error())
+
+			return
 		}
+
+		removeHopHeadersFastHTTP(&upstream.Header)
+		writeStreamedResponse(ctx, upstream, opt)
+	}
+
+	if opt.geoHeaders && opt.geoIP != nil {
+		handler = geoHeadersFastHTTP(opt, handler)
+	}
+	if opt.concurrency != nil {
+		handler = concurrencyFastHTTP(opt, handler)
+	}
+	if opt.purgeEnabled() {
+		handler = purgeFastHTTP(opt, handler)
+	}
+	if opt.auth != nil {
+		handler = authFastHTTP(opt, handler)
+	}
+	if len(opt.rateLimits) > 0 {
+		handler = rateLimitFastHTTP(opt, handler)
+	}
+	if len(opt.ipAccess) > 0 {
+		handler = accessFastHTTP(opt, handler)
 	}
 
 	return endpoint, handler, nil
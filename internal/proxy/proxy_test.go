@@ -2,12 +2,16 @@ package proxy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/ezex-io/proxier/internal/realip"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
 )
 
 func TestNewProxyHandler(t *testing.T) {
@@ -73,3 +77,150 @@ func TestProxyHandler_Unreachable(t *testing.T) {
 	assert.NotNil(t, resp, "Expected a response, since proxy should return 502 Bad Gateway")
 	assert.Equal(t, http.StatusBadGateway, resp.StatusCode, "Expected HTTP 502 Bad Gateway")
 }
+
+// serveFastHTTP starts srv on a free port and returns its URL.
+func serveFastHTTP(t *testing.T, srv *fasthttp.Server) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+
+	return "http://" + listener.Addr().String()
+}
+
+// serveBackends proxies endpoint to destination with both backends and
+// returns the URL of each server by backend name.
+func serveBackends(t *testing.T, endpoint, destination string, opts ...Option) map[string]string {
+	t.Helper()
+
+	return serveBackendsTimeout(t, 0, endpoint, destination, opts...)
+}
+
+// serveBackendsTimeout is serveBackends with servers giving up on responses
+// not written within writeTimeout, unless it is zero.
+func serveBackendsTimeout(t *testing.T, writeTimeout time.Duration,
+	endpoint, destination string, opts ...Option,
+) map[string]string {
+	t.Helper()
+
+	_, httpHandler, err := HTTPHandler(endpoint, destination, opts...)
+	require.NoError(t, err)
+	_, fastHandler, err := FastHTTPHandler(endpoint, destination, opts...)
+	require.NoError(t, err)
+
+	httpServer := httptest.NewUnstartedServer(httpHandler)
+	httpServer.Config.WriteTimeout = writeTimeout
+	httpServer.Start()
+	t.Cleanup(httpServer.Close)
+
+	return map[string]string{
+		"net/http": httpServer.URL,
+		"fasthttp": serveFastHTTP(t, &fasthttp.Server{Handler: fastHandler, WriteTimeout: writeTimeout}),
+	}
+}
+
+func TestProxyHandler_ForwardingHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	tests := []struct {
+		name    string
+		trusted []string
+		wantXFF string
+		wantFwd string
+	}{
+		{
+			name:    "untrusted peer replaces headers",
+			wantXFF: "127.0.0.1",
+			wantFwd: "for=127.0.0.1;host=proxier.test;proto=http",
+		},
+		{
+			name:    "trusted peer appends headers",
+			trusted: []string{"127.0.0.0/8"},
+			wantXFF: "203.0.113.7, 127.0.0.1",
+			wantFwd: "for=203.0.113.7, for=127.0.0.1;host=proxier.test;proto=http",
+		},
+	}
+
+	for _, tt := range tests {
+		trusted, err := realip.ParseTrustedProxies(tt.trusted)
+		require.NoError(t, err)
+
+		for backend, proxyURL := range serveBackends(t, "/proxy", mockServer.URL, WithTrustedProxies(trusted)) {
+			t.Run(tt.name+" "+backend, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, proxyURL+"/proxy/path", http.NoBody)
+				require.NoError(t, err)
+				req.Host = "proxier.test"
+				req.Header.Set("X-Forwarded-For", "203.0.113.7")
+				req.Header.Set("Forwarded", "for=203.0.113.7")
+				req.Header.Set("Connection", "X-Hop")
+				req.Header.Set("X-Hop", "secret")
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer func() {
+					_ = resp.Body.Close()
+				}()
+
+				got := <-headers
+				assert.Equal(t, tt.wantXFF, got.Get("X-Forwarded-For"))
+				assert.Equal(t, tt.wantFwd, got.Get("Forwarded"))
+				assert.Equal(t, "proxier.test", got.Get("X-Forwarded-Host"))
+				assert.Equal(t, "http", got.Get("X-Forwarded-Proto"))
+				assert.Empty(t, got.Get("X-Hop"), "Connection-listed headers must be stripped")
+				assert.Empty(t, resp.Header.Get("Keep-Alive"), "Hop-by-hop response headers must be stripped")
+			})
+		}
+	}
+}
+
+func TestProxyHandler_HostHeader(t *testing.T) {
+	hosts := make(chan string, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	destinationHost := mockServer.Listener.Addr().String()
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"destination host", nil, destinationHost},
+		{"preserve client host", []Option{WithPreserveHost()}, "client.test"},
+		{"custom host", []Option{WithCustomHost("custom.test")}, "custom.test"},
+	}
+
+	for _, tt := range tests {
+		for backend, proxyURL := range serveBackends(t, "/proxy", mockServer.URL, tt.opts...) {
+			t.Run(tt.name+" "+backend, func(t *testing.T) {
+				req, err := http.NewRequest(http.MethodGet, proxyURL+"/proxy/path", http.NoBody)
+				require.NoError(t, err)
+				req.Host = "client.test"
+
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer func() {
+					_ = resp.Body.Close()
+				}()
+
+				assert.Equal(t, tt.want, <-hosts)
+			})
+		}
+	}
+}
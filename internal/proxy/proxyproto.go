@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/ezex-io/proxier/internal/proxyproto"
+)
+
+// clientAddrsKey carries the client connection addresses that are announced
+// to the destination with the PROXY protocol.
+type clientAddrsKey struct{}
+
+type clientAddrs struct {
+	source      net.Addr
+	destination net.Addr
+}
+
+func withClientAddrs(ctx context.Context, source, destination net.Addr) context.Context {
+	return context.WithValue(ctx, clientAddrsKey{}, clientAddrs{source: source, destination: destination})
+}
+
+// withRequestAddrs stores the addresses of the connection r arrived on.
+func withRequestAddrs(r *http.Request) *http.Request {
+	var source net.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		source = net.TCPAddrFromAddrPort(addrPort)
+	}
+	destination, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	return r.WithContext(withClientAddrs(r.Context(), source, destination))
+}
+
+// proxyHeader encodes the PROXY protocol header for the client addresses in
+// ctx. Connections without a client, such as health checks, get a LOCAL or
+// UNKNOWN header.
+func proxyHeader(ctx context.Context, version int) ([]byte, error) {
+	addrs, _ := ctx.Value(clientAddrsKey{}).(clientAddrs)
+
+	return proxyproto.Encode(version, addrs.source, addrs.destination)
+}
+
+// dialWithProxyHeader returns a dial function that sends a PROXY protocol
+// header on every new connection before any other data.
+func dialWithProxyHeader(dial func(ctx context.Context, network, addr string) (net.Conn, error), version int,
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		header, err := proxyHeader(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(header); err != nil {
+			_ = conn.Close()
+
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ezex-io/proxier/internal/proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+// newProxyProtocolUpstream answers every request with the PROXY protocol
+// header received on its connection, formatted as "v<version> <source>".
+func newProxyProtocolUpstream(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				reader := bufio.NewReader(conn)
+				header, err := proxyproto.Read(reader)
+				if err != nil {
+					return
+				}
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+
+				body := "none"
+				if header != nil {
+					body = fmt.Sprintf("v%d %v", header.Version, header.Source)
+				}
+				_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+					len(body), body)
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String()
+}
+
+func TestHTTPHandler_ProxyProtocol(t *testing.T) {
+	upstream := newProxyProtocolUpstream(t)
+
+	for _, version := range []int{proxyproto.V1, proxyproto.V2} {
+		_, handler, err := HTTPHandler("/api", upstream, WithProxyProtocol(version))
+		require.NoError(t, err)
+
+		// Each request announces its own client, even on the same handler.
+		for _, client := range []string{"203.0.113.9:4567", "198.51.100.3:80"} {
+			req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+			req.RemoteAddr = client
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey,
+				&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8080}))
+
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, fmt.Sprintf("v%d %s", version, client), rec.Body.String())
+		}
+	}
+
+	_, handler, err := HTTPHandler("/api", upstream)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api/x", nil))
+	assert.Equal(t, "none", rec.Body.String())
+}
+
+func TestFastHTTPHandler_ProxyProtocol(t *testing.T) {
+	upstream := newProxyProtocolUpstream(t)
+
+	_, handler, err := FastHTTPHandler("/api", upstream, WithProxyProtocol(proxyproto.V2))
+	require.NoError(t, err)
+	proxyURL := serveFastHTTP(t, &fasthttp.Server{Handler: handler})
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(proxyURL + "/api/x")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(string(body), "v2 127.0.0.1:"), string(body))
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/valyala/fasthttp"
+)
+
+// methodPurge removes a cached response when enabled by WithPurge.
+const methodPurge = "PURGE"
+
+// purgeEnabled reports whether PURGE requests are answered by the proxy.
+func (opt *options) purgeEnabled() bool {
+	return opt.cache != nil && len(opt.purgeSources) > 0
+}
+
+// purge removes the cached response of key for a PURGE request from client
+// and returns the status and JSON body of the answer.
+func (opt *options) purge(client netip.Addr, key string) (int, []byte) {
+	status, resp := http.StatusOK, cache.PurgeResponse{}
+	if opt.purgeSources.Contains(client) {
+		resp.Purged = opt.cache.PurgeKey(key)
+		log.Printf("[Proxy] %s purged %s (%d responses)", client, key, resp.Purged)
+	} else {
+		status, resp.Error = http.StatusForbidden, "purge not allowed"
+	}
+
+	body, _ := json.Marshal(resp)
+
+	return status, append(body, '\n')
+}
+
+// purgeHTTP answers PURGE requests of the net/http backend and passes
+// other requests to next.
+func purgeHTTP(opt *options, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != methodPurge {
+			next(w, r)
+
+			return
+		}
+
+		status, body := opt.purge(clientIPHTTP(r, opt.trustedProxies), r.Host+r.URL.RequestURI())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	}
+}
+
+// purgeFastHTTP answers PURGE requests of the fasthttp backend and passes
+// other requests to next.
+func purgeFastHTTP(opt *options, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Method()) != methodPurge {
+			next(ctx)
+
+			return
+		}
+
+		key := string(ctx.Request.Host()) + string(ctx.Request.Header.RequestURI())
+		status, body := opt.purge(clientIPFastHTTP(ctx, opt.trustedProxies), key)
+		ctx.SetContentType("application/json")
+		ctx.SetStatusCode(status)
+		ctx.SetBody(body)
+	}
+}
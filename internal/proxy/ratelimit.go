@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/ratelimit"
+	"github.com/valyala/fasthttp"
+)
+
+// Response headers describing rate limits, see
+// draft-ietf-httpapi-ratelimit-headers.
+const (
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+	headerRetryAfter         = "Retry-After"
+)
+
+// rateLimit counts a request against every limit of the route. It returns
+// the decision of the most restrictive limit and its policy.
+func (opt *options) rateLimit(req ratelimit.Request) (ratelimit.Decision, string) {
+	var decision ratelimit.Decision
+	var policy string
+	for i, limiter := range opt.rateLimits {
+		d := limiter.Allow(req)
+		if i == 0 || restricts(d, decision) {
+			decision, policy = d, limiter.Policy()
+		}
+	}
+
+	return decision, policy
+}
+
+// restricts reports whether d is more restrictive than current.
+func restricts(d, current ratelimit.Decision) bool {
+	if d.Allowed != current.Allowed {
+		return !d.Allowed
+	}
+	if !d.Allowed {
+		return d.RetryAfter > current.RetryAfter
+	}
+
+	return d.Remaining < current.Remaining
+}
+
+// setRateLimitHeaders describes decision in the response headers.
+func setRateLimitHeaders(header responseHeader, decision ratelimit.Decision, policy string) {
+	header.Set(headerRateLimitLimit, strconv.Itoa(decision.Limit))
+	header.Set(headerRateLimitRemaining, strconv.Itoa(decision.Remaining))
+	header.Set(headerRateLimitReset, ceilSeconds(decision.Reset))
+	header.Set(headerRateLimitPolicy, policy)
+	if !decision.Allowed {
+		header.Set(headerRetryAfter, ceilSeconds(max(decision.RetryAfter, time.Second)))
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// rateLimitHTTP rejects requests of the net/http backend exceeding a limit
+// with 429 Too Many Requests.
+func rateLimitHTTP(opt *options, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decision, policy := opt.rateLimit(ratelimit.Request{
+			ClientIP: clientIPHTTP(r, opt.trustedProxies),
+			Header:   r.Header.Get,
+		})
+		setRateLimitHeaders(w.Header(), decision, policy)
+		if !decision.Allowed {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateLimitFastHTTP rejects requests of the fasthttp backend exceeding a
+// limit with 429 Too Many Requests.
+func rateLimitFastHTTP(opt *options, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		decision, policy := opt.rateLimit(ratelimit.Request{
+			ClientIP: clientIPFastHTTP(ctx, opt.trustedProxies),
+			Header: func(name string) string {
+				return string(ctx.Request.Header.Peek(name))
+			},
+		})
+		if !decision.Allowed {
+			ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+			ctx.SetContentType("text/plain; charset=utf-8")
+			ctx.SetBodyString(http.StatusText(http.StatusTooManyRequests) + "\n")
+			setRateLimitHeaders(fastHTTPResponseHeader{&ctx.Response.Header}, decision, policy)
+
+			return
+		}
+		next(ctx)
+		// The response is written once the handler returns, so the headers
+		// copied from the destination can still be extended.
+		setRateLimitHeaders(fastHTTPResponseHeader{&ctx.Response.Header}, decision, policy)
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit_Backends(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	perKey, err := ratelimit.New(ratelimit.Config{Name: t.Name(), Requests: 2, Period: time.Hour, Key: "header:X-API-Key"})
+	require.NoError(t, err)
+	perIP, err := ratelimit.New(ratelimit.Config{Name: t.Name(), Requests: 100, Period: time.Hour})
+	require.NoError(t, err)
+
+	for name, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithRateLimits(perKey, perIP)) {
+		t.Run(name, func(t *testing.T) {
+			get := func(apiKey string) (*http.Response, string) {
+				req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, proxyURL+"/stream/item", nil)
+				require.NoError(t, err)
+				req.Header.Set("X-API-Key", apiKey)
+				resp, err := http.DefaultClient.Do(req)
+				require.NoError(t, err)
+				defer resp.Body.Close()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				return resp, string(body)
+			}
+
+			// Each backend uses its own key, as both share the limiters.
+			resp, body := get(name)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "ok", body)
+			assert.Equal(t, "2", resp.Header.Get("RateLimit-Limit"))
+			assert.Equal(t, "1", resp.Header.Get("RateLimit-Remaining"))
+			assert.Equal(t, "2;w=3600", resp.Header.Get("RateLimit-Policy"))
+			assert.Empty(t, resp.Header.Get("Retry-After"))
+
+			resp, _ = get(name)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+			resp, body = get(name)
+			assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+			assert.Equal(t, "Too Many Requests\n", body)
+			assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+			assert.Equal(t, "1800", resp.Header.Get("Retry-After"))
+			assert.Equal(t, "3600", resp.Header.Get("RateLimit-Reset"))
+
+			// Another key has its own quota.
+			resp, _ = get(name + "-other")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestRestricts(t *testing.T) {
+	allowed := ratelimit.Decision{Allowed: true, Remaining: 5}
+	fewer := ratelimit.Decision{Allowed: true, Remaining: 1}
+	limited := ratelimit.Decision{RetryAfter: time.Second}
+	longer := ratelimit.Decision{RetryAfter: time.Minute}
+
+	assert.True(t, restricts(fewer, allowed))
+	assert.False(t, restricts(allowed, fewer))
+	assert.True(t, restricts(limited, fewer))
+	assert.False(t, restricts(fewer, limited))
+	assert.True(t, restricts(longer, limited))
+	assert.False(t, restricts(limited, longer))
+}
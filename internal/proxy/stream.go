@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultMaxBufferSize is the largest response body buffered in memory by
+// the fasthttp handler before it switches to streaming.
+const defaultMaxBufferSize = 1 << 20
+
+// flushIntervalFor mirrors httputil.ReverseProxy: Server-Sent Events and
+// responses of unknown length are flushed after every write, anything else
+// uses the configured interval.
+func flushIntervalFor(contentType string, contentLength int, configured time.Duration) time.Duration {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/event-stream" {
+		return -1
+	}
+	if contentLength == -1 {
+		return -1
+	}
+
+	return configured
+}
+
+// isStreamed reports whether a response body is streamed to the client
+// rather than sent at once: Server-Sent Events, bodies of unknown length and
+// bodies larger than maxBufferSize. They may take longer than the write
+// timeout of the server.
+func isStreamed(contentType string, contentLength, maxBufferSize int) bool {
+	return flushIntervalFor(contentType, contentLength, 0) != 0 || contentLength > maxBufferSize
+}
+
+// isEventStream reports whether a response carries Server-Sent Events.
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	return mediaType == "text/event-stream"
+}
+
+// streamDeadline returns how the write deadline of the connection is kept
+// while a response body is written: cleared for Server-Sent Events and on
+// routes with long-lived streams, pushed forward by the write timeout after
+// every write of other streamed bodies, so that slow clients are still
+// disconnected. It returns nil when the deadline of the server applies.
+func (opt *options) streamDeadline(setDeadline func(time.Time) error,
+	contentType string, contentLength int,
+) func() {
+	switch {
+	case !isStreamed(contentType, contentLength, opt.maxBufferSize):
+		return nil
+	case opt.longLived || isEventStream(contentType):
+		return func() { _ = setDeadline(time.Time{}) }
+	case opt.writeTimeout > 0:
+		return func() { _ = setDeadline(time.Now().Add(opt.writeTimeout)) }
+	default:
+		return nil
+	}
+}
+
+type responseWriterKey struct{}
+
+// deadlineWriter keeps the write deadline of a streamed response of the
+// net/http backend, see streamDeadline.
+type deadlineWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	keep       func()
+}
+
+// withDeadlineWriter wraps w and stores it in the request context, so that
+// the write deadline can be kept once the response turns out to be
+// streamed.
+func withDeadlineWriter(r *http.Request, w http.ResponseWriter) (*http.Request, *deadlineWriter) {
+	dw := &deadlineWriter{ResponseWriter: w, controller: http.NewResponseController(w)}
+
+	return r.WithContext(context.WithValue(r.Context(), responseWriterKey{}, dw)), dw
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	if dw.keep != nil {
+		dw.keep()
+	}
+
+	return dw.ResponseWriter.Write(p)
+}
+
+func (dw *deadlineWriter) FlushError() error {
+	if dw.keep != nil {
+		dw.keep()
+	}
+
+	return dw.controller.Flush()
+}
+
+func (dw *deadlineWriter) Flush() {
+	_ = dw.FlushError()
+}
+
+func (dw *deadlineWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// keepWriteDeadlineHTTP sets how the write deadline of the connection of
+// resp is kept while its body is written.
+func keepWriteDeadlineHTTP(resp *http.Response, opt *options) {
+	dw, ok := resp.Request.Context().Value(responseWriterKey{}).(*deadlineWriter)
+	if !ok {
+		return
+	}
+
+	dw.keep = opt.streamDeadline(dw.controller.SetWriteDeadline,
+		resp.Header.Get("Content-Type"), int(resp.ContentLength))
+	if dw.keep != nil {
+		dw.keep()
+	}
+}
+
+// writeStreamedResponse sends the upstream response to the client without
+// buffering its whole body. upstream is released once the body is sent.
+func writeStreamedResponse(ctx *fasthttp.RequestCtx, upstream *fasthttp.Response, opt *options) {
+	upstream.Header.CopyTo(&ctx.Response.Header)
+
+	body := upstream.BodyStream()
+	if body == nil {
+		fasthttp.ReleaseResponse(upstream)
+
+		return
+	}
+
+	release := func() {
+		_ = upstream.CloseBodyStream()
+		fasthttp.ReleaseResponse(upstream)
+	}
+	streamBody(ctx, body, release, upstream.Header.ContentLength(),
+		string(upstream.Header.ContentType()), opt)
+}
+
+// streamBody sets body as the response body, compressed when configured and
+// flushed according to the configured interval. release is called once the
+// body has been sent.
+func streamBody(ctx *fasthttp.RequestCtx, body io.Reader, release func(),
+	size int, contentType string, opt *options,
+) {
+	if opt.compressor != nil {
+		body, size, release = opt.compressor.compressFastHTTP(ctx, body, size, release)
+	}
+	if slot := slotFromFastHTTP(ctx); slot != nil {
+		slot.untilSent = true
+		releaseBody := release
+		release = func() {
+			releaseBody()
+			slot.release()
+		}
+	}
+
+	// fasthttp sets the write deadline after the handler returns, so it is
+	// kept while the body is being written.
+	var keep func()
+	if conn := ctx.Conn(); conn != nil {
+		keep = opt.streamDeadline(conn.SetWriteDeadline, contentType, size)
+	}
+
+	interval := flushIntervalFor(contentType, size, opt.flushInterval)
+	if interval == 0 {
+		ctx.Response.SetBodyStream(&releasingReader{reader: body, keep: keep, release: release}, size)
+
+		return
+	}
+
+	ctx.Response.SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer release()
+
+		if keep != nil {
+			keep()
+		}
+
+		fw := &flushWriter{w: w, interval: interval, keep: keep}
+		_, _ = io.Copy(fw, body)
+		fw.stop()
+	})
+}
+
+// releasingReader calls keep whenever fasthttp has read a chunk of the body
+// to write and release once it has finished reading it.
+type releasingReader struct {
+	reader  io.Reader
+	keep    func()
+	release func()
+	once    sync.Once
+}
+
+func (r *releasingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 && r.keep != nil {
+		r.keep()
+	}
+
+	return n, err
+}
+
+func (r *releasingReader) Close() error {
+	r.once.Do(r.release)
+
+	return nil
+}
+
+// flushWriter flushes after every write when interval is negative and at
+// most interval after a write otherwise, like httputil's maxLatencyWriter.
+// It calls keep before writing to the connection.
+type flushWriter struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	interval time.Duration
+	keep     func()
+	timer    *time.Timer
+	pending  bool
+	err      error
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.err != nil {
+		return 0, fw.err
+	}
+
+	if fw.keep != nil {
+		fw.keep()
+	}
+
+	n, err := fw.w.Write(p)
+	if err != nil {
+		fw.err = err
+
+		return n, err
+	}
+
+	if fw.interval < 0 {
+		fw.err = fw.w.Flush()
+
+		return n, fw.err
+	}
+
+	if !fw.pending {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if !fw.pending || fw.err != nil {
+		return
+	}
+	fw.pending = false
+	if fw.keep != nil {
+		fw.keep()
+	}
+	fw.err = fw.w.Flush()
+}
+
+// stop cancels a pending delayed flush. The final flush is left to fasthttp.
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
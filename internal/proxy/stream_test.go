@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHeldStreamServer writes the first chunk with the given content type and
+// holds the response open until release is closed.
+func newHeldStreamServer(t *testing.T, contentType string, contentLength int, release chan struct{}) *httptest.Server {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if contentLength > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(contentLength))
+		}
+		_, _ = w.Write([]byte("data: first\n\n"))
+		_ = http.NewResponseController(w).Flush()
+
+		<-release
+		_, _ = w.Write([]byte("data: last\n\n"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+func readFirstEvent(t *testing.T, proxyURL string) {
+	t.Helper()
+
+	resp, err := http.Get(proxyURL + "/stream/events")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+}
+
+func TestStreaming_ServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	upstream := newHeldStreamServer(t, "text/event-stream", 0, release)
+
+	for backend, proxyURL := range serveBackends(t, "/stream", upstream.URL) {
+		t.Run(backend, func(t *testing.T) {
+			readFirstEvent(t, proxyURL)
+		})
+	}
+}
+
+func TestStreaming_FlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	// A known length response is only flushed early because of the interval.
+	upstream := newHeldStreamServer(t, "text/plain", 26, release)
+
+	for backend, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithFlushInterval(10*time.Millisecond),
+		WithMaxBufferSize(8)) {
+		t.Run(backend, func(t *testing.T) {
+			readFirstEvent(t, proxyURL)
+		})
+	}
+}
+
+func TestStreaming_OutlivesWriteTimeout(t *testing.T) {
+	const writeTimeout = 100 * time.Millisecond
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 5 {
+			_, _ = w.Write([]byte("data: " + strconv.Itoa(i) + "\n\n"))
+			_ = http.NewResponseController(w).Flush()
+			time.Sleep(writeTimeout / 2)
+		}
+	}))
+	defer upstream.Close()
+
+	backends := serveBackendsTimeout(t, writeTimeout, "/stream", upstream.URL)
+	for backend, proxyURL := range backends {
+		t.Run(backend, func(t *testing.T) {
+			resp, err := http.Get(proxyURL + "/stream/events")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "data: 0\n\ndata: 1\n\ndata: 2\n\ndata: 3\n\ndata: 4\n\n", string(body))
+		})
+	}
+}
+
+func TestStreaming_ExtendsWriteTimeout(t *testing.T) {
+	const writeTimeout = 100 * time.Millisecond
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for i := range 5 {
+			_, _ = w.Write([]byte(strconv.Itoa(i)))
+			_ = http.NewResponseController(w).Flush()
+			time.Sleep(writeTimeout / 2)
+		}
+	}))
+	defer upstream.Close()
+
+	backends := serveBackendsTimeout(t, writeTimeout, "/stream", upstream.URL, WithWriteTimeout(writeTimeout))
+	for backend, proxyURL := range backends {
+		t.Run(backend, func(t *testing.T) {
+			resp, err := http.Get(proxyURL + "/stream/download")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "01234", string(body))
+		})
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	var deadline time.Time
+	setDeadline := func(d time.Time) error {
+		deadline = d
+
+		return nil
+	}
+	opt := newOptions([]Option{WithWriteTimeout(time.Minute)})
+
+	assert.Nil(t, opt.streamDeadline(setDeadline, "application/json", 10))
+
+	opt.streamDeadline(setDeadline, "text/event-stream", 10)()
+	assert.True(t, deadline.IsZero())
+
+	opt.streamDeadline(setDeadline, "application/json", -1)()
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	opt.streamDeadline(setDeadline, "application/json", defaultMaxBufferSize+1)()
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	WithLongLivedStreams()(opt)
+	opt.streamDeadline(setDeadline, "application/json", -1)()
+	assert.True(t, deadline.IsZero())
+}
+
+func TestStreaming_LargeBody(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 100_000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+		_, _ = w.Write(payload)
+	}))
+	defer upstream.Close()
+
+	for backend, proxyURL := range serveBackends(t, "/stream", upstream.URL, WithMaxBufferSize(4096)) {
+		t.Run(backend, func(t *testing.T) {
+			resp, err := http.Get(proxyURL + "/stream/file")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(payload)), resp.ContentLength)
+			assert.Equal(t, payload, body)
+		})
+	}
+}
+
+func TestFlushIntervalFor(t *testing.T) {
+	assert.Equal(t, time.Duration(-1), flushIntervalFor("text/event-stream; charset=utf-8", 10, 0))
+	assert.Equal(t, time.Duration(-1), flushIntervalFor("application/json", -1, time.Second))
+	assert.Equal(t, time.Second, flushIntervalFor("application/json", 10, time.Second))
+	assert.Equal(t, time.Duration(0), flushIntervalFor("application/json", 10, 0))
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/valyala/fasthttp"
+)
+
+// UpstreamProtocol selects the HTTP version used towards the destination.
+type UpstreamProtocol string
+
+const (
+	// ProtocolAuto uses HTTP/1.1, or HTTP/2 when negotiated over TLS.
+	ProtocolAuto UpstreamProtocol = ""
+	// ProtocolHTTP1 always uses HTTP/1.1.
+	ProtocolHTTP1 UpstreamProtocol = "http1"
+	// ProtocolH2 uses HTTP/2 over TLS.
+	ProtocolH2 UpstreamProtocol = "h2"
+	// ProtocolH2C uses HTTP/2 over cleartext TCP (prior knowledge).
+	ProtocolH2C UpstreamProtocol = "h2c"
+)
+
+// newTransport returns a transport speaking the given protocol upstream.
+// With a PROXY protocol version, every request uses its own connection so
+// the header announces the right client.
+func newTransport(protocol UpstreamProtocol, dialer upstreamDialer) *http.Transport {
+	base, _ := http.DefaultTransport.(*http.Transport)
+	transport := base.Clone()
+
+	if dialer.custom() {
+		transport.DialContext = dialer.dialContext
+	}
+	if dialer.proxyProtocol > 0 {
+		transport.DisableKeepAlives = true
+	}
+
+	protocols := new(http.Protocols)
+	switch protocol {
+	case ProtocolAuto:
+		return transport
+	case ProtocolHTTP1:
+		protocols.SetHTTP1(true)
+	case ProtocolH2:
+		protocols.SetHTTP2(true)
+	case ProtocolH2C:
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = protocols
+
+	return transport
+}
+
+// newUpstreamTransport returns the transport reaching targetURL: a FastCGI
+// client for fastcgi destinations, an HTTP transport otherwise, behind
+// request coalescing and the response cache when configured.
+func newUpstreamTransport(endpoint string, targetURL *url.URL, dialer upstreamDialer, opt *options) http.RoundTripper {
+	var transport http.RoundTripper
+	if targetURL.Scheme == schemeFastCGI {
+		transport = newFastCGITransport(targetURL.Host, dialer, opt.fastCGI)
+	} else {
+		transport = newTransport(opt.protocol, dialer)
+	}
+
+	if opt.coalescing != nil {
+		coalescing := *opt.coalescing
+		if opt.auth != nil {
+			// Credentials are removed before the request gets here, so that
+			// only requests of the same client share a response.
+			coalescing.Vary = append(slices.Clone(coalescing.Vary), opt.identityHeader)
+		}
+		transport = newCoalescingTransport(endpoint, transport, coalescing, opt.maxBufferSize)
+	}
+
+	if opt.cache != nil {
+		transport = opt.cache.Transport(transport)
+	}
+
+	return transport
+}
+
+// cacheContext sets the cache key of requests using ctx, and marks them as
+// authenticated on routes with authentication.
+func (opt *options) cacheContext(ctx context.Context, key string) context.Context {
+	ctx = cache.WithKey(ctx, key)
+	if opt.auth != nil {
+		ctx = cache.WithAuthenticated(ctx)
+	}
+
+	return ctx
+}
+
+// needsHTTPTransport reports whether the fasthttp handler has to use the
+// net/http transport, because fasthttp only speaks HTTP/1.1, its client
+// cannot send a PROXY protocol header per client, and the response cache and
+// request coalescing are net/http round trippers.
+func needsHTTPTransport(opt *options) bool {
+	return opt.protocol == ProtocolH2 || opt.protocol == ProtocolH2C || opt.proxyProtocol > 0 ||
+		opt.cache != nil || opt.coalescing != nil
+}
+
+// roundTripFastHTTP sends a prepared fasthttp request through a net/http
+// transport and streams the response back to the client. cacheKey is the
+// client request the response may be cached under.
+//
+// fasthttp does not notice a client going away while the handler runs, so
+// the upstream request is cancelled once the response has been sent, when
+// writing it to the client fails, or when the server stops.
+func roundTripFastHTTP(ctx *fasthttp.RequestCtx, transport http.RoundTripper, opt *options, cacheKey string) {
+	reqCtx, cancel := context.WithCancel(opt.baseContext)
+	reqCtx = withClientAddrs(reqCtx, ctx.RemoteAddr(), ctx.LocalAddr())
+	if opt.cache != nil {
+		reqCtx = opt.cacheContext(reqCtx, cacheKey)
+	}
+
+	outReq, err := toHTTPRequest(reqCtx, &ctx.Request)
+	if err != nil {
+		cancel()
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		ctx.SetBodyString("Proxy error: " + err.Error())
+
+		return
+	}
+	outReq.RemoteAddr = ctx.RemoteAddr().String()
+
+	resp, err := transport.RoundTrip(outReq)
+	if err != nil {
+		cancel()
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		ctx.SetBodyString("Proxy error: " + err.Error())
+
+		return
+	}
+
+	removeHopHeadersHTTP(resp.Header)
+
+	ctx.SetStatusCode(resp.StatusCode)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			ctx.Response.Header.Add(key, value)
+		}
+	}
+
+	size := int(resp.ContentLength)
+	if ctx.IsHead() || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		cancel()
+
+		return
+	}
+
+	release := func() {
+		_ = resp.Body.Close()
+		cancel()
+	}
+	streamBody(ctx, resp.Body, release, size, resp.Header.Get("Content-Type"), opt)
+}
+
+// toHTTPRequest converts the fasthttp request into an outgoing net/http one.
+func toHTTPRequest(reqCtx context.Context, req *fasthttp.Request) (*http.Request, error) {
+	var body io.Reader = http.NoBody
+	if stream := req.BodyStream(); stream != nil {
+		body = stream
+	} else if len(req.Body()) > 0 {
+		body = bytes.NewReader(req.Body())
+	}
+
+	outReq, err := http.NewRequestWithContext(reqCtx,
+		string(req.Header.Method()), req.URI().String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	outReq.Host = string(req.Header.Host())
+	if length := req.Header.ContentLength(); length >= 0 {
+		outReq.ContentLength = int64(length)
+	} else if body != http.NoBody {
+		outReq.ContentLength = -1
+	}
+
+	req.Header.VisitAll(func(key, value []byte) {
+		name := string(key)
+		if strings.EqualFold(name, "Host") || strings.EqualFold(name, "Content-Length") {
+			return
+		}
+		outReq.Header.Add(name, string(value))
+	})
+
+	return outReq, nil
+}
+
+// removeHopHeadersHTTP is the net/http counterpart of removeHopHeadersFastHTTP.
+func removeHopHeadersHTTP(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+func TestUpstreamProtocol_H2C(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Host", r.Host)
+		_, _ = w.Write(body)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	tests := []struct {
+		protocol  UpstreamProtocol
+		wantProto string
+	}{
+		{ProtocolAuto, "HTTP/1.1"},
+		{ProtocolHTTP1, "HTTP/1.1"},
+		{ProtocolH2C, "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		backends := serveBackends(t, "/stream", upstream.URL, WithUpstreamProtocol(tt.protocol),
+			WithCustomHost("upstream.test"))
+
+		for backend, proxyURL := range backends {
+			t.Run(string(tt.protocol)+" "+backend, func(t *testing.T) {
+				resp, err := http.Post(proxyURL+"/stream/echo", "text/plain", strings.NewReader("hello"))
+				require.NoError(t, err)
+				defer func() {
+					_ = resp.Body.Close()
+				}()
+
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Equal(t, tt.wantProto, resp.Header.Get("X-Proto"))
+				assert.Equal(t, "upstream.test", resp.Header.Get("X-Host"))
+				assert.Equal(t, "hello", string(body))
+			})
+		}
+	}
+}
+
+// trustUpstream makes the transports created from now on trust the
+// certificate of upstream.
+func trustUpstream(t *testing.T, upstream *httptest.Server) {
+	t.Helper()
+
+	base, ok := http.DefaultTransport.(*http.Transport)
+	require.True(t, ok)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	saved := base.TLSClientConfig
+	base.TLSClientConfig = saved.Clone()
+	if base.TLSClientConfig == nil {
+		base.TLSClientConfig = new(tls.Config)
+	}
+	base.TLSClientConfig.RootCAs = roots
+	t.Cleanup(func() {
+		base.TLSClientConfig = saved
+	})
+}
+
+func TestUpstreamProtocol_H2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Proto", r.Proto)
+		_, _ = w.Write(body)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	trustUpstream(t, upstream)
+
+	backends := serveBackends(t, "/stream", upstream.URL, WithUpstreamProtocol(ProtocolH2))
+
+	for backend, proxyURL := range backends {
+		t.Run(backend, func(t *testing.T) {
+			resp, err := http.Post(proxyURL+"/stream/echo", "text/plain", strings.NewReader("hello"))
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+			assert.Equal(t, "hello", string(body))
+		})
+	}
+}
+
+func TestFastHTTPHandler_CancelsUpstreamOnStop(t *testing.T) {
+	received := make(chan struct{})
+	cancelled := make(chan struct{})
+	finished := make(chan struct{})
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		close(received)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-finished:
+		}
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+	defer close(finished)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, handler, err := FastHTTPHandler("/stream", upstream.URL,
+		WithUpstreamProtocol(ProtocolH2C), WithBaseContext(ctx))
+	require.NoError(t, err)
+	proxyURL := serveFastHTTP(t, &fasthttp.Server{Handler: handler})
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(proxyURL + "/stream/wait")
+		if err != nil {
+			status <- 0
+
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request did not reach the upstream")
+	}
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not cancelled")
+	}
+	assert.Equal(t, http.StatusBadGateway, <-status)
+}
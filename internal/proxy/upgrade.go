@@ -0,0 +1,440 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	errUpgradeLimit    = errors.New("too many upgraded connections")
+	errMessageTooLarge = errors.New("websocket message exceeds limit")
+)
+
+const upgradeDialTimeout = 10 * time.Second
+
+var (
+	upgradesTotal = metrics.Default.CounterVec("proxier_upgrade_connections_total",
+		"Connections switched to another protocol.")
+	upgradesActive = metrics.Default.GaugeVec("proxier_upgrade_connections_active",
+		"Currently open upgraded connections.")
+	upgradesRejected = metrics.Default.CounterVec("proxier_upgrade_connections_rejected_total",
+		"Upgrade requests rejected because of the connection limit.")
+)
+
+// UpgradeLimits bounds connections switched to another protocol through an
+// Upgrade request, such as WebSocket.
+type UpgradeLimits struct {
+	// IdleTimeout closes a tunnel with no traffic in either direction.
+	IdleTimeout time.Duration
+	// MaxMessageSize is the largest WebSocket message accepted in bytes.
+	MaxMessageSize int64
+	// MaxConnections is the number of concurrent tunnels for the route.
+	MaxConnections int64
+}
+
+// upgradeTracker enforces UpgradeLimits and records tunnel metrics for a route.
+type upgradeTracker struct {
+	endpoint string
+	limits   UpgradeLimits
+	active   atomic.Int64
+}
+
+func newUpgradeTracker(endpoint string, limits UpgradeLimits) *upgradeTracker {
+	return &upgradeTracker{endpoint: endpoint, limits: limits}
+}
+
+// labels returns the metric labels of a tunnel. The protocol comes from the
+// client, so only well-known values are kept to bound the metric series.
+func (u *upgradeTracker) labels(protocol string) metrics.Labels {
+	switch protocol = strings.ToLower(protocol); protocol {
+	case "websocket", "h2c":
+	default:
+		protocol = "other"
+	}
+
+	return metrics.Labels{"endpoint": u.endpoint, "protocol": protocol}
+}
+
+// acquire reserves a tunnel slot, returning false when the route is full.
+func (u *upgradeTracker) acquire(protocol string) bool {
+	if u.active.Add(1) > u.limits.MaxConnections && u.limits.MaxConnections > 0 {
+		u.active.Add(-1)
+		upgradesRejected.With(u.labels(protocol)).Inc()
+
+		return false
+	}
+
+	return true
+}
+
+func (u *upgradeTracker) release() {
+	u.active.Add(-1)
+}
+
+// wrap meters an established tunnel to the destination. The returned
+// connection releases the slot taken by acquire when closed.
+func (u *upgradeTracker) wrap(conn io.ReadWriteCloser, protocol string) io.ReadWriteCloser {
+	upgradesTotal.With(u.labels(protocol)).Inc()
+	gauge := upgradesActive.With(u.labels(protocol))
+	gauge.Inc()
+
+	tun := &tunnelConn{
+		ReadWriteCloser: conn,
+		onClose: func() {
+			gauge.Dec()
+			u.release()
+		},
+	}
+
+	if strings.EqualFold(protocol, "websocket") && u.limits.MaxMessageSize > 0 {
+		tun.readMeter = &frameMeter{max: u.limits.MaxMessageSize}
+		tun.writeMeter = &frameMeter{max: u.limits.MaxMessageSize}
+	}
+
+	if u.limits.IdleTimeout > 0 {
+		tun.idle = u.limits.IdleTimeout
+		tun.timer = time.AfterFunc(u.limits.IdleTimeout, func() {
+			log.Printf("[Proxy] closing idle %s tunnel for %s", protocol, u.endpoint)
+			_ = tun.Close()
+		})
+	}
+
+	return tun
+}
+
+// tunnelConn wraps the destination side of a tunnel. Reads carry data towards
+// the client and writes carry data from the client.
+type tunnelConn struct {
+	io.ReadWriteCloser
+
+	idle       time.Duration
+	timer      *time.Timer
+	readMeter  *frameMeter
+	writeMeter *frameMeter
+	closeOnce  sync.Once
+	onClose    func()
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.touch()
+		if c.readMeter != nil {
+			if meterErr := c.readMeter.feed(p[:n]); meterErr != nil {
+				_ = c.Close()
+
+				return 0, meterErr
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	c.touch()
+	if c.writeMeter != nil {
+		if err := c.writeMeter.feed(p); err != nil {
+			_ = c.Close()
+
+			return 0, err
+		}
+	}
+
+	return c.ReadWriteCloser.Write(p)
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.closeOnce.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.onClose()
+	})
+
+	return err
+}
+
+func (c *tunnelConn) touch() {
+	if c.timer != nil {
+		c.timer.Reset(c.idle)
+	}
+}
+
+// frameMeter follows the WebSocket framing (RFC 6455, section 5.2) of one
+// direction of a tunnel and fails once a data message grows beyond max.
+type frameMeter struct {
+	max       int64
+	header    []byte
+	remaining uint64
+	message   uint64
+}
+
+func (m *frameMeter) feed(p []byte) error {
+	for len(p) > 0 {
+		if m.remaining > 0 {
+			n := min(uint64(len(p)), m.remaining)
+			m.remaining -= n
+			p = p[n:]
+
+			continue
+		}
+
+		m.header = append(m.header, p[0])
+		p = p[1:]
+		if len(m.header) < frameHeaderLen(m.header) {
+			continue
+		}
+
+		fin := m.header[0]&0x80 != 0
+		opcode := m.header[0] & 0x0f
+		length := frameLength(m.header)
+		m.header = m.header[:0]
+		m.remaining = length
+
+		if opcode >= 0x8 {
+			continue // control frames are not part of a message
+		}
+		if opcode != 0x0 {
+			m.message = 0
+		}
+		m.message += length
+		if m.message > uint64(m.max) {
+			return errMessageTooLarge
+		}
+		if fin {
+			m.message = 0
+		}
+	}
+
+	return nil
+}
+
+func frameHeaderLen(header []byte) int {
+	if len(header) < 2 {
+		return 2
+	}
+
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+
+	return size
+}
+
+func frameLength(header []byte) uint64 {
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(length)
+	}
+}
+
+// upgradeType returns the protocol requested by an Upgrade request.
+func upgradeType(connection, upgrade string) string {
+	if !hasToken(connection, "upgrade") {
+		return ""
+	}
+
+	return upgrade
+}
+
+// upgradeTransport meters upgraded connections established by a
+// httputil.ReverseProxy.
+type upgradeTransport struct {
+	base    http.RoundTripper
+	tracker *upgradeTracker
+}
+
+func (t *upgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	protocol := upgradeType(req.Header.Get("Connection"), req.Header.Get("Upgrade"))
+	if protocol == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	if !t.tracker.acquire(protocol) {
+		return nil, errUpgradeLimit
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.tracker.release()
+
+		return nil, err
+	}
+
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		t.tracker.release()
+
+		return resp, nil
+	}
+	resp.Body = t.tracker.wrap(body, protocol)
+
+	return resp, nil
+}
+
+// dialUpstream opens a raw connection to the destination of targetURL.
+func dialUpstream(ctx context.Context, targetURL *url.URL, dialer upstreamDialer) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, upgradeDialTimeout)
+	defer cancel()
+
+	conn, err := dialer.dialContext(ctx, "tcp", hostPort(targetURL))
+	if err != nil {
+		return nil, err
+	}
+
+	if targetURL.Scheme == "https" || targetURL.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: targetURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+
+	return conn, nil
+}
+
+func hostPort(targetURL *url.URL) string {
+	if targetURL.Port() != "" {
+		return targetURL.Host
+	}
+	if targetURL.Scheme == "https" || targetURL.Scheme == "wss" {
+		return net.JoinHostPort(targetURL.Hostname(), "443")
+	}
+
+	return net.JoinHostPort(targetURL.Hostname(), "80")
+}
+
+// serveFastHTTPUpgrade forwards an Upgrade request over a dedicated
+// connection and, once the destination switches protocols, tunnels the
+// hijacked client connection to it.
+func serveFastHTTPUpgrade(ctx *fasthttp.RequestCtx, targetURL *url.URL,
+	tracker *upgradeTracker, protocol string, dialer upstreamDialer,
+) {
+	if !tracker.acquire(protocol) {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.SetBodyString("Proxy error: " + errUpgradeLimit.Error())
+
+		return
+	}
+
+	// RequestCtx is not used as the dial context: its Done channel is not
+	// safe to watch concurrently with a server shutdown.
+	upstream, err := dialUpstream(withClientAddrs(context.Background(), ctx.RemoteAddr(), ctx.LocalAddr()),
+		targetURL, dialer)
+	if err != nil {
+		tracker.release()
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		ctx.SetBodyString("Proxy error: " + err.Error())
+
+		return
+	}
+
+	req := &ctx.Request
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+
+	reader := bufio.NewReader(upstream)
+	writer := bufio.NewWriter(upstream)
+	if err := exchangeUpgrade(req, &ctx.Response, reader, writer); err != nil {
+		tracker.release()
+		_ = upstream.Close()
+		ctx.Response.Reset()
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+		ctx.SetBodyString("Proxy error: " + err.Error())
+
+		return
+	}
+
+	if ctx.Response.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		tracker.release()
+		_ = upstream.Close()
+		removeHopHeadersFastHTTP(&ctx.Response.Header)
+
+		return
+	}
+
+	backend := tracker.wrap(&bufferedConn{Conn: upstream, reader: reader}, protocol)
+	ctx.Hijack(func(client net.Conn) {
+		_ = client.SetDeadline(time.Time{})
+		tunnel(client, backend)
+	})
+}
+
+func exchangeUpgrade(req *fasthttp.Request, resp *fasthttp.Response,
+	reader *bufio.Reader, writer *bufio.Writer,
+) error {
+	if err := req.Write(writer); err != nil {
+		return fmt.Errorf("writing upgrade request: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("writing upgrade request: %w", err)
+	}
+	if err := resp.Read(reader); err != nil {
+		return fmt.Errorf("reading upgrade response: %w", err)
+	}
+
+	return nil
+}
+
+// tunnel copies data in both directions until either side is done. Closing a
+// hijacked fasthttp connection is deferred to the server, which does so once
+// the hijack handler returns, so tunnel does not wait for the second copier.
+func tunnel(client net.Conn, backend io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(backend, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+
+	<-done
+	_ = backend.Close()
+	_ = client.Close()
+}
+
+// bufferedConn reads through the reader used to parse the upgrade response,
+// so bytes sent right after it are not lost.
+type bufferedConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
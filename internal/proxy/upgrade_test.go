@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoUpgradeServer switches every request to the requested protocol and
+// echoes everything it receives.
+func newEchoUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\nUpgrade: " + r.Header.Get("Upgrade") + "\r\n\r\n")
+		_ = rw.Flush()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := rw.Read(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write(buf[:n])
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// dialUpgrade sends an Upgrade request through the proxy and returns the
+// connection together with the response status code.
+func dialUpgrade(t *testing.T, proxyURL, protocol string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+
+	parsed, err := url.Parse(proxyURL)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", parsed.Host)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	_, err = conn.Write([]byte("GET /ws/chat HTTP/1.1\r\nHost: " + parsed.Host +
+		"\r\nConnection: Upgrade\r\nUpgrade: " + protocol + "\r\n\r\n"))
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+
+	return conn, reader, resp.StatusCode
+}
+
+func TestUpgrade_Tunnel(t *testing.T) {
+	upstream := newEchoUpgradeServer(t)
+
+	for backend, proxyURL := range serveBackends(t, "/ws", upstream.URL) {
+		t.Run(backend, func(t *testing.T) {
+			conn, reader, status := dialUpgrade(t, proxyURL, "websocket")
+			require.Equal(t, http.StatusSwitchingProtocols, status)
+
+			_, err := conn.Write([]byte("ping"))
+			require.NoError(t, err)
+
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(reader, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(buf))
+		})
+	}
+}
+
+func TestUpgrade_MaxConnections(t *testing.T) {
+	upstream := newEchoUpgradeServer(t)
+	limits := UpgradeLimits{MaxConnections: 1}
+
+	for backend, proxyURL := range serveBackends(t, "/ws", upstream.URL, WithUpgradeLimits(limits)) {
+		t.Run(backend, func(t *testing.T) {
+			first, _, status := dialUpgrade(t, proxyURL, "websocket")
+			require.Equal(t, http.StatusSwitchingProtocols, status)
+
+			_, _, status = dialUpgrade(t, proxyURL, "websocket")
+			assert.Equal(t, http.StatusServiceUnavailable, status)
+
+			_ = first.Close()
+			assert.Eventually(t, func() bool {
+				conn, _, status := dialUpgrade(t, proxyURL, "websocket")
+				_ = conn.Close()
+
+				return status == http.StatusSwitchingProtocols
+			}, 2*time.Second, 50*time.Millisecond)
+		})
+	}
+}
+
+func TestUpgrade_IdleTimeout(t *testing.T) {
+	upstream := newEchoUpgradeServer(t)
+	limits := UpgradeLimits{IdleTimeout: 100 * time.Millisecond}
+
+	for backend, proxyURL := range serveBackends(t, "/ws", upstream.URL, WithUpgradeLimits(limits)) {
+		t.Run(backend, func(t *testing.T) {
+			conn, reader, status := dialUpgrade(t, proxyURL, "websocket")
+			require.Equal(t, http.StatusSwitchingProtocols, status)
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			_, err := reader.ReadByte()
+			assert.ErrorIs(t, err, io.EOF, "Idle tunnel should be closed by the proxy")
+		})
+	}
+}
+
+func TestUpgrade_MaxMessageSize(t *testing.T) {
+	upstream := newEchoUpgradeServer(t)
+	limits := UpgradeLimits{MaxMessageSize: 4}
+
+	for backend, proxyURL := range serveBackends(t, "/ws", upstream.URL, WithUpgradeLimits(limits)) {
+		t.Run(backend, func(t *testing.T) {
+			conn, reader, status := dialUpgrade(t, proxyURL, "websocket")
+			require.Equal(t, http.StatusSwitchingProtocols, status)
+
+			// Masked text frame with a 3 byte payload is accepted and echoed.
+			small := []byte{0x81, 0x83, 0, 0, 0, 0, 'a', 'b', 'c'}
+			_, err := conn.Write(small)
+			require.NoError(t, err)
+
+			buf := make([]byte, len(small))
+			_, err = io.ReadFull(reader, buf)
+			require.NoError(t, err)
+			assert.Equal(t, small, buf)
+
+			// A 5 byte payload exceeds the limit and closes the tunnel.
+			_, err = conn.Write([]byte{0x81, 0x85, 0, 0, 0, 0, 'a', 'b', 'c', 'd', 'e'})
+			require.NoError(t, err)
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			_, err = reader.ReadByte()
+			assert.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestUpgrade_NotSwitched(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer upstream.Close()
+
+	limits := UpgradeLimits{MaxConnections: 1}
+	for backend, proxyURL := range serveBackends(t, "/ws", upstream.URL, WithUpgradeLimits(limits)) {
+		t.Run(backend, func(t *testing.T) {
+			for range 2 {
+				_, _, status := dialUpgrade(t, proxyURL, "websocket")
+				assert.Equal(t, http.StatusForbidden, status, "Refused upgrades must not hold a slot")
+			}
+		})
+	}
+}
+
+func TestFrameMeter(t *testing.T) {
+	meter := &frameMeter{max: 10}
+
+	// Fragmented message: 6 bytes, then a ping, then a final 4 bytes.
+	require.NoError(t, meter.feed([]byte{0x01, 0x06, 1, 2, 3, 4, 5, 6}))
+	require.NoError(t, meter.feed([]byte{0x89, 0x00}))
+	require.NoError(t, meter.feed([]byte{0x80, 0x04, 1, 2}))
+	require.NoError(t, meter.feed([]byte{3, 4}))
+
+	// A new message starts from zero.
+	require.NoError(t, meter.feed([]byte{0x82, 0x0a}))
+	require.NoError(t, meter.feed(make([]byte, 10)))
+
+	// Extended 16-bit length over the limit, split across writes.
+	require.NoError(t, meter.feed([]byte{0x82, 0x7e}))
+	assert.ErrorIs(t, meter.feed([]byte{0x00, 0x0b}), errMessageTooLarge)
+}
+
+func TestUpgradeType(t *testing.T) {
+	assert.Equal(t, "websocket", upgradeType("keep-alive, Upgrade", "websocket"))
+	assert.Empty(t, upgradeType("keep-alive", "websocket"))
+	assert.True(t, strings.EqualFold("h2c", upgradeType("upgrade", "h2c")))
+}
+
+func TestUpgradeTracker_Labels(t *testing.T) {
+	tracker := newUpgradeTracker("/ws", UpgradeLimits{})
+
+	tests := map[string]string{
+		"websocket":  "websocket",
+		"WebSocket":  "websocket",
+		"h2c":        "h2c",
+		"x-custom-1": "other",
+		"":           "other",
+	}
+	for protocol, want := range tests {
+		assert.Equal(t, want, tracker.labels(protocol)["protocol"], protocol)
+	}
+}
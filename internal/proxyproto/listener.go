@@ -0,0 +1,103 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/realip"
+)
+
+// DefaultReadHeaderTimeout bounds how long a trusted peer may take to send
+// its PROXY protocol header.
+const DefaultReadHeaderTimeout = 5 * time.Second
+
+// Listener accepts connections that may start with a PROXY protocol header.
+// Headers are only honored from peers in Trusted; connections from any other
+// peer are passed through untouched. Trusted peers may omit the header.
+type Listener struct {
+	net.Listener
+	Trusted           realip.TrustedProxies
+	ReadHeaderTimeout time.Duration
+}
+
+// Accept waits for the next connection. The header is read lazily on the
+// first Read, RemoteAddr or LocalAddr call, so a slow peer cannot block the
+// accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	peer := realip.AddrFromRemote(conn.RemoteAddr().String())
+	if !l.Trusted.Contains(peer) {
+		return conn, nil
+	}
+
+	timeout := l.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultReadHeaderTimeout
+	}
+
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Conn is a connection from a trusted peer whose addresses come from its
+// PROXY protocol header, when it sent one.
+type Conn struct {
+	net.Conn
+
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	header  *Header
+	err     error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = Read(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+// Header returns the PROXY protocol header, or nil when the peer sent none.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address announced in the header, or the
+// peer address.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address announced in the header, or the
+// local address.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
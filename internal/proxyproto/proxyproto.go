@@ -0,0 +1,237 @@
+// Package proxyproto reads and writes PROXY protocol v1 and v2 headers, which
+// carry the original client address across layer-4 load balancers.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol versions.
+const (
+	V1 = 1
+	V2 = 2
+)
+
+// v1MaxLength is the longest valid v1 header, including the CRLF.
+const v1MaxLength = 107
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ErrInvalidHeader is returned for malformed PROXY protocol headers.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Header is a parsed PROXY protocol header. Source and Destination are nil
+// for LOCAL (v2) and UNKNOWN (v1) headers, which carry no client address.
+type Header struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// Read parses a PROXY protocol header at the start of r. It returns a nil
+// header and no error when the stream does not start with one.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		if prefix, err := r.Peek(len(v1Prefix)); err != nil || !bytes.Equal(prefix, v1Prefix) {
+			return nil, nil //nolint:nilnil // not a PROXY protocol header
+		}
+
+		return readV1(r)
+	case v2Signature[0]:
+		if signature, err := r.Peek(len(v2Signature)); err != nil || !bytes.Equal(signature, v2Signature) {
+			return nil, nil //nolint:nilnil // not a PROXY protocol header
+		}
+
+		return readV2(r)
+	default:
+		return nil, nil //nolint:nilnil // not a PROXY protocol header
+	}
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: V1}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	source, err := parseV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+	destination, err := parseV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{Version: V1, Source: source, Destination: destination}, nil
+}
+
+func parseV1Addr(ip, port string, ipv4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != ipv4 {
+		return nil, ErrInvalidHeader
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(portNum))), nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := fixed[12], fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	header := &Header{Version: V2}
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL
+		return header, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var ipLength int
+	switch family >> 4 {
+	case 0x1:
+		ipLength = 4
+	case 0x2:
+		ipLength = 16
+	default:
+		// Unsupported families, such as unix sockets, carry no usable address.
+		return header, nil
+	}
+
+	transport := family & 0x0f
+	if (transport != 0x1 && transport != 0x2) || len(payload) < 2*ipLength+4 {
+		return nil, ErrInvalidHeader
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:ipLength])
+	dstIP, _ := netip.AddrFromSlice(payload[ipLength : 2*ipLength])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLength:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLength+2:])
+
+	if transport == 0x2 {
+		header.Source = net.UDPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+		header.Destination = net.UDPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	} else {
+		header.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+		header.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+	}
+
+	return header, nil
+}
+
+// Encode formats a header announcing a connection from source to
+// destination. Addresses that are missing or of different families produce
+// an UNKNOWN (v1) or LOCAL (v2) header.
+func Encode(version int, source, destination net.Addr) ([]byte, error) {
+	src, srcOK := addrPort(source)
+	dst, dstOK := addrPort(destination)
+	known := srcOK && dstOK && src.Addr().Is4() == dst.Addr().Is4()
+	_, udp := source.(*net.UDPAddr)
+
+	switch version {
+	case V1:
+		if !known || udp {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+
+		family := "TCP6"
+		if src.Addr().Is4() {
+			family = "TCP4"
+		}
+
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n",
+			family, src.Addr(), dst.Addr(), src.Port(), dst.Port()), nil
+	case V2:
+		header := append([]byte(nil), v2Signature...)
+		if !known {
+			return append(header, 0x20, 0x00, 0x00, 0x00), nil
+		}
+
+		family := byte(0x21)
+		if src.Addr().Is4() {
+			family = 0x11
+		}
+		if udp {
+			family++
+		}
+
+		srcIP, dstIP := src.Addr().AsSlice(), dst.Addr().AsSlice()
+		header = append(header, 0x21, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		header = binary.BigEndian.AppendUint16(header, src.Port())
+		header = binary.BigEndian.AppendUint16(header, dst.Port())
+
+		return header, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var addrPort netip.AddrPort
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		addrPort = addr.AddrPort()
+	case *net.UDPAddr:
+		addrPort = addr.AddrPort()
+	default:
+		return netip.AddrPort{}, false
+	}
+
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), addrPort.IsValid()
+}
@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/realip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		source  string
+		wantErr bool
+	}{
+		{name: "tcp4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", source: "192.0.2.1:56324"},
+		{name: "tcp6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\nGET", source: "[2001:db8::1]:1234"},
+		{name: "unknown", input: "PROXY UNKNOWN\r\nGET"},
+		{name: "family mismatch", input: "PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n", wantErr: true},
+		{name: "missing fields", input: "PROXY TCP4 192.0.2.1\r\n", wantErr: true},
+		{name: "no crlf", input: "PROXY TCP4 " + strings.Repeat("1", 120), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input))
+			header, err := Read(reader)
+			if tt.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, header)
+			assert.Equal(t, V1, header.Version)
+
+			if tt.source == "" {
+				assert.Nil(t, header.Source)
+			} else {
+				assert.Equal(t, tt.source, header.Source.String())
+			}
+
+			rest, _ := io.ReadAll(reader)
+			assert.Equal(t, "GET", string(rest))
+		})
+	}
+}
+
+func TestReadWithoutHeader(t *testing.T) {
+	for _, input := range []string{"GET / HTTP/1.1\r\n", "PUT /x HTTP/1.1\r\n", "\r\nfoo bar baz qux"} {
+		reader := bufio.NewReader(strings.NewReader(input))
+		header, err := Read(reader)
+		require.NoError(t, err)
+		assert.Nil(t, header)
+
+		rest, _ := io.ReadAll(reader)
+		assert.Equal(t, input, string(rest))
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tcp4Src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	tcp4Dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	tcp6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	tcp6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+	udpSrc := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	udpDst := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}
+
+	tests := []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+		known    bool
+	}{
+		{name: "v1 tcp4", version: V1, src: tcp4Src, dst: tcp4Dst, known: true},
+		{name: "v1 tcp6", version: V1, src: tcp6Src, dst: tcp6Dst, known: true},
+		{name: "v1 mixed families", version: V1, src: tcp4Src, dst: tcp6Dst},
+		{name: "v1 missing address", version: V1},
+		{name: "v2 tcp4", version: V2, src: tcp4Src, dst: tcp4Dst, known: true},
+		{name: "v2 tcp6", version: V2, src: tcp6Src, dst: tcp6Dst, known: true},
+		{name: "v2 udp4", version: V2, src: udpSrc, dst: udpDst, known: true},
+		{name: "v2 local", version: V2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := Encode(tt.version, tt.src, tt.dst)
+			require.NoError(t, err)
+
+			header, err := Read(bufio.NewReader(strings.NewReader(string(encoded) + "payload")))
+			require.NoError(t, err)
+			require.NotNil(t, header)
+			assert.Equal(t, tt.version, header.Version)
+
+			if !tt.known {
+				assert.Nil(t, header.Source)
+				assert.Nil(t, header.Destination)
+
+				return
+			}
+			assert.Equal(t, tt.src.String(), header.Source.String())
+			assert.Equal(t, tt.dst.String(), header.Destination.String())
+			assert.Equal(t, tt.src.Network(), header.Source.Network())
+		})
+	}
+
+	_, err := Encode(3, tcp4Src, tcp4Dst)
+	assert.Error(t, err)
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		prefix  string
+		remote  string
+		body    string
+	}{
+		{name: "trusted with header", trusted: []string{"127.0.0.0/8"},
+			prefix: "PROXY TCP4 203.0.113.7 127.0.0.1 4000 80\r\n", remote: "203.0.113.7:4000", body: "hello"},
+		{name: "trusted without header", trusted: []string{"127.0.0.0/8"}, remote: "127.0.0.1", body: "hello"},
+		{name: "untrusted header is not parsed", trusted: []string{"10.0.0.0/8"},
+			prefix: "PROXY TCP4 203.0.113.7 127.0.0.1 4000 80\r\n", remote: "127.0.0.1",
+			body: "PROXY TCP4 203.0.113.7 127.0.0.1 4000 80\r\nhello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := realip.ParseTrustedProxies(tt.trusted)
+			require.NoError(t, err)
+
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			listener := &Listener{Listener: inner, Trusted: trusted, ReadHeaderTimeout: time.Second}
+			defer func() {
+				_ = listener.Close()
+			}()
+
+			go func() {
+				conn, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer func() {
+					_ = conn.Close()
+				}()
+				_, _ = conn.Write([]byte(tt.prefix + "hello"))
+			}()
+
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			if strings.Contains(tt.remote, ":") {
+				assert.Equal(t, tt.remote, conn.RemoteAddr().String())
+			} else {
+				host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				assert.Equal(t, tt.remote, host)
+			}
+
+			body, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
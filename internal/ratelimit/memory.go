@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// shardCount splits the keys of a memory store so that concurrent requests
+// rarely wait for the same lock.
+const shardCount = 16
+
+// memoryStore keeps the state of up to maxKeys keys in memory and forgets
+// the least recently seen ones first. A forgotten key starts over with a
+// full quota.
+type memoryStore struct {
+	policy policy
+	seed   maphash.Seed
+	shards [shardCount]memoryShard
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	maxKeys int
+	lru     *list.List
+	items   map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key   string
+	state state
+}
+
+func newMemoryStore(p policy, maxKeys int) *memoryStore {
+	s := &memoryStore{policy: p, seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].maxKeys = max(maxKeys/shardCount, 1)
+		s.shards[i].lru = list.New()
+		s.shards[i].items = make(map[string]*list.Element)
+	}
+
+	return s
+}
+
+func (s *memoryStore) Take(key string, now time.Time) Decision {
+	shard := &s.shards[maphash.String(s.seed, key)%shardCount]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	elem, ok := shard.items[key]
+	if ok {
+		shard.lru.MoveToFront(elem)
+	} else {
+		elem = shard.lru.PushFront(&memoryEntry{key: key})
+		shard.items[key] = elem
+		for shard.lru.Len() > shard.maxKeys {
+			oldest := shard.lru.Back()
+			shard.lru.Remove(oldest)
+			delete(shard.items, oldest.Value.(*memoryEntry).key) //nolint:forcetypeassert // only entries are stored
+		}
+	}
+
+	entry := elem.Value.(*memoryEntry) //nolint:forcetypeassert // only entries are stored
+
+	return s.policy.take(&entry.state, now)
+}
+
+// len returns the number of tracked keys.
+func (s *memoryStore) len() int {
+	total := 0
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+		total += s.shards[i].lru.Len()
+		s.shards[i].mu.Unlock()
+	}
+
+	return total
+}
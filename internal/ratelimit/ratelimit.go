@@ -0,0 +1,360 @@
+// Package ratelimit limits the request rate of clients with token buckets or
+// sliding windows, keyed by client IP, a request header or a JWT claim.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+// Algorithms of a limit.
+const (
+	// TokenBucket refills Requests tokens per Period up to Burst; every
+	// request takes one token.
+	TokenBucket = "token_bucket"
+	// SlidingWindow allows Requests per Period, weighting the count of the
+	// previous period by how much of it still overlaps the window.
+	SlidingWindow = "sliding_window"
+)
+
+// Key kinds, see ParseKey.
+const (
+	KeyIP     = spec.KeyIP
+	KeyHeader = spec.KeyHeader
+	KeyJWT    = spec.KeyJWT
+)
+
+const (
+	defaultMaxKeys = 100_000
+	// maxKeyLength bounds the stored size of header and claim values; longer
+	// values are hashed.
+	maxKeyLength = 64
+)
+
+var (
+	requestsTotal = metrics.Default.CounterVec("proxier_rate_limit_requests_total",
+		"Requests checked against rate limits: allowed or limited.")
+	fallbackTotal = metrics.Default.CounterVec("proxier_rate_limit_fallback_total",
+		"Requests limited locally because Redis was unavailable.")
+)
+
+// Config configures a limit.
+type Config struct {
+	// Name identifies the limit in metrics, usually the route endpoint.
+	Name string
+	// Algorithm is TokenBucket (default) or SlidingWindow.
+	Algorithm string
+	// Requests are allowed per Period.
+	Requests int
+	Period   time.Duration
+	// Burst is the token bucket size; it defaults to Requests.
+	Burst int
+	// Key selects what requests are counted by, see ParseKey.
+	Key string
+	// MaxKeys bounds the number of keys tracked in memory. The least
+	// recently seen keys are forgotten first. It defaults to 100000.
+	MaxKeys int
+	// Redis, when set, keeps the state in a server shared by all proxies.
+	// The memory state is only used while Redis is unavailable.
+	Redis *Redis
+}
+
+// Decision is the outcome of a request against a limit.
+type Decision struct {
+	Allowed bool
+	// Limit is the quota: the bucket size or the requests per window.
+	Limit int
+	// Remaining is the quota left after the request.
+	Remaining int
+	// Reset is the time until the full quota is available again.
+	Reset time.Duration
+	// RetryAfter is the time until a rejected request would be allowed.
+	RetryAfter time.Duration
+}
+
+// Store keeps the state of the limited keys.
+type Store interface {
+	// Take counts one request of key at now.
+	Take(key string, now time.Time) Decision
+}
+
+// Key selects what a limit counts requests by.
+type Key struct {
+	Kind string
+	// Name is the header or claim name.
+	Name string
+}
+
+// ParseKey parses a key, see spec.ParseRateLimitKey.
+func ParseKey(key string) (Key, error) {
+	parsed, err := spec.ParseRateLimitKey(key)
+
+	return Key(parsed), err
+}
+
+// Request is the part of a client request limits are keyed on.
+type Request struct {
+	ClientIP netip.Addr
+	// Header returns the value of a request header.
+	Header func(name string) string
+}
+
+// value returns the store key of req. Requests without the header or claim
+// fall back to their client IP.
+func (k Key) value(req Request) string {
+	var value string
+	switch k.Kind {
+	case KeyHeader:
+		value = req.Header(k.Name)
+	case KeyJWT:
+		value = jwtClaim(req.Header("Authorization"), k.Name)
+	}
+	if value == "" {
+		return KeyIP + ":" + req.ClientIP.String()
+	}
+	if len(value) > maxKeyLength {
+		sum := sha256.Sum256([]byte(value))
+		value = hex.EncodeToString(sum[:])
+	}
+
+	return k.Kind + ":" + value
+}
+
+// jwtClaim returns a string or number claim of a bearer token, without
+// verifying it.
+func jwtClaim(authorization, claim string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch value := claims[claim].(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// Limiter applies one limit to requests.
+type Limiter struct {
+	key    Key
+	policy policy
+	store  Store
+	now    func() time.Time
+
+	allowed *metrics.Counter
+	limited *metrics.Counter
+}
+
+// New creates a limiter keeping its state in memory, or in cfg.Redis when
+// set.
+func New(cfg Config) (*Limiter, error) {
+	key, err := ParseKey(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	maxKeys := cfg.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	labels := func(result string) metrics.Labels {
+		return metrics.Labels{"endpoint": cfg.Name, "key": cfg.Key, "result": result}
+	}
+
+	var store Store = newMemoryStore(p, maxKeys)
+	if cfg.Redis != nil {
+		store = newRedisStore(cfg.Redis, p, cfg.Name, store)
+	}
+
+	return &Limiter{
+		key:     key,
+		policy:  p,
+		store:   store,
+		now:     time.Now,
+		allowed: requestsTotal.With(labels("allowed")),
+		limited: requestsTotal.With(labels("limited")),
+	}, nil
+}
+
+// Allow counts req and reports whether it is within the limit.
+func (l *Limiter) Allow(req Request) Decision {
+	decision := l.store.Take(l.key.value(req), l.now())
+	if decision.Allowed {
+		l.allowed.Inc()
+	} else {
+		l.limited.Inc()
+	}
+
+	return decision
+}
+
+// Policy describes the limit for the RateLimit-Policy header, such as
+// "100;w=60" or "100;w=60;burst=200".
+func (l *Limiter) Policy() string {
+	return l.policy.String()
+}
+
+// policy holds the parameters of a limit.
+type policy struct {
+	algorithm string
+	requests  int
+	burst     int
+	period    time.Duration
+}
+
+func newPolicy(cfg Config) (policy, error) {
+	p := policy{
+		algorithm: cfg.Algorithm,
+		requests:  cfg.Requests,
+		burst:     cfg.Burst,
+		period:    cfg.Period,
+	}
+	if p.algorithm == "" {
+		p.algorithm = TokenBucket
+	}
+	if p.algorithm != TokenBucket && p.algorithm != SlidingWindow {
+		return policy{}, fmt.Errorf("invalid rate limit algorithm %q", cfg.Algorithm)
+	}
+	if p.requests <= 0 || p.period < time.Millisecond || p.burst < 0 {
+		return policy{}, fmt.Errorf("rate limit needs positive requests and a period of at least 1ms, got %d per %s",
+			p.requests, p.period)
+	}
+	if p.burst == 0 || p.algorithm == SlidingWindow {
+		p.burst = p.requests
+	}
+
+	return p, nil
+}
+
+func (p policy) String() string {
+	window := strconv.FormatInt(int64(math.Ceil(p.period.Seconds())), 10)
+	if p.algorithm == TokenBucket && p.burst != p.requests {
+		return strconv.Itoa(p.requests) + ";w=" + window + ";burst=" + strconv.Itoa(p.burst)
+	}
+
+	return strconv.Itoa(p.requests) + ";w=" + window
+}
+
+// state is the state of one key. Token buckets hold the tokens left at
+// stamp; sliding windows hold the counts of the window starting at stamp
+// and of the one before.
+type state struct {
+	stamp    time.Time
+	tokens   float64
+	previous int
+	current  int
+}
+
+// take counts a request at now against s, which is zero for a new key.
+func (p policy) take(s *state, now time.Time) Decision {
+	if p.algorithm == SlidingWindow {
+		return p.takeWindow(s, now)
+	}
+
+	return p.takeBucket(s, now)
+}
+
+func (p policy) takeBucket(s *state, now time.Time) Decision {
+	rate := float64(p.requests) / p.period.Seconds()
+	capacity := float64(p.burst)
+	if s.stamp.IsZero() {
+		s.tokens = capacity
+	} else if elapsed := now.Sub(s.stamp).Seconds(); elapsed > 0 {
+		s.tokens = math.Min(capacity, s.tokens+elapsed*rate)
+	}
+	s.stamp = now
+
+	decision := Decision{Limit: p.burst}
+	if s.tokens >= 1 {
+		s.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = seconds((1 - s.tokens) / rate)
+	}
+	decision.Remaining = int(s.tokens)
+	decision.Reset = seconds((capacity - s.tokens) / rate)
+
+	return decision
+}
+
+func (p policy) takeWindow(s *state, now time.Time) Decision {
+	if s.stamp.IsZero() {
+		s.stamp = now
+	}
+	if passed := now.Sub(s.stamp) / p.period; passed > 0 {
+		if passed == 1 {
+			s.previous = s.current
+		} else {
+			s.previous = 0
+		}
+		s.current = 0
+		s.stamp = s.stamp.Add(passed * p.period)
+	}
+
+	elapsed := now.Sub(s.stamp)
+	overlap := 1 - elapsed.Seconds()/p.period.Seconds()
+	count := float64(s.previous)*overlap + float64(s.current)
+	limit := float64(p.requests)
+
+	decision := Decision{Limit: p.requests}
+	if count+1 <= limit {
+		s.current++
+		count++
+		decision.Allowed = true
+	} else if s.current+1 <= p.requests {
+		// The previous window must slide out far enough.
+		wait := p.period.Seconds()*(1-(limit-1-float64(s.current))/float64(s.previous)) - elapsed.Seconds()
+		decision.RetryAfter = seconds(wait)
+	} else {
+		// The current window must become the previous one and slide out.
+		wait := p.period.Seconds()*(1-(limit-1)/float64(s.current)) + (p.period - elapsed).Seconds()
+		decision.RetryAfter = seconds(wait)
+	}
+	decision.Remaining = max(int(limit-count), 0)
+
+	switch {
+	case s.current > 0:
+		decision.Reset = 2*p.period - elapsed
+	case s.previous > 0:
+		decision.Reset = p.period - elapsed
+	}
+
+	return decision
+}
+
+func seconds(value float64) time.Duration {
+	return max(time.Duration(value*float64(time.Second)), 0)
+}
@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"encoding/base64"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    Key
+		wantErr bool
+	}{
+		{key: "", want: Key{Kind: KeyIP}},
+		{key: "ip", want: Key{Kind: KeyIP}},
+		{key: "header:x-api-key", want: Key{Kind: KeyHeader, Name: "X-Api-Key"}},
+		{key: "jwt:sub", want: Key{Kind: KeyJWT, Name: "sub"}},
+		{key: "header:", wantErr: true},
+		{key: "header:a b", wantErr: true},
+		{key: "header:a:b", wantErr: true},
+		{key: "cookie:session", wantErr: true},
+		{key: "client", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			key, err := ParseKey(tt.key)
+			if tt.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, key)
+		})
+	}
+}
+
+func token(payload string) string {
+	return "Bearer e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestKey_Value(t *testing.T) {
+	client := netip.MustParseAddr("192.0.2.1")
+	long := strings.Repeat("k", 100)
+
+	tests := []struct {
+		name    string
+		key     string
+		headers map[string]string
+		want    string
+		hashed  bool
+	}{
+		{name: "ip", key: "ip", want: "ip:192.0.2.1"},
+		{name: "header", key: "header:X-API-Key", headers: map[string]string{"X-Api-Key": "secret"}, want: "header:secret"},
+		{name: "missing header", key: "header:X-API-Key", want: "ip:192.0.2.1"},
+		{name: "long header", key: "header:X-API-Key", headers: map[string]string{"X-Api-Key": long}, hashed: true},
+		{name: "jwt string", key: "jwt:sub", headers: map[string]string{"Authorization": token(`{"sub":"alice"}`)}, want: "jwt:alice"},
+		{name: "jwt number", key: "jwt:uid", headers: map[string]string{"Authorization": token(`{"uid":42}`)}, want: "jwt:42"},
+		{name: "jwt missing claim", key: "jwt:sub", headers: map[string]string{"Authorization": token(`{"uid":42}`)}, want: "ip:192.0.2.1"},
+		{name: "jwt not bearer", key: "jwt:sub", headers: map[string]string{"Authorization": "Basic YTpi"}, want: "ip:192.0.2.1"},
+		{name: "jwt malformed", key: "jwt:sub", headers: map[string]string{"Authorization": "Bearer abc.%%%.def"}, want: "ip:192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseKey(tt.key)
+			require.NoError(t, err)
+
+			value := key.value(Request{ClientIP: client, Header: func(name string) string {
+				return tt.headers[name]
+			}})
+			if tt.hashed {
+				assert.True(t, strings.HasPrefix(value, "header:"))
+				assert.Len(t, value, len("header:")+64)
+
+				return
+			}
+			assert.Equal(t, tt.want, value)
+		})
+	}
+}
+
+func TestPolicy_TokenBucket(t *testing.T) {
+	p, err := newPolicy(Config{Requests: 2, Period: time.Second, Burst: 3})
+	require.NoError(t, err)
+
+	start := time.Unix(1000, 0)
+	var s state
+	for i := range 3 {
+		d := p.take(&s, start)
+		require.True(t, d.Allowed, "request %d", i)
+		assert.Equal(t, 3, d.Limit)
+		assert.Equal(t, 2-i, d.Remaining)
+	}
+
+	d := p.take(&s, start)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, d.Reset)
+
+	// Half a second refills one token.
+	d = p.take(&s, start.Add(500*time.Millisecond))
+	assert.True(t, d.Allowed)
+	d = p.take(&s, start.Add(500*time.Millisecond))
+	assert.False(t, d.Allowed)
+
+	// The bucket never holds more than the burst.
+	d = p.take(&s, start.Add(time.Hour))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Remaining)
+}
+
+func TestPolicy_SlidingWindow(t *testing.T) {
+	p, err := newPolicy(Config{Algorithm: SlidingWindow, Requests: 4, Period: 10 * time.Second})
+	require.NoError(t, err)
+
+	start := time.Unix(1000, 0)
+	var s state
+	for i := range 4 {
+		d := p.take(&s, start)
+		require.True(t, d.Allowed, "request %d", i)
+		assert.Equal(t, 3-i, d.Remaining)
+	}
+
+	d := p.take(&s, start.Add(5*time.Second))
+	assert.False(t, d.Allowed)
+	// The current window must roll over and slide out by a quarter.
+	assert.Equal(t, 7500*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, 15*time.Second, d.Reset)
+
+	// 12.5s: the previous window (4 requests) still overlaps by 75%, so 3
+	// count and one request is allowed.
+	d = p.take(&s, start.Add(12500*time.Millisecond))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+
+	d = p.take(&s, start.Add(12500*time.Millisecond))
+	assert.False(t, d.Allowed)
+	// 4*(1-x)+1 <= 3 once x reaches 50%, 2.5s later.
+	assert.Equal(t, 2500*time.Millisecond, d.RetryAfter)
+
+	// Two idle periods forget all counts.
+	d = p.take(&s, start.Add(time.Minute))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 3, d.Remaining)
+}
+
+func TestPolicy_Invalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Requests: 0, Period: time.Second},
+		{Requests: 1, Period: 0},
+		{Requests: 1, Period: time.Second, Burst: -1},
+		{Algorithm: "leaky_bucket", Requests: 1, Period: time.Second},
+	} {
+		_, err := New(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+}
+
+func TestLimiter_Policy(t *testing.T) {
+	limiter, err := New(Config{Requests: 100, Period: time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, "100;w=60", limiter.Policy())
+
+	limiter, err = New(Config{Requests: 10, Period: time.Second, Burst: 50})
+	require.NoError(t, err)
+	assert.Equal(t, "10;w=1;burst=50", limiter.Policy())
+}
+
+func TestMemoryStore_MaxKeys(t *testing.T) {
+	p, err := newPolicy(Config{Requests: 1, Period: time.Hour})
+	require.NoError(t, err)
+
+	store := newMemoryStore(p, shardCount*4)
+	now := time.Unix(1000, 0)
+	for i := range 1000 {
+		store.Take("ip:"+strconv.Itoa(i), now)
+	}
+	assert.LessOrEqual(t, store.len(), shardCount*4)
+
+	// The most recent key is still limited.
+	assert.False(t, store.Take("ip:999", now).Allowed)
+}
+
+func TestLimiter_Concurrent(t *testing.T) {
+	limiter, err := New(Config{Name: "/concurrent", Requests: 50, Period: time.Hour, Key: "header:X-Key"})
+	require.NoError(t, err)
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := Request{ClientIP: netip.MustParseAddr("192.0.2.1"), Header: func(string) string {
+				return "key-" + strconv.Itoa(i%2)
+			}}
+			if limiter.Allow(req).Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(100), allowed.Load())
+}
@@ -0,0 +1,259 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisTimeout   = 100 * time.Millisecond
+	defaultRedisKeyPrefix = "proxier:ratelimit:"
+	// redisRetryInterval is how long limits stay local after Redis failed,
+	// so that an outage does not add the timeout to every request.
+	redisRetryInterval = time.Second
+)
+
+// tokenBucketScript applies a token bucket to the hash at KEYS[1], see
+// policy.takeBucket. ARGV holds the bucket size, the tokens refilled per
+// period, the period and the current time, both in milliseconds.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2]) / tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'stamp')
+local tokens = tonumber(state[1])
+local stamp = tonumber(state[2])
+if tokens == nil then
+  tokens = capacity
+  stamp = now
+elseif now > stamp then
+  tokens = math.min(capacity, tokens + (now - stamp) * rate)
+  stamp = now
+end
+
+local allowed, retry = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'stamp', stamp)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate) + 1000)
+
+return {allowed, math.floor(tokens), math.ceil((capacity - tokens) / rate), retry}
+`)
+
+// slidingWindowScript applies a sliding window to the hash at KEYS[1], see
+// policy.takeWindow. ARGV holds the requests per window, the window length
+// in milliseconds and the current time in milliseconds.
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call('HMGET', KEYS[1], 'start', 'previous', 'current')
+local start = tonumber(state[1]) or now
+local previous = tonumber(state[2]) or 0
+local current = tonumber(state[3]) or 0
+if now < start then
+  now = start
+end
+
+local passed = math.floor((now - start) / period)
+if passed > 0 then
+  if passed == 1 then
+    previous = current
+  else
+    previous = 0
+  end
+  current = 0
+  start = start + passed * period
+end
+
+local elapsed = now - start
+local count = previous * (1 - elapsed / period) + current
+local allowed, retry = 0, 0
+if count + 1 <= limit then
+  current = current + 1
+  count = count + 1
+  allowed = 1
+elseif current + 1 <= limit then
+  retry = period * (1 - (limit - 1 - current) / previous) - elapsed
+else
+  retry = period * (1 - (limit - 1) / current) + period - elapsed
+end
+
+local reset = 0
+if current > 0 then
+  reset = 2 * period - elapsed
+elseif previous > 0 then
+  reset = period - elapsed
+end
+
+redis.call('HSET', KEYS[1], 'start', start, 'previous', previous, 'current', current)
+redis.call('PEXPIRE', KEYS[1], 2 * period)
+
+return {allowed, math.max(math.floor(limit - count), 0), math.ceil(reset), math.ceil(retry)}
+`)
+
+// RedisConfig configures the connection to a Redis-compatible server shared
+// by the limiters of all proxies.
+type RedisConfig struct {
+	// Address is "host:port".
+	Address  string
+	Username string
+	Password string
+	DB       int
+	TLS      bool
+	// KeyPrefix is prepended to every key; it defaults to
+	// "proxier:ratelimit:".
+	KeyPrefix string
+	// Timeout bounds every command; it defaults to 100ms.
+	Timeout time.Duration
+}
+
+// Redis keeps limits in a Redis-compatible server, so that they apply
+// across proxies. While the server is unavailable, limiters fall back to
+// their local state.
+type Redis struct {
+	client  redis.UniversalClient
+	prefix  string
+	timeout time.Duration
+	now     func() time.Time
+
+	// retryAt is the Unix time in nanoseconds until which Redis is not
+	// used after a failure.
+	retryAt atomic.Int64
+	down    atomic.Bool
+}
+
+// NewRedis creates the client of a Redis server. No connection is made
+// until the first request.
+func NewRedis(cfg RedisConfig) *Redis {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultRedisTimeout
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = defaultRedisKeyPrefix
+	}
+
+	opts := &redis.Options{
+		Addr:         cfg.Address,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		DialTimeout:  cfg.Timeout,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+		MaxRetries:   -1,
+	}
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	return &Redis{
+		client:  redis.NewClient(opts),
+		prefix:  cfg.KeyPrefix,
+		timeout: cfg.Timeout,
+		now:     time.Now,
+	}
+}
+
+// Close closes the connections to the server.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// available reports whether Redis should be tried.
+func (r *Redis) available() bool {
+	return r.now().UnixNano() >= r.retryAt.Load()
+}
+
+// failed records an error, so that Redis is skipped for a while.
+func (r *Redis) failed(err error) {
+	r.retryAt.Store(r.now().Add(redisRetryInterval).UnixNano())
+	if r.down.CompareAndSwap(false, true) {
+		log.Printf("[RateLimit] redis unavailable, using local limits: %v", err)
+	}
+}
+
+// succeeded records a successful command after a failure.
+func (r *Redis) succeeded() {
+	if r.down.Load() && r.down.CompareAndSwap(true, false) {
+		log.Printf("[RateLimit] redis available again")
+	}
+}
+
+// redisStore keeps the state of a limiter in Redis and falls back to local
+// state while Redis is unavailable.
+type redisStore struct {
+	redis    *Redis
+	policy   policy
+	prefix   string
+	local    Store
+	fallback *metrics.Counter
+}
+
+func newRedisStore(r *Redis, p policy, name string, local Store) *redisStore {
+	return &redisStore{
+		redis:  r,
+		policy: p,
+		// Limits of different routes and settings never share keys.
+		prefix:   r.prefix + name + ":" + p.algorithm + ":" + p.String() + ":",
+		local:    local,
+		fallback: fallbackTotal.With(metrics.Labels{"endpoint": name}),
+	}
+}
+
+func (s *redisStore) Take(key string, now time.Time) Decision {
+	if s.redis.available() {
+		decision, err := s.take(key, now)
+		if err == nil {
+			s.redis.succeeded()
+
+			return decision
+		}
+		s.redis.failed(err)
+	}
+	s.fallback.Inc()
+
+	return s.local.Take(key, now)
+}
+
+func (s *redisStore) take(key string, now time.Time) (Decision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.redis.timeout)
+	defer cancel()
+
+	script, args := tokenBucketScript, []any{
+		s.policy.burst, s.policy.requests, s.policy.period.Milliseconds(), now.UnixMilli(),
+	}
+	if s.policy.algorithm == SlidingWindow {
+		script, args = slidingWindowScript, []any{s.policy.requests, s.policy.period.Milliseconds(), now.UnixMilli()}
+	}
+
+	result, err := script.Run(ctx, s.redis.client, []string{s.prefix + key}, args...).Int64Slice()
+	if err != nil {
+		return Decision{}, err
+	}
+	if len(result) != 4 {
+		return Decision{}, fmt.Errorf("unexpected rate limit script result %v", result)
+	}
+
+	return Decision{
+		Allowed:    result[0] == 1,
+		Limit:      s.policy.burst,
+		Remaining:  int(result[1]),
+		Reset:      time.Duration(result[2]) * time.Millisecond,
+		RetryAfter: time.Duration(result[3]) * time.Millisecond,
+	}, nil
+}
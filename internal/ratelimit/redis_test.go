@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *Redis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := NewRedis(RedisConfig{Address: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return server, client
+}
+
+func ipRequest(addr string) Request {
+	return Request{ClientIP: netip.MustParseAddr(addr), Header: func(string) string { return "" }}
+}
+
+// TestRedis_MatchesMemory runs the same requests through a memory and a
+// Redis store and expects the same decisions.
+func TestRedis_MatchesMemory(t *testing.T) {
+	_, client := newTestRedis(t)
+	start := time.UnixMilli(1_700_000_000_000)
+	offsets := []time.Duration{
+		0, 0, 0, 0, 0, 500 * time.Millisecond, 2 * time.Second, 2 * time.Second,
+		12500 * time.Millisecond, 12500 * time.Millisecond, 13 * time.Second, time.Minute,
+	}
+
+	for _, cfg := range []Config{
+		{Name: t.Name(), Requests: 2, Period: time.Second, Burst: 3},
+		{Name: t.Name(), Algorithm: SlidingWindow, Requests: 4, Period: 10 * time.Second},
+	} {
+		t.Run(cfg.Algorithm, func(t *testing.T) {
+			p, err := newPolicy(cfg)
+			require.NoError(t, err)
+
+			memory := newMemoryStore(p, defaultMaxKeys)
+			redis := newRedisStore(client, p, cfg.Name, newMemoryStore(p, defaultMaxKeys))
+			for i, offset := range offsets {
+				want := memory.Take("ip:192.0.2.1", start.Add(offset))
+				got, err := redis.take("ip:192.0.2.1", start.Add(offset))
+				require.NoError(t, err)
+
+				assert.Equal(t, want.Allowed, got.Allowed, "request %d", i)
+				assert.Equal(t, want.Remaining, got.Remaining, "request %d", i)
+				assert.InDelta(t, want.Reset, got.Reset, float64(time.Millisecond), "request %d", i)
+				assert.InDelta(t, want.RetryAfter, got.RetryAfter, float64(time.Millisecond), "request %d", i)
+			}
+		})
+	}
+}
+
+func TestRedis_SharedAcrossLimiters(t *testing.T) {
+	server, client := newTestRedis(t)
+
+	cfg := Config{Name: "/shared", Requests: 3, Period: time.Minute, Redis: client}
+	first, err := New(cfg)
+	require.NoError(t, err)
+	second, err := New(cfg)
+	require.NoError(t, err)
+
+	req := ipRequest("192.0.2.1")
+	assert.True(t, first.Allow(req).Allowed)
+	assert.True(t, second.Allow(req).Allowed)
+	decision := first.Allow(req)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.False(t, second.Allow(req).Allowed)
+
+	// Other clients are counted separately.
+	assert.True(t, second.Allow(ipRequest("192.0.2.2")).Allowed)
+
+	// Idle keys expire.
+	key := defaultRedisKeyPrefix + "/shared:token_bucket:3;w=60:ip:192.0.2.1"
+	require.True(t, server.Exists(key))
+	assert.Positive(t, server.TTL(key))
+}
+
+func TestRedis_Fallback(t *testing.T) {
+	server, client := newTestRedis(t)
+	now := time.Unix(1000, 0)
+	client.now = func() time.Time { return now }
+
+	limiter, err := New(Config{Name: t.Name(), Requests: 2, Period: time.Hour, Redis: client})
+	require.NoError(t, err)
+	limiter.now = client.now
+
+	req := ipRequest("192.0.2.1")
+	assert.True(t, limiter.Allow(req).Allowed)
+
+	// Without Redis the local state applies, starting with a full quota.
+	server.Close()
+	assert.True(t, limiter.Allow(req).Allowed)
+	assert.True(t, limiter.Allow(req).Allowed)
+	assert.False(t, limiter.Allow(req).Allowed)
+	assert.True(t, client.down.Load())
+
+	// Redis is tried again after the retry interval.
+	require.NoError(t, server.Restart())
+	assert.False(t, limiter.Allow(req).Allowed)
+	now = now.Add(redisRetryInterval)
+	assert.True(t, limiter.Allow(req).Allowed)
+	assert.False(t, client.down.Load())
+}
@@ -0,0 +1,129 @@
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Prefixes is a set of networks, such as the clients allowed to reach a
+// route.
+type Prefixes []netip.Prefix
+
+// ParsePrefixes parses a list of CIDRs or single IP addresses.
+func ParsePrefixes(list []string) (Prefixes, error) {
+	prefixes := make(Prefixes, 0, len(list))
+
+	for _, entry := range list {
+		prefix, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// Contains reports whether addr belongs to one of the networks.
+func (p Prefixes) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TrustedProxies is a list of networks whose forwarding headers are trusted.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a list of CIDRs or single IP addresses.
+func ParseTrustedProxies(list []string) (TrustedProxies, error) {
+	prefixes, err := ParsePrefixes(list)
+
+	return TrustedProxies(prefixes), err
+}
+
+// ParsePrefix parses a CIDR, or a single IP address as a host prefix.
+func ParsePrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address %q: %w", entry, err)
+	}
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Contains reports whether addr belongs to one of the trusted networks.
+func (t TrustedProxies) Contains(addr netip.Addr) bool {
+	return Prefixes(t).Contains(addr)
+}
+
+// ClientIP returns the address of the original client. The X-Forwarded-For
+// chain is only consulted when the peer is trusted, and it is walked from the
+// right so that a client cannot spoof its address by prepending entries.
+func (t TrustedProxies) ClientIP(peer netip.Addr, xff string) netip.Addr {
+	peer = peer.Unmap()
+	if !t.Contains(peer) || xff == "" {
+		return peer
+	}
+
+	hops := strings.Split(xff, ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !t.Contains(client) {
+			break
+		}
+	}
+
+	return client
+}
+
+// AddrFromRemote parses the address part of a "host:port" remote address.
+func AddrFromRemote(remoteAddr string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	return addr.Unmap()
+}
+
+// AddrFromIP converts a net.IP to a netip.Addr.
+func AddrFromIP(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+
+	return addr.Unmap()
+}
@@ -0,0 +1,72 @@
+package realip
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes([]string{"203.0.113.0/24", "2001:db8::1"})
+	require.NoError(t, err)
+
+	assert.True(t, prefixes.Contains(netip.MustParseAddr("203.0.113.7")))
+	assert.True(t, prefixes.Contains(netip.MustParseAddr("::ffff:203.0.113.7")))
+	assert.True(t, prefixes.Contains(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, prefixes.Contains(netip.MustParseAddr("198.51.100.1")))
+
+	_, err = ParsePrefixes([]string{"203.0.113.0/24", "bad"})
+	assert.Error(t, err)
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	require.NoError(t, err)
+
+	assert.True(t, trusted.Contains(netip.MustParseAddr("10.1.2.3")))
+	assert.True(t, trusted.Contains(netip.MustParseAddr("192.168.1.1")))
+	assert.True(t, trusted.Contains(netip.MustParseAddr("::ffff:10.0.0.1")))
+	assert.True(t, trusted.Contains(netip.MustParseAddr("::1")))
+	assert.False(t, trusted.Contains(netip.MustParseAddr("192.168.1.2")))
+
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		want string
+	}{
+		{"untrusted peer ignores header", "203.0.113.1", "198.51.100.1", "203.0.113.1"},
+		{"trusted peer without header", "10.0.0.1", "", "10.0.0.1"},
+		{"trusted peer uses header", "10.0.0.1", "198.51.100.1", "198.51.100.1"},
+		{"skips trusted hops", "10.0.0.1", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"stops at first untrusted hop", "10.0.0.1", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"stops at garbage", "10.0.0.1", "198.51.100.1, garbage", "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := trusted.ClientIP(netip.MustParseAddr(tt.peer), tt.xff)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestAddrFromRemote(t *testing.T) {
+	assert.Equal(t, "127.0.0.1", AddrFromRemote("127.0.0.1:8080").String())
+	assert.Equal(t, "::1", AddrFromRemote("[::1]:8080").String())
+	assert.Equal(t, "10.0.0.1", AddrFromRemote("10.0.0.1").String())
+	assert.False(t, AddrFromRemote("@").IsValid())
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/ezex-io/proxier/internal/metrics"
+)
+
+const (
+	// AdminPurgePath is the admin API endpoint purging cached responses.
+	AdminPurgePath = "/cache/purge"
+	// AdminMetricsPath is the admin API endpoint serving Prometheus metrics.
+	AdminMetricsPath = "/metrics"
+)
+
+type adminServer struct {
+	httpServer *http.Server
+	errCh      chan error
+	log        *slog.Logger
+}
+
+func newAdmin(log *slog.Logger, cfg *config.AdminConfig) Server {
+	mux := http.NewServeMux()
+	mux.Handle(AdminPurgePath, cache.Default.Handler())
+	mux.Handle(AdminMetricsPath, metrics.Default.Handler())
+
+	log.Info("Registered admin API", "listen", cfg.Listen, "authentication", cfg.Token != "")
+
+	return &adminServer{
+		httpServer: &http.Server{
+			Addr:              cfg.Listen,
+			Handler:           requireToken(cfg.Token, mux),
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+		},
+		errCh: make(chan error, 1),
+		log:   log,
+	}
+}
+
+// requireToken rejects requests without the bearer token, unless token is
+// empty.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxier"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *adminServer) Start() {
+	go func() {
+		s.log.Info("starting admin API", "address", s.httpServer.Addr)
+
+		listener, err := listen("tcp", s.httpServer.Addr, nil)
+		if err != nil {
+			s.errCh <- fmt.Errorf("admin API error: %w", err)
+
+			return
+		}
+
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.errCh <- fmt.Errorf("admin API error: %w", err)
+		}
+	}()
+}
+
+func (s *adminServer) Notify() <-chan error {
+	return s.errCh
+}
+
+func (s *adminServer) Stop(ctx context.Context) {
+	s.log.Info("shutting down admin API...")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+		s.log.Error("admin API forced to shutdown", "error", err)
+	} else {
+		s.log.Info("admin API stopped")
+	}
+}
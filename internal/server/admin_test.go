@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminPurge(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	port := freePort(t)
+	admin := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	srv, err := New(&config.Config{
+		Server: &config.ServerConfig{Host: "127.0.0.1", ListenPort: port},
+		Proxy: []*config.ProxyRule{{
+			Endpoint:       "/admin-purge",
+			DestinationURL: backend.URL,
+			Cache:          &config.CacheConfig{},
+		}},
+		Admin: &config.AdminConfig{Listen: admin, Token: "secret"},
+	}, log)
+	require.NoError(t, err)
+
+	srv.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	}()
+
+	get := func() string {
+		resp, err := http.Get("http://127.0.0.1:" + port + "/admin-purge/item")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		return resp.Header.Get("X-Cache")
+	}
+	purge := func(token string) (int, string) {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodPost, "http://"+admin+AdminPurgePath,
+			strings.NewReader(`{"route": "/admin-purge"}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		return resp.StatusCode, string(body)
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", admin)
+
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	get()
+	assert.Equal(t, cache.Hit, get())
+
+	status, _ := purge("wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, cache.Hit, get())
+
+	status, body := purge("secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"purged": 1}`, body)
+	assert.Equal(t, cache.Miss, get())
+}
+
+func TestAdminMetrics(t *testing.T) {
+	admin, ok := newAdmin(log, &config.AdminConfig{Token: "secret"}).(*adminServer)
+	require.True(t, ok)
+
+	testServer := httptest.NewServer(admin.httpServer.Handler)
+	defer testServer.Close()
+
+	get := func(url, token string) (int, string) {
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := get(testServer.URL+AdminMetricsPath, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, body := get(testServer.URL+AdminMetricsPath, "secret")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "# TYPE proxier_cache_requests_total counter")
+
+	// The proxy listener does not expose metrics.
+	srv, err := NewHTTP(log, serverConfig, proxyRules)
+	require.NoError(t, err)
+	sv, ok := srv.(*httpServer)
+	require.True(t, ok)
+	proxyServer := httptest.NewServer(sv.httpServer.Handler)
+	defer proxyServer.Close()
+
+	_, body = get(proxyServer.URL+"/metrics", "")
+	assert.NotContains(t, body, "# TYPE")
+}
@@ -8,24 +8,55 @@ import (
 	"time"
 
 	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/geoip"
 	"github.com/ezex-io/proxier/internal/proxy"
+	"github.com/ezex-io/proxier/internal/ratelimit"
 	"github.com/valyala/fasthttp"
 )
 
 type fastHTTPServer struct {
-	sv     *fasthttp.Server
-	errCh  chan error
-	log    *slog.Logger
-	addr   string
-	cancel context.CancelFunc
+	sv            *fasthttp.Server
+	tls           *config.TLSConfig
+	proxyProtocol *config.ProxyProtocolConfig
+	errCh         chan error
+	limitRedis    *ratelimit.Redis
+	geoIP         *geoip.DB
+	log           *slog.Logger
+	addr          string
+	ctx           context.Context
+	cancel        context.CancelFunc
 }
 
 func newFastHTTP(log *slog.Logger, cfg *config.ServerConfig, proxyRules []*config.ProxyRule) (Server, error) {
 	handlers := make(map[string]fasthttp.RequestHandler)
 
+	defaults, err := newRuleDefaults(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upstream requests are cancelled once the server stops.
+	baseCtx, cancel := context.WithCancel(context.Background())
+
 	for _, rule := range proxyRules {
-		endpoint, handler, err := proxy.FastHTTPHandler(rule.Endpoint, rule.DestinationURL)
+		if rule.Type == config.RuleTypeGRPC {
+			cancel()
+
+			return nil, fmt.Errorf("gRPC proxy rule %s is not supported with fasthttp", rule.Endpoint)
+		}
+
+		opts, err := proxyOptions(rule, defaults)
+		if err != nil {
+			cancel()
+
+			return nil, fmt.Errorf("invalid proxy rule %s: %w", rule.Endpoint, err)
+		}
+		opts = append(opts, proxy.WithBaseContext(baseCtx))
+
+		endpoint, handler, err := proxy.FastHTTPHandler(rule.Endpoint, rule.DestinationURL, opts...)
 		if err != nil {
+			cancel()
+
 			return nil, fmt.Errorf("failed to create fasthttp proxy handler for %s: %w", rule.Endpoint, err)
 		}
 		handlers[endpoint] = handler
@@ -70,7 +101,7 @@ func newFastHTTP(log *slog.Logger, cfg *config.ServerConfig, proxyRules []*confi
 			ReadBufferSize:        4096,
 			WriteBufferSize:       4096,
 			ReadTimeout:           10 * time.Second,
-			WriteTimeout:          15 * time.Second,
+			WriteTimeout:          writeTimeout,
 			IdleTimeout:           60 * time.Second,
 			MaxRequestsPerConn:    1000,
 			MaxConnsPerIP:         100,
@@ -87,24 +118,49 @@ func newFastHTTP(log *slog.Logger, cfg *config.ServerConfig, proxyRules []*confi
 				ctx.SetBodyString("Internal Server Error")
 			},
 		},
-		errCh: make(chan error, 1),
-		log:   log,
-		addr:  fmt.Sprintf("%s:%s", cfg.Host, cfg.ListenPort),
+		tls:           cfg.TLS,
+		proxyProtocol: cfg.ProxyProtocol,
+		errCh:         make(chan error, 1),
+		limitRedis:    defaults.limitRedis,
+		geoIP:         defaults.geoIP,
+		log:           log,
+		addr:          fmt.Sprintf("%s:%s", cfg.Host, cfg.ListenPort),
+		ctx:           baseCtx,
+		cancel:        cancel,
+	}
+
+	// With proxy_protocol, the limit applies to the client address read
+	// from the header.
+	switch {
+	case cfg.MaxConnsPerIP < 0:
+		srv.sv.MaxConnsPerIP = 0
+	case cfg.MaxConnsPerIP > 0:
+		srv.sv.MaxConnsPerIP = cfg.MaxConnsPerIP
 	}
 
 	return srv, nil
 }
 
 func (s *fastHTTPServer) Start() {
-	ctx, cancel := context.WithCancel(context.Background())
-	s.cancel = cancel
+	if s.geoIP != nil {
+		go s.geoIP.Run(s.ctx)
+	}
 
 	go func() {
 		s.log.Info("starting fasthttp server", "address", s.addr)
-		if err := s.sv.ListenAndServe(s.addr); err != nil {
+		listener, err := listen("tcp4", s.addr, s.proxyProtocol)
+		if err == nil {
+			if s.tls != nil {
+				err = s.sv.ServeTLS(listener, s.tls.CertFile, s.tls.KeyFile)
+			} else {
+				err = s.sv.Serve(listener)
+			}
+		}
+
+		if err != nil {
 			s.errCh <- fmt.Errorf("fasthttp server error: %w", err)
 		}
-		<-ctx.Done()
+		<-s.ctx.Done()
 	}()
 }
 
@@ -112,13 +168,22 @@ func (s *fastHTTPServer) Notify() <-chan error {
 	return s.errCh
 }
 
-func (s *fastHTTPServer) Stop(_ context.Context) {
+func (s *fastHTTPServer) Stop(ctx context.Context) {
 	s.log.Info("shutting down fasthttp server...")
 
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Requests still running past the grace period are cancelled upstream,
+	// so that their handlers return.
+	err := s.sv.ShutdownWithContext(shutdownCtx)
 	s.cancel()
-	if err := s.sv.Shutdown(); err != nil {
+	if err != nil {
 		s.log.Error("failed to shutdown fasthttp server", "error", err)
 	} else {
 		s.log.Info("fasthttp server stopped")
 	}
+	if s.limitRedis != nil {
+		_ = s.limitRedis.Close()
+	}
 }
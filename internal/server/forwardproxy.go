@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/forwardproxy"
+)
+
+type forwardProxyServer struct {
+	httpServer *http.Server
+	errCh      chan error
+	log        *slog.Logger
+}
+
+func newForwardProxy(log *slog.Logger, cfg *config.ForwardProxyConfig) (Server, error) {
+	authenticator, err := egressAuth(cfg.Users, cfg.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := forwardproxy.New(forwardproxy.Config{
+		Allow: cfg.Allow,
+		Deny:  cfg.Deny,
+		Auth:  authenticator,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Registered forward proxy", "listen", cfg.Listen, "authentication", authenticator != nil)
+
+	return &forwardProxyServer{
+		httpServer: &http.Server{
+			Addr:    cfg.Listen,
+			Handler: handler,
+			// No read or write timeouts, CONNECT tunnels are long-lived.
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+		},
+		errCh: make(chan error, 1),
+		log:   log,
+	}, nil
+}
+
+func (s *forwardProxyServer) Start() {
+	go func() {
+		s.log.Info("starting forward proxy", "address", s.httpServer.Addr)
+
+		listener, err := listen("tcp", s.httpServer.Addr, nil)
+		if err != nil {
+			s.errCh <- fmt.Errorf("forward proxy error: %w", err)
+
+			return
+		}
+
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.errCh <- fmt.Errorf("forward proxy error: %w", err)
+		}
+	}()
+}
+
+func (s *forwardProxyServer) Notify() <-chan error {
+	return s.errCh
+}
+
+func (s *forwardProxyServer) Stop(ctx context.Context) {
+	s.log.Info("shutting down forward proxy...")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Shutdown does not wait for hijacked CONNECT tunnels.
+	if err := s.httpServer.Shutdown(shutdownCtx); err != nil {
+		s.log.Error("forward proxy forced to shutdown", "error", err)
+	} else {
+		s.log.Info("forward proxy stopped")
+	}
+}
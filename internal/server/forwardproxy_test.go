@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardProxyLifecycle(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	listen := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	srv, err := New(&config.Config{
+		Server: &config.ServerConfig{Host: "127.0.0.1", ListenPort: freePort(t)},
+		ForwardProxy: &config.ForwardProxyConfig{
+			Listen: listen,
+			Allow:  []string{"127.0.0.1"},
+		},
+	}, log)
+	require.NoError(t, err)
+
+	srv.Start()
+
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: listen})},
+		Timeout:   time.Second,
+	}
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = client.Get(backend.URL)
+
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "backend", string(body))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Stop(ctx)
+
+	_, err = net.Dial("tcp", listen)
+	assert.Error(t, err)
+}
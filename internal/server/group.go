@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// group runs several servers as one: errors of any member are reported by
+// Notify and Stop shuts members down in reverse start order.
+type group struct {
+	servers []Server
+	errCh   chan error
+	once    sync.Once
+}
+
+func newGroup(servers ...Server) *group {
+	return &group{
+		servers: servers,
+		errCh:   make(chan error, len(servers)),
+	}
+}
+
+func (g *group) Start() {
+	for _, srv := range g.servers {
+		srv.Start()
+	}
+
+	g.once.Do(func() {
+		for _, srv := range g.servers {
+			go func() {
+				if err, ok := <-srv.Notify(); ok {
+					g.errCh <- err
+				}
+			}()
+		}
+	})
+}
+
+func (g *group) Notify() <-chan error {
+	return g.errCh
+}
+
+func (g *group) Stop(ctx context.Context) {
+	for i := len(g.servers) - 1; i >= 0; i-- {
+		g.servers[i].Stop(ctx)
+	}
+}
@@ -9,13 +9,21 @@ import (
 	"time"
 
 	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/geoip"
 	"github.com/ezex-io/proxier/internal/proxy"
+	"github.com/ezex-io/proxier/internal/ratelimit"
 )
 
 type httpServer struct {
-	httpServer *http.Server
-	errCh      chan error
-	log        *slog.Logger
+	httpServer    *http.Server
+	tls           *config.TLSConfig
+	proxyProtocol *config.ProxyProtocolConfig
+	checkers      []*proxy.GRPCHealthChecker
+	cancel        context.CancelFunc
+	errCh         chan error
+	limitRedis    *ratelimit.Redis
+	geoIP         *geoip.DB
+	log           *slog.Logger
 }
 
 func NewHTTP(log *slog.Logger, serverCfg *config.ServerConfig, proxyRules []*config.ProxyRule) (Server, error) {
@@ -31,8 +39,40 @@ func NewHTTP(log *slog.Logger, serverCfg *config.ServerConfig, proxyRules []*con
 		_, _ = w.Write([]byte("OK"))
 	})
 
+	defaults, err := newRuleDefaults(serverCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	checkers := make([]*proxy.GRPCHealthChecker, 0)
 	for _, rule := range proxyRules {
-		endpoint, handler, err := proxy.HTTPHandler(rule.Endpoint, rule.DestinationURL)
+		opts, err := proxyOptions(rule, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy rule %s: %w", rule.Endpoint, err)
+		}
+
+		if rule.Type == config.RuleTypeGRPC {
+			if rule.HealthCheck != nil {
+				checker, err := newGRPCHealthChecker(rule)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create health checker for endpoint %s: %w", rule.Endpoint, err)
+				}
+				checkers = append(checkers, checker)
+				opts = append(opts, proxy.WithHealthChecker(checker))
+			}
+
+			endpoint, handler, err := proxy.GRPCHandler(rule.Endpoint, rule.DestinationURL, opts...)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create gRPC proxy handler for endpoint %s: %w", rule.Endpoint, err)
+			}
+
+			mux.Handle(endpoint, handler)
+			log.Info("Registered gRPC route", "endpoint", rule.Endpoint, "destination", rule.DestinationURL)
+
+			continue
+		}
+
+		endpoint, handler, err := proxy.HTTPHandler(rule.Endpoint, rule.DestinationURL, opts...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create proxy handler for endpoint %s: %w", endpoint, err)
 		}
@@ -46,22 +86,51 @@ func NewHTTP(log *slog.Logger, serverCfg *config.ServerConfig, proxyRules []*con
 		Addr:         fmt.Sprintf("%s:%s", serverCfg.Host, serverCfg.ListenPort),
 		Handler:      mux,
 		ReadTimeout:  10 * time.Second, // Prevent slow client attacks
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  60 * time.Second, // Keep connections alive for long-lived clients
+		Protocols:    listenerProtocols(serverCfg),
 	}
 
 	return &httpServer{
-		httpServer: srv,
-		errCh:      make(chan error, 1),
-		log:        log,
+		httpServer:    srv,
+		tls:           serverCfg.TLS,
+		proxyProtocol: serverCfg.ProxyProtocol,
+		checkers:      checkers,
+		errCh:         make(chan error, 1),
+		limitRedis:    defaults.limitRedis,
+		geoIP:         defaults.geoIP,
+		log:           log,
 	}, nil
 }
 
 func (s *httpServer) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	for _, checker := range s.checkers {
+		go checker.Run(ctx)
+	}
+	if s.geoIP != nil {
+		go s.geoIP.Run(ctx)
+	}
+
 	go func() {
 		s.log.Info("starting server", "address", s.httpServer.Addr)
 
-		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		listener, err := listen("tcp", s.httpServer.Addr, s.proxyProtocol)
+		if err != nil {
+			s.errCh <- fmt.Errorf("server error: %w", err)
+
+			return
+		}
+
+		if s.tls != nil {
+			err = s.httpServer.ServeTLS(listener, s.tls.CertFile, s.tls.KeyFile)
+		} else {
+			err = s.httpServer.Serve(listener)
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			s.errCh <- fmt.Errorf("server error: %w", err)
 		}
 	}()
@@ -74,6 +143,10 @@ func (s *httpServer) Notify() <-chan error {
 func (s *httpServer) Stop(ctx context.Context) {
 	s.log.Info("shutting down server...")
 
+	if s.cancel != nil {
+		s.cancel()
+	}
+
 	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
@@ -82,4 +155,17 @@ func (s *httpServer) Stop(ctx context.Context) {
 	} else {
 		s.log.Info("server gracefully stopped")
 	}
+	if s.limitRedis != nil {
+		_ = s.limitRedis.Close()
+	}
+}
+
+// listenerProtocols returns the protocols accepted by the listener.
+func listenerProtocols(cfg *config.ServerConfig) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(cfg.TLS != nil && cfg.HTTP2)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+
+	return protocols
 }
@@ -1,14 +1,28 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/ezex-io/proxier/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -110,3 +124,374 @@ func TestServerStartStop(t *testing.T) {
 	defer cancel()
 	srv.Stop(ctx)
 }
+
+func TestH2CListener(t *testing.T) {
+	cfg := &config.ServerConfig{
+		Host:       "127.0.0.1",
+		ListenPort: "8080",
+		H2C:        true,
+	}
+
+	srv, err := NewHTTP(log, cfg, proxyRules)
+	require.NoError(t, err)
+
+	sv, ok := srv.(*httpServer)
+	require.True(t, ok)
+
+	testServer := httptest.NewUnstartedServer(sv.httpServer.Handler)
+	testServer.Config.Protocols = sv.httpServer.Protocols
+	testServer.Start()
+	defer testServer.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	resp, err := client.Get(fmt.Sprintf("%s/livez", testServer.URL))
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected HTTP 200 OK")
+	assert.Equal(t, 2, resp.ProtoMajor, "Expected HTTP/2 over cleartext")
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key, and
+// returns their paths and a pool trusting the certificate.
+func writeCert(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxier.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	return certFile, keyFile, roots
+}
+
+func TestTLSListener_HTTP2(t *testing.T) {
+	certFile, keyFile, roots := writeCert(t)
+
+	for _, http2 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("http2=%v", http2), func(t *testing.T) {
+			cfg := &config.ServerConfig{
+				Host:       "127.0.0.1",
+				ListenPort: freePort(t),
+				TLS:        &config.TLSConfig{CertFile: certFile, KeyFile: keyFile},
+				HTTP2:      http2,
+			}
+
+			srv, err := New(&config.Config{Server: cfg, Proxy: proxyRules}, log)
+			require.NoError(t, err)
+			srv.Start()
+			defer srv.Stop(context.Background())
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+				ForceAttemptHTTP2: true,
+			}}
+			defer client.CloseIdleConnections()
+
+			var resp *http.Response
+			require.Eventually(t, func() bool {
+				resp, err = client.Get("https://" + net.JoinHostPort(cfg.Host, cfg.ListenPort) + "/livez")
+
+				return err == nil
+			}, time.Second, 10*time.Millisecond)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			if http2 {
+				assert.Equal(t, 2, resp.ProtoMajor, "Expected HTTP/2 over TLS")
+			} else {
+				assert.Equal(t, 1, resp.ProtoMajor, "Expected HTTP/1.1 over TLS")
+			}
+		})
+	}
+}
+
+func TestGRPCRoute(t *testing.T) {
+	cfg := &config.ServerConfig{
+		Host:       "127.0.0.1",
+		ListenPort: "8080",
+		H2C:        true,
+	}
+	rules := []*config.ProxyRule{
+		{Type: config.RuleTypeGRPC, Endpoint: "/echo.Echo/", DestinationURL: "http://127.0.0.1:9999"},
+	}
+
+	srv, err := NewHTTP(log, cfg, rules)
+	require.NoError(t, err)
+
+	sv, ok := srv.(*httpServer)
+	require.True(t, ok)
+
+	testServer := httptest.NewUnstartedServer(sv.httpServer.Handler)
+	testServer.Config.Protocols = sv.httpServer.Protocols
+	testServer.Start()
+	defer testServer.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+	req, err := http.NewRequest(http.MethodPost, testServer.URL+"/echo.Echo/Say", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "14", resp.Header.Get("Grpc-Status"), "Unreachable upstream should map to UNAVAILABLE")
+
+	_, err = newFastHTTP(log, serverConfig, rules)
+	assert.Error(t, err, "gRPC rules are not supported with fasthttp")
+}
+
+func TestRateLimitRedis(t *testing.T) {
+	redisServer := miniredis.RunT(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	cfg := &config.ServerConfig{
+		Host:           "127.0.0.1",
+		ListenPort:     "8080",
+		RateLimitRedis: &config.RedisConfig{Address: redisServer.Addr()},
+	}
+	rules := []*config.ProxyRule{{
+		Endpoint:       "/limited",
+		DestinationURL: upstream.URL,
+		RateLimits:     []*config.RateLimitConfig{{Requests: 2, Period: time.Hour}},
+	}}
+
+	// Two proxies share the quota of a client through Redis.
+	proxies := make([]string, 0, 2)
+	for range 2 {
+		srv, err := NewHTTP(log, cfg, rules)
+		require.NoError(t, err)
+		sv, ok := srv.(*httpServer)
+		require.True(t, ok)
+		t.Cleanup(func() {
+			_ = sv.limitRedis.Close()
+		})
+
+		testServer := httptest.NewServer(sv.httpServer.Handler)
+		t.Cleanup(testServer.Close)
+		proxies = append(proxies, testServer.URL)
+	}
+
+	statuses := make([]int, 0, 3)
+	for _, proxyURL := range []string{proxies[0], proxies[1], proxies[0]} {
+		resp, err := http.Get(proxyURL + "/limited/item")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses)
+}
+
+func TestAccess(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	cfg := &config.ServerConfig{
+		Host:       "127.0.0.1",
+		ListenPort: "8080",
+		Access:     &config.AccessConfig{Deny: []string{"127.0.0.0/8"}},
+	}
+	rules := []*config.ProxyRule{
+		{Endpoint: "/open", DestinationURL: upstream.URL},
+		{
+			Endpoint:       "/internal",
+			DestinationURL: upstream.URL,
+			Access:         &config.AccessConfig{Allow: []string{"10.0.0.0/8"}},
+		},
+	}
+
+	status := func(path string) int {
+		srv, err := NewHTTP(log, cfg, rules)
+		require.NoError(t, err)
+		testServer := httptest.NewServer(srv.(*httpServer).httpServer.Handler)
+		defer testServer.Close()
+
+		resp, err := http.Get(testServer.URL + path)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// The global list applies to every rule, but not to the server routes.
+	assert.Equal(t, http.StatusForbidden, status("/open/item"))
+	assert.Equal(t, http.StatusForbidden, status("/internal/item"))
+	assert.Equal(t, http.StatusOK, status("/livez"))
+
+	cfg.Access = nil
+	assert.Equal(t, http.StatusOK, status("/open/item"))
+	assert.Equal(t, http.StatusForbidden, status("/internal/item"))
+}
+
+// freePort returns a port that is free to listen on.
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	return port
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer upstream.Close()
+
+	rules := []*config.ProxyRule{{Endpoint: "/echo", DestinationURL: upstream.URL}}
+
+	for _, fastHTTP := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fast_http=%v", fastHTTP), func(t *testing.T) {
+			cfg := &config.ServerConfig{
+				Host:       "127.0.0.1",
+				ListenPort: freePort(t),
+				FastHTTP:   fastHTTP,
+				ProxyProtocol: &config.ProxyProtocolConfig{
+					TrustedSources:    []string{"127.0.0.0/8"},
+					ReadHeaderTimeout: time.Second,
+				},
+			}
+
+			srv, err := New(&config.Config{Server: cfg, Proxy: rules}, log)
+			require.NoError(t, err)
+			srv.Start()
+			defer srv.Stop(context.Background())
+
+			addr := net.JoinHostPort(cfg.Host, cfg.ListenPort)
+			var conn net.Conn
+			require.Eventually(t, func() bool {
+				conn, err = net.Dial("tcp", addr)
+
+				return err == nil
+			}, time.Second, 10*time.Millisecond)
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 80\r\n" +
+				"GET /echo HTTP/1.1\r\nHost: proxier.test\r\nConnection: close\r\n\r\n"))
+			require.NoError(t, err)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "203.0.113.7", string(body))
+		})
+	}
+}
+
+func TestMaxConnsPerIP_ProxyProtocol(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.ServerConfig{
+		Host:          "127.0.0.1",
+		ListenPort:    freePort(t),
+		FastHTTP:      true,
+		MaxConnsPerIP: 1,
+		ProxyProtocol: &config.ProxyProtocolConfig{
+			TrustedSources:    []string{"127.0.0.0/8"},
+			ReadHeaderTimeout: time.Second,
+		},
+	}
+	rules := []*config.ProxyRule{{Endpoint: "/echo", DestinationURL: upstream.URL}}
+
+	srv, err := New(&config.Config{Server: cfg, Proxy: rules}, log)
+	require.NoError(t, err)
+	srv.Start()
+	defer srv.Stop(context.Background())
+
+	addr := net.JoinHostPort(cfg.Host, cfg.ListenPort)
+	var conns []net.Conn
+	request := func(client string) int {
+		var conn net.Conn
+		require.Eventually(t, func() bool {
+			conn, err = net.Dial("tcp", addr)
+
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		conns = append(conns, conn)
+
+		_, err = conn.Write([]byte("PROXY TCP4 " + client + " 127.0.0.1 4000 80\r\n" +
+			"GET /echo HTTP/1.1\r\nHost: proxier.test\r\n\r\n"))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// The first connection stays open, so the client is at its limit.
+	assert.Equal(t, http.StatusNoContent, request("203.0.113.7"))
+	assert.Equal(t, http.StatusTooManyRequests, request("203.0.113.7"))
+	assert.Equal(t, http.StatusNoContent, request("203.0.113.8"))
+
+	// fasthttp may close a connection twice when shutting down while it
+	// has per-client limits, so the connections are closed first.
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	sv, ok := srv.(*fastHTTPServer)
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		return sv.sv.GetOpenConnectionsCount() == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -2,9 +2,20 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/ezex-io/proxier/internal/cache"
+	"github.com/ezex-io/proxier/internal/geoip"
+	"github.com/ezex-io/proxier/internal/proxy"
+	"github.com/ezex-io/proxier/internal/proxyproto"
+	"github.com/ezex-io/proxier/internal/ratelimit"
+	"github.com/ezex-io/proxier/internal/realip"
 )
 
 type Server interface {
@@ -14,9 +25,373 @@ type Server interface {
 }
 
 func New(cfg *config.Config, log *slog.Logger) (Server, error) {
-	if cfg.Server.FastHTTP {
-		return newFastHTTP(log, cfg.Server, cfg.Proxy)
+	var servers []Server
+
+	// The HTTP listener only serves proxy rules, so configurations with only
+	// streams or egress proxies do not open it.
+	if len(cfg.Proxy) > 0 {
+		var (
+			srv Server
+			err error
+		)
+		if cfg.Server.FastHTTP {
+			srv, err = newFastHTTP(log, cfg.Server, cfg.Proxy)
+		} else {
+			srv, err = NewHTTP(log, cfg.Server, cfg.Proxy)
+		}
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, srv)
+	}
+
+	for _, streamCfg := range cfg.Streams {
+		streamSrv, err := newStream(log, streamCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream %s: %w", streamCfg.Name, err)
+		}
+		servers = append(servers, streamSrv)
+	}
+
+	if cfg.ForwardProxy != nil {
+		forwardSrv, err := newForwardProxy(log, cfg.ForwardProxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create forward proxy: %w", err)
+		}
+		servers = append(servers, forwardSrv)
+	}
+
+	if cfg.SOCKS5 != nil {
+		socksSrv, err := newSOCKS5(log, cfg.SOCKS5)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 proxy: %w", err)
+		}
+		servers = append(servers, socksSrv)
+	}
+
+	if cfg.Admin != nil {
+		servers = append(servers, newAdmin(log, cfg.Admin))
+	}
+
+	if len(servers) == 1 {
+		return servers[0], nil
+	}
+
+	return newGroup(servers...), nil
+}
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+
+	// writeTimeout bounds writing a response of the proxy listener.
+	writeTimeout = 15 * time.Second
+)
+
+// ruleDefaults holds the server settings applied to every proxy rule.
+type ruleDefaults struct {
+	trustedProxies realip.TrustedProxies
+	purgeSources   realip.Prefixes
+	access         *proxy.IPAccess
+	limitRedis     *ratelimit.Redis
+	geoIP          *geoip.DB
+}
+
+// newRuleDefaults parses the server settings applied to every proxy rule.
+func newRuleDefaults(cfg *config.ServerConfig) (*ruleDefaults, error) {
+	trustedProxies, err := realip.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	purgeSources, err := realip.ParsePrefixes(cfg.PurgeSources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid purge sources: %w", err)
+	}
+	access, err := ipAccess(cfg.Access)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access lists: %w", err)
+	}
+	var geoIP *geoip.DB
+	if g := cfg.GeoIP; g != nil {
+		geoIP, err = geoip.Open(geoip.Config{Databases: g.Databases, ReloadInterval: g.ReloadInterval})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ruleDefaults{
+		trustedProxies: trustedProxies,
+		purgeSources:   purgeSources,
+		access:         access,
+		limitRedis:     newRateLimitRedis(cfg),
+		geoIP:          geoIP,
+	}, nil
+}
+
+// proxyOptions translates a proxy rule into options shared by both backends.
+// Caches are registered in cache.Default for purging.
+func proxyOptions(rule *config.ProxyRule, defaults *ruleDefaults) ([]proxy.Option, error) {
+	opts := []proxy.Option{
+		proxy.WithTrustedProxies(defaults.trustedProxies),
+		proxy.WithFlushInterval(rule.FlushInterval),
+		proxy.WithMaxBufferSize(rule.MaxBufferSize),
+		proxy.WithWriteTimeout(writeTimeout),
+		proxy.WithUpstreamProtocol(proxy.UpstreamProtocol(rule.UpstreamProtocol)),
+		proxy.WithProxyProtocol(config.ProxyProtocolVersion(rule.SendProxyProtocol)),
+	}
+
+	if rule.LongLivedStreams {
+		opts = append(opts, proxy.WithLongLivedStreams())
+	}
+
+	switch rule.HostHeader {
+	case config.HostHeaderPreserve:
+		opts = append(opts, proxy.WithPreserveHost())
+	case config.HostHeaderCustom:
+		opts = append(opts, proxy.WithCustomHost(rule.CustomHost))
+	}
+
+	if fcgi := rule.FastCGI; fcgi != nil {
+		opts = append(opts, proxy.WithFastCGI(proxy.FastCGI{
+			Root:      fcgi.Root,
+			SplitPath: fcgi.SplitPath,
+			Index:     fcgi.Index,
+			Params:    fcgi.Params,
+		}))
+	}
+
+	if c := rule.Cache; c != nil {
+		cacheCfg := cache.Config{
+			Name:                 rule.Endpoint,
+			MaxSize:              c.MaxSize,
+			MaxEntrySize:         c.MaxEntrySize,
+			StaleWhileRevalidate: c.StaleWhileRevalidate,
+			StaleIfError:         c.StaleIfError,
+		}
+		if disk := c.Disk; disk != nil {
+			cacheCfg.Dir = disk.Dir
+			cacheCfg.DiskMaxSize = disk.MaxSize
+		}
+
+		responseCache, err := cache.New(cacheCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cache: %w", err)
+		}
+		cache.Default.Register(rule.Endpoint, responseCache)
+		opts = append(opts, proxy.WithCache(responseCache), proxy.WithPurge(defaults.purgeSources))
+	}
+
+	if c := rule.Coalesce; c != nil {
+		opts = append(opts, proxy.WithCoalescing(proxy.Coalescing{Vary: c.Vary, Timeout: c.Timeout}))
+	}
+
+	if c := rule.Compression; c != nil {
+		opts = append(opts, proxy.WithCompression(proxy.Compression{
+			Encodings:   c.Encodings,
+			Types:       c.Types,
+			MinSize:     c.MinSize,
+			GzipLevel:   c.GzipLevel,
+			BrotliLevel: c.BrotliLevel,
+			ZstdLevel:   c.ZstdLevel,
+		}))
+	}
+
+	for _, limit := range rule.RateLimits {
+		limiter, err := ratelimit.New(ratelimit.Config{
+			Name:      rule.Endpoint,
+			Algorithm: limit.Algorithm,
+			Requests:  limit.Requests,
+			Period:    limit.Period,
+			Burst:     limit.Burst,
+			Key:       limit.Key,
+			MaxKeys:   limit.MaxKeys,
+			Redis:     defaults.limitRedis,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create rate limit: %w", err)
+		}
+		opts = append(opts, proxy.WithRateLimits(limiter))
+	}
+
+	if c := rule.Concurrency; c != nil {
+		limit := proxy.ConcurrencyLimit{
+			MaxInFlight:  c.MaxInFlight,
+			QueueSize:    c.QueueSize,
+			QueueTimeout: c.QueueTimeout,
+		}
+		if adaptive := c.Adaptive; adaptive != nil {
+			limit.Adaptive = &proxy.AdaptiveConcurrency{
+				MinLimit:      adaptive.MinLimit,
+				TargetLatency: adaptive.TargetLatency,
+				Backoff:       adaptive.Backoff,
+			}
+		}
+		opts = append(opts, proxy.WithConcurrencyLimit(rule.Endpoint, limit))
+	}
+
+	if defaults.geoIP != nil {
+		opts = append(opts, proxy.WithGeoIP(defaults.geoIP))
+	}
+	if rule.GeoHeaders {
+		opts = append(opts, proxy.WithGeoHeaders())
+	}
+	if defaults.access != nil {
+		opts = append(opts, proxy.WithIPAccess(*defaults.access))
+	}
+	access, err := ipAccess(rule.Access)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access lists: %w", err)
+	}
+	if access != nil {
+		opts = append(opts, proxy.WithIPAccess(*access))
+	}
+
+	if a := rule.Auth; a != nil {
+		authCfg := auth.Config{}
+		if b := a.Basic; b != nil {
+			authCfg.Realm = b.Realm
+			authCfg.Users = b.Users
+			authCfg.HtpasswdFile = b.HtpasswdFile
+		}
+		if k := a.APIKeys; k != nil {
+			authCfg.APIKeyHeader = k.Header
+			authCfg.APIKeyQuery = k.QueryParam
+			authCfg.APIKeys = k.Keys
+			authCfg.APIKeysFile = k.KeysFile
+		}
+
+		authenticator, err := auth.New(authCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load auth credentials: %w", err)
+		}
+		opts = append(opts, proxy.WithAuth(authenticator, a.IdentityHeader))
+	}
+
+	if web := rule.GRPCWeb; web != nil && web.Enabled {
+		opts = append(opts, proxy.WithGRPCWeb(proxy.GRPCWeb{AllowedOrigins: web.AllowedOrigins}))
+	}
+
+	if ws := rule.WebSocket; ws != nil {
+		opts = append(opts, proxy.WithUpgradeLimits(proxy.UpgradeLimits{
+			IdleTimeout:    ws.IdleTimeout,
+			MaxMessageSize: ws.MaxMessageSize,
+			MaxConnections: ws.MaxConnections,
+		}))
+	}
+
+	return opts, nil
+}
+
+// egressAuth loads the users of the forward proxy or SOCKS5 proxy, or
+// returns nil when authentication is disabled.
+func egressAuth(users map[string]string, htpasswdFile string) (*auth.Authenticator, error) {
+	if len(users) == 0 && htpasswdFile == "" {
+		return nil, nil //nolint:nilnil // no authentication
+	}
+
+	authenticator, err := auth.New(auth.Config{Users: users, HtpasswdFile: htpasswdFile})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load users: %w", err)
+	}
+
+	return authenticator, nil
+}
+
+// ipAccess parses access lists, or returns nil when none is configured.
+func ipAccess(cfg *config.AccessConfig) (*proxy.IPAccess, error) {
+	if cfg == nil || len(cfg.Allow) == 0 && len(cfg.Deny) == 0 && len(cfg.AllowCountries) == 0 &&
+		len(cfg.DenyCountries) == 0 && len(cfg.AllowASNs) == 0 && len(cfg.DenyASNs) == 0 {
+		return nil, nil //nolint:nilnil // no access lists
+	}
+
+	allow, err := realip.ParsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := realip.ParsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	upper := func(codes []string) []string {
+		upper := make([]string, 0, len(codes))
+		for _, code := range codes {
+			upper = append(upper, strings.ToUpper(code))
+		}
+
+		return upper
+	}
+
+	return &proxy.IPAccess{
+		Allow:          allow,
+		Deny:           deny,
+		AllowCountries: upper(cfg.AllowCountries),
+		DenyCountries:  upper(cfg.DenyCountries),
+		AllowASNs:      cfg.AllowASNs,
+		DenyASNs:       cfg.DenyASNs,
+	}, nil
+}
+
+// newRateLimitRedis creates the client of the Redis server shared by the rate
+// limits of all rules, or returns nil when none is configured.
+func newRateLimitRedis(cfg *config.ServerConfig) *ratelimit.Redis {
+	r := cfg.RateLimitRedis
+	if r == nil {
+		return nil
+	}
+
+	return ratelimit.NewRedis(ratelimit.RedisConfig{
+		Address:   r.Address,
+		Username:  r.Username,
+		Password:  r.Password,
+		DB:        r.DB,
+		TLS:       r.TLS,
+		KeyPrefix: r.KeyPrefix,
+		Timeout:   r.Timeout,
+	})
+}
+
+// newGRPCHealthChecker creates the active health checker of a gRPC rule.
+func newGRPCHealthChecker(rule *config.ProxyRule) (*proxy.GRPCHealthChecker, error) {
+	check := proxy.GRPCHealthCheck{
+		Interval: rule.HealthCheck.Interval,
+		Timeout:  rule.HealthCheck.Timeout,
+		Service:  rule.HealthCheck.Service,
+
+		ProxyProtocol: config.ProxyProtocolVersion(rule.SendProxyProtocol),
+	}
+	if check.Interval == 0 {
+		check.Interval = defaultHealthCheckInterval
+	}
+	if check.Timeout == 0 {
+		check.Timeout = defaultHealthCheckTimeout
+	}
+
+	return proxy.NewGRPCHealthChecker(rule.Endpoint, rule.DestinationURL, check,
+		proxy.UpstreamProtocol(rule.UpstreamProtocol))
+}
+
+// listen opens the TCP listener of the server, accepting PROXY protocol
+// headers from trusted sources when enabled.
+func listen(network, addr string, cfg *config.ProxyProtocolConfig) (net.Listener, error) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return listener, nil
+	}
+
+	trusted, err := realip.ParseTrustedProxies(cfg.TrustedSources)
+	if err != nil {
+		_ = listener.Close()
+
+		return nil, fmt.Errorf("invalid proxy protocol trusted sources: %w", err)
 	}
 
-	return NewHTTP(log, cfg.Server, cfg.Proxy)
+	return &proxyproto.Listener{
+		Listener:          listener,
+		Trusted:           trusted,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+	}, nil
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/socks5"
+)
+
+type socks5Server struct {
+	server *socks5.Server
+	errCh  chan error
+	log    *slog.Logger
+}
+
+func newSOCKS5(log *slog.Logger, cfg *config.SOCKS5Config) (Server, error) {
+	authenticator, err := egressAuth(cfg.Users, cfg.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := socks5.New(socks5.Config{
+		Listen: cfg.Listen,
+		Allow:  cfg.Allow,
+		Deny:   cfg.Deny,
+		Auth:   authenticator,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Registered SOCKS5 proxy", "listen", cfg.Listen, "authentication", authenticator != nil)
+
+	return &socks5Server{
+		server: srv,
+		errCh:  make(chan error, 1),
+		log:    log,
+	}, nil
+}
+
+func (s *socks5Server) Start() {
+	go func() {
+		s.log.Info("starting SOCKS5 proxy", "address", s.server.Addr())
+
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, socks5.ErrClosed) {
+			s.errCh <- fmt.Errorf("SOCKS5 proxy error: %w", err)
+		}
+	}()
+}
+
+func (s *socks5Server) Notify() <-chan error {
+	return s.errCh
+}
+
+func (s *socks5Server) Stop(ctx context.Context) {
+	s.log.Info("shutting down SOCKS5 proxy...")
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.log.Error("SOCKS5 proxy forced to shutdown", "error", err)
+	} else {
+		s.log.Info("SOCKS5 proxy stopped")
+	}
+}
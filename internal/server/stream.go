@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/ezex-io/proxier/internal/stream"
+)
+
+type streamServer struct {
+	name     string
+	protocol string
+	proxy    stream.Proxy
+	errCh    chan error
+	log      *slog.Logger
+}
+
+func newStream(log *slog.Logger, cfg *config.StreamConfig) (Server, error) {
+	protocol := cfg.Protocol
+	if protocol == "" {
+		protocol = stream.TCP
+	}
+
+	routes := make([]stream.Route, 0, len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		routes = append(routes, stream.Route{ServerNames: route.ServerNames, Upstreams: route.Upstreams})
+	}
+
+	proxy, err := stream.New(protocol, stream.Config{
+		Name:           cfg.Name,
+		Listen:         cfg.Listen,
+		Upstreams:      cfg.Upstreams,
+		LoadBalancing:  cfg.LoadBalancing,
+		MaxConnections: cfg.MaxConnections,
+		IdleTimeout:    cfg.IdleTimeout,
+		ConnectTimeout: cfg.ConnectTimeout,
+		Routes:         routes,
+		ProxyProtocol:  config.ProxyProtocolVersion(cfg.SendProxyProtocol),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Registered stream", "name", cfg.Name, "protocol", protocol,
+		"listen", cfg.Listen, "upstreams", cfg.Upstreams)
+
+	return &streamServer{
+		name:     cfg.Name,
+		protocol: protocol,
+		proxy:    proxy,
+		errCh:    make(chan error, 1),
+		log:      log,
+	}, nil
+}
+
+func (s *streamServer) Start() {
+	go func() {
+		s.log.Info("starting stream", "name", s.name, "protocol", s.protocol, "address", s.proxy.Addr())
+
+		if err := s.proxy.ListenAndServe(); err != nil && !errors.Is(err, stream.ErrClosed) {
+			s.errCh <- fmt.Errorf("stream %s error: %w", s.name, err)
+		}
+	}()
+}
+
+func (s *streamServer) Notify() <-chan error {
+	return s.errCh
+}
+
+func (s *streamServer) Stop(ctx context.Context) {
+	s.log.Info("shutting down stream...", "name", s.name)
+
+	if err := s.proxy.Shutdown(ctx); err != nil {
+		s.log.Error("stream forced to shutdown", "name", s.name, "error", err)
+	} else {
+		s.log.Info("stream stopped", "name", s.name)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamLifecycle(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() {
+		_ = upstream.Close()
+	}()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		_, _ = conn.Write(buf[:n])
+	}()
+
+	listen := net.JoinHostPort("127.0.0.1", freePort(t))
+	httpPort := freePort(t)
+
+	srv, err := New(&config.Config{
+		Server: &config.ServerConfig{Host: "127.0.0.1", ListenPort: httpPort},
+		Streams: []*config.StreamConfig{
+			{Name: "echo", Listen: listen, Upstreams: []string{upstream.Addr().String()}},
+		},
+	}, log)
+	require.NoError(t, err)
+
+	srv.Start()
+
+	var conn net.Conn
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", listen)
+
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	_ = conn.Close()
+
+	// Without proxy rules, the HTTP listener is not started.
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", httpPort))
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	srv.Stop(ctx)
+
+	_, err = net.Dial("tcp", listen)
+	assert.Error(t, err)
+
+	select {
+	case err := <-srv.Notify():
+		t.Fatalf("unexpected server error: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,605 @@
+// Package socks5 implements a SOCKS5 proxy (RFC 1928) supporting CONNECT and
+// UDP ASSOCIATE with optional username/password authentication (RFC 1929).
+// Destinations are checked against an access list.
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/acl"
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/ezex-io/proxier/internal/metrics"
+)
+
+const (
+	version5       = 0x05
+	authVersion    = 0x01
+	handshakeTime  = 10 * time.Second
+	connectTimeout = 10 * time.Second
+)
+
+// Authentication methods.
+const (
+	methodNoAuth       = 0x00
+	methodUserPassword = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// Commands.
+const (
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+)
+
+// Address types.
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// Reply codes.
+const (
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyNotAllowed          = 0x02
+	replyNetworkUnreachable  = 0x03
+	replyHostUnreachable     = 0x04
+	replyConnectionRefused   = 0x05
+	replyCommandNotSupported = 0x07
+	replyAddressNotSupported = 0x08
+)
+
+// ErrClosed is returned by Serve after Shutdown.
+var ErrClosed = errors.New("socks5 server closed")
+
+var errUnsupportedAddress = errors.New("unsupported address type")
+
+// Config configures a SOCKS5 server.
+type Config struct {
+	Listen string
+	// Allow and Deny are access list entries, see acl.New.
+	Allow []string
+	Deny  []string
+	// Auth checks username/password credentials against its users; nil
+	// disables authentication.
+	Auth *auth.Authenticator
+}
+
+// Server is a SOCKS5 proxy server.
+type Server struct {
+	cfg     Config
+	acl     *acl.ACL
+	metrics *serverMetrics
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	closing  bool
+}
+
+// New creates a SOCKS5 server.
+func New(cfg Config) (*Server, error) {
+	list, err := acl.New(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		cfg:     cfg,
+		acl:     list,
+		metrics: newServerMetrics(),
+		conns:   make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the listening address, or the configured one before listening.
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+
+	return s.cfg.Listen
+}
+
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on listener until Shutdown is called.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		_ = listener.Close()
+
+		return ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return ErrClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// A burst of clients may exhaust file descriptors for a while;
+			// keep serving once they are released.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, time.Second)
+			}
+			log.Printf("[SOCKS5] accept error: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+
+			continue
+		}
+		delay = 0
+
+		if !s.track(conn, true) {
+			_ = conn.Close()
+
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.track(conn, false)
+
+			s.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// until ctx is done, then closes them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+	}
+
+	return err
+}
+
+func (s *Server) track(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.closing {
+			return false
+		}
+		s.conns[conn] = struct{}{}
+		s.metrics.active.Inc()
+	} else {
+		delete(s.conns, conn)
+		s.metrics.active.Dec()
+	}
+
+	return true
+}
+
+// request is a parsed SOCKS5 request.
+type request struct {
+	command byte
+	host    string
+	port    int
+}
+
+func (r *request) address() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.port))
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(handshakeTime))
+
+	user, err := s.negotiate(reader, conn)
+	if err != nil {
+		s.metrics.request("none", "unauthorized").Inc()
+		log.Printf("[SOCKS5] %s: %v", conn.RemoteAddr(), err)
+
+		return
+	}
+
+	req, err := readRequest(reader)
+	if err != nil {
+		reply := byte(replyGeneralFailure)
+		if errors.Is(err, errUnsupportedAddress) {
+			reply = replyAddressNotSupported
+		}
+		_ = writeReply(conn, reply, nil)
+		log.Printf("[SOCKS5] %s: %v", conn.RemoteAddr(), err)
+
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := &clientConn{Conn: conn, reader: reader}
+	start := time.Now()
+	var result string
+	switch req.command {
+	case cmdConnect:
+		result = s.connect(client, req)
+	case cmdUDPAssociate:
+		result = s.associate(client, req)
+	default:
+		_ = writeReply(conn, replyCommandNotSupported, nil)
+		result = "unsupported"
+	}
+
+	s.metrics.request(commandLabel(req.command), result).Inc()
+	log.Printf("[SOCKS5] %s %s %s %s %s %s", conn.RemoteAddr(), userLabel(user), commandLabel(req.command),
+		req.address(), result, time.Since(start).Round(time.Millisecond))
+}
+
+// negotiate selects the authentication method and authenticates the client,
+// returning the user name.
+func (s *Server) negotiate(reader *bufio.Reader, conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != version5 {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+
+	want := byte(methodNoAuth)
+	if s.cfg.Auth != nil {
+		want = methodUserPassword
+	}
+	if !containsByte(methods, want) {
+		_, _ = conn.Write([]byte{version5, methodNoAcceptable})
+
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{version5, want}); err != nil {
+		return "", err
+	}
+	if want == methodNoAuth {
+		return "", nil
+	}
+
+	user, password, err := readCredentials(reader)
+	if err != nil {
+		return "", err
+	}
+	if !s.cfg.Auth.CheckPassword(user, password) {
+		_, _ = conn.Write([]byte{authVersion, 0x01})
+
+		return "", fmt.Errorf("authentication failed for user %q", user)
+	}
+	if _, err := conn.Write([]byte{authVersion, 0x00}); err != nil {
+		return "", err
+	}
+
+	return user, nil
+}
+
+// readCredentials reads a username/password request, see RFC 1929.
+func readCredentials(reader *bufio.Reader) (string, string, error) {
+	ver, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+	if ver != authVersion {
+		return "", "", fmt.Errorf("unsupported authentication version %d", ver)
+	}
+
+	user, err := readString(reader)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readString(reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return user, password, nil
+}
+
+func readString(reader *bufio.Reader) (string, error) {
+	size, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+func readRequest(reader *bufio.Reader) (*request, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != version5 {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	host, port, err := readAddr(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{command: header[1], host: host, port: port}, nil
+}
+
+// readAddr reads ATYP, DST.ADDR and DST.PORT.
+func readAddr(reader io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		size := net.IPv4len
+		if atyp[0] == atypIPv6 {
+			size = net.IPv6len
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return "", 0, err
+		}
+		addr, _ := netip.AddrFromSlice(buf)
+		host = addr.String()
+	case atypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(reader, size); err != nil {
+			return "", 0, err
+		}
+		buf := make([]byte, size[0])
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return "", 0, err
+		}
+		host = string(buf)
+	default:
+		return "", 0, fmt.Errorf("%w %d", errUnsupportedAddress, atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", 0, err
+	}
+
+	return host, int(port[0])<<8 | int(port[1]), nil
+}
+
+// appendAddr appends ATYP, BND.ADDR and BND.PORT for addr.
+func appendAddr(buf []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		buf = append(buf, atypIPv4)
+	} else {
+		buf = append(buf, atypIPv6)
+	}
+	buf = append(buf, ip.AsSlice()...)
+
+	return append(buf, byte(addr.Port()>>8), byte(addr.Port()))
+}
+
+// writeReply writes a reply with the bound address, or 0.0.0.0:0 when addr
+// is nil.
+func writeReply(conn net.Conn, reply byte, addr net.Addr) error {
+	bound := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if parsed, err := netip.ParseAddrPort(addrString(addr)); err == nil {
+		bound = parsed
+	}
+
+	_, err := conn.Write(appendAddr([]byte{version5, reply, 0x00}, bound))
+
+	return err
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+// connect handles the CONNECT command.
+func (s *Server) connect(client *clientConn, req *request) string {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	backend, err := s.acl.DialContext(ctx, "tcp", req.address())
+	cancel()
+	if err != nil {
+		reply, result := dialReply(err)
+		_ = writeReply(client, reply, nil)
+
+		return result
+	}
+	defer func() {
+		_ = backend.Close()
+	}()
+
+	if err := writeReply(client, replySucceeded, backend.LocalAddr()); err != nil {
+		return "failed"
+	}
+
+	s.pipe(client, backend)
+
+	return "ok"
+}
+
+// pipe copies data in both directions until one side is done.
+func (s *Server) pipe(client, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		n, _ := io.Copy(backend, client)
+		s.metrics.received.Add(uint64(n))
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := io.Copy(client, backend)
+		s.metrics.sent.Add(uint64(n))
+		done <- struct{}{}
+	}()
+
+	<-done
+	_ = backend.Close()
+	_ = client.Close()
+	<-done
+}
+
+// dialReply maps a dial error to a reply code and metric result.
+func dialReply(err error) (byte, string) {
+	var (
+		netErr net.Error
+		dnsErr *net.DNSError
+	)
+	switch {
+	case errors.Is(err, acl.ErrDenied):
+		return replyNotAllowed, "denied"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnectionRefused, "failed"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return replyNetworkUnreachable, "failed"
+	case errors.As(err, &dnsErr), errors.As(err, &netErr) && netErr.Timeout():
+		return replyHostUnreachable, "failed"
+	default:
+		return replyGeneralFailure, "failed"
+	}
+}
+
+// clientConn reads through the reader used for the handshake.
+type clientConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func containsByte(list []byte, b byte) bool {
+	for _, item := range list {
+		if item == b {
+			return true
+		}
+	}
+
+	return false
+}
+
+func commandLabel(command byte) string {
+	switch command {
+	case cmdConnect:
+		return "connect"
+	case cmdBind:
+		return "bind"
+	case cmdUDPAssociate:
+		return "udp_associate"
+	default:
+		return "unknown"
+	}
+}
+
+func userLabel(user string) string {
+	if user == "" {
+		return "-"
+	}
+
+	return user
+}
+
+// serverMetrics holds the metric series of the SOCKS5 server.
+type serverMetrics struct {
+	active   *metrics.Gauge
+	received *metrics.Counter
+	sent     *metrics.Counter
+	dropped  *metrics.Counter
+}
+
+var (
+	connectionsActive = metrics.Default.GaugeVec("proxier_socks5_connections_active",
+		"Open SOCKS5 client connections.")
+	receivedBytesTotal = metrics.Default.CounterVec("proxier_socks5_received_bytes_total",
+		"Bytes received from SOCKS5 clients.")
+	sentBytesTotal = metrics.Default.CounterVec("proxier_socks5_sent_bytes_total",
+		"Bytes sent to SOCKS5 clients.")
+	udpDroppedTotal = metrics.Default.CounterVec("proxier_socks5_udp_dropped_total",
+		"Invalid or denied UDP datagrams dropped by the SOCKS5 relay.")
+	requestsTotal = metrics.Default.CounterVec("proxier_socks5_requests_total",
+		"SOCKS5 requests by command and result.")
+)
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		active:   connectionsActive.With(nil),
+		received: receivedBytesTotal.With(nil),
+		sent:     sentBytesTotal.With(nil),
+		dropped:  udpDroppedTotal.With(nil),
+	}
+}
+
+func (m *serverMetrics) request(command, result string) *metrics.Counter {
+	return requestsTotal.With(metrics.Labels{"command": command, "result": result})
+}
@@ -0,0 +1,340 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func startServer(t *testing.T, cfg Config) string {
+	t.Helper()
+
+	srv, err := New(cfg)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+
+	return listener.Addr().String()
+}
+
+func newTCPEcho(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func newUDPEcho(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// handshake connects to the server and authenticates, returning the
+// connection or the method/status byte on failure.
+func handshake(t *testing.T, srv string, user, password string) (net.Conn, *bufio.Reader, byte) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+	reader := bufio.NewReader(conn)
+
+	method := byte(methodNoAuth)
+	if user != "" {
+		method = methodUserPassword
+	}
+	_, err = conn.Write([]byte{version5, 1, method})
+	require.NoError(t, err)
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(reader, resp)
+	require.NoError(t, err)
+	if resp[1] != method || method == methodNoAuth {
+		return conn, reader, resp[1]
+	}
+
+	msg := []byte{authVersion, byte(len(user))}
+	msg = append(msg, user...)
+	msg = append(msg, byte(len(password)))
+	msg = append(msg, password...)
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(reader, resp)
+	require.NoError(t, err)
+
+	return conn, reader, resp[1]
+}
+
+// command sends a request for a domain or IP address and returns the reply.
+func command(t *testing.T, conn net.Conn, reader *bufio.Reader, cmd byte, address string) (byte, netip.AddrPort) {
+	t.Helper()
+
+	host, portText, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portText)
+	require.NoError(t, err)
+
+	msg := []byte{version5, cmd, 0x00}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		msg = appendAddr(msg, netip.AddrPortFrom(ip, uint16(port)))
+	} else {
+		msg = append(msg, atypDomain, byte(len(host)))
+		msg = append(msg, host...)
+		msg = append(msg, byte(port>>8), byte(port))
+	}
+	_, err = conn.Write(msg)
+	require.NoError(t, err)
+
+	header := make([]byte, 3)
+	_, err = io.ReadFull(reader, header)
+	require.NoError(t, err)
+	boundHost, boundPort, err := readAddr(reader)
+	require.NoError(t, err)
+
+	return header[1], netip.AddrPortFrom(netip.MustParseAddr(boundHost), uint16(boundPort))
+}
+
+func TestConnect(t *testing.T) {
+	echo := newTCPEcho(t)
+	srv := startServer(t, Config{Allow: []string{"127.0.0.1", "localhost"}})
+
+	_, port, _ := net.SplitHostPort(echo)
+	for _, target := range []string{echo, "localhost:" + port} {
+		conn, reader, method := handshake(t, srv, "", "")
+		require.Equal(t, byte(methodNoAuth), method)
+
+		reply, _ := command(t, conn, reader, cmdConnect, target)
+		require.Equal(t, byte(replySucceeded), reply, target)
+
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(reader, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf))
+	}
+}
+
+// failingListener fails its first accepts with EMFILE.
+type failingListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServe_AcceptError(t *testing.T) {
+	srv, err := New(Config{})
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	failing := &failingListener{Listener: listener}
+	failing.failures.Store(3)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(failing)
+	}()
+
+	conn, _, method := handshake(t, listener.Addr().String(), "", "")
+	assert.Equal(t, byte(methodNoAuth), method)
+	_ = conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	assert.ErrorIs(t, <-errCh, ErrClosed)
+}
+
+func TestConnect_Denied(t *testing.T) {
+	echo := newTCPEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		target string
+	}{
+		{"deny ip", Config{Deny: []string{"127.0.0.0/8"}}, echo},
+		{"deny resolved ip", Config{Deny: []string{"127.0.0.0/8", "::1"}}, "localhost:" + port},
+		{"deny port", Config{Deny: []string{":" + port}}, echo},
+		{"not allowed", Config{Allow: []string{"example.com"}}, echo},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startServer(t, tt.cfg)
+			conn, reader, _ := handshake(t, srv, "", "")
+
+			reply, _ := command(t, conn, reader, cmdConnect, tt.target)
+			assert.Equal(t, byte(replyNotAllowed), reply)
+		})
+	}
+}
+
+func TestConnect_Refused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	target := listener.Addr().String()
+	_ = listener.Close()
+
+	srv := startServer(t, Config{})
+	conn, reader, _ := handshake(t, srv, "", "")
+
+	reply, _ := command(t, conn, reader, cmdConnect, target)
+	assert.Equal(t, byte(replyConnectionRefused), reply)
+}
+
+func TestAuthentication(t *testing.T) {
+	echo := newTCPEcho(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	authenticator, err := auth.New(auth.Config{Users: map[string]string{"alice": string(hash)}})
+	require.NoError(t, err)
+	srv := startServer(t, Config{Auth: authenticator})
+
+	_, _, method := handshake(t, srv, "", "")
+	assert.Equal(t, byte(methodNoAcceptable), method)
+
+	_, _, status := handshake(t, srv, "alice", "wrong")
+	assert.Equal(t, byte(0x01), status)
+
+	_, _, status = handshake(t, srv, "bob", "secret")
+	assert.Equal(t, byte(0x01), status)
+
+	conn, reader, status := handshake(t, srv, "alice", "secret")
+	require.Equal(t, byte(0x00), status)
+	reply, _ := command(t, conn, reader, cmdConnect, echo)
+	assert.Equal(t, byte(replySucceeded), reply)
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	srv := startServer(t, Config{})
+	conn, reader, _ := handshake(t, srv, "", "")
+
+	reply, _ := command(t, conn, reader, cmdBind, "127.0.0.1:80")
+	assert.Equal(t, byte(replyCommandNotSupported), reply)
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := newUDPEcho(t)
+	blocked := newUDPEcho(t)
+	_, blockedPort, _ := net.SplitHostPort(blocked)
+
+	srv := startServer(t, Config{Deny: []string{":" + blockedPort}})
+	conn, reader, _ := handshake(t, srv, "", "")
+
+	reply, relayAddr := command(t, conn, reader, cmdUDPAssociate, "0.0.0.0:0")
+	require.Equal(t, byte(replySucceeded), reply)
+
+	udp, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relayAddr))
+	require.NoError(t, err)
+	defer udp.Close()
+
+	send := func(target, payload string) {
+		packet := appendAddr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort(target))
+		_, err := udp.Write(append(packet, payload...))
+		require.NoError(t, err)
+	}
+
+	// Denied datagrams are dropped, so only the echo answers.
+	send(blocked, "blocked")
+	send(echo, "hello")
+
+	require.NoError(t, udp.SetReadDeadline(time.Now().Add(2*time.Second)))
+	buf := make([]byte, 1024)
+	n, err := udp.Read(buf)
+	require.NoError(t, err)
+
+	host, port, payload, err := parseDatagram(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, echo, net.JoinHostPort(host, strconv.Itoa(port)))
+	assert.Equal(t, "echo:hello", string(payload))
+
+	// Closing the control connection ends the association.
+	_ = conn.Close()
+	assert.Eventually(t, func() bool {
+		send(echo, "late")
+		_ = udp.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := udp.Read(buf)
+
+		return err != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestParseDatagram(t *testing.T) {
+	_, _, _, err := parseDatagram([]byte{0x00, 0x00, 0x01, atypIPv4, 127, 0, 0, 1, 0, 53})
+	assert.Error(t, err, "fragments are not supported")
+
+	_, _, _, err = parseDatagram([]byte{0x00, 0x00})
+	assert.Error(t, err)
+
+	host, port, payload, err := parseDatagram([]byte{0x00, 0x00, 0x00, atypDomain, 3, 'a', '.', 'b', 0, 53, 'x'})
+	require.NoError(t, err)
+	assert.Equal(t, "a.b", host)
+	assert.Equal(t, 53, port)
+	assert.Equal(t, []byte("x"), payload)
+}
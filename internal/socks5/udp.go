@@ -0,0 +1,234 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+const (
+	maxDatagramSize = 64 * 1024
+	// maxPeers bounds the destinations and resolved names remembered per
+	// association.
+	maxPeers = 1024
+)
+
+// association relays UDP datagrams of one UDP ASSOCIATE request. It lasts
+// as long as the TCP control connection.
+type association struct {
+	server *Server
+	// clientIP and clientPort restrict who may use the relay; a zero port
+	// accepts any port of the client.
+	clientIP   netip.Addr
+	clientPort uint16
+	relay      *net.UDPConn
+	upstream   *net.UDPConn
+
+	mu         sync.Mutex
+	clientAddr netip.AddrPort
+	peers      map[netip.AddrPort]struct{}
+	resolved   map[string]netip.Addr
+}
+
+// associate handles the UDP ASSOCIATE command.
+func (s *Server) associate(client *clientConn, req *request) string {
+	local, err := netip.ParseAddrPort(client.LocalAddr().String())
+	if err != nil {
+		_ = writeReply(client, replyGeneralFailure, nil)
+
+		return "failed"
+	}
+	remote, err := netip.ParseAddrPort(client.RemoteAddr().String())
+	if err != nil {
+		_ = writeReply(client, replyGeneralFailure, nil)
+
+		return "failed"
+	}
+
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(local.Addr().Unmap(), 0)))
+	if err != nil {
+		_ = writeReply(client, replyGeneralFailure, nil)
+
+		return "failed"
+	}
+	defer func() {
+		_ = relay.Close()
+	}()
+
+	upstream, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		_ = writeReply(client, replyGeneralFailure, nil)
+
+		return "failed"
+	}
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	if err := writeReply(client, replySucceeded, relay.LocalAddr()); err != nil {
+		return "failed"
+	}
+
+	assoc := &association{
+		server:     s,
+		clientIP:   remote.Addr().Unmap(),
+		clientPort: uint16(req.port),
+		relay:      relay,
+		upstream:   upstream,
+		peers:      make(map[netip.AddrPort]struct{}),
+		resolved:   make(map[string]netip.Addr),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assoc.fromClient()
+	}()
+	go func() {
+		defer wg.Done()
+		assoc.fromUpstream()
+	}()
+
+	_, _ = io.Copy(io.Discard, client)
+	_ = relay.Close()
+	_ = upstream.Close()
+	wg.Wait()
+
+	return "ok"
+}
+
+// fromClient forwards datagrams of the client to their destinations.
+func (a *association) fromClient() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != a.clientIP || (a.clientPort != 0 && from.Port() != a.clientPort) {
+			continue
+		}
+
+		host, port, payload, err := parseDatagram(buf[:n])
+		if err != nil {
+			a.server.metrics.dropped.Inc()
+
+			continue
+		}
+
+		target, ok := a.resolve(host, port)
+		if !ok {
+			a.server.metrics.dropped.Inc()
+
+			continue
+		}
+
+		a.mu.Lock()
+		a.clientAddr = from
+		if len(a.peers) >= maxPeers {
+			clear(a.peers)
+		}
+		a.peers[target] = struct{}{}
+		a.mu.Unlock()
+
+		if _, err := a.upstream.WriteToUDPAddrPort(payload, target); err == nil {
+			a.server.metrics.received.Add(uint64(len(payload)))
+		}
+	}
+}
+
+// fromUpstream returns datagrams of contacted destinations to the client.
+func (a *association) fromUpstream() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.upstream.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		a.mu.Lock()
+		_, known := a.peers[from]
+		client := a.clientAddr
+		a.mu.Unlock()
+		if !known || !client.IsValid() {
+			continue
+		}
+
+		packet := appendAddr([]byte{0x00, 0x00, 0x00}, from)
+		packet = append(packet, buf[:n]...)
+		if _, err := a.relay.WriteToUDPAddrPort(packet, client); err == nil {
+			a.server.metrics.sent.Add(uint64(n))
+		}
+	}
+}
+
+// resolve checks the destination against the access list and returns the
+// address to send to.
+func (a *association) resolve(host string, port int) (netip.AddrPort, bool) {
+	acl := a.server.acl
+	allowed, pending := acl.CheckHost(host, port)
+	if !allowed && !pending {
+		return netip.AddrPort{}, false
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		a.mu.Lock()
+		cached, ok := a.resolved[host]
+		a.mu.Unlock()
+
+		if ok {
+			ip = cached
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			cancel()
+			if err != nil || len(addrs) == 0 {
+				return netip.AddrPort{}, false
+			}
+			ip = addrs[0]
+
+			a.mu.Lock()
+			if len(a.resolved) >= maxPeers {
+				clear(a.resolved)
+			}
+			a.resolved[host] = ip
+			a.mu.Unlock()
+		}
+	}
+
+	ip = ip.Unmap()
+	if !acl.CheckIP(ip, port, allowed) {
+		return netip.AddrPort{}, false
+	}
+
+	return netip.AddrPortFrom(ip, uint16(port)), true
+}
+
+// parseDatagram parses a UDP request header: RSV, FRAG, ATYP, DST.ADDR and
+// DST.PORT. Fragmented datagrams are not supported.
+func parseDatagram(packet []byte) (string, int, []byte, error) {
+	if len(packet) < 4 {
+		return "", 0, nil, errors.New("short datagram")
+	}
+	if packet[2] != 0x00 {
+		return "", 0, nil, errors.New("fragment " + strconv.Itoa(int(packet[2])) + " not supported")
+	}
+
+	reader := bytes.NewReader(packet[3:])
+	host, port, err := readAddr(reader)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return host, port, packet[len(packet)-reader.Len():], nil
+}
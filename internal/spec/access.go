@@ -0,0 +1,114 @@
+package spec
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/ezex-io/proxier/internal/realip"
+)
+
+// AccessRule matches egress destinations by host and port. Exactly one of
+// AnyHost, Domain and Prefix describes the host.
+type AccessRule struct {
+	AnyHost bool
+	// Domain is an exact name, "*.name" for subdomains only, or ".name" for
+	// the name and its subdomains.
+	Domain string
+	Prefix netip.Prefix
+	// PortLow and PortHigh bound the port; zero means any port.
+	PortLow  int
+	PortHigh int
+}
+
+// ParseAccessRules parses an access list. Entries are a host pattern
+// optionally followed by ":port" or ":low-high": "example.com",
+// "*.example.com" (subdomains), ".example.com" (domain and subdomains), an IP
+// or CIDR ("[2001:db8::/32]:443" with a port), or only a port such as ":22".
+func ParseAccessRules(entries []string) ([]AccessRule, error) {
+	rules := make([]AccessRule, 0, len(entries))
+	for _, entry := range entries {
+		r, err := parseAccessRule(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func parseAccessRule(entry string) (AccessRule, error) {
+	host, port := entry, ""
+	switch {
+	case strings.HasPrefix(entry, "["):
+		end := strings.Index(entry, "]")
+		if end < 0 {
+			return AccessRule{}, fmt.Errorf("invalid access list entry %q", entry)
+		}
+		host, port = entry[1:end], strings.TrimPrefix(entry[end+1:], ":")
+		if port == "" && end+1 != len(entry) {
+			return AccessRule{}, fmt.Errorf("invalid access list entry %q", entry)
+		}
+	case strings.Count(entry, ":") == 1:
+		host, port, _ = strings.Cut(entry, ":")
+	}
+
+	var r AccessRule
+	if port != "" {
+		low, high, err := parsePortRange(port)
+		if err != nil {
+			return AccessRule{}, fmt.Errorf("invalid port in access list entry %q: %w", entry, err)
+		}
+		r.PortLow, r.PortHigh = low, high
+	} else if strings.HasSuffix(entry, ":") {
+		return AccessRule{}, fmt.Errorf("invalid access list entry %q", entry)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case host == "" || host == "*":
+		if port == "" {
+			return AccessRule{}, fmt.Errorf("access list entry %q matches everything", entry)
+		}
+		r.AnyHost = true
+	case strings.Contains(host, "/") || isIP(host):
+		prefix, err := realip.ParsePrefix(host)
+		if err != nil {
+			return AccessRule{}, err
+		}
+		r.Prefix = prefix
+	default:
+		name := strings.TrimPrefix(strings.TrimPrefix(host, "*."), ".")
+		if name == "" || strings.ContainsAny(name, "*/ ") {
+			return AccessRule{}, fmt.Errorf("invalid host in access list entry %q", entry)
+		}
+		r.Domain = host
+	}
+
+	return r, nil
+}
+
+func parsePortRange(value string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(value, "-")
+	low, err := strconv.ParseUint(lowText, 10, 16)
+	if err != nil || low == 0 {
+		return 0, 0, fmt.Errorf("invalid port %q", lowText)
+	}
+	high := low
+	if isRange {
+		high, err = strconv.ParseUint(highText, 10, 16)
+		if err != nil || high < low {
+			return 0, 0, fmt.Errorf("invalid port range %q", value)
+		}
+	}
+
+	return int(low), int(high), nil
+}
+
+func isIP(host string) bool {
+	_, err := netip.ParseAddr(host)
+
+	return err == nil
+}
@@ -0,0 +1,53 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SchemeFastCGI is the destination URL scheme of FastCGI applications.
+const SchemeFastCGI = "fastcgi"
+
+// UnixSocketHost is the Host sent to unix socket destinations.
+const UnixSocketHost = "localhost"
+
+// ParseDestination parses a destination URL. "unix:///path/to.sock" and
+// "unix:///path/to.sock:/base/path" reach an HTTP server on a unix socket;
+// the returned URL then addresses that server and socket is its path.
+// FastCGI destinations are "fastcgi://host:port" or "fastcgi:///path/to.sock".
+func ParseDestination(destination string) (*url.URL, string, error) {
+	targetURL, err := url.Parse(destination)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid destination URL %s: %w", destination, err)
+	}
+	switch targetURL.Scheme {
+	case "unix":
+	case SchemeFastCGI:
+		// "fastcgi://host:port" or "fastcgi:///path/to.sock".
+		if targetURL.Host != "" {
+			if targetURL.Port() == "" {
+				return nil, "", errors.New("FastCGI destination " + destination + " requires a port")
+			}
+
+			return targetURL, "", nil
+		}
+		if targetURL.Path == "" || strings.HasSuffix(targetURL.Path, "/") {
+			return nil, "", errors.New("invalid FastCGI destination " + destination +
+				": expected fastcgi://host:port or fastcgi:///path/to.sock")
+		}
+
+		return &url.URL{Scheme: SchemeFastCGI, Host: UnixSocketHost}, targetURL.Path, nil
+	default:
+		return targetURL, "", nil
+	}
+
+	socket, basePath, _ := strings.Cut(targetURL.Path, ":")
+	if socket == "" || strings.HasSuffix(socket, "/") || targetURL.Host != "" {
+		return nil, "", errors.New("invalid unix socket destination " + destination +
+			": expected unix:///path/to.sock[:/base/path]")
+	}
+
+	return &url.URL{Scheme: "http", Host: UnixSocketHost, Path: basePath}, socket, nil
+}
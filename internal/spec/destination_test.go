@@ -0,0 +1,39 @@
+package spec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		url         string
+		socket      string
+		wantErr     bool
+	}{
+		{destination: "http://example.com/api", url: "http://example.com/api"},
+		{destination: "unix:///run/app.sock", url: "http://localhost", socket: "/run/app.sock"},
+		{destination: "unix:///run/app.sock:/api/v1", url: "http://localhost/api/v1", socket: "/run/app.sock"},
+		{destination: "unix://host/run/app.sock", wantErr: true},
+		{destination: "unix://", wantErr: true},
+		{destination: "fastcgi://127.0.0.1:9000", url: "fastcgi://127.0.0.1:9000"},
+		{destination: "fastcgi:///run/php-fpm.sock", url: "fastcgi://localhost", socket: "/run/php-fpm.sock"},
+		{destination: "fastcgi://php", wantErr: true},
+		{destination: "fastcgi:///run/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		targetURL, socket, err := ParseDestination(tt.destination)
+		if tt.wantErr {
+			assert.Error(t, err, tt.destination)
+
+			continue
+		}
+		require.NoError(t, err, tt.destination)
+		assert.Equal(t, tt.url, targetURL.String(), tt.destination)
+		assert.Equal(t, tt.socket, socket, tt.destination)
+	}
+}
@@ -0,0 +1,51 @@
+package spec
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Rate limit key kinds, see ParseRateLimitKey.
+const (
+	KeyIP     = "ip"
+	KeyHeader = "header"
+	KeyJWT    = "jwt"
+)
+
+// RateLimitKey selects what a rate limit counts requests by.
+type RateLimitKey struct {
+	Kind string
+	// Name is the header or claim name.
+	Name string
+}
+
+// ParseRateLimitKey parses a key: "ip" (default) for the client IP,
+// "header:<name>" for the value of a request header such as an API key, or
+// "jwt:<claim>" for a claim of the bearer token in the Authorization header.
+// The token signature is not verified, so a jwt key should be combined with
+// an ip limit unless tokens are verified before reaching the proxy.
+func ParseRateLimitKey(key string) (RateLimitKey, error) {
+	if key == "" || key == KeyIP {
+		return RateLimitKey{Kind: KeyIP}, nil
+	}
+
+	kind, name, ok := strings.Cut(key, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return RateLimitKey{}, fmt.Errorf("invalid rate limit key %q", key)
+	}
+
+	switch kind {
+	case KeyHeader:
+		if strings.Contains(name, ":") {
+			return RateLimitKey{}, fmt.Errorf("invalid rate limit key %q", key)
+		}
+
+		return RateLimitKey{Kind: KeyHeader, Name: http.CanonicalHeaderKey(name)}, nil
+	case KeyJWT:
+		return RateLimitKey{Kind: KeyJWT, Name: name}, nil
+	default:
+		return RateLimitKey{}, fmt.Errorf("invalid rate limit key %q", key)
+	}
+}
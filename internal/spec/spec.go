@@ -0,0 +1,20 @@
+// Package spec parses the configuration values that are validated by the
+// config package and acted on by the proxies, so that neither side depends
+// on the other.
+package spec
+
+// Stream protocols.
+const (
+	StreamTCP = "tcp"
+	StreamUDP = "udp"
+	// StreamTLSPassthrough forwards TCP connections by the TLS server name of
+	// the ClientHello without terminating TLS.
+	StreamTLSPassthrough = "tls"
+)
+
+// Load balancing strategies of streams.
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceRandom     = "random"
+)
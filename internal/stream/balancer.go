@@ -0,0 +1,87 @@
+package stream
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+// Load balancing strategies.
+const (
+	RoundRobin = spec.BalanceRoundRobin
+	LeastConn  = spec.BalanceLeastConn
+	Random     = spec.BalanceRandom
+)
+
+// balancer picks upstreams and tracks how many connections each one holds.
+type balancer struct {
+	mu        sync.Mutex
+	strategy  string
+	upstreams []string
+	active    []int
+	next      int
+}
+
+func newBalancer(strategy string, upstreams []string) (*balancer, error) {
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastConn, Random:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams defined")
+	}
+
+	return &balancer{
+		strategy:  strategy,
+		upstreams: upstreams,
+		active:    make([]int, len(upstreams)),
+	}, nil
+}
+
+// order returns upstream indexes in the order they should be tried: the
+// chosen upstream first, followed by the others as fallbacks.
+func (b *balancer) order() []int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := len(b.upstreams)
+	first := 0
+	switch b.strategy {
+	case RoundRobin:
+		first = b.next
+		b.next = (b.next + 1) % count
+	case Random:
+		first = rand.IntN(count) //nolint:gosec // load balancing does not need a secure source
+	case LeastConn:
+		for i := range b.active {
+			if b.active[i] < b.active[first] {
+				first = i
+			}
+		}
+	}
+
+	indexes := make([]int, 0, count)
+	for i := range count {
+		indexes = append(indexes, (first+i)%count)
+	}
+
+	return indexes
+}
+
+func (b *balancer) acquire(index int) {
+	b.mu.Lock()
+	b.active[index]++
+	b.mu.Unlock()
+}
+
+func (b *balancer) release(index int) {
+	b.mu.Lock()
+	b.active[index]--
+	b.mu.Unlock()
+}
@@ -0,0 +1,129 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clientHelloTimeout bounds how long a client may take to send its
+// ClientHello before the connection is closed.
+const clientHelloTimeout = 10 * time.Second
+
+// Route sends TLS connections whose SNI matches one of ServerNames to
+// Upstreams. A server name may start with "*." to match one extra label.
+type Route struct {
+	ServerNames []string
+	Upstreams   []string
+}
+
+// sniRouter maps TLS server names to upstream balancers.
+type sniRouter struct {
+	exact    map[string]*balancer
+	wildcard map[string]*balancer
+	fallback *balancer
+}
+
+func newSNIRouter(strategy string, routes []Route, fallback *balancer) (*sniRouter, error) {
+	router := &sniRouter{
+		exact:    make(map[string]*balancer),
+		wildcard: make(map[string]*balancer),
+		fallback: fallback,
+	}
+
+	for _, route := range routes {
+		bal, err := newBalancer(strategy, route.Upstreams)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range route.ServerNames {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			table := router.exact
+			if suffix, ok := strings.CutPrefix(name, "*."); ok {
+				name = suffix
+				table = router.wildcard
+			}
+
+			if _, ok := table[name]; ok {
+				return nil, fmt.Errorf("duplicate server name %q", name)
+			}
+			table[name] = bal
+		}
+	}
+
+	return router, nil
+}
+
+// match returns the balancer for serverName, the fallback when no route
+// matches, or nil when there is no fallback either.
+func (r *sniRouter) match(serverName string) *balancer {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	if bal, ok := r.exact[serverName]; ok {
+		return bal
+	}
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		if bal, ok := r.wildcard[parent]; ok {
+			return bal
+		}
+	}
+
+	return r.fallback
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the TLS ClientHello from conn and returns its server
+// name together with every byte consumed, which must be replayed to the
+// upstream. The server name is empty when the client did not send SNI.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	var (
+		consumed   bytes.Buffer
+		serverName string
+		seen       bool
+	)
+	recorder := &recordingConn{Conn: conn, reader: io.TeeReader(conn, &consumed)}
+	err := tls.Server(recorder, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			seen = true
+
+			// Abort the handshake: the stream is forwarded untouched.
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if !seen {
+		return "", nil, fmt.Errorf("reading TLS client hello: %w", err)
+	}
+
+	return serverName, consumed.Bytes(), nil
+}
+
+// recordingConn records everything read from the client and drops anything
+// the TLS stack tries to write back, such as the alert sent on abort.
+type recordingConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (*recordingConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,123 @@
+package stream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTLSBackend starts a TLS server answering every request with body.
+func newTLSBackend(t *testing.T, body string) string {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.Listener.Addr().String()
+}
+
+// getThrough requests https://host/ with the connection dialed to proxyAddr,
+// so host only determines the SNI.
+func getThrough(t *testing.T, proxyAddr, host string) (string, error) {
+	t.Helper()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, proxyAddr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test certificates
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("https://" + host + "/")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+
+	return string(body), err
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	backendA := newTLSBackend(t, "a")
+	backendB := newTLSBackend(t, "b")
+	routes := []Route{
+		{ServerNames: []string{"a.example.com"}, Upstreams: []string{backendA}},
+		{ServerNames: []string{"*.svc.example.com", "B.example.com"}, Upstreams: []string{backendB}},
+	}
+
+	t.Run("routes by server name", func(t *testing.T) {
+		proxy := startProxy(t, TLSPassthrough, Config{Routes: routes})
+
+		tests := map[string]string{
+			"a.example.com":       "a",
+			"b.example.com":       "b",
+			"api.svc.example.com": "b",
+		}
+		for host, want := range tests {
+			body, err := getThrough(t, proxy.Addr(), host)
+			require.NoError(t, err, host)
+			assert.Equal(t, want, body, host)
+		}
+	})
+
+	t.Run("closes unmatched connections", func(t *testing.T) {
+		proxy := startProxy(t, TLSPassthrough, Config{Routes: routes})
+
+		_, err := getThrough(t, proxy.Addr(), "c.example.com")
+		assert.Error(t, err)
+
+		// Wildcards match a single label only.
+		_, err = getThrough(t, proxy.Addr(), "x.api.svc.example.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("falls back to default upstreams", func(t *testing.T) {
+		proxy := startProxy(t, TLSPassthrough, Config{Routes: routes, Upstreams: []string{backendA}})
+
+		body, err := getThrough(t, proxy.Addr(), "c.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "a", body)
+
+		// IP addresses are not sent as SNI.
+		body, err = getThrough(t, proxy.Addr(), "127.0.0.1")
+		require.NoError(t, err)
+		assert.Equal(t, "a", body)
+	})
+
+	t.Run("rejects non-TLS clients", func(t *testing.T) {
+		proxy := startProxy(t, TLSPassthrough, Config{Routes: routes, Upstreams: []string{backendA}})
+
+		conn, err := net.Dial("tcp", proxy.Addr())
+		require.NoError(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"))
+		require.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+}
+
+func TestNewTLSPassthroughRejectsDuplicateNames(t *testing.T) {
+	_, err := New(TLSPassthrough, Config{Routes: []Route{
+		{ServerNames: []string{"a.example.com"}, Upstreams: []string{"127.0.0.1:1"}},
+		{ServerNames: []string{"A.example.com"}, Upstreams: []string{"127.0.0.1:2"}},
+	}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/ezex-io/proxier/internal/spec"
+)
+
+// Stream protocols.
+const (
+	TCP = spec.StreamTCP
+	UDP = spec.StreamUDP
+	// TLSPassthrough forwards TCP connections by the TLS server name of the
+	// ClientHello without terminating TLS.
+	TLSPassthrough = spec.StreamTLSPassthrough
+)
+
+const (
+	defaultConnectTimeout = 5 * time.Second
+	defaultUDPIdleTimeout = 30 * time.Second
+)
+
+// ErrClosed is returned by Serve after Shutdown.
+var ErrClosed = errors.New("stream proxy closed")
+
+// Config describes a layer-4 stream proxy.
+type Config struct {
+	Name           string
+	Listen         string
+	Upstreams      []string
+	LoadBalancing  string
+	MaxConnections int
+	IdleTimeout    time.Duration
+	ConnectTimeout time.Duration
+
+	// ProxyProtocol sends a PROXY protocol header of this version to TCP
+	// upstreams before any client data; zero sends none.
+	ProxyProtocol int
+
+	// Routes select upstreams by TLS server name in TLSPassthrough mode.
+	// Upstreams, when set, serve connections matching no route; otherwise
+	// those connections are closed.
+	Routes []Route
+}
+
+// Proxy forwards raw TCP connections or UDP datagrams to upstreams.
+type Proxy interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+	Addr() string
+}
+
+// New creates a stream proxy for protocol.
+func New(protocol string, cfg Config) (Proxy, error) {
+	switch protocol {
+	case TCP, "":
+		return newTCPProxy(cfg)
+	case UDP:
+		return newUDPProxy(cfg)
+	case TLSPassthrough:
+		return newTLSPassthroughProxy(cfg)
+	default:
+		return nil, errors.New("unknown stream protocol: " + protocol)
+	}
+}
+
+// streamMetrics holds the metric series of one stream proxy.
+type streamMetrics struct {
+	active   *metrics.Gauge
+	total    *metrics.Counter
+	rejected *metrics.Counter
+	unrouted *metrics.Counter
+	received *metrics.Counter
+	sent     *metrics.Counter
+}
+
+var (
+	connectionsActive = metrics.Default.GaugeVec("proxier_stream_connections_active",
+		"Currently open stream connections or UDP sessions.")
+	connectionsTotal = metrics.Default.CounterVec("proxier_stream_connections_total",
+		"Accepted stream connections or UDP sessions.")
+	connectionsRejected = metrics.Default.CounterVec("proxier_stream_connections_rejected_total",
+		"Stream connections rejected because of the connection limit.")
+	connectionsUnrouted = metrics.Default.CounterVec("proxier_stream_connections_unrouted_total",
+		"TLS passthrough connections closed because no route matched their server name.")
+	receivedBytesTotal = metrics.Default.CounterVec("proxier_stream_received_bytes_total",
+		"Bytes received from clients.")
+	sentBytesTotal = metrics.Default.CounterVec("proxier_stream_sent_bytes_total",
+		"Bytes sent to clients.")
+)
+
+func newStreamMetrics(name, protocol string) *streamMetrics {
+	labels := metrics.Labels{"stream": name, "protocol": protocol}
+
+	return &streamMetrics{
+		active:   connectionsActive.With(labels),
+		total:    connectionsTotal.With(labels),
+		rejected: connectionsRejected.With(labels),
+		unrouted: connectionsUnrouted.With(labels),
+		received: receivedBytesTotal.With(labels),
+		sent:     sentBytesTotal.With(labels),
+	}
+}
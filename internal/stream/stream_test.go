@@ -0,0 +1,339 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/proxyproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTCPEcho starts a TCP server that prefixes every echoed chunk with tag.
+func newTCPEcho(t *testing.T, tag string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() {
+					_ = conn.Close()
+				}()
+
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					_, _ = conn.Write(append([]byte(tag), buf[:n]...))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startProxy serves proxy on a random local port and returns its address.
+func startProxy(t *testing.T, protocol string, cfg Config) Proxy {
+	t.Helper()
+
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:0"
+	}
+	if cfg.Name == "" {
+		cfg.Name = t.Name()
+	}
+
+	proxy, err := New(protocol, cfg)
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- proxy.ListenAndServe()
+	}()
+	require.Eventually(t, func() bool {
+		return proxy.Addr() != cfg.Listen
+	}, time.Second, 5*time.Millisecond)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_ = proxy.Shutdown(ctx)
+		assert.ErrorIs(t, <-errCh, ErrClosed)
+	})
+
+	return proxy
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	t.Helper()
+
+	_, err := conn.Write([]byte(msg))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	return string(buf[:n])
+}
+
+func TestTCPProxy(t *testing.T) {
+	upstream := newTCPEcho(t, "a:")
+	proxy := startProxy(t, TCP, Config{Upstreams: []string{upstream}})
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	assert.Equal(t, "a:hello", roundTrip(t, conn, "hello"))
+	assert.Equal(t, "a:world", roundTrip(t, conn, "world"))
+}
+
+// failingListener fails its first accepts as when out of file descriptors.
+type failingListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestTCPProxyAcceptError(t *testing.T) {
+	upstream := newTCPEcho(t, "a:")
+	proxy, err := New(TCP, Config{Name: t.Name(), Upstreams: []string{upstream}})
+	require.NoError(t, err)
+	tcpProxy, ok := proxy.(*TCPProxy)
+	require.True(t, ok)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	failing := &failingListener{Listener: listener}
+	failing.failures.Store(3)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tcpProxy.Serve(failing)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, "a:hello", roundTrip(t, conn, "hello"))
+	_ = conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, proxy.Shutdown(ctx))
+	assert.ErrorIs(t, <-errCh, ErrClosed)
+}
+
+func TestTCPProxyLoadBalancing(t *testing.T) {
+	upstreams := []string{newTCPEcho(t, "a:"), newTCPEcho(t, "b:")}
+
+	t.Run("round robin", func(t *testing.T) {
+		proxy := startProxy(t, TCP, Config{Upstreams: upstreams})
+
+		var got []string
+		for range 4 {
+			conn, err := net.Dial("tcp", proxy.Addr())
+			require.NoError(t, err)
+			got = append(got, roundTrip(t, conn, "x"))
+			_ = conn.Close()
+		}
+
+		assert.Equal(t, []string{"a:x", "b:x", "a:x", "b:x"}, got)
+	})
+
+	t.Run("least conn", func(t *testing.T) {
+		proxy := startProxy(t, TCP, Config{Upstreams: upstreams, LoadBalancing: LeastConn})
+
+		first, err := net.Dial("tcp", proxy.Addr())
+		require.NoError(t, err)
+		defer func() {
+			_ = first.Close()
+		}()
+		assert.Equal(t, "a:x", roundTrip(t, first, "x"))
+
+		// The first connection is still open, so the next ones go to b.
+		for range 2 {
+			conn, err := net.Dial("tcp", proxy.Addr())
+			require.NoError(t, err)
+			assert.Equal(t, "b:x", roundTrip(t, conn, "x"))
+			_ = conn.Close()
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		down := listener.Addr().String()
+		require.NoError(t, listener.Close())
+
+		proxy := startProxy(t, TCP, Config{Upstreams: []string{down, upstreams[1]}})
+
+		conn, err := net.Dial("tcp", proxy.Addr())
+		require.NoError(t, err)
+		defer func() {
+			_ = conn.Close()
+		}()
+		assert.Equal(t, "b:x", roundTrip(t, conn, "x"))
+	})
+}
+
+func TestTCPProxyMaxConnections(t *testing.T) {
+	upstream := newTCPEcho(t, "")
+	proxy := startProxy(t, TCP, Config{Upstreams: []string{upstream}, MaxConnections: 1})
+
+	first, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer func() {
+		_ = first.Close()
+	}()
+	assert.Equal(t, "x", roundTrip(t, first, "x"))
+
+	second, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer func() {
+		_ = second.Close()
+	}()
+
+	require.NoError(t, second.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = second.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPProxyIdleTimeout(t *testing.T) {
+	upstream := newTCPEcho(t, "")
+	proxy := startProxy(t, TCP, Config{
+		Upstreams:   []string{upstream},
+		IdleTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// Traffic keeps the connection open past the idle timeout.
+	for range 3 {
+		assert.Equal(t, "x", roundTrip(t, conn, "x"))
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	var netErr net.Error
+	assert.False(t, errors.As(err, &netErr) && netErr.Timeout(), "connection was not closed by the proxy")
+}
+
+func TestUDPProxy(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = upstream.Close()
+	})
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = upstream.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	proxy := startProxy(t, UDP, Config{Upstreams: []string{upstream.LocalAddr().String()}})
+
+	for _, msg := range []string{"one", "two"} {
+		conn, err := net.Dial("udp", proxy.Addr())
+		require.NoError(t, err)
+
+		assert.Equal(t, "echo:"+msg, roundTrip(t, conn, msg))
+		assert.Equal(t, "echo:"+msg, roundTrip(t, conn, msg))
+		_ = conn.Close()
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	_, err := New("sctp", Config{Upstreams: []string{"127.0.0.1:1"}})
+	assert.Error(t, err)
+
+	_, err = New(TCP, Config{})
+	assert.Error(t, err)
+
+	_, err = New(UDP, Config{Upstreams: []string{"127.0.0.1:1"}, LoadBalancing: "weighted"})
+	assert.Error(t, err)
+}
+
+func TestTCPProxySendsProxyProtocol(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		header, err := proxyproto.Read(bufio.NewReader(conn))
+		if err != nil || header == nil {
+			return
+		}
+		_, _ = conn.Write([]byte(header.Source.String()))
+	}()
+
+	proxy := startProxy(t, TCP, Config{
+		Upstreams:     []string{listener.Addr().String()},
+		ProxyProtocol: proxyproto.V1,
+	})
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	// The upstream sees the client address, not the proxy's.
+	assert.Equal(t, conn.LocalAddr().String(), roundTrip(t, conn, "x"))
+}
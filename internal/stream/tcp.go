@@ -0,0 +1,359 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ezex-io/proxier/internal/metrics"
+	"github.com/ezex-io/proxier/internal/proxyproto"
+)
+
+// TCPProxy forwards TCP connections to a set of upstreams, optionally picked
+// by the TLS server name of the connection.
+type TCPProxy struct {
+	cfg      Config
+	balancer *balancer
+	sni      *sniRouter
+	metrics  *streamMetrics
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	active   atomic.Int64
+	closing  atomic.Bool
+}
+
+func newTCPProxy(cfg Config) (*TCPProxy, error) {
+	bal, err := newBalancer(cfg.LoadBalancing, cfg.Upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = defaultConnectTimeout
+	}
+
+	return &TCPProxy{
+		cfg:      cfg,
+		balancer: bal,
+		metrics:  newStreamMetrics(cfg.Name, TCP),
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func newTLSPassthroughProxy(cfg Config) (*TCPProxy, error) {
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = defaultConnectTimeout
+	}
+
+	var fallback *balancer
+	if len(cfg.Upstreams) > 0 {
+		bal, err := newBalancer(cfg.LoadBalancing, cfg.Upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+		}
+		fallback = bal
+	}
+
+	router, err := newSNIRouter(cfg.LoadBalancing, cfg.Routes, fallback)
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+	}
+
+	return &TCPProxy{
+		cfg:     cfg,
+		sni:     router,
+		metrics: newStreamMetrics(cfg.Name, TLSPassthrough),
+		conns:   make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the listening address, or the configured one before listening.
+func (p *TCPProxy) Addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listener != nil {
+		return p.listener.Addr().String()
+	}
+
+	return p.cfg.Listen
+}
+
+func (p *TCPProxy) ListenAndServe() error {
+	listener, err := net.Listen("tcp", p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(listener)
+}
+
+// Serve accepts connections on listener until Shutdown is called.
+func (p *TCPProxy) Serve(listener net.Listener) error {
+	p.mu.Lock()
+	p.listener = listener
+	p.mu.Unlock()
+
+	if p.closing.Load() {
+		_ = listener.Close()
+
+		return ErrClosed
+	}
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if p.closing.Load() {
+				return ErrClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Errors such as running out of file descriptors pass, so the
+			// listener is retried with a growing delay, like net/http does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, time.Second)
+			}
+			log.Printf("[Stream] %s: accept error: %v; retrying in %v", p.cfg.Name, err, delay)
+			time.Sleep(delay)
+
+			continue
+		}
+		delay = 0
+
+		if limit := int64(p.cfg.MaxConnections); limit > 0 && p.active.Load() >= limit {
+			p.metrics.rejected.Inc()
+			_ = conn.Close()
+
+			continue
+		}
+
+		p.track(conn, true)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.track(conn, false)
+
+			p.handle(conn)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// until ctx is done, then closes them.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.closing.Store(true)
+
+	p.mu.Lock()
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.mu.Lock()
+		for conn := range p.conns {
+			_ = conn.Close()
+		}
+		p.mu.Unlock()
+		<-done
+	}
+
+	return err
+}
+
+func (p *TCPProxy) track(conn net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if add {
+		p.conns[conn] = struct{}{}
+		p.active.Add(1)
+		p.metrics.active.Inc()
+		p.metrics.total.Inc()
+	} else {
+		delete(p.conns, conn)
+		p.active.Add(-1)
+		p.metrics.active.Dec()
+	}
+}
+
+func (p *TCPProxy) handle(client net.Conn) {
+	defer func() {
+		_ = client.Close()
+	}()
+
+	bal := p.balancer
+	var hello []byte
+	if p.sni != nil {
+		serverName, consumed, err := peekServerName(client)
+		if err != nil {
+			log.Printf("[Stream] %s: %v", p.cfg.Name, err)
+
+			return
+		}
+
+		bal = p.sni.match(serverName)
+		if bal == nil {
+			log.Printf("[Stream] %s: no route for server name %q", p.cfg.Name, serverName)
+			p.metrics.unrouted.Inc()
+
+			return
+		}
+		hello = consumed
+	}
+
+	upstream, index, err := dialBalanced(bal, "tcp", p.cfg.ConnectTimeout)
+	if err != nil {
+		log.Printf("[Stream] %s: %v", p.cfg.Name, err)
+
+		return
+	}
+	defer bal.release(index)
+
+	p.mu.Lock()
+	p.conns[upstream] = struct{}{}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, upstream)
+		p.mu.Unlock()
+	}()
+
+	var prefix []byte
+	if p.cfg.ProxyProtocol > 0 {
+		header, err := proxyproto.Encode(p.cfg.ProxyProtocol, client.RemoteAddr(), client.LocalAddr())
+		if err != nil {
+			log.Printf("[Stream] %s: %v", p.cfg.Name, err)
+			_ = upstream.Close()
+
+			return
+		}
+		prefix = header
+	}
+	p.metrics.received.Add(uint64(len(hello)))
+	prefix = append(prefix, hello...)
+
+	if len(prefix) > 0 {
+		if _, err := upstream.Write(prefix); err != nil {
+			_ = upstream.Close()
+
+			return
+		}
+	}
+
+	splice(client, upstream, p.cfg.IdleTimeout, p.metrics)
+}
+
+// dialBalanced connects to the upstream chosen by the balancer, falling back
+// to the others when it cannot be reached.
+func dialBalanced(bal *balancer, network string, timeout time.Duration) (net.Conn, int, error) {
+	var lastErr error
+	for _, index := range bal.order() {
+		conn, err := net.DialTimeout(network, bal.upstreams[index], timeout)
+		if err != nil {
+			lastErr = err
+
+			continue
+		}
+		bal.acquire(index)
+
+		return conn, index, nil
+	}
+
+	return nil, 0, fmt.Errorf("no upstream reachable: %w", lastErr)
+}
+
+// splice copies data between client and upstream in both directions,
+// propagating half-closes, until both directions are done or the connection
+// has been idle for idleTimeout.
+func splice(client, upstream net.Conn, idleTimeout time.Duration, stats *streamMetrics) {
+	defer func() {
+		_ = upstream.Close()
+	}()
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- pipe(upstream, client, idleTimeout, &lastActive, stats.received)
+	}()
+	go func() {
+		errc <- pipe(client, upstream, idleTimeout, &lastActive, stats.sent)
+	}()
+
+	for range 2 {
+		if err := <-errc; err != nil {
+			// Unblock the other direction.
+			_ = client.Close()
+			_ = upstream.Close()
+		}
+	}
+}
+
+// pipe copies src to dst and half-closes dst on EOF. Read deadlines only
+// expire when neither direction saw traffic for idleTimeout.
+func pipe(dst, src net.Conn, idleTimeout time.Duration, lastActive *atomic.Int64,
+	counter *metrics.Counter,
+) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if idleTimeout > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			counter.Add(uint64(n))
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && idleTimeout > 0 &&
+				time.Since(time.Unix(0, lastActive.Load())) < idleTimeout {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				closeWrite(dst)
+
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,275 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// UDPProxy relays datagrams between clients and upstreams. Each client address
+// gets its own session with a dedicated upstream socket, so replies can be
+// routed back to it.
+type UDPProxy struct {
+	cfg      Config
+	balancer *balancer
+	metrics  *streamMetrics
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	// dialing counts sessions whose upstream is being dialed.
+	dialing int
+	wg      sync.WaitGroup
+	closing atomic.Bool
+}
+
+type udpSession struct {
+	upstream   net.Conn
+	index      int
+	lastActive atomic.Int64
+}
+
+func newUDPProxy(cfg Config) (*UDPProxy, error) {
+	if cfg.ProxyProtocol > 0 {
+		return nil, fmt.Errorf("stream %s: PROXY protocol is not supported for UDP", cfg.Name)
+	}
+
+	bal, err := newBalancer(cfg.LoadBalancing, cfg.Upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: %w", cfg.Name, err)
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = defaultConnectTimeout
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultUDPIdleTimeout
+	}
+
+	return &UDPProxy{
+		cfg:      cfg,
+		balancer: bal,
+		metrics:  newStreamMetrics(cfg.Name, UDP),
+		sessions: make(map[string]*udpSession),
+	}, nil
+}
+
+// Addr returns the listening address, or the configured one before listening.
+func (p *UDPProxy) Addr() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		return p.conn.LocalAddr().String()
+	}
+
+	return p.cfg.Listen
+}
+
+func (p *UDPProxy) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(conn)
+}
+
+// Serve relays datagrams received on conn until Shutdown is called.
+func (p *UDPProxy) Serve(conn net.PacketConn) error {
+	p.mu.Lock()
+	p.conn = conn
+	p.mu.Unlock()
+
+	if p.closing.Load() {
+		_ = conn.Close()
+
+		return ErrClosed
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if p.closing.Load() {
+				return ErrClosed
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		session, ok := p.session(addr.String())
+		if !ok {
+			continue
+		}
+		if session == nil {
+			// The upstream is dialed off the read loop, so that a slow DNS
+			// lookup does not hold up the datagrams of other clients.
+			datagram := slices.Clone(buf[:n])
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+
+				p.open(conn, addr, datagram)
+			}()
+
+			continue
+		}
+
+		p.forward(session, buf[:n])
+	}
+}
+
+// forward sends a datagram of the client to the upstream of its session.
+func (p *UDPProxy) forward(session *udpSession, datagram []byte) {
+	session.lastActive.Store(time.Now().UnixNano())
+	p.metrics.received.Add(uint64(len(datagram)))
+	if _, err := session.upstream.Write(datagram); err != nil {
+		log.Printf("[Stream] %s: %v", p.cfg.Name, err)
+	}
+}
+
+// session returns the session for key. Without one, it reserves room for a
+// new session and returns nil, or reports false when the stream is full.
+func (p *UDPProxy) session(key string) (*udpSession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if session, ok := p.sessions[key]; ok {
+		return session, true
+	}
+
+	if p.cfg.MaxConnections > 0 && len(p.sessions)+p.dialing >= p.cfg.MaxConnections {
+		p.metrics.rejected.Inc()
+
+		return nil, false
+	}
+	p.dialing++
+
+	return nil, true
+}
+
+// open dials the upstream of a new session for addr, taking the room
+// reserved by session, and forwards the datagram that started it. When
+// another datagram of the client opened a session meanwhile, that one is
+// used.
+func (p *UDPProxy) open(conn net.PacketConn, addr net.Addr, datagram []byte) {
+	key := addr.String()
+
+	upstream, index, err := dialBalanced(p.balancer, "udp", p.cfg.ConnectTimeout)
+
+	p.mu.Lock()
+	p.dialing--
+	if err != nil {
+		p.mu.Unlock()
+		log.Printf("[Stream] %s: %v", p.cfg.Name, err)
+
+		return
+	}
+
+	session, ok := p.sessions[key]
+	if !ok && !p.closing.Load() {
+		session = &udpSession{upstream: upstream, index: index}
+		session.lastActive.Store(time.Now().UnixNano())
+		p.sessions[key] = session
+		p.metrics.active.Inc()
+		p.metrics.total.Inc()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			p.relay(conn, addr, session)
+		}()
+	}
+	p.mu.Unlock()
+
+	if session == nil || session.upstream != upstream {
+		_ = upstream.Close()
+		p.balancer.release(index)
+	}
+	if session != nil {
+		p.forward(session, datagram)
+	}
+}
+
+// relay copies replies from the upstream back to the client until the session
+// has been idle for the idle timeout.
+func (p *UDPProxy) relay(conn net.PacketConn, addr net.Addr, session *udpSession) {
+	defer p.closeSession(addr.String(), session)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		_ = session.upstream.SetReadDeadline(time.Now().Add(p.cfg.IdleTimeout))
+
+		n, err := session.upstream.Read(buf)
+		if n > 0 {
+			session.lastActive.Store(time.Now().UnixNano())
+			p.metrics.sent.Add(uint64(n))
+			if _, writeErr := conn.WriteTo(buf[:n], addr); writeErr != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !p.closing.Load() &&
+				time.Since(time.Unix(0, session.lastActive.Load())) < p.cfg.IdleTimeout {
+				continue
+			}
+
+			return
+		}
+	}
+}
+
+func (p *UDPProxy) closeSession(key string, session *udpSession) {
+	p.mu.Lock()
+	delete(p.sessions, key)
+	p.mu.Unlock()
+
+	_ = session.upstream.Close()
+	p.balancer.release(session.index)
+	p.metrics.active.Dec()
+}
+
+// Shutdown closes the listening socket and all sessions.
+func (p *UDPProxy) Shutdown(ctx context.Context) error {
+	p.closing.Store(true)
+
+	p.mu.Lock()
+	var err error
+	if p.conn != nil {
+		err = p.conn.Close()
+	}
+	for _, session := range p.sessions {
+		_ = session.upstream.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return err
+}